@@ -1,6 +1,7 @@
 package conf // import "bosun.org/cmd/bosun/conf"
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	htemplate "html/template"
@@ -10,8 +11,10 @@ import (
 	"net/mail"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	ttemplate "text/template"
@@ -22,7 +25,9 @@ import (
 	"bosun.org/cmd/bosun/conf/parse"
 	"bosun.org/cmd/bosun/expr"
 	eparse "bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/collect"
 	"bosun.org/graphite"
+	"bosun.org/metadata"
 	"bosun.org/opentsdb"
 	"bosun.org/slog"
 )
@@ -32,6 +37,7 @@ type Conf struct {
 	Name             string        // Config file name
 	CheckFrequency   time.Duration // Time between alert checks: 5m
 	DefaultRunEvery  int           // Default number of check intervals to run each alert: 1
+	MaxNewInstances  int           // Default most new instances an alert may create in one check, 0 for no limit
 	HTTPListen       string        // Web server listen address: :80
 	Hostname         string
 	RelayListen      string // OpenTSDB relay listen address: :4242
@@ -40,11 +46,20 @@ type Conf struct {
 	SMTPPassword     string // SMTP password
 	Ping             bool
 	PingDuration     time.Duration // Duration from now to stop pinging hosts based on time since the host tag was touched
+	ErrorCoalesce    time.Duration // repeats of an alert error within this long of the last are counted, not listed; 0 for no limit
+	CheckJitter      time.Duration // alert checks are spread over this much of each check interval
+	MaxQueryRange    time.Duration // longest range a web UI or API query may cover, 0 for no limit
+	RedisTimingFlush time.Duration // redis call timings are summarized and sent this often, 0 to sample each
+	ErrorHistoryMax  int           // most error entries kept per alert by compaction, 0 for no limit
+	ErrorDedup       bool          // compaction merges repeats of an entry's message within its category
 	EmailFrom        string
 	StateFile        string
 	LedisDir         string
 	RedisHost        string
-	TimeAndDate      []int // timeanddate.com cities list
+	StateEncoding    string // json or msgpack, for stored alert errors, incidents and redis values
+	RedisKeyPrefix   string // prepended to every redis key
+	CheckConcurrency int    // maximum alert checks evaluated at once, 0 for no limit
+	TimeAndDate      []int  // timeanddate.com cities list
 	ResponseLimit    int64
 	SearchSince      opentsdb.Duration
 	UnknownTemplate  *Template
@@ -55,40 +70,169 @@ type Conf struct {
 	RawText          string
 	Macros           map[string]*Macro
 	Lookups          map[string]*Lookup
+	Baselines        map[string]*Baseline
 	Squelch          Squelches `json:"-"`
+	Suppress         Squelches `json:"-"` // matching incidents are created but never notify
 	Quiet            bool
 	NoSleep          bool
 	ShortURLKey      string
+	DeployToken      string `json:"-"` // token CI must send to /api/deploy
+	AdminToken       string `json:"-"` // token that lets API requests override limits
+	SlackSecret      string `json:"-"` // secret Slack signs ack button callbacks with
 
 	TSDBHost             string                    // OpenTSDB relay and query destination: ny-devtsdb04:4242
+	TSDBFallbackHost     string                    // OpenTSDB host to query when TSDBHost fails: ny-devtsdb05:4242
+	TSDBReadHost         string                    // OpenTSDB host for web UI and API queries, defaults to TSDBHost
 	GraphiteHost         string                    // Graphite query host: foo.bar.baz
+	GraphiteReadHost     string                    // Graphite host for web UI and API queries, defaults to GraphiteHost
 	GraphiteHeaders      []string                  // extra http headers when querying graphite.
 	LogstashElasticHosts expr.LogstashElasticHosts // CSV Elastic Hosts (All part of the same cluster) that stores logstash documents, i.e http://ny-elastic01:9200
 	InfluxConfig         client.Config
+	BreakerThreshold     int           // consecutive datasource failures that open its circuit breaker, 0 to disable
+	BreakerCooldown      time.Duration // time an open breaker waits before probing the datasource again
+	TSDBBreaker          *expr.Breaker `json:"-"`
+	GraphiteBreaker      *expr.Breaker `json:"-"`
+
+	// FailingAlertNotification is sent when FailingAlertThreshold or more
+	// alerts are failing to evaluate, and again when fewer are.
+	FailingAlertNotification *Notification `json:"-"`
+	FailingAlertThreshold    int
 
 	tree            *parse.Tree
 	node            parse.Node
+	included        map[string]bool
+	includeDir      string
 	unknownTemplate string
 	bodies          *htemplate.Template
 	subjects        *ttemplate.Template
+	textBodies      *ttemplate.Template
 	squelch         []string
+
+	failingAlertNotification string
 }
 
-// TSDBContext returns an OpenTSDB context limited to
-// c.ResponseLimit. A nil context is returned if TSDBHost is not set.
+// TSDBContext returns the OpenTSDB context used by alert checks, limited to
+// c.ResponseLimit. A nil context is returned if TSDBHost is not set. If
+// TSDBFallbackHost is set, failed queries are retried against it, including
+// those rejected by an open TSDBBreaker.
 func (c *Conf) TSDBContext() opentsdb.Context {
+	return countTSDB(c.tsdbContext(), QueryScheduler)
+}
+
+// InteractiveTSDBContext returns the OpenTSDB context used by web UI and API
+// queries. If TSDBReadHost is set it is queried instead of TSDBHost, keeping
+// interactive load off the host used by alert checks.
+func (c *Conf) InteractiveTSDBContext() opentsdb.Context {
+	if c.TSDBReadHost == "" {
+		return countTSDB(c.tsdbContext(), QueryInteractive)
+	}
+	return countTSDB(opentsdb.NewLimitContext(c.TSDBReadHost, c.ResponseLimit), QueryInteractive)
+}
+
+// InteractiveTSDBHost returns the OpenTSDB host for web UI and API queries.
+func (c *Conf) InteractiveTSDBHost() string {
+	if c.TSDBReadHost != "" {
+		return c.TSDBReadHost
+	}
+	return c.TSDBHost
+}
+
+func (c *Conf) tsdbContext() opentsdb.Context {
 	if c.TSDBHost == "" {
 		return nil
 	}
-	return opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit)
+	var primary opentsdb.Context = opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit)
+	if c.TSDBBreaker != nil {
+		primary = expr.TSDBBreakerContext{Context: primary, Breaker: c.TSDBBreaker}
+	}
+	if c.TSDBFallbackHost == "" {
+		return primary
+	}
+	return &opentsdb.FallbackContext{
+		Primary:  primary,
+		Fallback: opentsdb.NewLimitContext(c.TSDBFallbackHost, c.ResponseLimit),
+		OnFallback: func(err error) {
+			slog.Warningf("tsdb query to %s failed, using fallback %s: %v", c.TSDBHost, c.TSDBFallbackHost, err)
+			collect.Add("tsdb.fallback", opentsdb.TagSet{"host": c.TSDBFallbackHost}, 1)
+		},
+	}
 }
 
-// GraphiteContext returns a Graphite context. A nil context is returned if
-// GraphiteHost is not set.
+// GraphiteContext returns the Graphite context used by alert checks. A nil
+// context is returned if GraphiteHost is not set.
 func (c *Conf) GraphiteContext() graphite.Context {
+	return countGraphite(c.graphiteContext(), QueryScheduler)
+}
+
+// InteractiveGraphiteContext returns the Graphite context used by web UI and
+// API queries. If GraphiteReadHost is set it is queried instead of
+// GraphiteHost.
+func (c *Conf) InteractiveGraphiteContext() graphite.Context {
+	if c.GraphiteReadHost == "" {
+		return countGraphite(c.graphiteContext(), QueryInteractive)
+	}
+	return countGraphite(c.graphiteHostContext(c.GraphiteReadHost), QueryInteractive)
+}
+
+func (c *Conf) graphiteContext() graphite.Context {
 	if c.GraphiteHost == "" {
 		return nil
 	}
+	ctx := c.graphiteHostContext(c.GraphiteHost)
+	if c.GraphiteBreaker != nil {
+		return expr.GraphiteBreakerContext{Context: ctx, Breaker: c.GraphiteBreaker}
+	}
+	return ctx
+}
+
+// Query paths, the path tag of the bosun.query.count metric.
+const (
+	QueryScheduler   = "scheduler"
+	QueryInteractive = "interactive"
+)
+
+func countTSDB(ctx opentsdb.Context, path string) opentsdb.Context {
+	if ctx == nil {
+		return nil
+	}
+	return countTSDBContext{ctx, path}
+}
+
+func countGraphite(ctx graphite.Context, path string) graphite.Context {
+	if ctx == nil {
+		return nil
+	}
+	return countGraphiteContext{ctx, path}
+}
+
+func init() {
+	metadata.AddMetricMeta("bosun.query.count", metadata.Counter, metadata.Query,
+		"The number of datasource queries, by datasource and by path: scheduler for alert checks, interactive for the web UI and API.")
+}
+
+// countTSDBContext counts queries by path.
+type countTSDBContext struct {
+	opentsdb.Context
+	path string
+}
+
+func (c countTSDBContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	collect.Add("query.count", opentsdb.TagSet{"datasource": "tsdb", "path": c.path}, 1)
+	return c.Context.Query(r)
+}
+
+// countGraphiteContext counts queries by path.
+type countGraphiteContext struct {
+	graphite.Context
+	path string
+}
+
+func (c countGraphiteContext) Query(r *graphite.Request) (graphite.Response, error) {
+	collect.Add("query.count", opentsdb.TagSet{"datasource": "graphite", "path": c.path}, 1)
+	return c.Context.Query(r)
+}
+
+func (c *Conf) graphiteHostContext(host string) graphite.Context {
 	if len(c.GraphiteHeaders) > 0 {
 		headers := http.Header(make(map[string][]string))
 		for _, s := range c.GraphiteHeaders {
@@ -96,11 +240,11 @@ func (c *Conf) GraphiteContext() graphite.Context {
 			headers.Add(kv[0], kv[1])
 		}
 		return graphite.HostHeader{
-			Host:   c.GraphiteHost,
+			Host:   host,
 			Header: headers,
 		}
 	}
-	return graphite.Host(c.GraphiteHost)
+	return graphite.Host(host)
 }
 
 type Squelch map[string]*regexp.Regexp
@@ -199,11 +343,15 @@ type Lookup struct {
 	Name    string
 	Tags    []string
 	Entries []*Entry
+	// Defaults are the values of keys for tag sets no entry with the key
+	// matches.
+	Defaults map[string]string `json:",omitempty"`
 }
 
 func (lookup *Lookup) ToExpr() *ExprLookup {
 	l := ExprLookup{
-		Tags: lookup.Tags,
+		Tags:     lookup.Tags,
+		Defaults: lookup.Defaults,
 	}
 	for _, entry := range lookup.Entries {
 		l.Entries = append(l.Entries, entry.ExprEntry)
@@ -211,6 +359,21 @@ func (lookup *Lookup) ToExpr() *ExprLookup {
 	return &l
 }
 
+// Baseline is a table of expected values by tag set, returned by the
+// staticBaseline expression function.
+type Baseline struct {
+	Text    string
+	Name    string
+	Tags    []string
+	Entries []*BaselineEntry
+}
+
+type BaselineEntry struct {
+	Def   string
+	Group opentsdb.TagSet
+	Value float64
+}
+
 type Entry struct {
 	*ExprEntry
 	Def  string
@@ -238,18 +401,56 @@ type Alert struct {
 	MaxLogFrequency  time.Duration
 	IgnoreUnknown    bool
 	UnjoinedOK       bool `json:",omitempty"`
+	// UnknownAfterError is how long the alert's checks must keep failing
+	// before its instances become unknown. Zero leaves them as they are.
+	UnknownAfterError time.Duration `json:",omitempty"`
+	// QuietUnknown stops unknown events from sending notifications.
+	QuietUnknown bool `json:",omitempty"`
+	// NotifyRecovery sends a notification to the last notified targets
+	// when an open instance returns to normal.
+	NotifyRecovery bool `json:",omitempty"`
+	// MaxNewInstances is the most new instances one check may create before
+	// the alert is marked in error instead. Zero for no limit.
+	MaxNewInstances int `json:",omitempty"`
+	// SuppressDuringParentSilence marks instances unevaluated while a
+	// matching instance of an alert referenced by Depends is silenced.
+	SuppressDuringParentSilence bool     `json:",omitempty"`
+	DependsAlerts               []string `json:",omitempty"`
+	// StaleState is the status ("normal" or "unknown") given to instances
+	// whose crit or warn expression evaluates to NaN. Empty keeps the
+	// default of treating NaN as triggering.
+	StaleState string `json:",omitempty"`
+	// Runbook is the URL of the alert's runbook.
+	Runbook string `json:",omitempty"`
+	// Impact is evaluated with crit and warn, and its value for each
+	// instance is stored on the instance's incident.
+	Impact *expr.Expr `json:",omitempty"`
+	// PartialResults evaluates the alert's expressions without the data of
+	// queries that fail, instead of failing the check.
+	PartialResults bool `json:",omitempty"`
+	// RecoveryTemplate, if set, renders the notification sent when an
+	// instance recovers instead of the alert's template.
+	RecoveryTemplate *Template `json:"-"`
+	// RecoveryCooldown is how long after an instance returns to normal a
+	// re-fire continues its incident instead of starting a new one. The
+	// recovery notification is held until the cooldown passes.
+	RecoveryCooldown time.Duration `json:",omitempty"`
 	Log              bool
 	RunEvery         int
 	returnType       eparse.FuncType
 
 	template string
 	squelch  []string
+	// maxNewInstancesSet is whether the alert sets maxNewInstances, even to 0.
+	maxNewInstancesSet bool
 }
 
 type Notifications struct {
 	Notifications map[string]*Notification `json:"-"`
 	// Table key -> table
 	Lookups map[string]*Lookup
+	// Table key -> notifications to use when no lookup entry matches
+	LookupDefaults map[string]string
 }
 
 // Get returns the set of notifications based on given tags.
@@ -262,7 +463,9 @@ func (ns *Notifications) Get(c *Conf, tags opentsdb.TagSet) map[string]*Notifica
 		l := lookup.ToExpr()
 		val, ok := l.Get(key, tags)
 		if !ok {
-			continue
+			if val, ok = ns.LookupDefaults[key]; !ok {
+				continue
+			}
 		}
 		ns, err := c.parseNotifications(val)
 		if err != nil {
@@ -294,11 +497,12 @@ func (c *Conf) parseNotifications(v string) (map[string]*Notification, error) {
 type Template struct {
 	Text string
 	Vars
-	Name    string
-	Body    *htemplate.Template `json:"-"`
-	Subject *ttemplate.Template `json:"-"`
+	Name     string
+	Body     *htemplate.Template `json:"-"`
+	Subject  *ttemplate.Template `json:"-"`
+	TextBody *ttemplate.Template `json:"-"` // plain text alternative to Body for email
 
-	body, subject string
+	body, subject, textBody string
 }
 
 type Notification struct {
@@ -313,6 +517,17 @@ type Notification struct {
 	Timeout      time.Duration
 	ContentType  string
 	RunOnActions bool
+	Quiet        *QuietHours
+	// RateLimit is the most alert notifications sent in each RateInterval.
+	// The rest are held and sent as one digest when the interval ends.
+	RateLimit    int
+	RateInterval time.Duration
+	// AckButton sends posts as Slack messages with a button that
+	// acknowledges the incident.
+	AckButton bool
+	// Fanout are more notifications sent, each on its own, whenever this
+	// one is.
+	Fanout []*Notification `json:"-"`
 
 	next      string
 	email     string
@@ -320,6 +535,66 @@ type Notification struct {
 	body      string
 }
 
+// QuietHours is a daily window during which notifications of some statuses
+// are deferred. Start and End are offsets from midnight in Location; a window
+// whose End is before its Start crosses midnight.
+type QuietHours struct {
+	Start, End time.Duration
+	Location   *time.Location
+	Status     []string
+}
+
+// Until returns the end of the quiet window t is in, and whether it is in one.
+func (q *QuietHours) Until(t time.Time) (time.Time, bool) {
+	t = t.In(q.Location)
+	y, m, d := t.Date()
+	at := func(day int, off time.Duration) time.Time {
+		return time.Date(y, m, day, 0, int(off/time.Minute), 0, 0, q.Location)
+	}
+	off := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	switch {
+	case q.Start < q.End:
+		if off >= q.Start && off < q.End {
+			return at(d, q.End), true
+		}
+	case off >= q.Start:
+		return at(d+1, q.End), true
+	case off < q.End:
+		return at(d, q.End), true
+	}
+	return time.Time{}, false
+}
+
+// Applies returns whether notifications of status are deferred.
+func (q *QuietHours) Applies(status string) bool {
+	for _, s := range q.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// parseQuietHours parses a window such as "22:00-07:00".
+func parseQuietHours(v string) (start, end time.Duration, err error) {
+	sp := strings.Split(v, "-")
+	if len(sp) != 2 {
+		return 0, 0, fmt.Errorf("quietHours must be of the form 22:00-07:00, got %q", v)
+	}
+	var offs [2]time.Duration
+	for i, s := range sp {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, 0, fmt.Errorf("quietHours: %v", err)
+		}
+		offs[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if offs[0] == offs[1] {
+		return 0, 0, fmt.Errorf("quietHours: start and end must differ")
+	}
+	return offs[0], offs[1], nil
+}
+
 func (n *Notification) MarshalJSON() ([]byte, error) {
 	return nil, fmt.Errorf("conf: cannot json marshal notifications")
 }
@@ -331,10 +606,20 @@ func ParseFile(fname string) (*Conf, error) {
 	if err != nil {
 		return nil, err
 	}
-	return New(fname, string(f))
+	dir := filepath.Dir(absPath(fname))
+	if d, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = d
+	}
+	return newConf(fname, string(f), dir)
 }
 
-func New(name, text string) (c *Conf, err error) {
+// New parses the config text. The text may not include other files, since it
+// may not come from the config file, such as the text of a rule test.
+func New(name, text string) (*Conf, error) {
+	return newConf(name, text, "")
+}
+
+func newConf(name, text, includeDir string) (c *Conf, err error) {
 	defer errRecover(&err)
 	c = &Conf{
 		Name:             name,
@@ -347,6 +632,7 @@ func New(name, text string) (c *Conf, err error) {
 		ResponseLimit:    1 << 20, // 1MB
 		SearchSince:      opentsdb.Day * 3,
 		UnknownThreshold: 5,
+		BreakerCooldown:  time.Minute,
 		Vars:             make(map[string]string),
 		Templates:        make(map[string]*Template),
 		Alerts:           make(map[string]*Alert),
@@ -354,26 +640,34 @@ func New(name, text string) (c *Conf, err error) {
 		RawText:          text,
 		bodies:           htemplate.New(name).Funcs(htemplate.FuncMap(defaultFuncs)),
 		subjects:         ttemplate.New(name).Funcs(defaultFuncs),
+		textBodies:       ttemplate.New(name).Funcs(defaultFuncs),
 		Lookups:          make(map[string]*Lookup),
+		Baselines:        make(map[string]*Baseline),
 		Macros:           make(map[string]*Macro),
+		includeDir:       includeDir,
 	}
 	c.tree, err = parse.Parse(name, text)
 	if err != nil {
 		c.error(err)
 	}
-	saw := make(map[string]bool)
-	for _, n := range c.tree.Root.Nodes {
-		c.at(n)
-		switch n := n.(type) {
-		case *parse.PairNode:
-			c.seen(n.Key.Text, saw)
-			c.loadGlobal(n)
-		case *parse.SectionNode:
-			c.loadSection(n)
-		default:
-			c.errorf("unexpected parse node %s", n)
+	c.included = map[string]bool{absPath(name): true}
+	c.RawText = c.loadTree(c.tree, text, make(map[string]bool))
+	if c.failingAlertNotification != "" {
+		n, ok := c.Notifications[c.failingAlertNotification]
+		if !ok {
+			c.at(nil)
+			c.errorf("failingAlertNotification: unknown notification %s", c.failingAlertNotification)
+		}
+		c.FailingAlertNotification = n
+		if c.FailingAlertThreshold == 0 {
+			c.FailingAlertThreshold = 1
 		}
 	}
+	if c.BreakerThreshold > 0 {
+		c.TSDBBreaker = expr.NewBreaker("tsdb", c.BreakerThreshold, c.BreakerCooldown)
+		c.TSDBBreaker.IsFailure = expr.IsTSDBFailure
+		c.GraphiteBreaker = expr.NewBreaker("graphite", c.BreakerThreshold, c.BreakerCooldown)
+	}
 	if c.Hostname == "" {
 		c.Hostname = c.HTTPListen
 		if strings.HasPrefix(c.Hostname, ":") {
@@ -388,6 +682,108 @@ func New(name, text string) (c *Conf, err error) {
 	return
 }
 
+// loadTree loads the globals and sections of t, the main config file or an
+// included one, parsed from text. saw holds the global keys already set by any
+// file. It returns text with each include replaced by the included files.
+func (c *Conf) loadTree(t *parse.Tree, text string, saw map[string]bool) string {
+	main := c.tree
+	c.tree = t
+	expanded := new(bytes.Buffer)
+	last := 0
+	for _, n := range t.Root.Nodes {
+		c.at(n)
+		switch n := n.(type) {
+		case *parse.PairNode:
+			c.seen(n.Key.Text, saw)
+			if n.Key.Text == "include" {
+				included := c.include(c.Expand(n.Val.Text, nil, false), saw)
+				expanded.WriteString(text[last:n.Pos])
+				expanded.WriteString(included)
+				last = int(n.Val.Pos) + len(n.Val.Quoted)
+				continue
+			}
+			c.loadGlobal(n)
+		case *parse.SectionNode:
+			c.loadSection(n)
+		default:
+			c.errorf("unexpected parse node %s", n)
+		}
+	}
+	c.tree = main
+	if last == 0 {
+		return text
+	}
+	expanded.WriteString(text[last:])
+	return expanded.String()
+}
+
+// include loads the config files matching pattern, relative to the directory
+// of the including file. If pattern is a directory, its .conf files are
+// loaded in name order. Each file may be included only once, and must be in
+// the directory of the config file. It returns the text of the files.
+func (c *Conf) include(pattern string, saw map[string]bool) string {
+	if c.includeDir == "" {
+		c.errorf("include is only allowed in the config file")
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(absPath(c.tree.Name)), pattern)
+	}
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		pattern = filepath.Join(pattern, "*.conf")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		c.error(err)
+	}
+	// Files outside includeDir are left out as if they did not exist, so
+	// errors do not tell which do.
+	var inDir []string
+	for _, f := range files {
+		if real, err := filepath.EvalSymlinks(f); err == nil && c.inIncludeDir(real) {
+			inDir = append(inDir, f)
+		}
+	}
+	files = inDir
+	if len(files) == 0 {
+		c.errorf("include: no files in %s match %s", c.includeDir, pattern)
+	}
+	sort.Strings(files)
+	included := new(bytes.Buffer)
+	for _, f := range files {
+		if abs := absPath(f); c.included[abs] {
+			c.errorf("include: %s is already included", f)
+		} else {
+			c.included[abs] = true
+		}
+		text, err := ioutil.ReadFile(f)
+		if err != nil {
+			c.error(err)
+		}
+		t, err := parse.Parse(f, string(text))
+		if err != nil {
+			c.error(err)
+		}
+		node := c.node
+		fmt.Fprintf(included, "# include %s\n%s\n", f, c.loadTree(t, string(text), saw))
+		c.at(node)
+	}
+	return included.String()
+}
+
+// inIncludeDir returns whether path is in the directory include may load
+// files from.
+func (c *Conf) inIncludeDir(path string) bool {
+	rel, err := filepath.Rel(c.includeDir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
 func (c *Conf) loadGlobal(p *parse.PairNode) {
 	v := c.Expand(p.Val.Text, nil, false)
 	switch k := p.Key.Text; k {
@@ -406,8 +802,20 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			v += ":4242"
 		}
 		c.TSDBHost = v
+	case "tsdbFallbackHost":
+		if !strings.Contains(v, ":") && v != "" {
+			v += ":4242"
+		}
+		c.TSDBFallbackHost = v
+	case "tsdbReadHost":
+		if !strings.Contains(v, ":") && v != "" {
+			v += ":4242"
+		}
+		c.TSDBReadHost = v
 	case "graphiteHost":
 		c.GraphiteHost = v
+	case "graphiteReadHost":
+		c.GraphiteReadHost = v
 	case "graphiteHeader":
 		if !strings.Contains(v, ":") {
 			c.errorf("graphiteHeader must be in key:value form")
@@ -493,6 +901,12 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			c.errorf("responseLimit must be > 0")
 		}
 		c.ResponseLimit = i
+	case "maxNewInstances":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			c.errorf("maxNewInstances must be a non-negative integer")
+		}
+		c.MaxNewInstances = i
 	case "defaultRunEvery":
 		var err error
 		c.DefaultRunEvery, err = strconv.Atoi(v)
@@ -508,6 +922,14 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			c.error(err)
 		}
 		c.SearchSince = s
+	case "failingAlertNotification":
+		c.failingAlertNotification = v
+	case "failingAlertThreshold":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			c.errorf("failingAlertThreshold must be a positive integer")
+		}
+		c.FailingAlertThreshold = i
 	case "unknownTemplate":
 		c.unknownTemplate = v
 		t, ok := c.Templates[c.unknownTemplate]
@@ -520,12 +942,79 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 		if err := c.Squelch.Add(v); err != nil {
 			c.error(err)
 		}
+	case "suppress":
+		if err := c.Suppress.Add(v); err != nil {
+			c.error(err)
+		}
 	case "shortURLKey":
 		c.ShortURLKey = v
 	case "ledisDir":
 		c.LedisDir = v
 	case "redisHost":
 		c.RedisHost = v
+	case "stateEncoding":
+		if v != "json" && v != "msgpack" {
+			c.errorf("stateEncoding must be json or msgpack")
+		}
+		c.StateEncoding = v
+	case "redisKeyPrefix":
+		c.RedisKeyPrefix = v
+	case "redisTimingFlush":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.RedisTimingFlush = time.Duration(od)
+	case "breakerThreshold":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			c.errorf("breakerThreshold must be a non-negative integer")
+		}
+		c.BreakerThreshold = i
+	case "breakerCooldown":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.BreakerCooldown = time.Duration(od)
+	case "deployToken":
+		c.DeployToken = v
+	case "adminToken":
+		c.AdminToken = v
+	case "slackSigningSecret":
+		c.SlackSecret = v
+	case "maxQueryRange":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.MaxQueryRange = time.Duration(od)
+	case "errorCoalesce":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.ErrorCoalesce = time.Duration(od)
+	case "checkJitter":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.CheckJitter = time.Duration(od)
+	case "errorHistoryMax":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			c.errorf("errorHistoryMax must be a non-negative integer")
+		}
+		c.ErrorHistoryMax = i
+	case "errorDedup":
+		c.ErrorDedup = true
+	case "checkConcurrency":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			c.errorf("checkConcurrency must be a non-negative integer")
+		}
+		c.CheckConcurrency = i
 	default:
 		if !strings.HasPrefix(k, "$") {
 			c.errorf("unknown key %s", k)
@@ -547,6 +1036,8 @@ func (c *Conf) loadSection(s *parse.SectionNode) {
 		c.loadMacro(s)
 	case "lookup":
 		c.loadLookup(s)
+	case "baseline":
+		c.loadBaseline(s)
 	default:
 		c.errorf("unknown section type: %s", s.SectionType.Text)
 	}
@@ -678,6 +1169,14 @@ func (c *Conf) loadLookup(s *parse.SectionNode) {
 				}
 			}
 			l.Entries = append(l.Entries, &e)
+		case *parse.PairNode:
+			if l.Defaults == nil {
+				l.Defaults = make(map[string]string)
+			}
+			if _, ok := l.Defaults[n.Key.Text]; ok {
+				c.errorf("duplicate default: %s", n.Key.Text)
+			}
+			l.Defaults[n.Key.Text] = n.Val.Text
 		default:
 			c.errorf("unexpected node")
 		}
@@ -686,6 +1185,88 @@ func (c *Conf) loadLookup(s *parse.SectionNode) {
 	c.Lookups[name] = &l
 }
 
+func (c *Conf) loadBaseline(s *parse.SectionNode) {
+	name := s.Name.Text
+	if _, ok := c.Baselines[name]; ok {
+		c.errorf("duplicate baseline name: %s", name)
+	}
+	b := Baseline{
+		Name: name,
+		Text: s.RawText,
+	}
+	var baselineTags opentsdb.TagSet
+	saw := make(map[string]bool)
+	for _, n := range s.Nodes.Nodes {
+		c.at(n)
+		switch n := n.(type) {
+		case *parse.SectionNode:
+			if n.SectionType.Text != "entry" {
+				c.errorf("unexpected subsection type")
+			}
+			tags, err := opentsdb.ParseTags(n.Name.Text)
+			if tags == nil && err != nil {
+				c.error(err)
+			}
+			if len(tags) == 0 {
+				c.errorf("baseline entries require tags")
+			}
+			for k, v := range tags {
+				if strings.ContainsAny(v, "*|") {
+					c.errorf("baseline entries must not use wildcards: %s=%s", k, v)
+				}
+			}
+			if saw[tags.String()] {
+				c.errorf("duplicate entry")
+			}
+			saw[tags.String()] = true
+			empty := make(opentsdb.TagSet)
+			for k := range tags {
+				empty[k] = ""
+			}
+			if len(baselineTags) == 0 {
+				baselineTags = empty
+				for k := range empty {
+					b.Tags = append(b.Tags, k)
+				}
+				sort.Strings(b.Tags)
+			} else if !baselineTags.Equal(empty) {
+				c.errorf("baseline tags mismatch, expected %v", baselineTags)
+			}
+			e := BaselineEntry{
+				Def:   n.RawText,
+				Group: tags,
+			}
+			var sawValue bool
+			for _, en := range n.Nodes.Nodes {
+				c.at(en)
+				switch en := en.(type) {
+				case *parse.PairNode:
+					if en.Key.Text != "value" {
+						c.errorf("unknown key %s", en.Key.Text)
+					}
+					v, err := strconv.ParseFloat(en.Val.Text, 64)
+					if err != nil {
+						c.errorf("baseline value must be a number: %s", en.Val.Text)
+					}
+					e.Value = v
+					sawValue = true
+				default:
+					c.errorf("unexpected node")
+				}
+			}
+			c.at(n)
+			if !sawValue {
+				c.errorf("baseline entries require a value")
+			}
+			b.Entries = append(b.Entries, &e)
+		default:
+			c.errorf("unexpected node")
+		}
+	}
+	c.at(s)
+	c.Baselines[name] = &b
+}
+
 func (c *Conf) loadMacro(s *parse.SectionNode) {
 	name := s.Name.Text
 	if _, ok := c.Macros[name]; ok {
@@ -769,6 +1350,14 @@ func (c *Conf) loadTemplate(s *parse.SectionNode) {
 					c.error(err)
 				}
 				t.Subject = tmpl
+			case "textBody":
+				t.textBody = v
+				tmpl := c.textBodies.New(name).Funcs(funcs)
+				_, err := tmpl.Parse(t.textBody)
+				if err != nil {
+					c.error(err)
+				}
+				t.TextBody = tmpl
 			default:
 				if !strings.HasPrefix(k, "$") {
 					c.errorf("unknown key %s", k)
@@ -787,7 +1376,7 @@ func (c *Conf) loadTemplate(s *parse.SectionNode) {
 	c.Templates[name] = &t
 }
 
-var lookupNotificationRE = regexp.MustCompile(`^lookup\("(.*)", "(.*)"\)$`)
+var lookupNotificationRE = regexp.MustCompile(`^lookup\("(.*?)", "(.*?)"(?:, "(.*)")?\)$`)
 
 func (c *Conf) loadAlert(s *parse.SectionNode) {
 	name := s.Name.Text
@@ -820,7 +1409,21 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 					}
 				}
 			}
+			if v, ok := l.Defaults[lookup[2]]; ok {
+				if _, err := c.parseNotifications(v); err != nil {
+					c.errorf("lookup %s: %v", v, err)
+				}
+			}
 			ns.Lookups[lookup[2]] = l
+			if lookup[3] != "" {
+				if _, err := c.parseNotifications(lookup[3]); err != nil {
+					c.errorf("lookup default %s: %v", lookup[3], err)
+				}
+				if ns.LookupDefaults == nil {
+					ns.LookupDefaults = make(map[string]string)
+				}
+				ns.LookupDefaults[lookup[2]] = lookup[3]
+			}
 			return
 		}
 		n, err := c.parseNotifications(v)
@@ -846,12 +1449,20 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 				c.errorf("template not found %s", a.template)
 			}
 			a.Template = t
+		case "recoveryTemplate":
+			t, ok := c.Templates[v]
+			if !ok {
+				c.errorf("template not found %s", v)
+			}
+			a.RecoveryTemplate = t
 		case "crit":
 			a.Crit = c.NewExpr(v)
 		case "warn":
 			a.Warn = c.NewExpr(v)
 		case "depends":
 			a.Depends = c.NewExpr(v)
+		case "impact":
+			a.Impact = c.NewExpr(v)
 		case "squelch":
 			a.squelch = append(a.squelch, v)
 			if err := a.Squelch.Add(v); err != nil {
@@ -885,8 +1496,46 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			a.UnjoinedOK = true
 		case "ignoreUnknown":
 			a.IgnoreUnknown = true
+		case "unknownAfterError":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			a.UnknownAfterError = time.Duration(od)
+		case "quietUnknown":
+			a.QuietUnknown = true
+		case "notifyRecovery":
+			a.NotifyRecovery = true
+		case "suppressDuringParentSilence":
+			a.SuppressDuringParentSilence = true
+		case "partialResults":
+			a.PartialResults = true
+		case "recoveryCooldown":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			a.RecoveryCooldown = time.Duration(od)
+		case "runbook":
+			u, err := url.Parse(v)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				c.errorf("runbook must be an http or https URL: %s", v)
+			}
+			a.Runbook = v
+		case "staleState":
+			if v != "normal" && v != "unknown" {
+				c.errorf("staleState must be normal or unknown")
+			}
+			a.StaleState = v
 		case "log":
 			a.Log = true
+		case "maxNewInstances":
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				c.errorf("maxNewInstances must be a non-negative integer")
+			}
+			a.MaxNewInstances = i
+			a.maxNewInstancesSet = true
 		case "runEvery":
 			var err error
 			a.RunEvery, err = strconv.Atoi(v)
@@ -900,6 +1549,9 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 	if a.MaxLogFrequency != 0 && !a.Log {
 		c.errorf("maxLogFrequency can only be used on alerts with `log = true`.")
 	}
+	if a.RecoveryCooldown != 0 && a.Log {
+		c.errorf("recoveryCooldown cannot be used on alerts with `log = true`.")
+	}
 	c.at(s)
 	if a.Crit == nil && a.Warn == nil {
 		c.errorf("neither crit or warn specified")
@@ -937,6 +1589,30 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 		if len(depTags.Intersection(tags)) < 1 {
 			c.errorf("Depends and crit/warn must share at least one tag.")
 		}
+		eparse.Walk(a.Depends.Root, func(n eparse.Node) {
+			if f, ok := n.(*eparse.FuncNode); ok && f.Name == "alert" && len(f.Args) > 0 {
+				if name, ok := f.Args[0].(*eparse.StringNode); ok {
+					a.DependsAlerts = append(a.DependsAlerts, name.Text)
+				}
+			}
+		})
+	}
+	if a.Impact != nil {
+		impTags, err := a.Impact.Root.Tags()
+		if err != nil {
+			c.error(err)
+		}
+		if !impTags.Subset(tags) {
+			c.errorf("impact tags (%v) must be a subset of crit/warn tags (%v)", impTags, tags)
+		}
+	}
+	if a.SuppressDuringParentSilence && len(a.DependsAlerts) == 0 {
+		c.errorf("suppressDuringParentSilence requires depends to reference an alert")
+	}
+	for _, e := range []*expr.Expr{a.Crit, a.Warn, a.Depends, a.Impact} {
+		if e != nil {
+			e.PartialResults = a.PartialResults
+		}
 	}
 	if a.Log {
 		for _, n := range a.CritNotification.Notifications {
@@ -972,6 +1648,12 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			c.errorf("critNotification specified, but no template")
 		}
 	}
+	if a.RecoveryTemplate != nil && !a.NotifyRecovery {
+		c.errorf("recoveryTemplate specified, but no notifyRecovery")
+	}
+	if !a.maxNewInstancesSet {
+		a.MaxNewInstances = c.MaxNewInstances
+	}
 	if a.RunEvery == 0 {
 		a.RunEvery = c.DefaultRunEvery
 	}
@@ -991,6 +1673,16 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 		RunOnActions: true,
 	}
 	n.Text = s.RawText
+	quiet := func() *QuietHours {
+		if n.Quiet == nil {
+			n.Quiet = &QuietHours{
+				Location: time.UTC,
+				Status:   []string{"warning"},
+			}
+		}
+		return n.Quiet
+	}
+	var quietWindow bool
 	funcs := ttemplate.FuncMap{
 		"V": func(v string) string {
 			return c.Expand(v, n.Vars, false)
@@ -1060,6 +1752,67 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 			n.Body = tmpl
 		case "runOnActions":
 			n.RunOnActions = v == "true"
+		case "ackButton":
+			n.AckButton = v == "true"
+		case "fanout":
+			for _, t := range strings.Split(v, ",") {
+				t = strings.TrimSpace(t)
+				target, ok := c.Notifications[t]
+				if !ok {
+					c.errorf("unknown notification %s", t)
+				}
+				if target == &n {
+					c.errorf("notification cannot fan out to itself")
+				}
+				if len(target.Fanout) > 0 {
+					c.errorf("fanout target %s cannot fan out", t)
+				}
+				n.Fanout = append(n.Fanout, target)
+			}
+		case "quietHours":
+			start, end, err := parseQuietHours(v)
+			if err != nil {
+				c.error(err)
+			}
+			q := quiet()
+			q.Start, q.End = start, end
+			quietWindow = true
+		case "quietTimezone":
+			loc, err := time.LoadLocation(v)
+			if err != nil {
+				c.error(err)
+			}
+			quiet().Location = loc
+		case "quietStatus":
+			var status []string
+			for _, st := range strings.Split(v, ",") {
+				st = strings.TrimSpace(st)
+				switch st {
+				case "normal", "warning", "critical":
+				default:
+					c.errorf("quietStatus: unknown status %q", st)
+				}
+				status = append(status, st)
+			}
+			quiet().Status = status
+		case "rateLimit":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i <= 0 {
+				c.errorf("rateLimit must be positive")
+			}
+			n.RateLimit = i
+		case "rateInterval":
+			d, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			if d <= 0 {
+				c.errorf("rateInterval must be positive")
+			}
+			n.RateInterval = time.Duration(d)
 		default:
 			c.errorf("unknown key %s", k)
 		}
@@ -1068,13 +1821,36 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 	if n.Timeout > 0 && n.Next == nil {
 		c.errorf("timeout specified without next")
 	}
+	if n.Quiet != nil && !quietWindow {
+		c.errorf("quietTimezone or quietStatus specified without quietHours")
+	}
+	if n.RateInterval > 0 && n.RateLimit == 0 {
+		c.errorf("rateInterval specified without rateLimit")
+	}
+	if n.RateLimit > 0 && n.RateInterval == 0 {
+		n.RateInterval = time.Hour
+	}
+	if n.AckButton && n.Post == nil {
+		c.errorf("ackButton specified without post")
+	}
 }
 
 var exRE = regexp.MustCompile(`\$(?:[\w.]+|\{[\w.]+\})`)
 
+// exprVarRE matches the variables an expression binds itself, as in
+// `$x = q(...); $x / avg($x)`. Expand leaves them for the expression.
+var exprVarRE = regexp.MustCompile(`(\$\w+)\s*=[^=]`)
+
 func (c *Conf) Expand(v string, vars map[string]string, ignoreBadExpand bool) string {
+	bound := make(map[string]bool)
+	for _, m := range exprVarRE.FindAllStringSubmatch(v, -1) {
+		bound[m[1]] = true
+	}
 	ss := exRE.ReplaceAllStringFunc(v, func(s string) string {
 		var n string
+		if bound[s] {
+			return s
+		}
 		if strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}") {
 			s = "$" + s[2:len(s)-1]
 		}
@@ -1097,7 +1873,7 @@ func (c *Conf) Expand(v string, vars map[string]string, ignoreBadExpand bool) st
 func (c *Conf) seen(v string, m map[string]bool) {
 	if m[v] {
 		switch v {
-		case "squelch", "critNotification", "warnNotification", "graphiteHeader":
+		case "squelch", "suppress", "critNotification", "warnNotification", "graphiteHeader", "include":
 			// ignore
 		default:
 			c.errorf("duplicate key: %s", v)
@@ -1268,6 +2044,33 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 		return t, nil
 	}
 
+	baseline := func(e *expr.State, T miniprofiler.Timer, name string) (*expr.Results, error) {
+		b := c.Baselines[name]
+		if b == nil {
+			return nil, fmt.Errorf("baseline not found: %v", name)
+		}
+		results := new(expr.Results)
+		for _, entry := range b.Entries {
+			results.Results = append(results.Results, &expr.Result{
+				Value: expr.Number(entry.Value),
+				Group: entry.Group.Copy(),
+			})
+		}
+		return results, nil
+	}
+	baselineTags := func(args []eparse.Node) (eparse.Tags, error) {
+		name := args[0].(*eparse.StringNode).Text
+		b := c.Baselines[name]
+		if b == nil {
+			return nil, fmt.Errorf("bad baseline %v", name)
+		}
+		t := make(eparse.Tags)
+		for _, v := range b.Tags {
+			t[v] = struct{}{}
+		}
+		return t, nil
+	}
+
 	tagAlert := func(args []eparse.Node) (eparse.Tags, error) {
 		name := args[0].(*eparse.StringNode).Text
 		key := args[1].(*eparse.StringNode).Text
@@ -1300,6 +2103,12 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 			Tags:   lookupSeriesTags,
 			F:      lookupSeries,
 		},
+		"staticBaseline": {
+			Args:   []eparse.FuncType{eparse.TypeString},
+			Return: eparse.TypeNumberSet,
+			Tags:   baselineTags,
+			F:      baseline,
+		},
 	}
 	merge := func(fs map[string]eparse.Func) {
 		for k, v := range fs {
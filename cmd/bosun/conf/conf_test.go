@@ -1,12 +1,27 @@
 package conf
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"bosun.org/_third_party/github.com/influxdb/influxdb/client"
+	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
 )
 
@@ -70,6 +85,11 @@ func TestInvalid(t *testing.T) {
 		"depends-no-overlap": `conf: depends-no-overlap:3:0: at <alert broken {\n	dep...>: Depends and crit/warn must share at least one tag.`,
 		"log-no-notification": `conf: log-no-notification:1:0: at <alert a {\n	crit = 1...>: log + crit specified, but no critNotification`,
 		"crit-notification-no-template": `conf: crit-notification-no-template:5:0: at <alert a {\n	crit = 1...>: critNotification specified, but no template`,
+		"runbook-malformed":             "conf: runbook-malformed:3:1: at <runbook = wiki/disk-...>: runbook must be an http or https URL: wiki/disk-full",
+		"impact-tags":                   `conf: impact-tags:3:0: at <alert broken {\n	imp...>: impact tags (host,region) must be a subset of crit/warn tags (host)`,
+		"impact-series":                 `conf: impact-series:4:1: at <impact = q("avg:user...>: expression must return a number`,
+		"fanout-nested":                 `conf: fanout-nested:10:1: at <fanout = a, b>: fanout target b cannot fan out`,
+		"recovery-template-no-notify":   `conf: recovery-template-no-notify:5:0: at <alert a {\n	crit = 1...>: recoveryTemplate specified, but no notifyRecovery`,
 	}
 	for fname, reason := range names {
 		path := filepath.Join("invalid", fname)
@@ -88,6 +108,117 @@ func TestInvalid(t *testing.T) {
 	}
 }
 
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bosun-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	main := write("bosun.conf", `
+		tsdbHost = tsdb:4242
+		$threshold = 90
+		include = notifications.conf
+		include = alerts
+	`)
+	write("notifications.conf", `
+		notification ops {
+			print = true
+		}
+	`)
+	write("alerts/b.conf", `
+		alert b {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > $threshold
+			critNotification = ops
+		}
+	`)
+	write("alerts/a.conf", `
+		template t {
+			subject = {{.Alert.Name}}
+		}
+	`)
+	write("alerts/c.conf", `
+		alert c {
+			template = t
+			warn = 1
+		}
+	`)
+	write("alerts/README", "not a config file")
+	c, err := ParseFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TSDBHost != "tsdb:4242" || c.Notifications["ops"] == nil || c.Templates["t"] == nil {
+		t.Fatalf("included sections missing: %+v", c)
+	}
+	// Files in a directory are loaded in name order, so b and c can use
+	// the template from a.conf, and b can use the variable of the main file.
+	b := c.Alerts["b"]
+	if b == nil || c.Alerts["c"] == nil || c.Alerts["c"].Template != c.Templates["t"] {
+		t.Fatalf("unexpected alerts %v", c.Alerts)
+	}
+	if s := b.Crit.String(); !strings.Contains(s, "> 90") {
+		t.Errorf("expected main file variable in included alert, got %s", s)
+	}
+	// The raw text has the included files in place of the includes, so it
+	// parses on its own, as it is for rule tests and bundles.
+	if strings.Contains(c.RawText, "include =") || !strings.Contains(c.RawText, "notification ops") {
+		t.Errorf("expected included text in raw text, got %s", c.RawText)
+	}
+	if raw, err := New("raw", c.RawText); err != nil || raw.Alerts["b"] == nil || raw.Notifications["ops"] == nil {
+		t.Errorf("expected raw text to parse with the included sections, got %v", err)
+	}
+
+	// Definitions with the same name in two files collide, and the error
+	// names the file and line of the second.
+	write("alerts/d.conf", `
+		# another b
+		alert b {
+			warn = 1
+		}
+	`)
+	_, err = ParseFile(main)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "alerts", "d.conf")+":3:") || !strings.Contains(err.Error(), "duplicate alert name: b") {
+		t.Errorf("expected duplicate alert error in d.conf, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "alerts", "d.conf"))
+
+	// A file may be included only once.
+	write("notifications.conf", `
+		include = bosun.conf
+	`)
+	if _, err = ParseFile(main); err == nil || !strings.Contains(err.Error(), "already included") {
+		t.Errorf("expected include cycle error, got %v", err)
+	}
+	write("bosun.conf", `include = missing/*.conf`)
+	if _, err = ParseFile(main); err == nil || !strings.Contains(err.Error(), "no files in") {
+		t.Errorf("expected error for missing include, got %v", err)
+	}
+
+	// Only files in the directory of the config file may be included, and
+	// only from a config file.
+	outside := write("outside.conf", `notification x {
+		print = true
+	}`)
+	main = write("conf/bosun.conf", `include = ../outside.conf`)
+	if _, err = ParseFile(main); err == nil || !strings.Contains(err.Error(), "no files in") {
+		t.Errorf("expected error for include outside the config directory, got %v", err)
+	}
+	if _, err = New("test", "include = "+outside); err == nil || !strings.Contains(err.Error(), "only allowed in the config file") {
+		t.Errorf("expected error for include in config text, got %v", err)
+	}
+}
+
 func TestSquelch(t *testing.T) {
 	s := Squelches{
 		[]Squelch{
@@ -149,3 +280,434 @@ func TestSquelch(t *testing.T) {
 		}
 	}
 }
+
+func TestNotificationLookupDefault(t *testing.T) {
+	c, err := New("lookup-default", `
+		template t {
+			subject = s
+		}
+		notification payments {
+			print = true
+		}
+		notification fallback {
+			print = true
+		}
+		lookup owners {
+			entry owner=payments {
+				n = payments
+			}
+		}
+		alert a {
+			template = t
+			crit = 1
+			critNotification = lookup("owners", "n", "fallback")
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := c.Alerts["a"].CritNotification
+	tests := []struct {
+		tags   opentsdb.TagSet
+		expect string
+	}{
+		{opentsdb.TagSet{"owner": "payments"}, "payments"},
+		{opentsdb.TagSet{"owner": "search"}, "fallback"},
+		{opentsdb.TagSet{"host": "a"}, "fallback"},
+	}
+	for _, test := range tests {
+		nots := ns.Get(c, test.tags)
+		if len(nots) != 1 || nots[test.expect] == nil {
+			t.Errorf("%v: expected only %s, got %v", test.tags, test.expect, nots)
+		}
+	}
+	_, err = New("lookup-bad-default", `
+		template t {
+			subject = s
+		}
+		notification n {
+			print = true
+		}
+		lookup l {
+			entry a=* {
+				v = n
+			}
+		}
+		alert a {
+			template = t
+			crit = 1
+			critNotification = lookup("l", "v", "missing")
+		}
+	`)
+	if err == nil || !strings.Contains(err.Error(), "lookup default missing") {
+		t.Errorf("expected error for unknown default notification, got %v", err)
+	}
+}
+
+// baselineTSDB answers every query with its response set.
+type baselineTSDB opentsdb.ResponseSet
+
+func (b baselineTSDB) Query(*opentsdb.Request) (opentsdb.ResponseSet, error) {
+	return opentsdb.ResponseSet(b), nil
+}
+
+func TestBaseline(t *testing.T) {
+	c, err := New("baseline", `
+		tsdbHost = localhost:4242
+		baseline conns {
+			entry host=a {
+				value = 250
+			}
+			entry host=b {
+				value = 400
+			}
+		}
+		alert conns {
+			crit = avg(q("avg:conns{host=*}", "5m", "")) - staticBaseline("conns") > 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := baselineTSDB{
+		{Metric: "conns", Tags: opentsdb.TagSet{"host": "a"}, DPS: map[string]opentsdb.Point{"0": 300}},
+		{Metric: "conns", Tags: opentsdb.TagSet{"host": "c"}, DPS: map[string]opentsdb.Point{"0": 100}},
+	}
+	e, err := expr.New(`avg(q("avg:conns{host=*}", "5m", "")) - staticBaseline("conns")`, c.Funcs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := e.Execute(live, nil, nil, client.Config{}, nil, nil, time.Now(), 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// host=b is only in the baseline and host=c only in the live data.
+	expected := map[string]float64{"a": 50, "b": math.NaN(), "c": math.NaN()}
+	if len(res.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(res.Results))
+	}
+	for _, r := range res.Results {
+		host := r.Group["host"]
+		v, ok := expected[host]
+		got := float64(r.Value.(expr.Number))
+		if !ok || (math.IsNaN(v) != math.IsNaN(got)) || (!math.IsNaN(v) && got != v) {
+			t.Errorf("host %s: expected %v, got %v", host, v, got)
+		}
+	}
+
+	for name, conf := range map[string]string{
+		"baseline-glob":     "entry host=web-* {\n value = 1\n}",
+		"baseline-no-value": "entry host=a {\n}",
+		"baseline-nan":      "entry host=a {\n value = lots\n}",
+		"baseline-mismatch": "entry host=a {\n value = 1\n}\nentry dc=a {\n value = 1\n}",
+	} {
+		if _, err := New(name, "baseline b {\n"+conf+"\n}"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestExpressionVariables(t *testing.T) {
+	c, err := New("vars", `
+		tsdbHost = localhost:4242
+		alert a {
+			$threshold = 2
+			crit = $x = avg(q("avg:m{host=*}", "5m", "")); $x > $threshold && $x != 0
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `$x = avg(q("avg:m{host=*}", "5m", "")); $x > 2 && $x != 0`
+	if got := c.Alerts["a"].Crit.String(); got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+	if _, err := New("vars", `
+		tsdbHost = localhost:4242
+		alert a {
+			crit = $x = avg(q("avg:m{host=*}", "5m", "")); $y > 1
+		}
+	`); err == nil {
+		t.Error("expected an unknown variable to be rejected")
+	}
+}
+
+func TestEmailMultipart(t *testing.T) {
+	c, err := New("", `
+		smtpHost = localhost:25
+		emailFrom = bosun@example.com
+		template t {
+			subject = s
+			body = <p>html</p>
+			textBody = text
+		}
+		notification n {
+			email = a@example.com
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Templates["t"].TextBody == nil {
+		t.Fatal("expected textBody to be parsed")
+	}
+	mediaType := func(h interface {
+		Get(string) string
+	}) (string, map[string]string) {
+		mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mt, params
+	}
+	b, err := c.Notifications["n"].newEmail([]byte("s"), []byte("<p>html</p>"), []byte("text"), c).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params := mediaType(msg.Header)
+	if mt != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %s", mt)
+	}
+	alt, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params = mediaType(alt.Header)
+	if mt != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", mt)
+	}
+	parts := multipart.NewReader(alt, params["boundary"])
+	for _, expected := range []string{"text/plain", "text/html"} {
+		p, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt, _ := mediaType(p.Header); mt != expected {
+			t.Fatalf("expected %s part, got %s", expected, mt)
+		}
+	}
+	if _, err := parts.NextPart(); err == nil {
+		t.Fatal("expected exactly two alternative parts")
+	}
+
+	// Without a text body only the HTML part is sent.
+	b, err = c.Notifications["n"].newEmail([]byte("s"), []byte("<p>html</p>"), nil, c).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("text/plain")) || !bytes.Contains(b, []byte("text/html")) {
+		t.Fatal("expected only an HTML part")
+	}
+}
+
+func TestEmailAttachments(t *testing.T) {
+	c, err := New("", `
+		smtpHost = localhost:25
+		emailFrom = bosun@example.com
+		notification n {
+			email = a@example.com
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := []byte("group,time,value\n{host=a},,1\n")
+	b, err := c.Notifications["n"].newEmail([]byte("s"), []byte("<p>html</p>"), nil, c, &Attachment{
+		Data:        csv,
+		Filename:    "1.csv",
+		ContentType: "text/csv",
+	}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %s", mt)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	p, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); mt != "multipart/alternative" {
+		t.Fatalf("expected the body first, got %s", mt)
+	}
+	p, err = parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := p.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("expected a text/csv attachment, got %s", ct)
+	}
+	disposition, dparams, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disposition != "attachment" || dparams["filename"] != "1.csv" {
+		t.Fatalf("unexpected disposition %s %v", disposition, dparams)
+	}
+	data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, csv) {
+		t.Fatalf("unexpected attachment content %q", data)
+	}
+	if _, err := parts.NextPart(); err == nil {
+		t.Fatal("expected exactly one attachment")
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	c, err := New("", `
+		notification overnight {
+			print = true
+			quietHours = 22:00-07:00
+			quietTimezone = America/New_York
+			quietStatus = warning,normal
+		}
+		notification lunch {
+			print = true
+			quietHours = 12:00-13:30
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n     string
+		t     time.Time
+		quiet bool
+		end   time.Time
+	}{
+		{"overnight", time.Date(2015, 1, 1, 21, 59, 0, 0, ny), false, time.Time{}},
+		{"overnight", time.Date(2015, 1, 1, 22, 0, 0, 0, ny), true, time.Date(2015, 1, 2, 7, 0, 0, 0, ny)},
+		{"overnight", time.Date(2015, 1, 2, 3, 0, 0, 0, ny), true, time.Date(2015, 1, 2, 7, 0, 0, 0, ny)},
+		{"overnight", time.Date(2015, 1, 2, 7, 0, 0, 0, ny), false, time.Time{}},
+		// 23:00 UTC is 18:00 in New York.
+		{"overnight", time.Date(2015, 1, 1, 23, 0, 0, 0, time.UTC), false, time.Time{}},
+		{"lunch", time.Date(2015, 1, 1, 12, 30, 0, 0, time.UTC), true, time.Date(2015, 1, 1, 13, 30, 0, 0, time.UTC)},
+		{"lunch", time.Date(2015, 1, 1, 13, 30, 0, 0, time.UTC), false, time.Time{}},
+	}
+	for _, test := range tests {
+		end, quiet := c.Notifications[test.n].Quiet.Until(test.t)
+		if quiet != test.quiet || !end.Equal(test.end) {
+			t.Errorf("%s at %v: got %v %v, expected %v %v", test.n, test.t, quiet, end, test.quiet, test.end)
+		}
+	}
+	q := c.Notifications["overnight"].Quiet
+	if !q.Applies("normal") || !q.Applies("warning") || q.Applies("critical") {
+		t.Errorf("unexpected quiet statuses %v", q.Status)
+	}
+	if q := c.Notifications["lunch"].Quiet; !q.Applies("warning") || q.Applies("critical") {
+		t.Errorf("expected quiet hours to apply to warnings by default, got %v", q.Status)
+	}
+	_, err = New("", `
+		notification n {
+			print = true
+			quietTimezone = UTC
+		}
+	`)
+	if err == nil {
+		t.Error("expected quietTimezone without quietHours to fail")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, err := New("", `
+		notification hourly {
+			print = true
+			rateLimit = 5
+		}
+		notification fast {
+			print = true
+			rateLimit = 2
+			rateInterval = 10m
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Notifications["hourly"]; n.RateLimit != 5 || n.RateInterval != time.Hour {
+		t.Errorf("expected 5 per hour by default, got %v per %v", n.RateLimit, n.RateInterval)
+	}
+	if n := c.Notifications["fast"]; n.RateLimit != 2 || n.RateInterval != 10*time.Minute {
+		t.Errorf("expected 2 per 10m, got %v per %v", n.RateLimit, n.RateInterval)
+	}
+	for _, text := range []string{
+		"notification n {\n print = true\n rateInterval = 1h\n}",
+		"notification n {\n print = true\n rateLimit = 0\n}",
+	} {
+		if _, err := New("", text); err == nil {
+			t.Errorf("expected %q to fail", text)
+		}
+	}
+}
+
+func TestQueryRouting(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			fmt.Fprint(w, "[]")
+		}))
+	}
+	primary, replica := server("primary"), server("replica")
+	defer primary.Close()
+	defer replica.Close()
+	host := func(ts *httptest.Server) string {
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Host
+	}
+	query := func(ctx opentsdb.Context) {
+		req := &opentsdb.Request{Start: "1h-ago", Queries: []*opentsdb.Query{{Metric: "m", Aggregator: "sum"}}}
+		if _, err := ctx.Query(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := New("routing", fmt.Sprintf("tsdbHost = %s\ntsdbReadHost = %s", host(primary), host(replica)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(c.TSDBContext())
+	query(c.InteractiveTSDBContext())
+	query(c.InteractiveTSDBContext())
+	if hits["primary"] != 1 || hits["replica"] != 2 {
+		t.Errorf("expected scheduler queries on the primary and interactive on the replica, got %v", hits)
+	}
+	if h := c.InteractiveTSDBHost(); h != host(replica) {
+		t.Errorf("expected interactive host %s, got %s", host(replica), h)
+	}
+
+	// Without a read host interactive queries use the primary.
+	hits = make(map[string]int)
+	c, err = New("routing-default", fmt.Sprintf("tsdbHost = %s", host(primary)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(c.InteractiveTSDBContext())
+	if hits["primary"] != 1 || hits["replica"] != 0 {
+		t.Errorf("expected interactive queries on the primary, got %v", hits)
+	}
+}
@@ -8,8 +8,9 @@ import (
 
 // TODO: remove this and merge it with Lookup
 type ExprLookup struct {
-	Tags    []string
-	Entries []*ExprEntry
+	Tags     []string
+	Entries  []*ExprEntry
+	Defaults map[string]string
 }
 
 type ExprEntry struct {
@@ -39,5 +40,6 @@ func (lookup *ExprLookup) Get(key string, tag opentsdb.TagSet) (value string, ok
 		}
 		return
 	}
-	return "", false
+	value, ok = lookup.Defaults[key]
+	return
 }
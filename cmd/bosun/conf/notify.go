@@ -3,11 +3,14 @@ package conf
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/mail"
 	"net/smtp"
 	"strings"
+	"sync"
 
 	"bosun.org/_third_party/github.com/jordan-wright/email"
 	"bosun.org/collect"
@@ -26,55 +29,190 @@ func init() {
 }
 
 func (n *Notification) Notify(subject, body string, emailsubject, emailbody []byte, c *Conf, ak string, attachments ...*Attachment) {
+	n.NotifyErr(nil, subject, body, emailsubject, emailbody, nil, c, ak, attachments...)
+}
+
+// NotifyErr is like Notify, but calls onErr (if not nil) for each delivery that fails.
+// Notifications are sent asynchronously, so onErr may be called after NotifyErr returns.
+// If emailtext is not empty, emails include it as a plain text alternative to emailbody.
+func (n *Notification) NotifyErr(onErr func(error), subject, body string, emailsubject, emailbody, emailtext []byte, c *Conf, ak string, attachments ...*Attachment) {
+	report := func(err error) {
+		if err != nil && onErr != nil {
+			onErr(err)
+		}
+	}
 	if len(n.Email) > 0 {
-		go n.DoEmail(emailsubject, emailbody, c, ak, attachments...)
+		go func() { report(n.DoEmail(emailsubject, emailbody, emailtext, c, ak, attachments...)) }()
 	}
 	if n.Post != nil {
-		go n.DoPost([]byte(subject))
+		go func() { report(n.DoPost([]byte(subject))) }()
 	}
 	if n.Get != nil {
-		go n.DoGet()
+		go func() { report(n.DoGet()) }()
 	}
 	if n.Print {
 		go n.DoPrint(subject)
 	}
 }
 
+// DedupHeader is the header posts and emails sent by Deliver carry their key
+// in. A notification may be delivered more than once with the same key, for
+// example if bosun restarts while sending it.
+const DedupHeader = "X-Bosun-Dedup-Key"
+
+// Deliver sends the notification on each of n's channels, except those whose
+// medium ("email", "post", "get" or "print") is in skip, waits for them to
+// finish, and returns the first error. onSent (if not nil) is called as each
+// channel finishes with its medium and error. key is sent in the DedupHeader of posts and emails. incidentId is the
+// incident the ack button of posts acknowledges, if n has one; zero leaves the
+// button out.
+func (n *Notification) Deliver(onSent func(medium string, err error), skip []string, key, subject, body string, emailsubject, emailbody, emailtext []byte, c *Conf, ak string, incidentId uint64, attachments ...*Attachment) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	skipped := func(medium string) bool {
+		for _, s := range skip {
+			if s == medium {
+				return true
+			}
+		}
+		return false
+	}
+	do := func(medium string, f func() error) {
+		if skipped(medium) {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := f()
+			if onSent != nil {
+				onSent(medium, err)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	if len(n.Email) > 0 {
+		do("email", func() error { return n.doEmail(key, emailsubject, emailbody, emailtext, c, ak, attachments...) })
+	}
+	if n.Post != nil {
+		do("post", func() error { return n.doPost(key, []byte(subject), incidentId) })
+	}
+	if n.Get != nil {
+		do("get", n.DoGet)
+	}
+	if n.Print && !skipped("print") {
+		n.DoPrint(subject)
+		if onSent != nil {
+			onSent("print", nil)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
 func (n *Notification) DoPrint(subject string) {
 	slog.Infoln(subject)
 }
 
-func (n *Notification) DoPost(subject []byte) {
+func (n *Notification) DoPost(subject []byte) error {
+	return n.doPost("", subject, 0)
+}
+
+func (n *Notification) doPost(key string, subject []byte, incidentId uint64) error {
 	if n.Body != nil {
 		buf := new(bytes.Buffer)
 		if err := n.Body.Execute(buf, string(subject)); err != nil {
 			slog.Errorln(err)
-			return
+			return err
 		}
 		subject = buf.Bytes()
 	}
-	resp, err := http.Post(n.Post.String(), n.ContentType, bytes.NewBuffer(subject))
+	contentType := n.ContentType
+	if n.AckButton && incidentId != 0 {
+		var err error
+		if subject, err = ackMessage(subject, incidentId); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	req, err := http.NewRequest("POST", n.Post.String(), bytes.NewBuffer(subject))
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if key != "" {
+		req.Header.Set(DedupHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
 		slog.Error(err)
-		return
+		return err
 	}
 	if resp.StatusCode >= 300 {
 		slog.Errorln("bad response on notification post:", resp.Status)
+		return fmt.Errorf("bad response on notification post: %s", resp.Status)
 	}
+	return nil
+}
+
+// AckCallbackId identifies the ack buttons of Slack messages sent by
+// notifications with AckButton set. The button's value is the incident id.
+const AckCallbackId = "bosun_ack"
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback   string        `json:"fallback"`
+	CallbackId string        `json:"callback_id"`
+	Actions    []slackAction `json:"actions"`
 }
 
-func (n *Notification) DoGet() {
+type slackAction struct {
+	Name  string `json:"name"`
+	Text  string `json:"text"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ackMessage returns a Slack message of text with a button that acknowledges
+// the incident.
+func ackMessage(text []byte, incidentId uint64) ([]byte, error) {
+	return json.Marshal(slackMessage{
+		Text: string(text),
+		Attachments: []slackAttachment{{
+			Fallback:   fmt.Sprintf("Acknowledge incident %d in bosun", incidentId),
+			CallbackId: AckCallbackId,
+			Actions: []slackAction{{
+				Name:  "ack",
+				Text:  "Ack",
+				Type:  "button",
+				Value: fmt.Sprint(incidentId),
+			}},
+		}},
+	})
+}
+
+func (n *Notification) DoGet() error {
 	resp, err := http.Get(n.Get.String())
 	if err != nil {
 		slog.Error(err)
-		return
+		return err
 	}
 	if resp.StatusCode >= 300 {
 		slog.Error("bad response on notification get:", resp.Status)
+		return fmt.Errorf("bad response on notification get: %s", resp.Status)
 	}
+	return nil
 }
 
 type Attachment struct {
@@ -83,7 +221,28 @@ type Attachment struct {
 	ContentType string
 }
 
-func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachments ...*Attachment) {
+// DoEmail sends body as HTML. If text is not empty, the message is
+// multipart/alternative with text as the plain text version.
+func (n *Notification) DoEmail(subject, body, text []byte, c *Conf, ak string, attachments ...*Attachment) error {
+	return n.doEmail("", subject, body, text, c, ak, attachments...)
+}
+
+func (n *Notification) doEmail(key string, subject, body, text []byte, c *Conf, ak string, attachments ...*Attachment) error {
+	e := n.newEmail(subject, body, text, c, attachments...)
+	if key != "" {
+		e.Headers.Add(DedupHeader, key)
+	}
+	if err := Send(e, c.SMTPHost, c.SMTPUsername, c.SMTPPassword); err != nil {
+		collect.Add("email.sent_failed", nil, 1)
+		slog.Errorf("failed to send alert %v to %v %v\n", ak, e.To, err)
+		return err
+	}
+	collect.Add("email.sent", nil, 1)
+	slog.Infof("relayed alert %v to %v sucessfully\n", ak, e.To)
+	return nil
+}
+
+func (n *Notification) newEmail(subject, body, text []byte, c *Conf, attachments ...*Attachment) *email.Email {
 	e := email.NewEmail()
 	e.From = c.EmailFrom
 	for _, a := range n.Email {
@@ -91,17 +250,12 @@ func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachm
 	}
 	e.Subject = string(subject)
 	e.HTML = body
+	e.Text = text
 	for _, a := range attachments {
 		e.Attach(bytes.NewBuffer(a.Data), a.Filename, a.ContentType)
 	}
 	e.Headers.Add("X-Bosun-Server", util.Hostname)
-	if err := Send(e, c.SMTPHost, c.SMTPUsername, c.SMTPPassword); err != nil {
-		collect.Add("email.sent_failed", nil, 1)
-		slog.Errorf("failed to send alert %v to %v %v\n", ak, e.To, err)
-		return
-	}
-	collect.Add("email.sent", nil, 1)
-	slog.Infof("relayed alert %v to %v sucessfully\n", ak, e.To)
+	return e
 }
 
 // Send an email using the given host and SMTP auth (optional), returns any
@@ -26,7 +26,18 @@ type DataAccess interface {
 	GetTagMetadata(tags opentsdb.TagSet, name string) ([]*TagMetadata, error)
 	DeleteTagMetadata(tags opentsdb.TagSet, name string) error
 
+	// Page through the list at key in chunks of batch elements, calling fn for each element in order.
+	// Iteration stops at the first error returned by fn.
+	ScanList(key string, batch int, fn func([]byte) error) error
+
 	Search() SearchDataAccess
+	NotificationQueue() NotificationQueueDataAccess
+	Favorites() FavoritesDataAccess
+	Recoveries() RecoveryDataAccess
+	EvalInfo() EvalInfoDataAccess
+
+	// Close the connection pool. Connections in use are closed when they are released.
+	Close() error
 }
 
 type SearchDataAccess interface {
@@ -50,22 +61,33 @@ type SearchDataAccess interface {
 }
 
 type dataAccess struct {
-	pool    *redis.Pool
-	isRedis bool
+	pool     *redis.Pool
+	isRedis  bool
+	encoding Encoding
+	prefix   string
 }
 
 // Create a new data access object pointed at the specified address. isRedis parameter used to distinguish true redis from ledis in-proc.
-func NewDataAccess(addr string, isRedis bool) DataAccess {
-	return newDataAccess(addr, isRedis)
+// Stored values are written with enc, but values in either encoding can be read.
+// Every key is prefixed with prefix, so several bosun instances can share one server.
+func NewDataAccess(addr string, isRedis bool, enc Encoding, prefix string) DataAccess {
+	return newDataAccess(addr, isRedis, enc, prefix)
 }
 
-func newDataAccess(addr string, isRedis bool) *dataAccess {
+func newDataAccess(addr string, isRedis bool, enc Encoding, prefix string) *dataAccess {
 	return &dataAccess{
-		pool:    newPool(addr, "", 0, isRedis, 1000, true),
-		isRedis: isRedis,
+		pool:     newPool(addr, "", 0, isRedis, 1000, true),
+		isRedis:  isRedis,
+		encoding: enc,
+		prefix:   prefix,
 	}
 }
 
+// key returns the name k is stored under, with the instance's prefix applied.
+func (d *dataAccess) key(k string) string {
+	return d.prefix + k
+}
+
 // Start in-process ledis server. Data will go in the specified directory and it will bind to the given port.
 // Return value is a function you can call to stop the server.
 func StartLedis(dataDir string, bind string) (stop func(), err error) {
@@ -91,6 +113,10 @@ func (d *dataAccess) GetConnection() redis.Conn {
 	return d.pool.Get()
 }
 
+func (d *dataAccess) Close() error {
+	return d.pool.Close()
+}
+
 func newPool(server, password string, database int, isRedis bool, maxActive int, wait bool) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     50,
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+
+	"bosun.org/_third_party/github.com/ugorji/go/codec"
+	"bosun.org/util"
+)
+
+/*
+	Values stored as blobs (the search:last backup, and alert errors and
+	incidents in the state file) are written in one of two encodings:
+
+	JSON: gzipped JSON, the original format.
+	Msgpack: msgpackPrefix followed by the msgpack encoding of the value.
+
+	Unmarshal detects the encoding from the prefix, so a store containing both
+	can always be read regardless of the encoding selected for writes.
+*/
+
+// Encoding selects how stored values are serialized.
+type Encoding int
+
+const (
+	EncodingJSON Encoding = iota
+	EncodingMsgpack
+)
+
+// msgpackPrefix cannot begin a gzip stream, which always starts with 0x1f 0x8b.
+var msgpackPrefix = []byte("\x00mp1")
+
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// Marshal encodes v with the encoding e.
+func (e Encoding) Marshal(v interface{}) ([]byte, error) {
+	switch e {
+	case EncodingJSON:
+		return util.MarshalGzipJson(v)
+	case EncodingMsgpack:
+		var b []byte
+		if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(v); err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, msgpackPrefix...), b...), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %d", e)
+	}
+}
+
+// IsMsgpack reports whether b was written with EncodingMsgpack.
+func IsMsgpack(b []byte) bool {
+	return bytes.HasPrefix(b, msgpackPrefix)
+}
+
+// Unmarshal decodes b into v, detecting whether b was written as JSON or msgpack.
+func Unmarshal(b []byte, v interface{}) error {
+	if IsMsgpack(b) {
+		return codec.NewDecoderBytes(b[len(msgpackPrefix):], msgpackHandle).Decode(v)
+	}
+	return util.UnmarshalGzipJson(b, v)
+}
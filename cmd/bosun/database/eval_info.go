@@ -0,0 +1,55 @@
+package database
+
+import (
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+The last evaluation of each alert:
+
+alertEvalInfo -> hash of alert name to encoded AlertEvalInfo
+*/
+
+const alertEvalInfoKey = "alertEvalInfo"
+
+type EvalInfoDataAccess interface {
+	// Set the last evaluation of the named alert, replacing the previous one.
+	SetAlertEvalInfo(name string, info *AlertEvalInfo) error
+	// Get the last evaluation of the named alert, or nil if it has not run.
+	GetAlertEvalInfo(name string) (*AlertEvalInfo, error)
+}
+
+func (d *dataAccess) EvalInfo() EvalInfoDataAccess {
+	return d
+}
+
+func (d *dataAccess) SetAlertEvalInfo(name string, info *AlertEvalInfo) error {
+	defer startTimer("SetAlertEvalInfo")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	dat, err := d.encoding.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", d.key(alertEvalInfoKey), name, dat)
+	return err
+}
+
+func (d *dataAccess) GetAlertEvalInfo(name string) (*AlertEvalInfo, error) {
+	defer startTimer("GetAlertEvalInfo")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("HGET", d.key(alertEvalInfoKey), name))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info := new(AlertEvalInfo)
+	if err := Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
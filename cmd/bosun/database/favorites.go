@@ -0,0 +1,51 @@
+package database
+
+import (
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+Favorites by user:
+
+favorites:{user} -> set of favorited items
+*/
+
+func favoritesKey(user string) string {
+	return "favorites:" + user
+}
+
+type FavoritesDataAccess interface {
+	AddFavorite(user, item string) error
+	RemoveFavorite(user, item string) error
+	GetFavorites(user string) ([]string, error)
+}
+
+func (d *dataAccess) Favorites() FavoritesDataAccess {
+	return d
+}
+
+func (d *dataAccess) AddFavorite(user, item string) error {
+	defer startTimer("AddFavorite")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", d.key(favoritesKey(user)), item)
+	return err
+}
+
+func (d *dataAccess) RemoveFavorite(user, item string) error {
+	defer startTimer("RemoveFavorite")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	_, err := conn.Do("SREM", d.key(favoritesKey(user)), item)
+	return err
+}
+
+func (d *dataAccess) GetFavorites(user string) ([]string, error) {
+	defer startTimer("GetFavorites")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", d.key(favoritesKey(user))))
+}
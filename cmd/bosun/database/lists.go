@@ -0,0 +1,42 @@
+package database
+
+import (
+	"fmt"
+
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+	ScanList is a generic helper for reading potentially large lists without
+	loading them entirely into memory. Elements are fetched with LRANGE in
+	fixed-size pages and handed to the callback one at a time.
+*/
+
+const defaultScanBatch = 100
+
+func (d *dataAccess) ScanList(key string, batch int, fn func([]byte) error) error {
+	defer startTimer("ScanList")()
+	if batch <= 0 {
+		batch = defaultScanBatch
+	}
+	conn := d.GetConnection()
+	defer conn.Close()
+	for start := 0; ; start += batch {
+		items, err := redis.Values(conn.Do("LRANGE", d.key(key), start, start+batch-1))
+		if err != nil {
+			return fmt.Errorf("scanning %s: %v", key, err)
+		}
+		for _, item := range items {
+			b, err := redis.Bytes(item, nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(b); err != nil {
+				return err
+			}
+		}
+		if len(items) < batch {
+			return nil
+		}
+	}
+}
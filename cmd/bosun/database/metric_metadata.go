@@ -5,8 +5,6 @@ import (
 	"time"
 
 	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
-	"bosun.org/collect"
-	"bosun.org/opentsdb"
 )
 
 /*
@@ -26,21 +24,21 @@ func metricMetaKey(metric string) string {
 const metricMetaTTL = int((time.Hour * 24 * 7) / time.Second)
 
 func (d *dataAccess) PutMetricMetadata(metric string, field string, value string) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "PutMetricMeta"})()
+	defer startTimer("PutMetricMeta")()
 	if field != "desc" && field != "unit" && field != "rate" {
 		return fmt.Errorf("Unknown metric metadata field: %s", field)
 	}
 	conn := d.GetConnection()
 	defer conn.Close()
-	_, err := conn.Do("HMSET", metricMetaKey(metric), field, value, "lastTouched", time.Now().UTC().Unix())
+	_, err := conn.Do("HMSET", d.key(metricMetaKey(metric)), field, value, "lastTouched", time.Now().UTC().Unix())
 	return err
 }
 
 func (d *dataAccess) GetMetricMetadata(metric string) (*MetricMetadata, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetMetricMeta"})()
+	defer startTimer("GetMetricMeta")()
 	conn := d.GetConnection()
 	defer conn.Close()
-	v, err := redis.Values(conn.Do("HGETALL", metricMetaKey(metric)))
+	v, err := redis.Values(conn.Do("HGETALL", d.key(metricMetaKey(metric))))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,261 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+	Migrate copies every key in one database to another, for moving bosun to a new redis.
+
+	Keys are enumerated with SCAN on redis and XSCAN (once per data type) on ledis.
+	Strings and lists are replaced in the destination, and hash, set and zset writes are idempotent,
+	so an interrupted migration can simply be run again. Keys that expire get the same time to live
+	in the destination.
+*/
+
+// MigrateProgress counts the work done by Migrate so far.
+type MigrateProgress struct {
+	Keys     int // keys visited
+	Elements int // values, fields or members copied (or that would be copied in a dry run)
+	Expiring int // keys copied with a time to live
+}
+
+const migrateScanBatch = 100
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Migrate copies all keys from src to dst. If dryRun is true nothing is written and the
+// returned counts report what would have been copied. progress, if not nil, is called after each key.
+func Migrate(src, dst DataAccess, dryRun bool, progress func(key string, p MigrateProgress)) (MigrateProgress, error) {
+	defer startTimer("Migrate")()
+	var p MigrateProgress
+	s, ok := src.(*dataAccess)
+	if !ok {
+		return p, fmt.Errorf("migrate: unsupported source %T", src)
+	}
+	d, ok := dst.(*dataAccess)
+	if !ok {
+		return p, fmt.Errorf("migrate: unsupported destination %T", dst)
+	}
+	sc := migrateConn{s.GetConnection(), s.isRedis}
+	defer sc.Close()
+	dc := migrateConn{d.GetConnection(), d.isRedis}
+	defer dc.Close()
+	copyKey := func(key, typ string) error {
+		n, expiring, err := migrateKey(sc, dc, key, typ, dryRun)
+		if err != nil {
+			return fmt.Errorf("migrate %s %s: %v", typ, key, err)
+		}
+		p.Keys++
+		p.Elements += n
+		if expiring {
+			p.Expiring++
+		}
+		if progress != nil {
+			progress(key, p)
+		}
+		return nil
+	}
+	// Only keys in the source's namespace are copied; they keep their names in the destination.
+	// redis matches keys with a glob, ledis with a regular expression.
+	if s.isRedis {
+		return p, scanRedisKeys(sc, globEscaper.Replace(s.prefix)+"*", copyKey)
+	}
+	return p, scanLedisKeys(sc, "^"+regexp.QuoteMeta(s.prefix), copyKey)
+}
+
+func scanRedisKeys(conn redis.Conn, match string, fn func(key, typ string) error) error {
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", migrateScanBatch))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			typ, err := redis.String(conn.Do("TYPE", key))
+			if err != nil {
+				return err
+			}
+			if err := fn(key, typ); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// ledis data types as named by XSCAN, with the matching redis TYPE name.
+var ledisScanTypes = []struct{ ledis, redis string }{
+	{"KV", "string"},
+	{"HASH", "hash"},
+	{"LIST", "list"},
+	{"SET", "set"},
+	{"ZSET", "zset"},
+}
+
+func scanLedisKeys(conn redis.Conn, match string, fn func(key, typ string) error) error {
+	for _, t := range ledisScanTypes {
+		cursor := ""
+		for {
+			values, err := redis.Values(conn.Do("XSCAN", t.ledis, cursor, "MATCH", match, "COUNT", migrateScanBatch))
+			if err != nil {
+				return err
+			}
+			var keys []string
+			if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := fn(key, t.redis); err != nil {
+					return err
+				}
+			}
+			if cursor == "" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// migrateConn is a connection to one side of a migration. The expiry and
+// delete commands of ledis differ from redis by type.
+type migrateConn struct {
+	redis.Conn
+	isRedis bool
+}
+
+// ledisTypeCommands are the ledis commands that delete a key of each redis
+// type and get or set its time to live in seconds. redis uses DEL, PTTL and
+// PEXPIRE, in milliseconds, for all types.
+var ledisTypeCommands = map[string]struct{ del, ttl, expire string }{
+	"string": {"DEL", "TTL", "EXPIRE"},
+	"hash":   {"HCLEAR", "HTTL", "HEXPIRE"},
+	"list":   {"LCLEAR", "LTTL", "LEXPIRE"},
+	"set":    {"SCLEAR", "STTL", "SEXPIRE"},
+	"zset":   {"ZCLEAR", "ZTTL", "ZEXPIRE"},
+}
+
+func (c migrateConn) del(key, typ string) error {
+	cmd := "DEL"
+	if !c.isRedis {
+		cmd = ledisTypeCommands[typ].del
+	}
+	_, err := c.Do(cmd, key)
+	return err
+}
+
+// ttl returns the time to live of key in milliseconds, or 0 if it does not expire.
+func (c migrateConn) ttl(key, typ string) (int64, error) {
+	if c.isRedis {
+		ms, err := redis.Int64(c.Do("PTTL", key))
+		if err != nil || ms < 0 {
+			return 0, err
+		}
+		return ms, nil
+	}
+	secs, err := redis.Int64(c.Do(ledisTypeCommands[typ].ttl, key))
+	if err != nil || secs < 0 {
+		return 0, err
+	}
+	return secs * 1000, nil
+}
+
+// expire sets the time to live of key to ms milliseconds, rounded up to
+// whole seconds on ledis.
+func (c migrateConn) expire(key, typ string, ms int64) error {
+	if c.isRedis {
+		_, err := c.Do("PEXPIRE", key, ms)
+		return err
+	}
+	_, err := c.Do(ledisTypeCommands[typ].expire, key, (ms+999)/1000)
+	return err
+}
+
+// migrateKey copies a single key of the given redis type, replacing it in the destination, along
+// with its time to live. It returns the number of elements copied and whether the key expires.
+func migrateKey(src, dst migrateConn, key, typ string, dryRun bool) (int, bool, error) {
+	n, err := migrateValue(src, dst, key, typ, dryRun)
+	if err != nil {
+		return n, false, err
+	}
+	ttl, err := src.ttl(key, typ)
+	if err != nil || ttl == 0 || dryRun {
+		return n, ttl != 0, err
+	}
+	return n, true, dst.expire(key, typ, ttl)
+}
+
+// migrateValue copies the value of a single key and returns the number of elements copied.
+func migrateValue(src, dst migrateConn, key, typ string, dryRun bool) (int, error) {
+	switch typ {
+	case "string":
+		v, err := redis.Bytes(src.Do("GET", key))
+		if err != nil || dryRun {
+			return 1, err
+		}
+		_, err = dst.Do("SET", key, v)
+		return 1, err
+	case "hash":
+		values, err := redis.Values(src.Do("HGETALL", key))
+		if err != nil || len(values) == 0 || dryRun {
+			return len(values) / 2, err
+		}
+		_, err = dst.Do("HMSET", append([]interface{}{key}, values...)...)
+		return len(values) / 2, err
+	case "set":
+		values, err := redis.Values(src.Do("SMEMBERS", key))
+		if err != nil || len(values) == 0 || dryRun {
+			return len(values), err
+		}
+		_, err = dst.Do("SADD", append([]interface{}{key}, values...)...)
+		return len(values), err
+	case "zset":
+		values, err := redis.Values(src.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+		if err != nil || len(values) == 0 || dryRun {
+			return len(values) / 2, err
+		}
+		// ZRANGE gives member, score pairs; ZADD wants score, member.
+		args := []interface{}{key}
+		for i := 0; i+1 < len(values); i += 2 {
+			args = append(args, values[i+1], values[i])
+		}
+		_, err = dst.Do("ZADD", args...)
+		return len(values) / 2, err
+	case "list":
+		srcLen, err := redis.Int(src.Do("LLEN", key))
+		if err != nil || dryRun {
+			return srcLen, err
+		}
+		// The list is replaced rather than appended to, so a rerun does not duplicate elements.
+		if err := dst.del(key, typ); err != nil {
+			return 0, err
+		}
+		copied := 0
+		for start := 0; start < srcLen; start += migrateScanBatch {
+			values, err := redis.Values(src.Do("LRANGE", key, start, start+migrateScanBatch-1))
+			if err != nil {
+				return copied, err
+			}
+			if len(values) == 0 {
+				break
+			}
+			if _, err := dst.Do("RPUSH", append([]interface{}{key}, values...)...); err != nil {
+				return copied, err
+			}
+			copied += len(values)
+		}
+		return copied, nil
+	}
+	return 0, fmt.Errorf("unsupported type %q", typ)
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"time"
+
 	"bosun.org/opentsdb"
 )
 
@@ -23,3 +25,47 @@ type LastInfo struct {
 	DiffFromPrev float64
 	Timestamp    int64
 }
+
+// AlertEvalInfo describes the last evaluation of an alert.
+type AlertEvalInfo struct {
+	// Time is when the evaluation started, in unix seconds.
+	Time     int64
+	Duration time.Duration
+	// Crits, Warns, Unevaluated and Unknown count the alert's instances in
+	// each state after the evaluation.
+	Crits       int
+	Warns       int
+	Unevaluated int
+	Unknown     int
+	// Error is the error the evaluation failed with, if any.
+	Error string `json:",omitempty"`
+}
+
+// QueuedNotification is a rendered notification waiting to be sent.
+type QueuedNotification struct {
+	// Id identifies the notification in the queue, and is sent with it so
+	// receivers can drop repeated deliveries.
+	Id           string
+	Notification string
+	AlertKey     string
+	// IncidentId is the incident the notification is for, which its ack
+	// button acknowledges and its sends are recorded on, or zero for none.
+	IncidentId   uint64
+	Subject      string
+	Body         string
+	EmailSubject []byte
+	EmailBody    []byte
+	EmailText    []byte
+	Attachments  []*QueuedAttachment
+	Enqueued     int64
+	Attempts     int
+	// Sent is the channels ("email", "post", "get" or "print") already
+	// delivered to, which retries skip.
+	Sent []string
+}
+
+type QueuedAttachment struct {
+	Data        []byte
+	Filename    string
+	ContentType string
+}
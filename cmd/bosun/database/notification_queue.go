@@ -0,0 +1,95 @@
+package database
+
+import (
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+Outbound notifications waiting to be sent:
+
+notifications:queue -> hash of notification id to encoded QueuedNotification
+
+A notification is added before it is sent and removed once it has been, so
+any left over after a restart were never delivered.
+*/
+
+const notificationQueueKey = "notifications:queue"
+
+type NotificationQueueDataAccess interface {
+	// Add n to the queue, replacing any queued notification with the same Id.
+	Enqueue(n *QueuedNotification) error
+	// Get all queued notifications, in no particular order.
+	Pending() ([]*QueuedNotification, error)
+	// Remove the notification with the given id from the queue.
+	Dequeue(id string) error
+	// Get whether the notification with the given id is still queued.
+	IsQueued(id string) (bool, error)
+	// Get the number of queued notifications.
+	QueueDepth() (int, error)
+}
+
+func (d *dataAccess) NotificationQueue() NotificationQueueDataAccess {
+	return d
+}
+
+func (d *dataAccess) Enqueue(n *QueuedNotification) error {
+	defer startTimer("Enqueue")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	dat, err := d.encoding.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", d.key(notificationQueueKey), n.Id, dat)
+	return err
+}
+
+func (d *dataAccess) Pending() ([]*QueuedNotification, error) {
+	defer startTimer("Pending")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	vals, err := redis.Values(conn.Do("HVALS", d.key(notificationQueueKey)))
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*QueuedNotification, 0, len(vals))
+	for _, v := range vals {
+		b, err := redis.Bytes(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		n := new(QueuedNotification)
+		if err := Unmarshal(b, n); err != nil {
+			return nil, err
+		}
+		pending = append(pending, n)
+	}
+	return pending, nil
+}
+
+func (d *dataAccess) Dequeue(id string) error {
+	defer startTimer("Dequeue")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", d.key(notificationQueueKey), id)
+	return err
+}
+
+func (d *dataAccess) IsQueued(id string) (bool, error) {
+	defer startTimer("IsQueued")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("HEXISTS", d.key(notificationQueueKey), id))
+}
+
+func (d *dataAccess) QueueDepth() (int, error) {
+	defer startTimer("QueueDepth")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("HLEN", d.key(notificationQueueKey)))
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"time"
+
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+)
+
+/*
+Alert keys in their post-recovery cooldown:
+
+recovered -> hash of alert key to the unix time its cooldown ends
+*/
+
+const recoveredKey = "recovered"
+
+type RecoveryDataAccess interface {
+	// Mark the alert key as recovered, with its cooldown ending at until.
+	SetRecoveredUntil(ak string, until time.Time) error
+	// Get the end of the cooldown of the alert key, or the zero time if it is not recovered.
+	GetRecoveredUntil(ak string) (time.Time, error)
+	// Get the end of the cooldown of every recovered alert key.
+	GetAllRecovered() (map[string]time.Time, error)
+	// Remove the recovered mark of the alert key.
+	ClearRecovered(ak string) error
+}
+
+func (d *dataAccess) Recoveries() RecoveryDataAccess {
+	return d
+}
+
+func (d *dataAccess) SetRecoveredUntil(ak string, until time.Time) error {
+	defer startTimer("SetRecoveredUntil")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", d.key(recoveredKey), ak, until.Unix())
+	return err
+}
+
+func (d *dataAccess) GetRecoveredUntil(ak string) (time.Time, error) {
+	defer startTimer("GetRecoveredUntil")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	until, err := redis.Int64(conn.Do("HGET", d.key(recoveredKey), ak))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(until, 0).UTC(), nil
+}
+
+func (d *dataAccess) GetAllRecovered() (map[string]time.Time, error) {
+	defer startTimer("GetAllRecovered")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	m, err := stringInt64Map(conn.Do("HGETALL", d.key(recoveredKey)))
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]time.Time, len(m))
+	for ak, until := range m {
+		all[ak] = time.Unix(until, 0).UTC()
+	}
+	return all, nil
+}
+
+func (d *dataAccess) ClearRecovered(ak string) error {
+	defer startTimer("ClearRecovered")()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", d.key(recoveredKey), ak)
+	return err
+}
@@ -5,9 +5,7 @@ import (
 	"strconv"
 
 	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
-	"bosun.org/collect"
 	"bosun.org/opentsdb"
-	"bosun.org/util"
 )
 
 /*
@@ -48,20 +46,20 @@ func (d *dataAccess) Search() SearchDataAccess {
 }
 
 func (d *dataAccess) AddMetricForTag(tagK, tagV, metric string, time int64) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "AddMetricForTag"})()
+	defer startTimer("AddMetricForTag")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	_, err := conn.Do("HSET", searchMetricKey(tagK, tagV), metric, time)
+	_, err := conn.Do("HSET", d.key(searchMetricKey(tagK, tagV)), metric, time)
 	return err
 }
 
 func (d *dataAccess) GetMetricsForTag(tagK, tagV string) (map[string]int64, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetMetricsForTag"})()
+	defer startTimer("GetMetricsForTag")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	return stringInt64Map(conn.Do("HGETALL", searchMetricKey(tagK, tagV)))
+	return stringInt64Map(conn.Do("HGETALL", d.key(searchMetricKey(tagK, tagV))))
 }
 
 func stringInt64Map(d interface{}, err error) (map[string]int64, error) {
@@ -78,68 +76,68 @@ func stringInt64Map(d interface{}, err error) (map[string]int64, error) {
 }
 
 func (d *dataAccess) AddTagKeyForMetric(metric, tagK string, time int64) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "AddTagKeyForMetric"})()
+	defer startTimer("AddTagKeyForMetric")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	_, err := conn.Do("HSET", searchTagkKey(metric), tagK, time)
+	_, err := conn.Do("HSET", d.key(searchTagkKey(metric)), tagK, time)
 	return err
 }
 
 func (d *dataAccess) GetTagKeysForMetric(metric string) (map[string]int64, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetTagKeysForMetric"})()
+	defer startTimer("GetTagKeysForMetric")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	return stringInt64Map(conn.Do("HGETALL", searchTagkKey(metric)))
+	return stringInt64Map(conn.Do("HGETALL", d.key(searchTagkKey(metric))))
 }
 
 func (d *dataAccess) AddMetric(metric string, time int64) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "AddMetric"})()
+	defer startTimer("AddMetric")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	_, err := conn.Do("HSET", searchAllMetricsKey, metric, time)
+	_, err := conn.Do("HSET", d.key(searchAllMetricsKey), metric, time)
 	return err
 }
 func (d *dataAccess) GetAllMetrics() (map[string]int64, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetAllMetrics"})()
+	defer startTimer("GetAllMetrics")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	return stringInt64Map(conn.Do("HGETALL", searchAllMetricsKey))
+	return stringInt64Map(conn.Do("HGETALL", d.key(searchAllMetricsKey)))
 }
 
 func (d *dataAccess) AddTagValue(metric, tagK, tagV string, time int64) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "AddTagValue"})()
+	defer startTimer("AddTagValue")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	_, err := conn.Do("HSET", searchTagvKey(metric, tagK), tagV, time)
+	_, err := conn.Do("HSET", d.key(searchTagvKey(metric, tagK)), tagV, time)
 	return err
 }
 func (d *dataAccess) GetTagValues(metric, tagK string) (map[string]int64, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetTagValues"})()
+	defer startTimer("GetTagValues")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	return stringInt64Map(conn.Do("HGETALL", searchTagvKey(metric, tagK)))
+	return stringInt64Map(conn.Do("HGETALL", d.key(searchTagvKey(metric, tagK))))
 }
 
 func (d *dataAccess) AddMetricTagSet(metric, tagSet string, time int64) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "AddMetricTagSet"})()
+	defer startTimer("AddMetricTagSet")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	_, err := conn.Do("HSET", searchMetricTagSetKey(metric), tagSet, time)
+	_, err := conn.Do("HSET", d.key(searchMetricTagSetKey(metric)), tagSet, time)
 	return err
 }
 func (d *dataAccess) GetMetricTagSets(metric string, tags opentsdb.TagSet) (map[string]int64, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetMetricTagSets"})()
+	defer startTimer("GetMetricTagSets")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	mtss, err := stringInt64Map(conn.Do("HGETALL", searchMetricTagSetKey(metric)))
+	mtss, err := stringInt64Map(conn.Do("HGETALL", d.key(searchMetricTagSetKey(metric))))
 	if err != nil {
 		return nil, err
 	}
@@ -156,29 +154,29 @@ func (d *dataAccess) GetMetricTagSets(metric string, tags opentsdb.TagSet) (map[
 }
 
 func (d *dataAccess) BackupLastInfos(m map[string]map[string]*LastInfo) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "BackupLast"})()
+	defer startTimer("BackupLast")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	dat, err := util.MarshalGzipJson(m)
+	dat, err := d.encoding.Marshal(m)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Do("SET", "search:last", dat)
+	_, err = conn.Do("SET", d.key("search:last"), dat)
 	return err
 }
 
 func (d *dataAccess) LoadLastInfos() (map[string]map[string]*LastInfo, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "LoadLast"})()
+	defer startTimer("LoadLast")()
 	conn := d.GetConnection()
 	defer conn.Close()
 
-	b, err := redis.Bytes(conn.Do("GET", "search:last"))
+	b, err := redis.Bytes(conn.Do("GET", d.key("search:last")))
 	if err != nil {
 		return nil, err
 	}
 	var m map[string]map[string]*LastInfo
-	err = util.UnmarshalGzipJson(b, &m)
+	err = Unmarshal(b, &m)
 	if err != nil {
 		return nil, err
 	}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
-	"bosun.org/collect"
 	"bosun.org/opentsdb"
 )
 
@@ -29,17 +28,17 @@ func tagMetaIdxKey(tagK, tagV string) string {
 }
 
 func (d *dataAccess) PutTagMetadata(tags opentsdb.TagSet, name string, value string, updated time.Time) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "PutTagMeta"})()
+	defer startTimer("PutTagMeta")()
 	conn := d.GetConnection()
 	defer conn.Close()
-	key := tagMetaKey(tags, name)
+	key := d.key(tagMetaKey(tags, name))
 	keyValue := fmt.Sprintf("%d:%s", updated.UTC().Unix(), value)
 	_, err := conn.Do("SET", key, keyValue)
 	if err != nil {
 		return err
 	}
 	for tagK, tagV := range tags {
-		_, err := conn.Do("SADD", tagMetaIdxKey(tagK, tagV), key)
+		_, err := conn.Do("SADD", d.key(tagMetaIdxKey(tagK, tagV)), key)
 		if err != nil {
 			return err
 		}
@@ -48,16 +47,16 @@ func (d *dataAccess) PutTagMetadata(tags opentsdb.TagSet, name string, value str
 }
 
 func (d *dataAccess) DeleteTagMetadata(tags opentsdb.TagSet, name string) error {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "DeleteTagMeta"})()
+	defer startTimer("DeleteTagMeta")()
 	conn := d.GetConnection()
 	defer conn.Close()
-	key := tagMetaKey(tags, name)
+	key := d.key(tagMetaKey(tags, name))
 	_, err := conn.Do("DEL", key)
 	if err != nil {
 		return err
 	}
 	for tagK, tagV := range tags {
-		_, err := conn.Do("SREM", tagMetaIdxKey(tagK, tagV), key)
+		_, err := conn.Do("SREM", d.key(tagMetaIdxKey(tagK, tagV)), key)
 		if err != nil {
 			return err
 		}
@@ -66,12 +65,12 @@ func (d *dataAccess) DeleteTagMetadata(tags opentsdb.TagSet, name string) error
 }
 
 func (d *dataAccess) GetTagMetadata(tags opentsdb.TagSet, name string) ([]*TagMetadata, error) {
-	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetTagMeta"})()
+	defer startTimer("GetTagMeta")()
 	conn := d.GetConnection()
 	defer conn.Close()
 	args := []interface{}{}
 	for tagK, tagV := range tags {
-		args = append(args, tagMetaIdxKey(tagK, tagV))
+		args = append(args, d.key(tagMetaIdxKey(tagK, tagV)))
 	}
 	keys, err := redis.Strings(conn.Do("SINTER", args...))
 	if err != nil {
@@ -87,7 +86,7 @@ func (d *dataAccess) GetTagMetadata(tags opentsdb.TagSet, name string) ([]*TagMe
 	data := []*TagMetadata{}
 	for i := range args {
 		// break up key to get tags and name
-		key := args[i].(string)[len("tmeta:"):]
+		key := args[i].(string)[len(d.key("tmeta:")):]
 		sepIdx := strings.LastIndex(key, ":")
 		tags := key[:sepIdx]
 		name := key[sepIdx+1:]
@@ -0,0 +1,51 @@
+package dbtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/database"
+)
+
+func TestEncoding_RoundTrip(t *testing.T) {
+	type event struct {
+		FirstTime, LastTime time.Time
+		Count               int
+		Message             string
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	in := map[string][]event{
+		"a": {{FirstTime: now, LastTime: now.Add(time.Minute), Count: 3, Message: "boom"}},
+	}
+	for _, enc := range []database.Encoding{database.EncodingJSON, database.EncodingMsgpack} {
+		b, err := enc.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string][]event
+		// Unmarshal must detect the encoding, so mixed stores can be read.
+		if err := database.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("encoding %d: got %v, expected %v", enc, out, in)
+		}
+	}
+}
+
+func TestEncoding_LastInfos(t *testing.T) {
+	m := map[string]map[string]*database.LastInfo{
+		"m": {"{host=a}": {LastVal: 1.5, DiffFromPrev: .5, Timestamp: 100}},
+	}
+	if err := testData.Search().BackupLastInfos(m); err != nil {
+		t.Fatal(err)
+	}
+	out, err := testData.Search().LoadLastInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, out) {
+		t.Errorf("got %v, expected %v", out, m)
+	}
+}
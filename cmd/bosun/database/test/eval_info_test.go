@@ -0,0 +1,43 @@
+package dbtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/database"
+)
+
+func TestAlertEvalInfo(t *testing.T) {
+	evalInfo := testData.EvalInfo()
+	ok, failed := randString(5), randString(5)
+	if info, err := evalInfo.GetAlertEvalInfo(ok); err != nil || info != nil {
+		t.Fatalf("expected no evaluation, got %+v, %v", info, err)
+	}
+	infos := map[string]*database.AlertEvalInfo{
+		ok:     {Time: 100, Duration: 2 * time.Second, Crits: 1, Warns: 2},
+		failed: {Time: 200, Duration: time.Millisecond, Unknown: 3, Error: "boom"},
+	}
+	for name, info := range infos {
+		if err := evalInfo.SetAlertEvalInfo(name, info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range infos {
+		info, err := evalInfo.GetAlertEvalInfo(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("%s: got %+v, expected %+v", name, info, expected)
+		}
+	}
+	// A later evaluation replaces the earlier one.
+	next := &database.AlertEvalInfo{Time: 300, Duration: time.Second}
+	if err := evalInfo.SetAlertEvalInfo(failed, next); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := evalInfo.GetAlertEvalInfo(failed); err != nil || !reflect.DeepEqual(info, next) {
+		t.Errorf("got %+v, %v, expected %+v", info, err, next)
+	}
+}
@@ -0,0 +1,44 @@
+package dbtest
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFavorites(t *testing.T) {
+	alice, bob := "alice"+randString(5), "bob"+randString(5)
+	favorites := testData.Favorites()
+	for _, item := range []string{"alert:a", "alert:b", "incident:1"} {
+		if err := favorites.AddFavorite(alice, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := favorites.AddFavorite(bob, "alert:c"); err != nil {
+		t.Fatal(err)
+	}
+	// Adding a favorite again does nothing.
+	if err := favorites.AddFavorite(bob, "alert:c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := favorites.RemoveFavorite(alice, "alert:b"); err != nil {
+		t.Fatal(err)
+	}
+	// Removing another user's favorite does not affect them.
+	if err := favorites.RemoveFavorite(alice, "alert:c"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(user string, expected []string) {
+		got, err := favorites.GetFavorites(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v, expected %v", user, got, expected)
+		}
+	}
+	check(alice, []string{"alert:a", "incident:1"})
+	check(bob, []string{"alert:c"})
+	check("nobody"+randString(5), []string{})
+}
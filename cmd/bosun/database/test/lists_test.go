@@ -0,0 +1,75 @@
+package dbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"bosun.org/cmd/bosun/database"
+)
+
+func TestScanList_MultipleBatches(t *testing.T) {
+	key := "list:" + randString(6)
+	conn := testData.(database.Connector).GetConnection()
+	defer conn.Close()
+	for i := 0; i < 25; i++ {
+		if _, err := conn.Do("RPUSH", key, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := []string{}
+	err := testData.ScanList(key, 10, func(b []byte) error {
+		got = append(got, string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 25 {
+		t.Fatalf("expected 25 elements, got %d", len(got))
+	}
+	for i, v := range got {
+		if v != fmt.Sprint(i) {
+			t.Fatalf("element %d: expected %d, got %s", i, i, v)
+		}
+	}
+}
+
+func TestScanList_Empty(t *testing.T) {
+	calls := 0
+	err := testData.ScanList("list:"+randString(6), 10, func(b []byte) error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no callbacks, got %d", calls)
+	}
+}
+
+func TestScanList_StopsOnError(t *testing.T) {
+	key := "list:" + randString(6)
+	conn := testData.(database.Connector).GetConnection()
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Do("RPUSH", key, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err := testData.ScanList(key, 2, func(b []byte) error {
+		calls++
+		if calls == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("expected stop error, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 callbacks, got %d", calls)
+	}
+}
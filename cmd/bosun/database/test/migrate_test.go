@@ -0,0 +1,133 @@
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"bosun.org/_third_party/github.com/garyburd/redigo/redis"
+	"bosun.org/cmd/bosun/database"
+)
+
+// startMigrateDest starts a second, empty ledis to migrate into.
+func startMigrateDest(t *testing.T) (database.DataAccess, func()) {
+	addr := "127.0.0.1:9877"
+	dir := filepath.Join(os.TempDir(), "bosun_ledis_migrate_test", fmt.Sprint(time.Now().UnixNano()))
+	stop, err := database.StartLedis(dir, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.NewDataAccess(addr, false, database.EncodingJSON, ""), func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dst, stop := startMigrateDest(t)
+	defer stop()
+	prefix := "migrate:" + randString(6) + ":"
+	src := testData.(database.Connector).GetConnection()
+	defer src.Close()
+	for i := 0; i < 250; i++ {
+		if _, err := src.Do("RPUSH", prefix+"list", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.Do("SADD", prefix+"set", "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Do("HMSET", prefix+"hash", "f1", "v1", "f2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Do("SET", prefix+"string", "value"); err != nil {
+		t.Fatal(err)
+	}
+	listExpire := "LEXPIRE"
+	if testIsRedis {
+		listExpire = "EXPIRE"
+	}
+	if _, err := src.Do(listExpire, prefix+"list", 3600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Do("EXPIRE", prefix+"string", 3600); err != nil {
+		t.Fatal(err)
+	}
+	dc := dst.(database.Connector).GetConnection()
+	defer dc.Close()
+
+	// A dry run must not write anything.
+	p, err := database.Migrate(testData, dst, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Elements < 256 {
+		t.Fatalf("dry run: expected at least 256 elements, got %+v", p)
+	}
+	if n, _ := redis.Int(dc.Do("LLEN", prefix+"list")); n != 0 {
+		t.Fatalf("dry run wrote %d list elements", n)
+	}
+
+	// Simulate an interrupted run that had already copied part of the list,
+	// and a string that changed since.
+	if _, err := dc.Do("RPUSH", prefix+"list", "0", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.Do("SET", prefix+"string", "stale"); err != nil {
+		t.Fatal(err)
+	}
+	visited := 0
+	if _, err := database.Migrate(testData, dst, false, func(string, database.MigrateProgress) { visited++ }); err != nil {
+		t.Fatal(err)
+	}
+	if visited < 4 {
+		t.Fatalf("expected progress for at least 4 keys, got %d", visited)
+	}
+	list, err := redis.Strings(dc.Do("LRANGE", prefix+"list", 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 250 {
+		t.Fatalf("expected 250 list elements, got %d", len(list))
+	}
+	for i, v := range list {
+		if v != fmt.Sprint(i) {
+			t.Fatalf("list element %d: expected %d, got %s", i, i, v)
+		}
+	}
+	set, err := redis.Strings(dc.Do("SMEMBERS", prefix+"set"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(set)
+	if !reflect.DeepEqual(set, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected set members %v", set)
+	}
+	hash, err := redis.StringMap(dc.Do("HGETALL", prefix+"hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hash, map[string]string{"f1": "v1", "f2": "v2"}) {
+		t.Fatalf("unexpected hash %v", hash)
+	}
+	if s, _ := redis.String(dc.Do("GET", prefix+"string")); s != "value" {
+		t.Fatalf("unexpected string %q", s)
+	}
+	for key, cmd := range map[string]string{prefix + "list": "LTTL", prefix + "string": "TTL"} {
+		if ttl, _ := redis.Int(dc.Do(cmd, key)); ttl <= 0 || ttl > 3600 {
+			t.Fatalf("%s: expected the source's time to live, got %d", key, ttl)
+		}
+	}
+
+	// Running again copies nothing new.
+	if _, err := database.Migrate(testData, dst, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := redis.Int(dc.Do("LLEN", prefix+"list")); n != 250 {
+		t.Fatalf("rerun changed list length to %d", n)
+	}
+}
@@ -0,0 +1,61 @@
+package dbtest
+
+import (
+	"testing"
+
+	"bosun.org/cmd/bosun/database"
+)
+
+func TestNotificationQueue_RoundTrip(t *testing.T) {
+	queue := testData.NotificationQueue()
+	n := &database.QueuedNotification{
+		Id:           randString(10),
+		Notification: "n",
+		AlertKey:     "a{host=a}",
+		Subject:      "subject",
+		EmailBody:    []byte("<p>body</p>"),
+		Attachments:  []*database.QueuedAttachment{{Data: []byte("a,b"), Filename: "1.csv", ContentType: "text/csv"}},
+		Enqueued:     42,
+	}
+	if err := queue.Enqueue(n); err != nil {
+		t.Fatal(err)
+	}
+	n.Attempts = 2
+	if err := queue.Enqueue(n); err != nil {
+		t.Fatal(err)
+	}
+	find := func() *database.QueuedNotification {
+		pending, err := queue.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pending {
+			if p.Id == n.Id {
+				return p
+			}
+		}
+		return nil
+	}
+	p := find()
+	if p == nil {
+		t.Fatal("expected queued notification to be pending")
+	}
+	if p.Attempts != 2 || string(p.EmailBody) != "<p>body</p>" || len(p.Attachments) != 1 || p.Attachments[0].Filename != "1.csv" {
+		t.Errorf("unexpected pending notification %+v", p)
+	}
+	if queued, err := queue.IsQueued(n.Id); err != nil || !queued {
+		t.Errorf("expected the notification to be queued, got %v, %v", queued, err)
+	}
+	if depth, err := queue.QueueDepth(); err != nil || depth < 1 {
+		t.Errorf("expected a queue depth of at least 1, got %d, %v", depth, err)
+	}
+	if err := queue.Dequeue(n.Id); err != nil {
+		t.Fatal(err)
+	}
+	if find() != nil {
+		t.Error("expected dequeued notification to be gone")
+	}
+	if queued, err := queue.IsQueued(n.Id); err != nil || queued {
+		t.Errorf("expected the notification not to be queued, got %v, %v", queued, err)
+	}
+}
@@ -0,0 +1,62 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/database"
+	"bosun.org/opentsdb"
+)
+
+func TestKeyPrefix_Isolation(t *testing.T) {
+	ns := randString(6)
+	a := database.NewDataAccess(testAddr, testIsRedis, database.EncodingJSON, ns+"a:")
+	b := database.NewDataAccess(testAddr, testIsRedis, database.EncodingJSON, ns+"b:")
+	metric := "m." + randString(6)
+	if err := a.PutMetricMetadata(metric, "desc", "from a"); err != nil {
+		t.Fatal(err)
+	}
+	mm, err := b.GetMetricMetadata(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm != nil {
+		t.Fatalf("b sees a's metadata: %+v", mm)
+	}
+	if err := b.PutMetricMetadata(metric, "desc", "from b"); err != nil {
+		t.Fatal(err)
+	}
+	if mm, err = a.GetMetricMetadata(metric); err != nil {
+		t.Fatal(err)
+	} else if mm == nil || mm.Desc != "from a" {
+		t.Fatalf("expected a's own description, got %+v", mm)
+	}
+
+	if err := a.Search().AddMetric(metric, 42); err != nil {
+		t.Fatal(err)
+	}
+	all, err := b.Search().GetAllMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := all[metric]; ok {
+		t.Fatal("b sees a's metrics")
+	}
+
+	tags := opentsdb.TagSet{"host": randString(6)}
+	if err := a.PutTagMetadata(tags, "alias", "x", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	metas, err := a.GetTagMetadata(tags, "alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || !metas[0].Tags.Equal(tags) || metas[0].Name != "alias" {
+		t.Fatalf("unexpected tag metadata %+v", metas)
+	}
+	if metas, err = b.GetTagMetadata(tags, "alias"); err != nil {
+		t.Fatal(err)
+	} else if len(metas) != 0 {
+		t.Fatalf("b sees a's tag metadata: %+v", metas)
+	}
+}
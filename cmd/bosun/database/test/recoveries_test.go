@@ -0,0 +1,37 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecoveries(t *testing.T) {
+	ak := "a{host=" + randString(5) + "}"
+	recoveries := testData.Recoveries()
+	check := func(expected time.Time) {
+		until, err := recoveries.GetRecoveredUntil(ak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !until.Equal(expected) {
+			t.Errorf("got %v, expected %v", until, expected)
+		}
+	}
+	check(time.Time{})
+	until := time.Date(2015, 1, 1, 0, 10, 0, 0, time.UTC)
+	if err := recoveries.SetRecoveredUntil(ak, until); err != nil {
+		t.Fatal(err)
+	}
+	check(until)
+	all, err := recoveries.GetAllRecovered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all[ak].Equal(until) {
+		t.Errorf("GetAllRecovered: got %v, expected %v", all[ak], until)
+	}
+	if err := recoveries.ClearRecovered(ak); err != nil {
+		t.Fatal(err)
+	}
+	check(time.Time{})
+}
@@ -14,11 +14,16 @@ import (
 var flagReddisHost = flag.String("redis", "", "redis server to test against")
 var flagFlushRedis = flag.Bool("flush", false, "flush database before tests. DANGER!")
 
+// address of the server StartTestRedis connected to, for tests that need a second data access object.
+var testAddr string
+var testIsRedis bool
+
 func StartTestRedis() (database.DataAccess, func()) {
 	flag.Parse()
 	// For redis tests we just point at an external server.
 	if *flagReddisHost != "" {
-		testData := database.NewDataAccess(*flagReddisHost, true)
+		testAddr, testIsRedis = *flagReddisHost, true
+		testData := database.NewDataAccess(*flagReddisHost, true, database.EncodingJSON, "")
 		if *flagFlushRedis {
 			log.Println("FLUSHING REDIS")
 			c := testData.(database.Connector).GetConnection()
@@ -32,13 +37,14 @@ func StartTestRedis() (database.DataAccess, func()) {
 	}
 	// To test ledis, start a local instance in a new tmp dir. We will attempt to delete it when we're done.
 	addr := "127.0.0.1:9876"
+	testAddr = addr
 	testPath := filepath.Join(os.TempDir(), "bosun_ledis_test", fmt.Sprint(time.Now().Unix()))
 	log.Println(testPath)
 	stop, err := database.StartLedis(testPath, addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	testData := database.NewDataAccess(addr, false)
+	testData := database.NewDataAccess(addr, false, database.EncodingJSON, "")
 	return testData, func() {
 		stop()
 		os.RemoveAll(testPath)
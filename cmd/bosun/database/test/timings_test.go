@@ -0,0 +1,45 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/database"
+)
+
+func TestTimingFlush(t *testing.T) {
+	if database.FlushTimings() != nil {
+		t.Fatal("expected no summaries when sampling each call")
+	}
+	database.SetTimingFlush(time.Hour)
+	defer database.SetTimingFlush(0)
+	user := randString(5)
+	favorites := testData.Favorites()
+	for _, item := range []string{"a", "b", "c"} {
+		if err := favorites.AddFavorite(user, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := favorites.GetFavorites(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops := database.FlushTimings()
+	if len(ops) != 2 {
+		t.Fatalf("expected summaries of 2 ops, got %v", ops)
+	}
+	for op, count := range map[string]int{"AddFavorite": 3, "GetFavorites": 2} {
+		s := ops[op]
+		if s.Count != count {
+			t.Errorf("%s: got count %d, expected %d", op, s.Count, count)
+		}
+		if s.Max <= 0 || s.Max > s.Sum || s.Sum > time.Duration(s.Count)*s.Max {
+			t.Errorf("%s: inconsistent sum %v and max %v", op, s.Sum, s.Max)
+		}
+	}
+	// A flush starts a new summary.
+	if ops := database.FlushTimings(); len(ops) != 0 {
+		t.Errorf("expected no ops after a flush, got %v", ops)
+	}
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/opentsdb"
+)
+
+/*
+Redis operation timings:
+
+By default each operation is sampled in bosun.redis as it completes. With a
+flush interval set, timings are instead summarized in process and each
+operation's count, total and longest time are sent once per interval as
+bosun.redis.count, bosun.redis.sum and bosun.redis.max.
+*/
+
+func init() {
+	metadata.AddMetricMeta("bosun.redis.count", metadata.Gauge, metadata.Operation,
+		"The number of redis calls of each op since the last flush.")
+	metadata.AddMetricMeta("bosun.redis.sum", metadata.Gauge, metadata.MilliSecond,
+		"The total time in milliseconds of redis calls of each op since the last flush.")
+	metadata.AddMetricMeta("bosun.redis.max", metadata.Gauge, metadata.MilliSecond,
+		"The longest time in milliseconds of a redis call of each op since the last flush.")
+}
+
+// OpSummary summarizes the timings of one redis operation since the last
+// flush.
+type OpSummary struct {
+	Count int
+	Sum   time.Duration
+	Max   time.Duration
+}
+
+var timings = struct {
+	sync.Mutex
+	ops  map[string]*OpSummary
+	stop chan bool
+}{}
+
+// SetTimingFlush summarizes redis operation timings and flushes them every
+// interval. An interval of zero, the default, samples each operation as it
+// completes.
+func SetTimingFlush(interval time.Duration) {
+	timings.Lock()
+	defer timings.Unlock()
+	if timings.stop != nil {
+		close(timings.stop)
+		timings.stop = nil
+	}
+	if interval <= 0 {
+		timings.ops = nil
+		return
+	}
+	if timings.ops == nil {
+		timings.ops = make(map[string]*OpSummary)
+	}
+	stop := make(chan bool)
+	timings.stop = stop
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				FlushTimings()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// FlushTimings sends the summaries of the operations since the last flush and
+// returns them. It returns nil when timings are not being summarized.
+func FlushTimings() map[string]OpSummary {
+	timings.Lock()
+	if timings.ops == nil {
+		timings.Unlock()
+		return nil
+	}
+	ops := make(map[string]OpSummary, len(timings.ops))
+	for op, s := range timings.ops {
+		ops[op] = *s
+	}
+	timings.ops = make(map[string]*OpSummary)
+	timings.Unlock()
+	for op, s := range ops {
+		ts := opentsdb.TagSet{"op": op}
+		collect.Put("redis.count", ts, s.Count)
+		collect.Put("redis.sum", ts, float64(s.Sum)/float64(time.Millisecond))
+		collect.Put("redis.max", ts, float64(s.Max)/float64(time.Millisecond))
+	}
+	return ops
+}
+
+// startTimer times a redis operation. Call the returned function when it
+// completes.
+func startTimer(op string) func() {
+	timings.Lock()
+	summarize := timings.ops != nil
+	timings.Unlock()
+	if !summarize {
+		return collect.StartTimer("redis", opentsdb.TagSet{"op": op})
+	}
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		timings.Lock()
+		defer timings.Unlock()
+		if timings.ops == nil {
+			return
+		}
+		s := timings.ops[op]
+		if s == nil {
+			s = new(OpSummary)
+			timings.ops[op] = s
+		}
+		s.Count++
+		s.Sum += d
+		if d > s.Max {
+			s.Max = d
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package expr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bosun.org/graphite"
+	"bosun.org/opentsdb"
+)
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single probe request through to test recovery.
+	BreakerHalfOpen
+	// BreakerOpen fails all requests immediately.
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// BreakerOpenError is returned for requests rejected by an open Breaker.
+type BreakerOpenError struct {
+	Name string
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("%s: circuit breaker open, not querying", e.Name)
+}
+
+// Breaker is a circuit breaker for a datasource. After Threshold consecutive
+// failures it opens and rejects requests. Once Cooldown has passed it lets a
+// single probe through: success closes it again, failure reopens it.
+type Breaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+	// IsFailure reports whether err should count against the datasource. If
+	// nil, every error counts.
+	IsFailure func(err error) bool
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		Name:      name,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// State returns the current state of b. A nil Breaker is always closed.
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Do calls f unless the breaker is open, and records its result.
+func (b *Breaker) Do(f func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := f()
+	b.record(err)
+	return err
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerOpen:
+		return &BreakerOpenError{b.Name}
+	case BreakerHalfOpen:
+		if b.probing {
+			return &BreakerOpenError{b.Name}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+	if err == nil || (b.IsFailure != nil && !b.IsFailure(err)) {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// TSDBBreakerContext is an OpenTSDB context whose queries pass through a Breaker.
+type TSDBBreakerContext struct {
+	opentsdb.Context
+	Breaker *Breaker
+}
+
+func (c TSDBBreakerContext) Query(r *opentsdb.Request) (rs opentsdb.ResponseSet, err error) {
+	err = c.Breaker.Do(func() error {
+		rs, err = c.Context.Query(r)
+		return err
+	})
+	return
+}
+
+// IsTSDBFailure reports whether err indicates a problem with the OpenTSDB
+// server rather than with the query: client errors (4xx) do not count.
+func IsTSDBFailure(err error) bool {
+	if re, ok := err.(*opentsdb.RequestError); ok {
+		return re.Err.Code < 400 || re.Err.Code >= 500
+	}
+	return true
+}
+
+// GraphiteBreakerContext is a Graphite context whose queries pass through a Breaker.
+type GraphiteBreakerContext struct {
+	graphite.Context
+	Breaker *Breaker
+}
+
+func (c GraphiteBreakerContext) Query(r *graphite.Request) (resp graphite.Response, err error) {
+	err = c.Breaker.Do(func() error {
+		resp, err = c.Context.Query(r)
+		return err
+	})
+	return
+}
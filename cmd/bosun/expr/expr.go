@@ -33,6 +33,14 @@ type State struct {
 	unjoinedOk  bool
 	squelched   func(tags opentsdb.TagSet) bool
 
+	maxQueryRange time.Duration
+	deadline      time.Time
+
+	// partialResults allows evaluation to continue when a datasource query
+	// fails, and failedQueries lists the queries that did.
+	partialResults bool
+	failedQueries  []string
+
 	// Graphite
 	graphiteQueries []graphite.Request
 	graphiteContext graphite.Context
@@ -45,18 +53,42 @@ type State struct {
 	InfluxConfig client.Config
 
 	History AlertStatusProvider
+
+	// vars holds the value of each variable once it has been evaluated.
+	vars map[*parse.VarNode]*Results
 }
 
 // Alert Status Provider is used to provide information about alert results.
 // This facilitates alerts referencing other alerts, even when they go unknown or unevaluated.
 type AlertStatusProvider interface {
 	GetUnknownAndUnevaluatedAlertKeys(alertName string) (unknown, unevaluated []AlertKey)
+	// GetFailingAlerts returns the number of unresolved errors for each alert
+	// that is currently failing to evaluate.
+	GetFailingAlerts() map[string]int
+	// GetOpenIncidentCounts returns the number of open alert instances per
+	// alert that match the given dashboard filter.
+	GetOpenIncidentCounts(filter string) (map[string]int, error)
 }
 
 var ErrUnknownOp = fmt.Errorf("expr: unknown op type")
 
+// ErrDeadline is returned when evaluation does not finish by the
+// expression's Deadline.
+var ErrDeadline = fmt.Errorf("expr: evaluation deadline exceeded")
+
 type Expr struct {
 	*parse.Tree
+	// MaxQueryRange is the longest time range a datasource query may cover,
+	// 0 for no limit.
+	MaxQueryRange time.Duration
+	// PartialResults evaluates the expression without the data of OpenTSDB
+	// and Graphite queries that fail, instead of failing it. The failed
+	// queries are listed in the Partial field of the results.
+	PartialResults bool
+	// Deadline, if not zero, is when evaluation gives up with
+	// ErrDeadline. OpenTSDB and Graphite queries still running then are
+	// left to finish on their own.
+	Deadline time.Time
 }
 
 func (e *Expr) MarshalJSON() ([]byte, error) {
@@ -96,6 +128,9 @@ func (e *Expr) Execute(c opentsdb.Context, g graphite.Context, l LogstashElastic
 		Search:          search,
 		squelched:       squelched,
 		History:         history,
+		maxQueryRange:   e.MaxQueryRange,
+		partialResults:  e.PartialResults,
+		deadline:        e.Deadline,
 	}
 	return e.ExecuteState(s, T)
 }
@@ -110,6 +145,7 @@ func (e *Expr) ExecuteState(s *State, T miniprofiler.Timer) (r *Results, queries
 	T.Step("expr execute", func(T miniprofiler.Timer) {
 		r = s.walk(e.Tree.Root, T)
 	})
+	r.Partial = s.failedQueries
 	queries = s.tsdbQueries
 	return
 }
@@ -172,6 +208,22 @@ func (s Series) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r)
 }
 
+// StringSeries is a timeseries of text values, such as the states reported
+// by a status check. It can't be averaged or compared, so it must be mapped
+// to numbers with match before use.
+type StringSeries map[time.Time]string
+
+func (s StringSeries) Type() parse.FuncType { return parse.TypeStringSeriesSet }
+func (s StringSeries) Value() interface{}   { return s }
+
+func (s StringSeries) MarshalJSON() ([]byte, error) {
+	r := make(map[string]string, len(s))
+	for k, v := range s {
+		r[fmt.Sprint(k.Unix())] = v
+	}
+	return json.Marshal(r)
+}
+
 type SortablePoint struct {
 	T time.Time
 	V float64
@@ -209,6 +261,9 @@ type Results struct {
 	IgnoreOtherUnjoined bool
 	// If non nil, will set any NaN value to it.
 	NaNValue *float64
+	// Partial lists the datasource queries that failed, with their errors,
+	// when the expression was evaluated on the data of the rest.
+	Partial []string `json:",omitempty"`
 }
 
 type ResultSlice []*Result
@@ -254,6 +309,38 @@ func (r ResultSliceByGroup) Len() int           { return len(r) }
 func (r ResultSliceByGroup) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 func (r ResultSliceByGroup) Less(i, j int) bool { return r[i].Group.String() < r[j].Group.String() }
 
+// copy returns a copy of r that shares none of its results, values or groups.
+func (r *Results) copy() *Results {
+	c := *r
+	c.Results = make(ResultSlice, len(r.Results))
+	for i, res := range r.Results {
+		value := res.Value
+		switch v := value.(type) {
+		case Series:
+			s := make(Series, len(v))
+			for k, p := range v {
+				s[k] = p
+			}
+			value = s
+		case StringSeries:
+			s := make(StringSeries, len(v))
+			for k, p := range v {
+				s[k] = p
+			}
+			value = s
+		}
+		c.Results[i] = &Result{
+			Computations: append(Computations(nil), res.Computations...),
+			Value:        value,
+		}
+		if res.Group != nil {
+			c.Results[i].Group = res.Group.Copy()
+		}
+	}
+	c.Partial = append([]string(nil), r.Partial...)
+	return &c
+}
+
 type Computations []Computation
 
 type Computation struct {
@@ -290,6 +377,24 @@ func (u *Union) ExtendComputations(o *Result) {
 	u.Computations = append(u.Computations, o.Computations...)
 }
 
+// joinGroup reports whether results with groups a and b are joined by binary
+// operators, and if so the group of the joined result.
+func joinGroup(a, b opentsdb.TagSet) (opentsdb.TagSet, bool) {
+	if a.Equal(b) || len(a) == 0 || len(b) == 0 {
+		if len(a) == 0 {
+			return b, true
+		}
+		return a, true
+	} else if len(a) == len(b) {
+		return nil, false
+	} else if a.Subset(b) {
+		return a, true
+	} else if b.Subset(a) {
+		return b, true
+	}
+	return nil, false
+}
+
 // union returns the combination of a and b where one is a subset of the other.
 func (e *State) union(a, b *Results, expression string) []*Union {
 	const unjoinedGroup = "unjoined group (%v)"
@@ -305,23 +410,10 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 	for _, rb := range b.Results {
 		bm[rb] = true
 	}
-	var group opentsdb.TagSet
 	for _, ra := range a.Results {
 		for _, rb := range b.Results {
-
-			if ra.Group.Equal(rb.Group) || len(ra.Group) == 0 || len(rb.Group) == 0 {
-				g := ra.Group
-				if len(ra.Group) == 0 {
-					g = rb.Group
-				}
-				group = g
-			} else if len(ra.Group) == len(rb.Group) {
-				continue
-			} else if ra.Group.Subset(rb.Group) {
-				group = ra.Group
-			} else if rb.Group.Subset(ra.Group) {
-				group = rb.Group
-			} else {
+			group, ok := joinGroup(ra.Group, rb.Group)
+			if !ok {
 				continue
 			}
 			delete(am, ra)
@@ -366,6 +458,9 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 }
 
 func (e *State) walk(node parse.Node, T miniprofiler.Timer) *Results {
+	if !e.deadline.IsZero() && time.Now().After(e.deadline) {
+		panic(ErrDeadline)
+	}
 	var res *Results
 	switch node := node.(type) {
 	case *parse.NumberNode:
@@ -376,6 +471,8 @@ func (e *State) walk(node parse.Node, T miniprofiler.Timer) *Results {
 		res = e.walkUnary(node, T)
 	case *parse.FuncNode:
 		res = e.walkFunc(node, T)
+	case *parse.VarNode:
+		res = e.walkVar(node, T)
 	default:
 		panic(fmt.Errorf("expr: unknown node type"))
 	}
@@ -538,6 +635,22 @@ func operate(op string, a, b float64) (r float64) {
 	return
 }
 
+// walkVar returns the value of a variable, evaluating it on its first use
+// only. Each use gets a copy, since walks may change results in place.
+func (e *State) walkVar(node *parse.VarNode, T miniprofiler.Timer) *Results {
+	res, ok := e.vars[node]
+	if !ok {
+		T.Step("var: "+node.Name, func(T miniprofiler.Timer) {
+			res = e.walk(node.Value, T)
+		})
+		if e.vars == nil {
+			e.vars = make(map[*parse.VarNode]*Results)
+		}
+		e.vars[node] = res
+	}
+	return res.copy()
+}
+
 func (e *State) walkUnary(node *parse.UnaryNode, T miniprofiler.Timer) *Results {
 	a := e.walk(node.Arg, T)
 	T.Step("walkUnary: "+node.OpStr, func(T miniprofiler.Timer) {
@@ -598,6 +711,8 @@ func (e *State) walkFunc(node *parse.FuncNode, T miniprofiler.Timer) *Results {
 				v = extractScalar(e.walkUnary(t, T))
 			case *parse.BinaryNode:
 				v = extractScalar(e.walkBinary(t, T))
+			case *parse.VarNode:
+				v = extractScalar(e.walkVar(t, T))
 			default:
 				panic(fmt.Errorf("expr: unknown func arg type"))
 			}
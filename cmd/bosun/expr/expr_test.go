@@ -8,10 +8,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"bosun.org/_third_party/github.com/influxdb/influxdb/client"
+	"bosun.org/graphite"
 	"bosun.org/opentsdb"
 )
 
@@ -248,3 +252,1255 @@ func TestQueryExpr(t *testing.T) {
 		}
 	}
 }
+
+func TestBurnRate(t *testing.T) {
+	d := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := func(vals ...float64) Series {
+		s := make(Series)
+		for i, v := range vals {
+			s[d.Add(time.Duration(i)*time.Minute)] = v
+		}
+		return s
+	}
+	good := &Results{Results: ResultSlice{
+		{Group: opentsdb.TagSet{"svc": "a"}, Value: series(495, 490)},
+		{Group: opentsdb.TagSet{"svc": "b"}, Value: series(1000)},
+		{Group: opentsdb.TagSet{"svc": "c"}, Value: series(0)},
+	}}
+	total := &Results{Results: ResultSlice{
+		{Group: opentsdb.TagSet{"svc": "a"}, Value: series(500, 500)},
+		{Group: opentsdb.TagSet{"svc": "b"}, Value: series(1000)},
+		{Group: opentsdb.TagSet{"svc": "c"}, Value: series(0)},
+	}}
+	r, err := BurnRate(&State{}, nil, good, total, .99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"svc=a": 1.5,
+		"svc=b": 0,
+		"svc=c": math.NaN(),
+	}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(r.Results))
+	}
+	for _, res := range r.Results {
+		ex := expected[res.Group.Tags()]
+		got := float64(res.Value.(Number))
+		if math.IsNaN(ex) && math.IsNaN(got) {
+			continue
+		}
+		if math.Abs(got-ex) > 1e-9 {
+			t.Errorf("%v: got %v, expected %v", res.Group, got, ex)
+		}
+	}
+	if _, err := BurnRate(&State{}, nil, good, total, 1); err == nil {
+		t.Error("expected error for target of 1")
+	}
+}
+
+func TestPctChange(t *testing.T) {
+	d := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := func(vals ...float64) Series {
+		s := make(Series)
+		for i, v := range vals {
+			s[d.Add(time.Duration(i)*time.Minute)] = v
+		}
+		return s
+	}
+	in := &Results{Results: ResultSlice{
+		{Group: opentsdb.TagSet{"s": "up"}, Value: series(100, 110, 150)},
+		{Group: opentsdb.TagSet{"s": "down"}, Value: series(200, 150, 100, 50)},
+		{Group: opentsdb.TagSet{"s": "zero"}, Value: series(0, 5, 10)},
+		{Group: opentsdb.TagSet{"s": "short"}, Value: series(10, 20)},
+	}}
+	r, err := PctChange(&State{}, nil, in, "2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"s=up":    50,
+		"s=down":  -100.0 * 2 / 3,
+		"s=zero":  math.NaN(),
+		"s=short": math.NaN(),
+	}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(r.Results))
+	}
+	for _, res := range r.Results {
+		ex := expected[res.Group.Tags()]
+		got := float64(res.Value.(Number))
+		if math.IsNaN(ex) && math.IsNaN(got) {
+			continue
+		}
+		if math.Abs(got-ex) > 1e-9 {
+			t.Errorf("%v: got %v, expected %v", res.Group, got, ex)
+		}
+	}
+}
+
+func TestComputedTags(t *testing.T) {
+	results := func(groups ...opentsdb.TagSet) *Results {
+		r := new(Results)
+		for _, g := range groups {
+			r.Results = append(r.Results, &Result{Group: g, Value: Series{}})
+		}
+		return r
+	}
+	groups := func(r *Results) []string {
+		var s []string
+		for _, res := range r.Results {
+			s = append(s, res.Group.String())
+		}
+		return s
+	}
+
+	r, err := Rename(nil, nil, results(opentsdb.TagSet{"hostname": "a"}), "hostname=host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := groups(r); len(g) != 1 || g[0] != "{host=a}" {
+		t.Errorf("rename: unexpected groups %v", g)
+	}
+
+	r, err = DropTag(nil, nil, results(opentsdb.TagSet{"host": "a", "dc": "ny"}, opentsdb.TagSet{"host": "b", "dc": "ny"}), "dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := groups(r); len(g) != 2 || g[0] != "{host=a}" || g[1] != "{host=b}" {
+		t.Errorf("droptag: unexpected groups %v", g)
+	}
+	_, err = DropTag(nil, nil, results(opentsdb.TagSet{"host": "a", "dc": "ny"}, opentsdb.TagSet{"host": "a", "dc": "co"}), "dc")
+	if err == nil {
+		t.Error("droptag: expected collision error")
+	}
+
+	r, err = DeriveTag(nil, nil, results(opentsdb.TagSet{"host": "ny-web01"}, opentsdb.TagSet{"host": "co-db02"}), "dc", "host", "^([a-z]+)-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := groups(r); len(g) != 2 || g[0] != "{dc=ny,host=ny-web01}" || g[1] != "{dc=co,host=co-db02}" {
+		t.Errorf("derivetag: unexpected groups %v", g)
+	}
+	if _, err := DeriveTag(nil, nil, results(opentsdb.TagSet{"host": "web01"}), "dc", "host", "^([a-z]+)-"); err == nil {
+		t.Error("derivetag: expected error for non-matching value")
+	}
+	if _, err := DeriveTag(nil, nil, results(opentsdb.TagSet{"host": "ny-web01", "dc": "ny"}), "dc", "host", "^([a-z]+)-"); err == nil {
+		t.Error("derivetag: expected error for existing tag")
+	}
+	if _, err := New(`derivetag(q("avg:m{host=*}", "5m", ""), "dc", "host", "^[a-z]+-")`, TSDB); err == nil {
+		t.Error("derivetag: expected error for regexp without capture group")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBreaker("test", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	fail := func() error { return fmt.Errorf("down") }
+	ok := func() error { return nil }
+	expect := func(state BreakerState) {
+		if s := b.State(); s != state {
+			t.Fatalf("expected %v, got %v", state, s)
+		}
+	}
+	isOpenErr := func(err error) bool {
+		_, ok := err.(*BreakerOpenError)
+		return ok
+	}
+
+	b.Do(fail)
+	expect(BreakerClosed)
+	b.Do(ok)
+	b.Do(fail)
+	expect(BreakerClosed) // failures must be consecutive
+	b.Do(fail)
+	expect(BreakerOpen)
+	called := false
+	if err := b.Do(func() error { called = true; return nil }); !isOpenErr(err) || called {
+		t.Fatalf("expected open breaker to fail fast, got %v (called %v)", err, called)
+	}
+
+	now = now.Add(time.Minute)
+	expect(BreakerHalfOpen)
+	// A failed probe reopens the breaker.
+	b.Do(fail)
+	expect(BreakerOpen)
+
+	now = now.Add(time.Minute)
+	probe := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(func() error { <-probe; return nil })
+	}()
+	for !b.probingNow() {
+		time.Sleep(time.Millisecond)
+	}
+	// Only one probe at a time is let through.
+	if err := b.Do(ok); !isOpenErr(err) {
+		t.Fatalf("expected second request during probe to fail fast, got %v", err)
+	}
+	close(probe)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expect(BreakerClosed)
+
+	// Errors that IsFailure rejects do not count.
+	b.IsFailure = func(error) bool { return false }
+	b.Do(fail)
+	b.Do(fail)
+	expect(BreakerClosed)
+}
+
+func (b *Breaker) probingNow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.probing
+}
+
+func TestWeightedAvg(t *testing.T) {
+	numbers := func(m map[string]float64) *Results {
+		r := new(Results)
+		for host, v := range m {
+			r.Results = append(r.Results, &Result{Group: opentsdb.TagSet{"host": host}, Value: Number(v)})
+		}
+		return r
+	}
+	tests := []struct {
+		values, weights map[string]float64
+		expected        float64
+	}{
+		{
+			map[string]float64{"a": 10, "b": 40},
+			map[string]float64{"a": 3, "b": 1},
+			17.5,
+		},
+		// c has no weight and is dropped.
+		{
+			map[string]float64{"a": 10, "b": 40, "c": 1000},
+			map[string]float64{"a": 1, "b": 1},
+			25,
+		},
+		{
+			map[string]float64{"a": 10},
+			map[string]float64{"a": 0},
+			math.NaN(),
+		},
+	}
+	for i, test := range tests {
+		r, err := WeightedAvg(&State{enableComputations: true}, nil, numbers(test.values), numbers(test.weights))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 || len(r.Results[0].Group) != 0 {
+			t.Fatalf("%v: expected one ungrouped result, got %v", i, r.Results)
+		}
+		if len(r.Results[0].Computations) != len(test.values) {
+			t.Errorf("%v: expected a computation per value, got %v", i, r.Results[0].Computations)
+		}
+		got := float64(r.Results[0].Value.(Number))
+		if math.IsNaN(test.expected) && math.IsNaN(got) {
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%v: got %v, expected %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	now := queryTime.Unix()
+	missing := now - 5*60
+	// Each hour repeats the minute of the hour, plus how many hours back it
+	// is. The point 5 minutes ago is missing 3 hours back.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		start, end := int64(req.Start.(float64)), int64(req.End.(float64))
+		back := (now - end) / 3600
+		dps := make(map[string]opentsdb.Point)
+		for i := start; i <= end; i += 60 {
+			if back == 3 && i+back*3600 == missing {
+				continue
+			}
+			dps[fmt.Sprint(i)] = opentsdb.Point(i%3600/60 + back)
+		}
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: dps}})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(`baseline("avg:m{host=*}", "10m", "1h", 3)`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(opentsdb.Host(u.Host), nil, nil, client.Config{}, nil, nil, queryTime, 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 {
+		t.Fatalf("expected one result, got %v", r.Results)
+	}
+	series := r.Results[0].Value.(Series)
+	if len(series) != 11 {
+		t.Errorf("expected 11 points over the last 10m, got %v", len(series))
+	}
+	for k, v := range series {
+		if k.After(queryTime) || k.Before(queryTime.Add(-10*time.Minute)) {
+			t.Errorf("point %v outside the last 10m", k)
+		}
+		// The average of 1, 2 and 3 hours back, or of 1 and 2 for the missing point.
+		expected := float64(k.Unix()%3600/60) + 2
+		if k.Unix() == missing {
+			expected = float64(k.Unix()%3600/60) + 1.5
+		}
+		if v != expected {
+			t.Errorf("%v: got %v, expected %v", k, v, expected)
+		}
+	}
+}
+
+func TestBaselineMisaligned(t *testing.T) {
+	now := queryTime.Unix()
+	// Each hour back has points every minute, offset by that many seconds
+	// from the minute, with the value of how many hours back it is.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		start, end := int64(req.Start.(float64)), int64(req.End.(float64))
+		back := (now - end) / 3600
+		dps := make(map[string]opentsdb.Point)
+		for i := start + 60 - back; i <= end; i += 60 {
+			dps[fmt.Sprint(i)] = opentsdb.Point(back)
+		}
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: dps}})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(`baseline("avg:m{host=*}", "10m", "1h", 3)`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(opentsdb.Host(u.Host), nil, nil, client.Config{}, nil, nil, queryTime, 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 {
+		t.Fatalf("expected one result, got %v", r.Results)
+	}
+	series := r.Results[0].Value.(Series)
+	if len(series) != 10 {
+		t.Errorf("expected 10 buckets over the last 10m, got %v", series)
+	}
+	for k, v := range series {
+		if (now-k.Unix())%60 != 0 {
+			t.Errorf("bucket %v not aligned to the step", k)
+		}
+		// The average of 1, 2 and 3 hours back.
+		if v != 2 {
+			t.Errorf("%v: got %v, expected 2", k, v)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	var queries int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		fmt.Fprint(w, `[
+			{"metric":"m","tags":{"host":"a"},"dps":{"100":1,"160":3}},
+			{"metric":"m","tags":{"host":"b"},"dps":{"100":4}}
+		]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr     string
+		queries  int
+		expected map[string]float64
+	}{
+		{
+			`$x = q("avg:m{host=*}", "5m", ""); $max = max($x); $max / avg($x) + $max - $max`,
+			1,
+			map[string]float64{"host=a": 1.5, "host=b": 1},
+		},
+		// Changing one use of a variable leaves the others alone.
+		{
+			`$x = avg(q("avg:m{host=*}", "5m", "")); -$x + $x`,
+			1,
+			map[string]float64{"host=a": 0, "host=b": 0},
+		},
+		// A variable that is not used is not evaluated.
+		{
+			`$x = q("avg:m{host=*}", "5m", ""); 1`,
+			0,
+			map[string]float64{"": 1},
+		},
+		{
+			`max(q("avg:m{host=*}", "5m", "")) / avg(q("avg:m{host=*}", "5m", ""))`,
+			2,
+			map[string]float64{"host=a": 1.5, "host=b": 1},
+		},
+	}
+	for _, test := range tests {
+		queries = 0
+		e, err := New(test.expr, TSDB)
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		results, _, err := e.Execute(opentsdb.Host(u.Host), nil, nil, client.Config{}, nil, nil, queryTime, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		if queries != test.queries {
+			t.Errorf("%v: got %d queries, expected %d", test.expr, queries, test.queries)
+		}
+		got := make(map[string]float64)
+		for _, r := range results.Results {
+			switch v := r.Value.(type) {
+			case Number:
+				got[r.Group.Tags()] = float64(v)
+			case Scalar:
+				got[r.Group.Tags()] = float64(v)
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: got %v, expected %v", test.expr, got, test.expected)
+		}
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	now := queryTime.Unix()
+	var ranges [][2]int64
+	// Each point is its age in weeks at the query time.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		start, end := int64(req.Start.(float64)), int64(req.End.(float64))
+		ranges = append(ranges, [2]int64{start, end})
+		dps := make(map[string]opentsdb.Point)
+		for i := start; i <= end; i += 60 {
+			dps[fmt.Sprint(i)] = opentsdb.Point((now - i) / (7 * 24 * 3600))
+		}
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: dps}})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(`periods("avg:m{host=*}", "1h", "1w")`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(opentsdb.Host(u.Host), nil, nil, client.Config{}, nil, nil, queryTime, 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := int64(7 * 24 * 3600)
+	expectedRanges := [][2]int64{{now - 3600, now}, {now - week - 3600, now - week}}
+	if !reflect.DeepEqual(ranges, expectedRanges) {
+		t.Errorf("expected queries over %v, got %v", expectedRanges, ranges)
+	}
+	if len(r.Results) != 2 {
+		t.Fatalf("expected two results, got %v", r.Results)
+	}
+	for _, res := range r.Results {
+		var expected float64
+		switch p := res.Group["period"]; p {
+		case "current":
+		case "previous":
+			expected = 1
+		default:
+			t.Fatalf("unexpected period %q in %v", p, res.Group)
+		}
+		if res.Group["host"] != "a" {
+			t.Errorf("expected host tag to be kept, got %v", res.Group)
+		}
+		series := res.Value.(Series)
+		if len(series) != 61 {
+			t.Errorf("%v: expected 61 points, got %v", res.Group, len(series))
+		}
+		for k, v := range series {
+			if k.After(queryTime) || k.Before(queryTime.Add(-time.Hour)) {
+				t.Errorf("%v: point %v not shifted into the last hour", res.Group, k)
+			}
+			if v != expected {
+				t.Errorf("%v: %v: got %v, expected %v", res.Group, k, v, expected)
+			}
+		}
+	}
+}
+
+func TestTopK(t *testing.T) {
+	numbers := func() *Results {
+		r := new(Results)
+		for _, v := range []struct {
+			host  string
+			value float64
+		}{
+			{"e", 5}, {"a", 1}, {"d", 3}, {"b", 3}, {"c", 3}, {"f", math.NaN()}, {"g", 0},
+		} {
+			r.Results = append(r.Results, &Result{Group: opentsdb.TagSet{"host": v.host}, Value: Number(v.value)})
+		}
+		return r
+	}
+	hosts := func(r *Results) string {
+		var s []string
+		for _, res := range r.Results {
+			s = append(s, res.Group["host"])
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		f        func(*State, miniprofiler.Timer, *Results, float64) (*Results, error)
+		n        float64
+		expected string
+	}{
+		{TopK, 3, "e,b,c"},
+		{TopK, 2, "e,b"},
+		{BottomK, 3, "g,a,b"},
+		{TopK, 10, "e,b,c,d,a,g"},
+		{BottomK, 0, ""},
+	}
+	for i, test := range tests {
+		r, err := test.f(&State{}, nil, numbers(), test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hosts(r); got != test.expected {
+			t.Errorf("%v: got %s, expected %s", i, got, test.expected)
+		}
+	}
+}
+
+func TestIf(t *testing.T) {
+	numbers := func(m map[string]float64) *Results {
+		r := new(Results)
+		for host, v := range m {
+			g := opentsdb.TagSet{}
+			if host != "" {
+				g["host"] = host
+			}
+			r.Results = append(r.Results, &Result{Group: g, Value: Number(v)})
+		}
+		return r
+	}
+	tests := []struct {
+		cond, then, els map[string]float64
+		unjoinedOk      bool
+		expected        map[string]float64
+	}{
+		// Element-wise selection.
+		{
+			map[string]float64{"a": 1, "b": 0},
+			map[string]float64{"a": 10, "b": 20},
+			map[string]float64{"a": 100, "b": 200},
+			false,
+			map[string]float64{"a": 10, "b": 200},
+		},
+		// An ungrouped value joins every element.
+		{
+			map[string]float64{"a": 1, "b": 0},
+			map[string]float64{"": 5},
+			map[string]float64{"a": 100, "b": 200},
+			false,
+			map[string]float64{"a": 5, "b": 200},
+		},
+		// c has no then value, so is NaN.
+		{
+			map[string]float64{"a": 0, "c": 1},
+			map[string]float64{"a": 10},
+			map[string]float64{"a": 100, "c": 300},
+			false,
+			map[string]float64{"a": 100, "c": math.NaN()},
+		},
+		// Or dropped if unjoined groups are allowed.
+		{
+			map[string]float64{"a": 0, "c": 1},
+			map[string]float64{"a": 10},
+			map[string]float64{"a": 100, "c": 300},
+			true,
+			map[string]float64{"a": 100},
+		},
+	}
+	for i, test := range tests {
+		r, err := If(&State{unjoinedOk: test.unjoinedOk}, nil, numbers(test.cond), numbers(test.then), numbers(test.els))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != len(test.expected) {
+			t.Errorf("%v: expected %v results, got %v", i, len(test.expected), len(r.Results))
+		}
+		for _, res := range r.Results {
+			got := float64(res.Value.(Number))
+			expected, ok := test.expected[res.Group["host"]]
+			if !ok || !(got == expected || math.IsNaN(got) && math.IsNaN(expected)) {
+				t.Errorf("%v: %s: got %v, expected %v", i, res.Group, got, expected)
+			}
+		}
+	}
+	e, err := New(`if(1 > 2, 3, 4)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(nil, nil, nil, client.Config{}, nil, nil, time.Now(), 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := r.Results[0].Value.Value(); v != Number(4) {
+		t.Errorf("got %v, expected 4", v)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	series := Series{
+		at(0):   1,
+		at(10):  0,
+		at(40):  1,
+		at(100): 1,
+		at(700): 0,
+	}
+	// Up for 10s, down for 30s, up for 60s, then a 600s interval of which
+	// 300s is credited as up and 300s is a gap.
+	tests := []struct {
+		gaps     string
+		expected float64
+	}{
+		{"down", 370.0 / 700},
+		{"ignore", 370.0 / 400},
+	}
+	for _, test := range tests {
+		r, err := Availability(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, "5m", test.gaps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(r.Results[0].Value.(Number)); math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("gaps %s: got %v, expected %v", test.gaps, got, test.expected)
+		}
+	}
+}
+
+func TestEdges(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	steady, flipping, gap := Series{}, Series{}, Series{}
+	for i := int64(0); i <= 600; i += 60 {
+		steady[at(i)] = 1
+		flipping[at(i)] = float64(i / 60 % 2)
+		gap[at(i)] = 0
+	}
+	// A change across a NaN is not counted, one after it is.
+	gap[at(300)] = math.NaN()
+	gap[at(360)] = 1
+	gap[at(420)] = 0
+	tests := []struct {
+		name     string
+		series   Series
+		window   string
+		expected float64
+	}{
+		{"steady", steady, "10m", 0},
+		{"flipping", flipping, "10m", 10},
+		{"flipping", flipping, "5m", 5},
+		{"gap", gap, "10m", 1},
+	}
+	for _, test := range tests {
+		r, err := Edges(&State{now: at(600)}, nil, &Results{Results: ResultSlice{{Value: test.series, Group: opentsdb.TagSet{}}}}, test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(r.Results[0].Value.(Number)); got != test.expected {
+			t.Errorf("%s over %s: got %v, expected %v", test.name, test.window, got, test.expected)
+		}
+	}
+}
+
+func TestResets(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	clean, restarts := Series{}, Series{}
+	for i := int64(0); i <= 600; i += 60 {
+		clean[at(i)] = float64(i * 10)
+		restarts[at(i)] = float64(i % 180)
+	}
+	// A NaN gap is not a reset, but a drop across one is.
+	clean[at(300)] = math.NaN()
+	restarts[at(540)] = math.NaN()
+	tests := []struct {
+		name     string
+		series   Series
+		window   string
+		expected float64
+	}{
+		{"clean", clean, "10m", 0},
+		{"restarts", restarts, "10m", 3},
+		{"restarts", restarts, "4m", 2},
+	}
+	for _, test := range tests {
+		r, err := Resets(&State{now: at(600)}, nil, &Results{Results: ResultSlice{{Value: test.series, Group: opentsdb.TagSet{}}}}, test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(r.Results[0].Value.(Number)); got != test.expected {
+			t.Errorf("%s over %s: got %v, expected %v", test.name, test.window, got, test.expected)
+		}
+	}
+}
+
+func TestIntegral(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	constant, linear, gap := Series{}, Series{}, Series{}
+	// Irregular sampling: the intervals are 10s, 50s, 60s, ...
+	for _, sec := range []int64{0, 10, 60, 120, 180, 300, 420, 600} {
+		constant[at(sec)] = 5
+		linear[at(sec)] = float64(sec) / 2
+		gap[at(sec)] = 5
+	}
+	// The intervals on each side of a NaN point are left out.
+	gap[at(180)] = math.NaN()
+	tests := []struct {
+		name     string
+		series   Series
+		window   string
+		expected float64
+	}{
+		{"constant", constant, "10m", 5 * 600},
+		{"constant", constant, "5m", 5 * 300},
+		// The integral of t/2 from a to b is (b²-a²)/4, which the trapezoid
+		// rule gives exactly for a linear series.
+		{"linear", linear, "10m", 600 * 600 / 4},
+		{"linear", linear, "8m", (600*600 - 120*120) / 4},
+		{"gap", gap, "10m", 5 * (600 - 60 - 120)},
+	}
+	for _, test := range tests {
+		r, err := Integral(&State{now: at(600)}, nil, &Results{Results: ResultSlice{{Value: test.series, Group: opentsdb.TagSet{}}}}, test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(r.Results[0].Value.(Number)); got != test.expected {
+			t.Errorf("%s over %s: got %v, expected %v", test.name, test.window, got, test.expected)
+		}
+	}
+}
+
+func TestTimeThreshold(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	// A latency series that crosses 500 several times, with a 250s gap after
+	// 150 and a 180s one after 420.
+	latency := Series{
+		at(0):   100,
+		at(30):  600,
+		at(60):  700,
+		at(120): 200,
+		at(150): 800,
+		at(400): 900,
+		at(420): 100,
+		at(600): 100,
+	}
+	tests := []struct {
+		f        func(*State, miniprofiler.Timer, *Results, float64, string, string, string) (*Results, error)
+		name     string
+		window   string
+		gaps     string
+		expected float64
+	}{
+		// 30→60, 60→120, 120s of 150→400 and 400→420.
+		{TimeAbove, "timeabove", "10m", "ignore", 30 + 60 + 120 + 20},
+		{TimeAbove, "timeabove", "10m", "count", 30 + 60 + 250 + 20},
+		{TimeAbove, "timeabove", "5m", "ignore", 20},
+		// 0→30, 120→150 and 120s of 420→600.
+		{TimeBelow, "timebelow", "10m", "ignore", 30 + 30 + 120},
+		{TimeBelow, "timebelow", "10m", "count", 30 + 30 + 180},
+	}
+	for _, test := range tests {
+		r, err := test.f(&State{now: at(600)}, nil, &Results{Results: ResultSlice{{Value: latency, Group: opentsdb.TagSet{}}}}, 500, test.window, "2m", test.gaps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(r.Results[0].Value.(Number)); got != test.expected {
+			t.Errorf("%s over %s, gaps %s: got %v, expected %v", test.name, test.window, test.gaps, got, test.expected)
+		}
+	}
+	if _, err := New(`timeabove(q("avg:m{host=*}", "1h", ""), 500, "1h", "2m", "sometimes")`, TSDB); err == nil {
+		t.Error("expected an unknown gaps mode to be rejected")
+	}
+}
+
+func TestBusinessHours(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, day, hour, min int) time.Time {
+		return time.Date(2015, 1, day, hour, min, 0, 0, loc).UTC()
+	}
+	// 2015-01-01 is a Thursday.
+	open := []time.Time{
+		at(ny, 2, 9, 0),
+		at(ny, 2, 16, 59),
+		at(time.UTC, 2, 21, 30), // 16:30 in New York
+		at(ny, 5, 9, 0),
+	}
+	closed := []time.Time{
+		at(ny, 1, 12, 0), // holiday
+		at(ny, 2, 8, 59),
+		at(ny, 2, 17, 0),
+		at(time.UTC, 3, 1, 0), // Friday 20:00 in New York
+		at(ny, 3, 12, 0),      // Saturday
+		at(ny, 4, 12, 0),      // Sunday
+		at(time.UTC, 5, 3, 0), // Sunday 22:00 in New York
+		at(ny, 5, 8, 59),
+	}
+	series := make(Series)
+	for _, t := range append(open, closed...) {
+		series[t] = 1
+	}
+	r, err := BusinessHours(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, "09:00", "17:00", "mon-fri", "America/New_York", "2015-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Results[0].Value.(Series)
+	if len(got) != len(open) {
+		t.Errorf("expected %d points, got %d: %v", len(open), len(got), got)
+	}
+	for _, t0 := range open {
+		if _, ok := got[t0]; !ok {
+			t.Errorf("expected %v to be kept", t0.In(ny))
+		}
+	}
+
+	// Day ranges may wrap around the week.
+	r, err = BusinessHours(&State{}, nil, &Results{Results: ResultSlice{{Value: Series{at(ny, 3, 12, 0): 1, at(ny, 4, 12, 0): 1, at(ny, 5, 12, 0): 1, at(ny, 6, 12, 0): 1}, Group: opentsdb.TagSet{}}}}, "09:00", "17:00", "sat-mon", "America/New_York", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Results[0].Value.(Series); len(got) != 3 {
+		t.Errorf("expected Saturday to Monday to be kept, got %v", got)
+	}
+
+	if _, err := New(`businessHours(q("avg:m{host=*}", "1d", ""), "09:00", "17:00", "mon-fri", "UTC", "")`, TSDB); err != nil {
+		t.Error(err)
+	}
+	for _, expr := range []string{
+		`businessHours(q("avg:m{host=*}", "1d", ""), "09:00", "17:00", "mon-fry", "UTC", "")`,
+		`businessHours(q("avg:m{host=*}", "1d", ""), "17:00", "09:00", "mon-fri", "UTC", "")`,
+		`businessHours(q("avg:m{host=*}", "1d", ""), "09:00", "17:00", "mon-fri", "Nowhere/Special", "")`,
+		`businessHours(q("avg:m{host=*}", "1d", ""), "09:00", "17:00", "mon-fri", "UTC", "12/25")`,
+	} {
+		if _, err := New(expr, TSDB); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	resample := func(series Series, step, agg, fill string) Series {
+		r, err := Resample(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, step, agg, fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Results[0].Value.(Series)
+	}
+	check := func(name string, got, expected Series) {
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+			return
+		}
+		for k, v := range expected {
+			if g, ok := got[k]; !ok || g != v && !(math.IsNaN(g) && math.IsNaN(v)) {
+				t.Errorf("%s: at %v expected %v, got %v", name, k.Unix(), v, g)
+			}
+		}
+	}
+
+	// Downsampling aggregates the points in each bucket.
+	fine := Series{at(0): 1, at(10): 2, at(20): 6, at(60): 4, at(125): 5, at(170): 3}
+	check("avg", resample(fine, "1m", "avg", "nan"), Series{at(0): 3, at(60): 4, at(120): 4})
+	check("max", resample(fine, "1m", "max", "nan"), Series{at(0): 6, at(60): 4, at(120): 5})
+	check("min", resample(fine, "1m", "min", "nan"), Series{at(0): 1, at(60): 4, at(120): 3})
+	check("last", resample(fine, "1m", "last", "nan"), Series{at(0): 6, at(60): 4, at(120): 3})
+
+	// Upsampling leaves empty buckets NaN or carries the previous value.
+	coarse := Series{at(65): 1, at(245): 2}
+	check("nan", resample(coarse, "1m", "avg", "nan"), Series{at(60): 1, at(120): math.NaN(), at(180): math.NaN(), at(240): 2})
+	check("carry", resample(coarse, "1m", "avg", "carry"), Series{at(60): 1, at(120): 1, at(180): 1, at(240): 2})
+
+	check("empty", resample(Series{}, "1m", "avg", "carry"), Series{})
+
+	// Buckets start at multiples of step since the Unix epoch, even for
+	// steps that do not divide the time since the zero time.
+	check("epoch", resample(Series{at(430): 1, at(850): 2}, "7m", "avg", "nan"), Series{at(420): 1, at(840): 2})
+
+	for _, expr := range []string{
+		`resample(q("avg:m{host=*}", "1h", ""), "0s", "avg", "nan")`,
+		`resample(q("avg:m{host=*}", "1h", ""), "1m", "median", "nan")`,
+		`resample(q("avg:m{host=*}", "1h", ""), "1m", "avg", "zero")`,
+	} {
+		if _, err := New(expr, TSDB); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	// x is sampled every minute; the others every 30s, offset by 15s.
+	x := make(Series)
+	up, down, square, constant := make(Series), make(Series), make(Series), make(Series)
+	for i := int64(0); i <= 60; i++ {
+		x[at(i*60)] = float64(i)
+		for _, o := range []int64{15, 45} {
+			sec := i*60 + o
+			up[at(sec)] = 2*float64(sec) + 3
+			down[at(sec)] = -float64(sec)
+			square[at(sec)] = math.Pow(float64(i-30), 2)
+			constant[at(sec)] = 5
+		}
+	}
+	tests := []struct {
+		name     string
+		y        Series
+		window   string
+		expected float64
+	}{
+		{"correlated", up, "1h", 1},
+		{"anti-correlated", down, "1h", -1},
+		{"uncorrelated", square, "1h", 0},
+		{"constant", constant, "1h", math.NaN()},
+		// Only the last 30 minutes, where the square rises with x.
+		{"window", square, "30m", 0.966},
+	}
+	for _, test := range tests {
+		a := &Results{Results: ResultSlice{{Value: x, Group: opentsdb.TagSet{"host": "a"}}}}
+		b := &Results{Results: ResultSlice{{Value: test.y, Group: opentsdb.TagSet{"host": "a"}}}}
+		r, err := Correlate(&State{now: at(3600)}, nil, a, b, test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := float64(r.Results[0].Value.(Number))
+		if math.IsNaN(test.expected) {
+			if !math.IsNaN(got) {
+				t.Errorf("%s: expected NaN, got %v", test.name, got)
+			}
+		} else if math.Abs(got-test.expected) > 0.001 {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	series := make(Series)
+	for i, v := range []float64{-5, 0, 3, 9.5, 10, 10, 42, 100, 250, math.NaN()} {
+		series[at(int64(i))] = v
+	}
+	r, err := Histogram(nil, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{"host": "a"}}}}, "0, 10,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Number{
+		"-inf_0":  1,
+		"0_10":    3,
+		"10_100":  3,
+		"100_inf": 2,
+	}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d", len(expected), len(r.Results))
+	}
+	for _, res := range r.Results {
+		if res.Group["host"] != "a" {
+			t.Errorf("bucket %s lost host tag: %v", res.Group[histogramTag], res.Group)
+		}
+		bucket := res.Group[histogramTag]
+		if res.Value.(Number) != expected[bucket] {
+			t.Errorf("bucket %s: expected %v, got %v", bucket, expected[bucket], res.Value)
+		}
+	}
+	for _, bounds := range []string{"", "1,x", "10,5", "1,1"} {
+		if _, err := parseHistogramBounds(bounds); err == nil {
+			t.Errorf("bounds %q: expected error", bounds)
+		}
+	}
+}
+
+func TestEMA(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	series := Series{at(0): 10, at(60): 20, at(120): math.NaN(), at(180): 0, at(240): 10}
+	r, err := EMA(nil, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10, then .5*20+.5*10 = 15, the NaN skipped, .5*0+.5*15 = 7.5 and
+	// .5*10+.5*7.5 = 8.75.
+	expected := Series{at(0): 10, at(60): 15, at(180): 7.5, at(240): 8.75}
+	if got := r.Results[0].Value.(Series); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for _, alpha := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if _, err := EMA(nil, nil, &Results{}, alpha); err == nil {
+			t.Errorf("alpha %v: expected error", alpha)
+		}
+	}
+	if _, err := New(`ema(q("avg:m{host=*}", "1h", ""), 2)`, TSDB); err == nil {
+		t.Error("expected parse error for alpha 2")
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	nan := math.NaN()
+	// Points every minute, with a two minute gap of missing points from 60
+	// to 240, a NaN at 360, and a ten minute outage from 420 to 1020.
+	series := Series{
+		at(0): 1, at(60): 2, at(240): 5, at(300): 6, at(360): nan, at(420): 10,
+		at(1020): 20, at(1080): 21,
+	}
+	tests := []struct {
+		method   string
+		expected Series
+	}{
+		{"linear", Series{
+			at(0): 1, at(60): 2, at(120): 3, at(180): 4, at(240): 5, at(300): 6, at(360): 8, at(420): 10,
+			at(1020): 20, at(1080): 21,
+		}},
+		{"carry", Series{
+			at(0): 1, at(60): 2, at(120): 2, at(180): 2, at(240): 5, at(300): 6, at(360): 6, at(420): 10,
+			at(1020): 20, at(1080): 21,
+		}},
+	}
+	for _, test := range tests {
+		r, err := FillGaps(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, "5m", test.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := r.Results[0].Value.(Series)
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.method, test.expected, got)
+			continue
+		}
+		for k, v := range test.expected {
+			if got[k] != v {
+				t.Errorf("%s: at %v expected %v, got %v", test.method, k.Unix(), v, got[k])
+			}
+		}
+	}
+
+	// A gap longer than maxGap is left alone, even when it is only NaNs.
+	series = Series{at(0): 1, at(60): nan, at(120): nan, at(180): 4}
+	r, err := FillGaps(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, "2m", "linear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Results[0].Value.(Series); len(got) != 4 || !math.IsNaN(got[at(60)]) || !math.IsNaN(got[at(120)]) {
+		t.Errorf("expected the NaNs to be kept, got %v", got)
+	}
+
+	for _, expr := range []string{
+		`fillgaps(q("avg:m{host=*}", "1h", ""), "0s", "linear")`,
+		`fillgaps(q("avg:m{host=*}", "1h", ""), "5m", "zero")`,
+	} {
+		if _, err := New(expr, TSDB); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestLastHold(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	nan := math.NaN()
+	// Points every minute: a short dropout at 120 and 180, a long one from
+	// 300 to 720, missing points from 780 to 1080, and a dropout at the end.
+	series := Series{at(0): 1, at(60): 2, at(120): nan, at(180): nan, at(240): 5, at(780): 8, at(1080): 9, at(1140): nan, at(1200): nan}
+	for sec := int64(300); sec <= 720; sec += 60 {
+		series[at(sec)] = nan
+	}
+	r, err := LastHold(&State{}, nil, &Results{Results: ResultSlice{{Value: series, Group: opentsdb.TagSet{}}}}, "3m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Results[0].Value.(Series)
+	expected := Series{
+		at(0): 1, at(60): 2, at(120): 2, at(180): 2, at(240): 5,
+		at(300): 5, at(360): 5, at(420): 5, at(480): nan, at(540): nan, at(600): nan, at(660): nan, at(720): nan,
+		at(780): 8, at(840): 8, at(900): 8, at(960): 8, at(1080): 9, at(1140): 9, at(1200): 9,
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for k, v := range expected {
+		if g, ok := got[k]; !ok || g != v && !(math.IsNaN(g) && math.IsNaN(v)) {
+			t.Errorf("at %v expected %v, got %v", k.Unix(), v, g)
+		}
+	}
+
+	if _, err := New(`lasthold(q("avg:m{host=*}", "1h", ""), "0s")`, TSDB); err == nil {
+		t.Error("expected a non-positive maxAge to fail")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	a := &Results{Results: ResultSlice{
+		{Group: opentsdb.TagSet{"host": "a", "dev": "sda"}, Value: Number(1)},
+		{Group: opentsdb.TagSet{"host": "a", "dev": "sdb"}, Value: Number(2)},
+		{Group: opentsdb.TagSet{"host": "b", "dev": "sda"}, Value: Number(3)},
+		{Group: opentsdb.TagSet{"host": "c", "dev": "sda"}, Value: Number(4)},
+	}}
+	b := &Results{Results: ResultSlice{
+		{Group: opentsdb.TagSet{"host": "a", "dc": "ny"}, Value: Number(10)},
+		{Group: opentsdb.TagSet{"host": "b", "dc": "la"}, Value: Number(20)},
+	}}
+	r, err := Join(&State{}, nil, a, b, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Number{
+		"{dev=sda,host=a}": 10,
+		"{dev=sdb,host=a}": 10,
+		"{dev=sda,host=b}": 20,
+	}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %v results, got %v", len(expected), r.Results)
+	}
+	for _, res := range r.Results {
+		if v, ok := expected[res.Group.String()]; !ok || res.Value != v {
+			t.Errorf("%s: got %v, expected %v", res.Group, res.Value, v)
+		}
+	}
+	b.Results = append(b.Results, &Result{Group: opentsdb.TagSet{"host": "a", "dc": "la"}, Value: Number(30)})
+	if _, err := Join(&State{}, nil, a, b, "host"); err == nil {
+		t.Error("expected error for ambiguous match")
+	}
+}
+
+func TestGraphiteAndTSDB(t *testing.T) {
+	gs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch target := r.FormValue("target"); target {
+		case "svc.*.requests":
+			fmt.Fprint(w, `[{"target": "svc.web01.requests", "datapoints": [[1, 100], [3, 160]]},
+				{"target": "svc.web02.requests", "datapoints": [[10, 100]]}]`)
+		case "svc.web02.requests":
+			fmt.Fprint(w, `[{"target": "svc.web02.requests", "datapoints": [[10, 100]]}]`)
+		default:
+			t.Errorf("unexpected target %q", target)
+		}
+	}))
+	defer gs.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{
+			{Metric: "svc.requests", Tags: opentsdb.TagSet{"host": "web01"}, DPS: map[string]opentsdb.Point{"100": 4, "160": 6}},
+			{Metric: "svc.requests", Tags: opentsdb.TagSet{"host": "web03"}, DPS: map[string]opentsdb.Point{"100": 7}},
+		})
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr     string
+		expected map[string]float64
+		err      bool
+	}{
+		{
+			`avg(graphite("svc.*.requests", "5m", "", ".host.")) + avg(q("avg:svc.requests{host=*}", "5m", ""))`,
+			// Hosts in only one set have no pair and are NaN.
+			map[string]float64{"host=web01": 7, "host=web02": math.NaN(), "host=web03": math.NaN()},
+			false,
+		},
+		{
+			`merge(avg(graphite("svc.web02.requests", "5m", "", ".host.")), avg(q("avg:svc.requests{host=*}", "5m", "")))`,
+			map[string]float64{"host=web01": 5, "host=web02": 10, "host=web03": 7},
+			false,
+		},
+		{
+			`merge(avg(graphite("svc.*.requests", "5m", "", ".host.")), avg(q("avg:svc.requests{host=*}", "5m", "")))`,
+			nil,
+			true,
+		},
+	}
+	for _, test := range tests {
+		e, err := New(test.expr, TSDB, Graphite)
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		results, _, err := e.Execute(opentsdb.Host(u.Host), graphite.Host(gs.URL), nil, client.Config{}, nil, nil, queryTime, 0, false, nil, nil, nil)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected error", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.expr, err)
+			continue
+		}
+		if len(results.Results) != len(test.expected) {
+			t.Errorf("%v: got %v results, expected %v", test.expr, len(results.Results), len(test.expected))
+		}
+		for _, r := range results.Results {
+			v := float64(r.Value.(Number))
+			expected, ok := test.expected[r.Group.Tags()]
+			if !ok || v != expected && !(math.IsNaN(v) && math.IsNaN(expected)) {
+				t.Errorf("%v: %v: got %v, expected %v", test.expr, r.Group, v, expected)
+			}
+		}
+	}
+	if _, err := New(`merge(avg(graphite("svc.*.requests", "5m", "", ".host.")), avg(q("avg:svc.requests{dc=*}", "5m", "")))`, TSDB, Graphite); err == nil {
+		t.Error("expected merge of different tag keys to be rejected")
+	}
+}
+
+func TestGraphiteConsolidate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.FormValue("target"); target != "consolidateBy(foo.*.cpu,'max')" {
+			t.Errorf("unexpected target %q", target)
+		}
+		if m := r.FormValue("maxDataPoints"); m != "100" {
+			t.Errorf("unexpected maxDataPoints %q", m)
+		}
+		fmt.Fprint(w, `[{"target": "consolidateBy(foo.web01.cpu,'max')", "datapoints": [[1.5, 100], [null, 160], [3, 220]]}]`)
+	}))
+	defer ts.Close()
+	e, err := New(`graphiteConsolidate("foo.*.cpu", "1h", "", ".host.", 100, "max")`, Graphite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _, err := e.Execute(nil, graphite.Host(ts.URL), nil, client.Config{}, nil, nil, time.Now(), 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results.Results))
+	}
+	r := results.Results[0]
+	if r.Group.Tags() != "host=web01" {
+		t.Errorf("unexpected group %v", r.Group)
+	}
+	expected := Series{time.Unix(100, 0): 1.5, time.Unix(220, 0): 3}
+	if !reflect.DeepEqual(r.Value, expected) {
+		t.Errorf("got %v, expected %v", r.Value, expected)
+	}
+	if _, err := New(`graphiteConsolidate("foo", "1h", "", "", 100, "median")`, Graphite); err == nil {
+		t.Error("expected an unknown consolidation function to be rejected")
+	}
+}
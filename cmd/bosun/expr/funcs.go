@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -40,6 +41,15 @@ func tagQuery(args []parse.Node) (parse.Tags, error) {
 	return t, nil
 }
 
+func tagPeriods(args []parse.Node) (parse.Tags, error) {
+	t, err := tagQuery(args)
+	if err != nil {
+		return nil, err
+	}
+	t[periodTag] = struct{}{}
+	return t, nil
+}
+
 func tagFirst(args []parse.Node) (parse.Tags, error) {
 	return args[0].Tags()
 }
@@ -60,6 +70,45 @@ func tagTranspose(args []parse.Node) (parse.Tags, error) {
 	return tags, nil
 }
 
+func tagJoin(args []parse.Node) (parse.Tags, error) {
+	tags := make(parse.Tags)
+	for _, t := range strings.Split(args[2].(*parse.StringNode).Text, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags[t] = struct{}{}
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("join: no tag keys specified")
+	}
+	for i := 0; i < 2; i++ {
+		if atags, err := args[i].Tags(); err != nil {
+			return nil, err
+		} else if !tags.Subset(atags) {
+			return nil, fmt.Errorf("join tags (%v) must be a subset of argument %d's tags (%v)", tags, i+1, atags)
+		}
+	}
+	return args[0].Tags()
+}
+
+func tagNone(args []parse.Node) (parse.Tags, error) {
+	return make(parse.Tags), nil
+}
+
+func tagMerge(args []parse.Node) (parse.Tags, error) {
+	a, err := args[0].Tags()
+	if err != nil {
+		return nil, err
+	}
+	b, err := args[1].Tags()
+	if err != nil {
+		return nil, err
+	}
+	if !a.Equal(b) {
+		return nil, fmt.Errorf("merge: tags (%v) and (%v) must be equal, use rename or droptag to make them so", a, b)
+	}
+	return a, nil
+}
+
 func tagRename(args []parse.Node) (parse.Tags, error) {
 	tags, err := tagFirst(args)
 	if err != nil {
@@ -83,6 +132,30 @@ func tagRename(args []parse.Node) (parse.Tags, error) {
 	return tags, nil
 }
 
+func tagDropTag(args []parse.Node) (parse.Tags, error) {
+	tags, err := tagFirst(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range strings.Split(args[1].(*parse.StringNode).Text, ",") {
+		delete(tags, k)
+	}
+	return tags, nil
+}
+
+func tagDeriveTag(args []parse.Node) (parse.Tags, error) {
+	tags, err := tagFirst(args)
+	if err != nil {
+		return nil, err
+	}
+	newKey := args[1].(*parse.StringNode).Text
+	if _, ok := tags[newKey]; ok {
+		return nil, fmt.Errorf("%s already in group", newKey)
+	}
+	tags[newKey] = struct{}{}
+	return tags, nil
+}
+
 // Graphite defines functions for use with a Graphite backend.
 var Graphite = map[string]parse.Func{
 	"graphiteBand": {
@@ -97,6 +170,13 @@ var Graphite = map[string]parse.Func{
 		Tags:   graphiteTagQuery,
 		F:      GraphiteQuery,
 	},
+	"graphiteConsolidate": {
+		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteConsolidate,
+		Check:  graphiteConsolidateCheck,
+	},
 }
 
 // TSDB defines functions for use with an OpenTSDB backend.
@@ -107,6 +187,12 @@ var TSDB = map[string]parse.Func{
 		Tags:   tagQuery,
 		F:      Band,
 	},
+	"baseline": {
+		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagQuery,
+		F:      Baseline,
+	},
 	"change": {
 		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
 		Return: parse.TypeNumberSet,
@@ -118,6 +204,12 @@ var TSDB = map[string]parse.Func{
 		Return: parse.TypeScalar,
 		F:      Count,
 	},
+	"periods": {
+		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagPeriods,
+		F:      Periods,
+	},
 	"q": {
 		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
 		Return: parse.TypeSeriesSet,
@@ -142,6 +234,32 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      Avg,
 	},
+	"burnRate": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeSeriesSet, parse.TypeScalar},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      BurnRate,
+	},
+	"correlate": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      Correlate,
+	},
+	"histogram": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagHistogram,
+		F:      Histogram,
+		Check:  histogramCheck,
+	},
+	"match": {
+		Args:   []parse.FuncType{parse.TypeStringSeriesSet, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      Match,
+		Check:  matchCheck,
+	},
 	"cCount": {
 		Args:   []parse.FuncType{parse.TypeSeriesSet},
 		Return: parse.TypeNumberSet,
@@ -208,6 +326,12 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      Percentile,
 	},
+	"pctchange": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      PctChange,
+	},
 	"since": {
 		Args:   []parse.FuncType{parse.TypeSeriesSet},
 		Return: parse.TypeNumberSet,
@@ -226,6 +350,45 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      Streak,
 	},
+	"availability": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      Availability,
+		Check:  availabilityCheck,
+	},
+	"edges": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      Edges,
+	},
+	"resets": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      Resets,
+	},
+	"integral": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      Integral,
+	},
+	"timeabove": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeScalar, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      TimeAbove,
+		Check:  timeThresholdCheck,
+	},
+	"timebelow": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeScalar, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      TimeBelow,
+		Check:  timeThresholdCheck,
+	},
 
 	// Group functions
 	"rename": {
@@ -234,6 +397,19 @@ var builtins = map[string]parse.Func{
 		Tags:   tagRename,
 		F:      Rename,
 	},
+	"droptag": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagDropTag,
+		F:      DropTag,
+	},
+	"derivetag": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagDeriveTag,
+		F:      DeriveTag,
+		Check:  deriveTagCheck,
+	},
 
 	"t": {
 		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeString},
@@ -241,6 +417,31 @@ var builtins = map[string]parse.Func{
 		Tags:   tagTranspose,
 		F:      Transpose,
 	},
+	"if": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeNumberSet, parse.TypeNumberSet},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      If,
+	},
+	"join": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeNumberSet, parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagJoin,
+		F:      Join,
+	},
+	"merge": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeNumberSet},
+		Return: parse.TypeNumberSet,
+		Tags:   tagMerge,
+		F:      Merge,
+		Check:  mergeCheck,
+	},
+	"wavg": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeNumberSet},
+		Return: parse.TypeNumberSet,
+		Tags:   tagNone,
+		F:      WeightedAvg,
+	},
 	"ungroup": {
 		Args:   []parse.FuncType{parse.TypeNumberSet},
 		Return: parse.TypeScalar,
@@ -255,6 +456,18 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      Abs,
 	},
+	"bosunErrors": {
+		Args:   []parse.FuncType{},
+		Return: parse.TypeNumberSet,
+		Tags:   tagAlertName,
+		F:      BosunErrors,
+	},
+	"bosunIncidents": {
+		Args:   []parse.FuncType{parse.TypeString},
+		Return: parse.TypeNumberSet,
+		Tags:   tagAlertName,
+		F:      BosunIncidents,
+	},
 	"d": {
 		Args:   []parse.FuncType{parse.TypeString},
 		Return: parse.TypeScalar,
@@ -296,6 +509,41 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      DropNA,
 	},
+	"businessHours": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      BusinessHours,
+		Check:  businessHoursCheck,
+	},
+	"fillgaps": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      FillGaps,
+		Check:  fillGapsCheck,
+	},
+	"lasthold": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      LastHold,
+		Check:  lastHoldCheck,
+	},
+	"ema": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeScalar},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      EMA,
+		Check:  emaCheck,
+	},
+	"resample": {
+		Args:   []parse.FuncType{parse.TypeSeriesSet, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeSeriesSet,
+		Tags:   tagFirst,
+		F:      Resample,
+		Check:  resampleCheck,
+	},
 	"epoch": {
 		Args:   []parse.FuncType{},
 		Return: parse.TypeScalar,
@@ -325,6 +573,54 @@ var builtins = map[string]parse.Func{
 		Tags:   tagFirst,
 		F:      Sort,
 	},
+	"topk": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeScalar},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      TopK,
+	},
+	"bottomk": {
+		Args:   []parse.FuncType{parse.TypeNumberSet, parse.TypeScalar},
+		Return: parse.TypeNumberSet,
+		Tags:   tagFirst,
+		F:      BottomK,
+	},
+}
+
+func tagAlertName(args []parse.Node) (parse.Tags, error) {
+	return parse.Tags{"alert": struct{}{}}, nil
+}
+
+// alertCounts converts a map of alert name to count into a number set tagged
+// by alert.
+func alertCounts(counts map[string]int) *Results {
+	r := new(Results)
+	for name, c := range counts {
+		r.Results = append(r.Results, &Result{
+			Value: Number(c),
+			Group: opentsdb.TagSet{"alert": name},
+		})
+	}
+	sort.Sort(ResultSliceByGroup(r.Results))
+	return r
+}
+
+func BosunErrors(e *State, T miniprofiler.Timer) (*Results, error) {
+	if e.History == nil {
+		return nil, fmt.Errorf("bosunErrors: alert status not available")
+	}
+	return alertCounts(e.History.GetFailingAlerts()), nil
+}
+
+func BosunIncidents(e *State, T miniprofiler.Timer, filter string) (*Results, error) {
+	if e.History == nil {
+		return nil, fmt.Errorf("bosunIncidents: alert status not available")
+	}
+	counts, err := e.History.GetOpenIncidentCounts(filter)
+	if err != nil {
+		return nil, fmt.Errorf("bosunIncidents: %v", err)
+	}
+	return alertCounts(counts), nil
 }
 
 func Epoch(e *State, T miniprofiler.Timer) (*Results, error) {
@@ -362,6 +658,35 @@ func Limit(e *State, T miniprofiler.Timer, series *Results, v float64) (*Results
 	return series, nil
 }
 
+// TopK returns the n results with the highest values, highest first. Ties
+// are broken by group name. NaN values are dropped.
+func TopK(e *State, T miniprofiler.Timer, series *Results, n float64) (*Results, error) {
+	return rankK(e, T, series, "desc", n)
+}
+
+// BottomK returns the n results with the lowest values, lowest first. Ties
+// are broken by group name. NaN values are dropped.
+func BottomK(e *State, T miniprofiler.Timer, series *Results, n float64) (*Results, error) {
+	return rankK(e, T, series, "asc", n)
+}
+
+func rankK(e *State, T miniprofiler.Timer, series *Results, order string, n float64) (*Results, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("count must not be negative")
+	}
+	var rs ResultSlice
+	for _, r := range series.Results {
+		if !math.IsNaN(float64(r.Value.(Number))) {
+			rs = append(rs, r)
+		}
+	}
+	series.Results = rs
+	if _, err := Sort(e, T, series, order); err != nil {
+		return nil, err
+	}
+	return Limit(e, T, series, n)
+}
+
 func Filter(e *State, T miniprofiler.Timer, series *Results, number *Results) (*Results, error) {
 	var ns ResultSlice
 	for _, sr := range series.Results {
@@ -435,88 +760,483 @@ func DropNA(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
 	return DropValues(e, T, series, fromScalar(0), dropFunction)
 }
 
-func parseGraphiteResponse(req *graphite.Request, s *graphite.Response, formatTags []string) ([]*Result, error) {
-	const parseErrFmt = "graphite ParseError (%s): %s"
-	if len(*s) == 0 {
-		return nil, fmt.Errorf(parseErrFmt, req.URL, "empty response")
-	}
-	seen := make(map[string]bool)
-	results := make([]*Result, 0)
-	for _, res := range *s {
-		// build tag set
-		tags := make(opentsdb.TagSet)
-		if len(formatTags) == 1 && formatTags[0] == "" {
-			tags["key"] = res.Target
-		} else {
-			nodes := strings.Split(res.Target, ".")
-			if len(nodes) < len(formatTags) {
-				msg := fmt.Sprintf("returned target '%s' does not match format '%s'", res.Target, strings.Join(formatTags, ","))
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
-			}
-			for i, key := range formatTags {
-				if len(key) > 0 {
-					tags[key] = nodes[i]
-				}
-			}
+// businessHours is a weekly schedule of open hours, less holidays.
+type businessHours struct {
+	start, end time.Duration
+	days       [7]bool
+	loc        *time.Location
+	holidays   map[string]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseBusinessHours(start, end, days, tz, holidays string) (*businessHours, error) {
+	b := &businessHours{holidays: make(map[string]bool)}
+	for _, v := range []struct {
+		s string
+		d *time.Duration
+	}{{start, &b.start}, {end, &b.end}} {
+		t, err := time.Parse("15:04", v.s)
+		if err != nil {
+			return nil, fmt.Errorf("businessHours: bad time %q, expected HH:MM", v.s)
 		}
-		if ts := tags.String(); !seen[ts] {
-			seen[ts] = true
-		} else {
-			return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("More than 1 series identified by tagset '%v'", ts))
+		*v.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if b.start >= b.end {
+		return nil, fmt.Errorf("businessHours: start must be before end")
+	}
+	for _, d := range strings.Split(days, ",") {
+		sp := strings.SplitN(strings.TrimSpace(d), "-", 2)
+		from, ok := weekdays[strings.ToLower(sp[0])]
+		if !ok {
+			return nil, fmt.Errorf("businessHours: unknown day %q", sp[0])
 		}
-		// build data
-		dps := make(Series)
-		for _, dp := range res.Datapoints {
-			if len(dp) != 2 {
-				return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("Datapoint has != 2 fields: %v", dp))
+		to := from
+		if len(sp) == 2 {
+			if to, ok = weekdays[strings.ToLower(sp[1])]; !ok {
+				return nil, fmt.Errorf("businessHours: unknown day %q", sp[1])
 			}
-			if len(dp[0].String()) == 0 {
-				// none value. skip this record
-				continue
-			}
-			val, err := dp[0].Float64()
-			if err != nil {
-				msg := fmt.Sprintf("value '%s' cannot be decoded to Float64: %s", dp[0], err.Error())
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+		}
+		for wd := from; ; wd = (wd + 1) % 7 {
+			b.days[wd] = true
+			if wd == to {
+				break
 			}
-			unixTS, err := dp[1].Int64()
-			if err != nil {
-				msg := fmt.Sprintf("timestamp '%s' cannot be decoded to Int64: %s", dp[1], err.Error())
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+		}
+	}
+	var err error
+	if b.loc, err = time.LoadLocation(tz); err != nil {
+		return nil, fmt.Errorf("businessHours: %v", err)
+	}
+	if holidays != "" {
+		for _, h := range strings.Split(holidays, ",") {
+			h = strings.TrimSpace(h)
+			if _, err := time.Parse("2006-01-02", h); err != nil {
+				return nil, fmt.Errorf("businessHours: bad holiday %q, expected YYYY-MM-DD", h)
 			}
-			t := time.Unix(unixTS, 0)
-			dps[t] = val
+			b.holidays[h] = true
 		}
-		results = append(results, &Result{
-			Value: dps,
-			Group: tags,
-		})
 	}
-	return results, nil
+	return b, nil
 }
 
-func GraphiteBand(e *State, T miniprofiler.Timer, query, duration, period, format string, num float64) (r *Results, err error) {
-	r = new(Results)
-	r.IgnoreOtherUnjoined = true
-	r.IgnoreUnjoined = true
-	T.Step("graphiteBand", func(T miniprofiler.Timer) {
-		var d, p opentsdb.Duration
-		d, err = opentsdb.ParseDuration(duration)
-		if err != nil {
-			return
-		}
-		p, err = opentsdb.ParseDuration(period)
-		if err != nil {
-			return
-		}
-		if num < 1 || num > 100 {
-			err = fmt.Errorf("expr: Band: num out of bounds")
+// open returns whether t is within business hours.
+func (b *businessHours) open(t time.Time) bool {
+	t = t.In(b.loc)
+	if !b.days[t.Weekday()] || b.holidays[t.Format("2006-01-02")] {
+		return false
+	}
+	off := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return off >= b.start && off < b.end
+}
+
+func businessHoursCheck(t *parse.Tree, f *parse.FuncNode) error {
+	var args [5]string
+	for i := range args {
+		n, ok := f.Args[i+1].(*parse.StringNode)
+		if !ok {
+			return nil
 		}
-		req := &graphite.Request{
-			Targets: []string{query},
+		args[i] = n.Text
+	}
+	_, err := parseBusinessHours(args[0], args[1], args[2], args[3], args[4])
+	return err
+}
+
+// BusinessHours drops the points of each series outside of start to end on
+// days in tz, and on holidays.
+func BusinessHours(e *State, T miniprofiler.Timer, series *Results, start, end, days, tz, holidays string) (*Results, error) {
+	b, err := parseBusinessHours(start, end, days, tz, holidays)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		open := make(Series)
+		for t, v := range s.Value.(Series) {
+			if b.open(t) {
+				open[t] = v
+			}
 		}
-		now := e.now
-		req.End = &now
+		s.Value = open
+	}
+	return series, nil
+}
+
+func parseFillGaps(maxGap, method string) (time.Duration, bool, error) {
+	d, err := opentsdb.ParseDuration(maxGap)
+	if err != nil {
+		return 0, false, err
+	}
+	if d <= 0 {
+		return 0, false, fmt.Errorf("fillgaps: maxGap must be positive")
+	}
+	switch method {
+	case "linear":
+		return time.Duration(d), true, nil
+	case "carry":
+		return time.Duration(d), false, nil
+	}
+	return 0, false, fmt.Errorf("fillgaps: unknown method %q, expected linear or carry", method)
+}
+
+func fillGapsCheck(t *parse.Tree, f *parse.FuncNode) error {
+	maxGap, ok := f.Args[1].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	method, ok := f.Args[2].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	_, _, err := parseFillGaps(maxGap.Text, method.Text)
+	return err
+}
+
+// FillGaps fills the gaps in each series that are no longer than maxGap,
+// either by linear interpolation or by carrying forward the last value before
+// the gap. A gap is a run of NaN points, or missing points where the time
+// between two points is more than 1.5 times the series' median interval.
+// Longer gaps are left as they are.
+func FillGaps(e *State, T miniprofiler.Timer, series *Results, maxGap, method string) (*Results, error) {
+	d, linear, err := parseFillGaps(maxGap, method)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		s.Value = fillGaps(s.Value.(Series), d, linear)
+	}
+	return series, nil
+}
+
+func fillGaps(dps Series, maxGap time.Duration, linear bool) Series {
+	sorted := NewSortedSeries(dps)
+	step := medianInterval(dps)
+	filled := make(Series, len(dps))
+	for t, v := range dps {
+		filled[t] = v
+	}
+	prev := -1
+	for i, p := range sorted {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if prev < 0 {
+			prev = i
+			continue
+		}
+		a, b, nans := sorted[prev], p, sorted[prev+1:i]
+		prev = i
+		gap := b.T.Sub(a.T)
+		if gap > maxGap {
+			continue
+		}
+		value := func(t time.Time) float64 {
+			if !linear {
+				return a.V
+			}
+			return a.V + (b.V-a.V)*float64(t.Sub(a.T))/float64(gap)
+		}
+		for _, n := range nans {
+			filled[n.T] = value(n.T)
+		}
+		if step > 0 && gap > step*3/2 {
+			for t := a.T.Add(step); b.T.Sub(t) > step/2; t = t.Add(step) {
+				if _, ok := dps[t]; !ok {
+					filled[t] = value(t)
+				}
+			}
+		}
+	}
+	return filled
+}
+
+func parseLastHold(maxAge string) (time.Duration, error) {
+	d, err := opentsdb.ParseDuration(maxAge)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("lasthold: maxAge must be positive")
+	}
+	return time.Duration(d), nil
+}
+
+func lastHoldCheck(t *parse.Tree, f *parse.FuncNode) error {
+	maxAge, ok := f.Args[1].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	_, err := parseLastHold(maxAge.Text)
+	return err
+}
+
+// LastHold carries the last non-NaN value of each series forward over NaN
+// points and missing points, for up to maxAge after it. Missing points are
+// where the time between two points is more than 1.5 times the series' median
+// interval. Unlike fillgaps, a dropout at the end of the series is held too.
+// Points more than maxAge after the last value are left as they are.
+func LastHold(e *State, T miniprofiler.Timer, series *Results, maxAge string) (*Results, error) {
+	d, err := parseLastHold(maxAge)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		s.Value = lastHold(s.Value.(Series), d)
+	}
+	return series, nil
+}
+
+func lastHold(dps Series, maxAge time.Duration) Series {
+	sorted := NewSortedSeries(dps)
+	step := medianInterval(dps)
+	held := make(Series, len(dps))
+	for t, v := range dps {
+		held[t] = v
+	}
+	var good SortablePoint
+	hasGood := false
+	for i, p := range sorted {
+		if hasGood && i > 0 && step > 0 {
+			for t := sorted[i-1].T.Add(step); p.T.Sub(t) > step/2 && t.Sub(good.T) <= maxAge; t = t.Add(step) {
+				held[t] = good.V
+			}
+		}
+		if !math.IsNaN(p.V) {
+			good, hasGood = p, true
+		} else if hasGood && p.T.Sub(good.T) <= maxAge {
+			held[p.T] = good.V
+		}
+	}
+	return held
+}
+
+// resampleAggs are the functions resample can aggregate a bucket with.
+var resampleAggs = map[string]func(Series, ...float64) float64{
+	"avg":  avg,
+	"max":  func(dps Series, args ...float64) float64 { return percentile(dps, 1) },
+	"min":  func(dps Series, args ...float64) float64 { return percentile(dps, 0) },
+	"last": last,
+}
+
+func parseResample(step, agg, fill string) (time.Duration, func(Series, ...float64) float64, bool, error) {
+	d, err := opentsdb.ParseDuration(step)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if d < opentsdb.Duration(time.Second) {
+		return 0, nil, false, fmt.Errorf("resample: step must be at least 1s")
+	}
+	f := resampleAggs[agg]
+	if f == nil {
+		return 0, nil, false, fmt.Errorf("resample: unknown aggregator %q, expected avg, max, min or last", agg)
+	}
+	var carry bool
+	switch fill {
+	case "nan":
+	case "carry":
+		carry = true
+	default:
+		return 0, nil, false, fmt.Errorf("resample: unknown fill %q, expected nan or carry", fill)
+	}
+	return time.Duration(d), f, carry, nil
+}
+
+func resampleCheck(t *parse.Tree, f *parse.FuncNode) error {
+	var args [3]string
+	for i := range args {
+		n, ok := f.Args[i+1].(*parse.StringNode)
+		if !ok {
+			return nil
+		}
+		args[i] = n.Text
+	}
+	_, _, _, err := parseResample(args[0], args[1], args[2])
+	return err
+}
+
+func checkEMAAlpha(alpha float64) error {
+	if !(alpha > 0 && alpha <= 1) {
+		return fmt.Errorf("ema: alpha must be greater than 0 and at most 1, got %v", alpha)
+	}
+	return nil
+}
+
+func emaCheck(t *parse.Tree, f *parse.FuncNode) error {
+	n, ok := f.Args[1].(*parse.NumberNode)
+	if !ok {
+		return nil
+	}
+	return checkEMAAlpha(n.Float64)
+}
+
+// EMA returns the exponential moving average of each series, where each
+// point is alpha times its value plus 1 - alpha times the average of the
+// previous point. The first point is its own value. NaN points are left out
+// and do not change the average.
+func EMA(e *State, T miniprofiler.Timer, series *Results, alpha float64) (*Results, error) {
+	if err := checkEMAAlpha(alpha); err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		ema := make(Series)
+		avg := math.NaN()
+		for _, p := range NewSortedSeries(s.Value.(Series)) {
+			if math.IsNaN(p.V) {
+				continue
+			}
+			if math.IsNaN(avg) {
+				avg = p.V
+			} else {
+				avg = alpha*p.V + (1-alpha)*avg
+			}
+			ema[p.T] = avg
+		}
+		s.Value = ema
+	}
+	return series, nil
+}
+
+// Resample aligns each series to buckets of width step starting at multiples
+// of step since the Unix epoch. Each bucket is aggregated with agg and
+// timestamped with its start. Empty buckets between the first and last point
+// are NaN, or the value of the previous bucket if fill is "carry".
+func Resample(e *State, T miniprofiler.Timer, series *Results, step, agg, fill string) (*Results, error) {
+	d, f, carry, err := parseResample(step, agg, fill)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		s.Value = resample(s.Value.(Series), d, f, carry)
+	}
+	return series, nil
+}
+
+func resample(dps Series, d time.Duration, f func(Series, ...float64) float64, carry bool) Series {
+	buckets := make(map[time.Time]Series)
+	for t, v := range dps {
+		// Truncate would count from the zero time, not the Unix epoch.
+		off := time.Duration(t.UnixNano() % int64(d))
+		if off < 0 {
+			off += d
+		}
+		b := t.Add(-off)
+		if buckets[b] == nil {
+			buckets[b] = make(Series)
+		}
+		buckets[b][t] = v
+	}
+	var first, end time.Time
+	for b := range buckets {
+		if first.IsZero() || b.Before(first) {
+			first = b
+		}
+		if b.After(end) {
+			end = b
+		}
+	}
+	resampled := make(Series)
+	prev := math.NaN()
+	for b := first; len(buckets) > 0 && !b.After(end); b = b.Add(d) {
+		if dps := buckets[b]; dps != nil {
+			prev = f(dps)
+		} else if !carry {
+			prev = math.NaN()
+		}
+		resampled[b] = prev
+	}
+	return resampled
+}
+
+func parseGraphiteResponse(req *graphite.Request, s *graphite.Response, formatTags []string) ([]*Result, error) {
+	const parseErrFmt = "graphite ParseError (%s): %s"
+	if len(*s) == 0 {
+		return nil, fmt.Errorf(parseErrFmt, req.URL, "empty response")
+	}
+	seen := make(map[string]bool)
+	results := make([]*Result, 0)
+	for _, res := range *s {
+		// build tag set
+		tags := make(opentsdb.TagSet)
+		if len(formatTags) == 1 && formatTags[0] == "" {
+			tags["key"] = res.Target
+		} else {
+			nodes := strings.Split(res.Target, ".")
+			if len(nodes) < len(formatTags) {
+				msg := fmt.Sprintf("returned target '%s' does not match format '%s'", res.Target, strings.Join(formatTags, ","))
+				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+			}
+			for i, key := range formatTags {
+				if len(key) > 0 {
+					tags[key] = nodes[i]
+				}
+			}
+		}
+		if ts := tags.String(); !seen[ts] {
+			seen[ts] = true
+		} else {
+			return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("More than 1 series identified by tagset '%v'", ts))
+		}
+		// build data
+		dps := make(Series)
+		for _, dp := range res.Datapoints {
+			if len(dp) != 2 {
+				return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("Datapoint has != 2 fields: %v", dp))
+			}
+			if len(dp[0].String()) == 0 {
+				// none value. skip this record
+				continue
+			}
+			val, err := dp[0].Float64()
+			if err != nil {
+				msg := fmt.Sprintf("value '%s' cannot be decoded to Float64: %s", dp[0], err.Error())
+				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+			}
+			unixTS, err := dp[1].Int64()
+			if err != nil {
+				msg := fmt.Sprintf("timestamp '%s' cannot be decoded to Int64: %s", dp[1], err.Error())
+				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+			}
+			t := time.Unix(unixTS, 0)
+			dps[t] = val
+		}
+		results = append(results, &Result{
+			Value: dps,
+			Group: tags,
+		})
+	}
+	return results, nil
+}
+
+func GraphiteBand(e *State, T miniprofiler.Timer, query, duration, period, format string, num float64) (r *Results, err error) {
+	r = new(Results)
+	r.IgnoreOtherUnjoined = true
+	r.IgnoreUnjoined = true
+	T.Step("graphiteBand", func(T miniprofiler.Timer) {
+		var d, p opentsdb.Duration
+		d, err = opentsdb.ParseDuration(duration)
+		if err != nil {
+			return
+		}
+		p, err = opentsdb.ParseDuration(period)
+		if err != nil {
+			return
+		}
+		if num < 1 || num > 100 {
+			err = fmt.Errorf("expr: Band: num out of bounds")
+		}
+		req := &graphite.Request{
+			Targets: []string{query},
+		}
+		now := e.now
+		req.End = &now
 		st := e.now.Add(-time.Duration(d))
 		req.Start = &st
 		for i := 0; i < int(num); i++ {
@@ -529,6 +1249,10 @@ func GraphiteBand(e *State, T miniprofiler.Timer, query, duration, period, forma
 			if err != nil {
 				return
 			}
+			if s == nil {
+				// The request failed and partial results are allowed.
+				continue
+			}
 			formatTags := strings.Split(format, ".")
 			var results []*Result
 			results, err = parseGraphiteResponse(req, &s, formatTags)
@@ -566,7 +1290,9 @@ func GraphiteBand(e *State, T miniprofiler.Timer, query, duration, period, forma
 	return
 }
 
-func bandTSDB(e *State, T miniprofiler.Timer, query, duration, period string, num float64, rfunc func(*Results, *opentsdb.Response) error) (r *Results, err error) {
+// bandTSDB runs query num times over duration, each period further back, and
+// calls rfunc with each response and how far back its query was.
+func bandTSDB(e *State, T miniprofiler.Timer, query, duration, period string, num float64, rfunc func(*Results, *opentsdb.Response, time.Duration) error) (r *Results, err error) {
 	r = new(Results)
 	r.IgnoreOtherUnjoined = true
 	r.IgnoreUnjoined = true
@@ -613,7 +1339,7 @@ func bandTSDB(e *State, T miniprofiler.Timer, query, duration, period string, nu
 				if e.squelched(res.Tags) {
 					continue
 				}
-				if err = rfunc(r, res); err != nil {
+				if err = rfunc(r, res, e.now.Sub(now)); err != nil {
 					return
 				}
 			}
@@ -628,7 +1354,7 @@ func Window(e *State, T miniprofiler.Timer, query, duration, period string, num
 		return nil, fmt.Errorf("expr: Window: no %v function", rfunc)
 	}
 	windowFn := reflect.ValueOf(fn.F)
-	bandFn := func(results *Results, resp *opentsdb.Response) error {
+	bandFn := func(results *Results, resp *opentsdb.Response, offset time.Duration) error {
 		values := make(Series)
 		min := int64(math.MaxInt64)
 		for k, v := range resp.DPS {
@@ -699,7 +1425,7 @@ func windowCheck(t *parse.Tree, f *parse.FuncNode) error {
 }
 
 func Band(e *State, T miniprofiler.Timer, query, duration, period string, num float64) (r *Results, err error) {
-	r, err = bandTSDB(e, T, query, duration, period, num, func(r *Results, res *opentsdb.Response) error {
+	r, err = bandTSDB(e, T, query, duration, period, num, func(r *Results, res *opentsdb.Response, offset time.Duration) error {
 		newarr := true
 		for _, a := range r.Results {
 			if !a.Group.Equal(res.Tags) {
@@ -736,7 +1462,176 @@ func Band(e *State, T miniprofiler.Timer, query, duration, period string, num fl
 	return
 }
 
+// Baseline returns, for each group, the average of query over the num
+// previous periods, shifted forward to line up with the last duration. The
+// shifted points are grouped into buckets of the series' step, the smallest
+// interval between two of its points, so periods whose points do not share
+// timestamps are still averaged together. Buckets missing from some periods
+// are averaged over the periods that have them.
+func Baseline(e *State, T miniprofiler.Timer, query, duration, period string, num float64) (*Results, error) {
+	type sum struct {
+		group  opentsdb.TagSet
+		points SortableSeries
+		step   time.Duration
+	}
+	sums := make(map[string]*sum)
+	var order []string
+	r, err := bandTSDB(e, T, query, duration, period, num, func(r *Results, res *opentsdb.Response, offset time.Duration) error {
+		id := res.Tags.String()
+		s, ok := sums[id]
+		if !ok {
+			s = &sum{group: res.Tags}
+			sums[id] = s
+			order = append(order, id)
+		}
+		values := make(Series, len(res.DPS))
+		for k, v := range res.DPS {
+			i, err := strconv.ParseInt(k, 10, 64)
+			if err != nil {
+				return err
+			}
+			values[time.Unix(i, 0).UTC()] = float64(v)
+		}
+		sorted := NewSortedSeries(values)
+		for i, p := range sorted {
+			if i > 0 {
+				if d := p.T.Sub(sorted[i-1].T); s.step == 0 || d < s.step {
+					s.step = d
+				}
+			}
+			s.points = append(s.points, SortablePoint{p.T.Add(offset), p.V})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("expr: Baseline: %v", err)
+	}
+	end := e.now.UTC()
+	for _, id := range order {
+		s := sums[id]
+		values := make(Series)
+		counts := make(map[time.Time]int)
+		for _, p := range s.points {
+			// Buckets end at now, so the last one holds the most recent points.
+			b := p.T
+			if s.step > 0 {
+				b = end.Add(-end.Sub(p.T) / s.step * s.step)
+			}
+			values[b] += p.V
+			counts[b]++
+		}
+		for b, v := range values {
+			values[b] = v / float64(counts[b])
+		}
+		r.Results = append(r.Results, &Result{Group: s.group, Value: values})
+	}
+	return r, nil
+}
+
+// periodTag is the tag periods uses to mark which range a series is from.
+const periodTag = "period"
+
+// Periods returns query over the last duration, tagged period=current, and
+// over the duration ending offset earlier, tagged period=previous. The
+// previous series are shifted forward by offset to line up with the current
+// ones.
+func Periods(e *State, T miniprofiler.Timer, query, duration, offset string) (r *Results, err error) {
+	q, err := opentsdb.ParseQuery(query)
+	if q == nil && err != nil {
+		return nil, err
+	}
+	if _, ok := q.Tags[periodTag]; ok {
+		return nil, fmt.Errorf("expr: Periods: query must not use the %s tag", periodTag)
+	}
+	if err = e.Search.Expand(q); err != nil {
+		return nil, err
+	}
+	d, err := opentsdb.ParseDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+	o, err := opentsdb.ParseDuration(offset)
+	if err != nil {
+		return nil, err
+	}
+	if o <= 0 {
+		return nil, fmt.Errorf("expr: Periods: offset must be positive")
+	}
+	r = new(Results)
+	for _, p := range []struct {
+		name  string
+		shift time.Duration
+	}{
+		{"current", 0},
+		{"previous", time.Duration(o)},
+	} {
+		end := e.now.Add(-p.shift)
+		req := opentsdb.Request{
+			Queries: []*opentsdb.Query{q},
+			Start:   end.Add(-time.Duration(d)).Unix(),
+			End:     end.Unix(),
+		}
+		s, err := timeTSDBRequest(e, T, &req)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range s {
+			if e.squelched(res.Tags) {
+				continue
+			}
+			values := make(Series)
+			for k, v := range res.DPS {
+				i, err := strconv.ParseInt(k, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				values[time.Unix(i, 0).Add(p.shift).UTC()] = float64(v)
+			}
+			r.Results = append(r.Results, &Result{
+				Value: values,
+				Group: res.Tags.Copy().Merge(opentsdb.TagSet{periodTag: p.name}),
+			})
+		}
+	}
+	return r, nil
+}
+
 func GraphiteQuery(e *State, T miniprofiler.Timer, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, T, query, sduration, eduration, format, 0, "")
+}
+
+// graphiteConsolidateFuncs maps the consolidation functions accepted by
+// graphiteConsolidate to their names in Graphite.
+var graphiteConsolidateFuncs = map[string]string{
+	"avg": "average",
+	"max": "max",
+	"min": "min",
+	"sum": "sum",
+}
+
+func graphiteConsolidateCheck(t *parse.Tree, f *parse.FuncNode) error {
+	if n, ok := f.Args[5].(*parse.StringNode); ok {
+		if _, ok := graphiteConsolidateFuncs[n.Text]; !ok {
+			return fmt.Errorf("graphiteConsolidate: unknown consolidation function %q, must be avg, max, min or sum", n.Text)
+		}
+	}
+	return nil
+}
+
+// GraphiteConsolidate is GraphiteQuery with the series consolidated by
+// Graphite to at most maxDataPoints points each using consolidateBy.
+func GraphiteConsolidate(e *State, T miniprofiler.Timer, query string, sduration, eduration, format string, maxDataPoints float64, consolidateBy string) (r *Results, err error) {
+	if maxDataPoints < 1 {
+		return nil, fmt.Errorf("graphiteConsolidate: maxDataPoints must be at least 1")
+	}
+	fn, ok := graphiteConsolidateFuncs[consolidateBy]
+	if !ok {
+		return nil, fmt.Errorf("graphiteConsolidate: unknown consolidation function %q", consolidateBy)
+	}
+	return graphiteQuery(e, T, query, sduration, eduration, format, int(maxDataPoints), fn)
+}
+
+func graphiteQuery(e *State, T miniprofiler.Timer, query string, sduration, eduration, format string, maxDataPoints int, consolidateBy string) (r *Results, err error) {
 	sd, err := opentsdb.ParseDuration(sduration)
 	if err != nil {
 		return
@@ -751,14 +1646,20 @@ func GraphiteQuery(e *State, T miniprofiler.Timer, query string, sduration, edur
 	st := e.now.Add(-time.Duration(sd))
 	et := e.now.Add(-time.Duration(ed))
 	req := &graphite.Request{
-		Targets: []string{query},
-		Start:   &st,
-		End:     &et,
+		Targets:       []string{query},
+		Start:         &st,
+		End:           &et,
+		MaxDataPoints: maxDataPoints,
+		ConsolidateBy: consolidateBy,
 	}
 	s, err := timeGraphiteRequest(e, T, req)
 	if err != nil {
 		return nil, err
 	}
+	if s == nil {
+		// The request failed and partial results are allowed.
+		return new(Results), nil
+	}
 	formatTags := strings.Split(format, ".")
 	r = new(Results)
 	results, err := parseGraphiteResponse(req, &s, formatTags)
@@ -834,24 +1735,52 @@ func Query(e *State, T miniprofiler.Timer, query, sduration, eduration string) (
 	return
 }
 
+// timeGraphiteRequest runs req through the cache. If it fails and partial
+// results are allowed, it returns a nil response and a nil error.
 func timeGraphiteRequest(e *State, T miniprofiler.Timer, req *graphite.Request) (resp graphite.Response, err error) {
+	if req.Start != nil && req.End != nil {
+		if err := e.checkQueryRange(req.End.Sub(*req.Start)); err != nil {
+			return nil, err
+		}
+	}
 	e.graphiteQueries = append(e.graphiteQueries, *req)
 	b, _ := json.MarshalIndent(req, "", "  ")
 	T.StepCustomTiming("graphite", "query", string(b), func() {
 		key := req.CacheKey()
+		ctx := e.graphiteContext
 		getFn := func() (interface{}, error) {
-			return e.graphiteContext.Query(req)
+			return e.untilDeadline(func() (interface{}, error) {
+				return ctx.Query(req)
+			})
 		}
 		var val interface{}
 		val, err = e.cache.Get(key, getFn)
-		resp = val.(graphite.Response)
+		resp, _ = val.(graphite.Response)
 	})
+	if err != nil {
+		err = e.queryFailed(strings.Join(req.Targets, ","), err)
+	}
 	return
 }
 
 const tsdbMaxTries = 3
 
+// checkQueryRange returns an error if d is longer than the maximum query range.
+func (e *State) checkQueryRange(d time.Duration) error {
+	if e.maxQueryRange > 0 && d > e.maxQueryRange {
+		return fmt.Errorf("query range %v exceeds maxQueryRange of %v", d, e.maxQueryRange)
+	}
+	return nil
+}
+
 func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s opentsdb.ResponseSet, err error) {
+	d, err := opentsdb.GetDuration(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkQueryRange(time.Duration(d)); err != nil {
+		return nil, err
+	}
 	e.tsdbQueries = append(e.tsdbQueries, *req)
 	if e.autods > 0 {
 		for _, q := range req.Queries {
@@ -866,23 +1795,78 @@ func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s o
 	tries := 1
 	for {
 		T.StepCustomTiming("tsdb", "query", string(b), func() {
+			ctx := e.tsdbContext
 			getFn := func() (interface{}, error) {
-				return e.tsdbContext.Query(req)
+				return e.untilDeadline(func() (interface{}, error) {
+					return ctx.Query(req)
+				})
 			}
 			var val interface{}
 			val, err = e.cache.Get(string(b), getFn)
-			s = val.(opentsdb.ResponseSet).Copy()
+			if rs, ok := val.(opentsdb.ResponseSet); ok {
+				s = rs.Copy()
+			}
 
 		})
-		if err == nil || tries == tsdbMaxTries {
+		if err == nil || err == ErrDeadline || tries == tsdbMaxTries {
+			break
+		}
+		if _, ok := err.(*BreakerOpenError); ok {
 			break
 		}
 		slog.Errorf("Error on tsdb query %d: %s", tries, err.Error())
 		tries++
 	}
+	if err != nil {
+		var queries []string
+		for _, q := range req.Queries {
+			queries = append(queries, q.String())
+		}
+		err = e.queryFailed(strings.Join(queries, ","), err)
+	}
 	return
 }
 
+// untilDeadline returns the result of query, or ErrDeadline if the state's
+// deadline passes first. A query still running then is abandoned, so it must
+// not use the state.
+func (e *State) untilDeadline(query func() (interface{}, error)) (interface{}, error) {
+	if e.deadline.IsZero() {
+		return query()
+	}
+	wait := e.deadline.Sub(time.Now())
+	if wait <= 0 {
+		return nil, ErrDeadline
+	}
+	type result struct {
+		v   interface{}
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := query()
+		ch <- result{v, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-time.After(wait):
+		return nil, ErrDeadline
+	}
+}
+
+// queryFailed returns err, or records the failed query and returns nil if
+// partial results are allowed. Queries skipped by an open circuit breaker
+// always fail, since none of the datasource's queries can succeed.
+func (e *State) queryFailed(query string, err error) error {
+	if _, ok := err.(*BreakerOpenError); ok || !e.partialResults {
+		return err
+	}
+	slog.Warningf("partial results without query %s: %v", query, err)
+	e.failedQueries = append(e.failedQueries, fmt.Sprintf("%s: %v", query, err))
+	return nil
+}
+
 func Change(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
 	r = new(Results)
 	sd, err := opentsdb.ParseDuration(sduration)
@@ -954,78 +1938,331 @@ func reduce(e *State, T miniprofiler.Timer, series *Results, F func(Series, ...f
 		res.Results = append(res.Results, s)
 		return nil
 	}
-	return match(f, series, args...)
-}
-
-func Abs(e *State, T miniprofiler.Timer, series *Results) *Results {
-	for _, s := range series.Results {
-		s.Value = Number(math.Abs(float64(s.Value.Value().(Number))))
+	return match(f, series, args...)
+}
+
+func Abs(e *State, T miniprofiler.Timer, series *Results) *Results {
+	for _, s := range series.Results {
+		s.Value = Number(math.Abs(float64(s.Value.Value().(Number))))
+	}
+	return series
+}
+
+func Diff(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, diff)
+}
+
+func diff(dps Series, args ...float64) float64 {
+	return last(dps) - first(dps)
+}
+
+func Avg(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, avg)
+}
+
+// avg returns the mean of x.
+func avg(dps Series, args ...float64) (a float64) {
+	for _, v := range dps {
+		a += float64(v)
+	}
+	a /= float64(len(dps))
+	return
+}
+
+func CCount(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, cCount)
+}
+
+func cCount(dps Series, args ...float64) (a float64) {
+	if len(dps) < 2 {
+		return float64(0)
+	}
+	series := NewSortedSeries(dps)
+	count := 0
+	last := series[0].V
+	for _, p := range series[1:] {
+		if p.V != last {
+			count++
+		}
+		last = p.V
+	}
+	return float64(count)
+}
+
+func Count(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
+	r, err = Query(e, T, query, sduration, eduration)
+	if err != nil {
+		return
+	}
+	return &Results{
+		Results: []*Result{
+			{Value: Scalar(len(r.Results))},
+		},
+	}, nil
+}
+
+func Sum(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, sum)
+}
+
+func sum(dps Series, args ...float64) (a float64) {
+	for _, v := range dps {
+		a += float64(v)
+	}
+	return
+}
+
+// BurnRate computes how quickly an SLO error budget is being consumed: the
+// ratio of the observed error rate (1 - good/total) to the allowed error
+// rate (1 - target). Groups with no total events are NaN.
+func BurnRate(e *State, T miniprofiler.Timer, good, total *Results, target float64) (*Results, error) {
+	if target <= 0 || target >= 1 {
+		return nil, fmt.Errorf("burnRate: target must be between 0 and 1, got %v", target)
+	}
+	var r Results
+	for _, u := range e.union(good, total, "burnRate") {
+		res := &Result{
+			Group:        u.Group,
+			Value:        Number(math.NaN()),
+			Computations: u.Computations,
+		}
+		r.Results = append(r.Results, res)
+		g, ok := u.A.(Series)
+		if !ok {
+			continue
+		}
+		t, ok := u.B.(Series)
+		if !ok {
+			continue
+		}
+		gs, ts := sum(g), sum(t)
+		if ts == 0 {
+			continue
+		}
+		res.Value = Number((1 - gs/ts) / (1 - target))
+	}
+	return &r, nil
+}
+
+// Correlate computes the Pearson correlation coefficient of each pair of
+// joined series over the window before now. The series are first averaged
+// into intervals of the larger of their median sampling intervals, so points
+// taken at different times can be paired. Groups with fewer than two paired
+// points or with a constant series are NaN.
+func Correlate(e *State, T miniprofiler.Timer, a, b *Results, window string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("correlate: window must be positive")
+	}
+	start := e.now.Add(-time.Duration(d))
+	var r Results
+	for _, u := range e.union(a, b, "correlate") {
+		res := &Result{
+			Group:        u.Group,
+			Value:        Number(math.NaN()),
+			Computations: u.Computations,
+		}
+		r.Results = append(r.Results, res)
+		x, ok := u.A.(Series)
+		if !ok {
+			continue
+		}
+		y, ok := u.B.(Series)
+		if !ok {
+			continue
+		}
+		res.Value = Number(correlate(x, y, start))
+	}
+	return &r, nil
+}
+
+func correlate(x, y Series, start time.Time) float64 {
+	within := func(dps Series) Series {
+		w := make(Series)
+		for t, v := range dps {
+			if !t.Before(start) {
+				w[t] = v
+			}
+		}
+		return w
+	}
+	x, y = within(x), within(y)
+	step := medianInterval(x)
+	if s := medianInterval(y); s > step {
+		step = s
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	x, y = resample(x, step, avg, false), resample(y, step, avg, false)
+	var xs, ys []float64
+	for t, xv := range x {
+		yv, ok := y[t]
+		if !ok || math.IsNaN(xv) || math.IsNaN(yv) {
+			continue
+		}
+		xs = append(xs, xv)
+		ys = append(ys, yv)
+	}
+	if len(xs) < 2 {
+		return math.NaN()
+	}
+	var xm, ym float64
+	for i := range xs {
+		xm += xs[i]
+		ym += ys[i]
 	}
-	return series
-}
-
-func Diff(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
-	return reduce(e, T, series, diff)
+	xm /= float64(len(xs))
+	ym /= float64(len(ys))
+	var cov, xvar, yvar float64
+	for i := range xs {
+		dx, dy := xs[i]-xm, ys[i]-ym
+		cov += dx * dy
+		xvar += dx * dx
+		yvar += dy * dy
+	}
+	if xvar == 0 || yvar == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(xvar*yvar)
 }
 
-func diff(dps Series, args ...float64) float64 {
-	return last(dps) - first(dps)
-}
+// histogramTag is the tag histogram uses to mark which bucket a count is for.
+const histogramTag = "bucket"
 
-func Avg(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, avg)
+func tagHistogram(args []parse.Node) (parse.Tags, error) {
+	tags, err := tagFirst(args)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tags[histogramTag]; ok {
+		return nil, fmt.Errorf("histogram: series must not have the %s tag", histogramTag)
+	}
+	tags[histogramTag] = struct{}{}
+	return tags, nil
 }
 
-// avg returns the mean of x.
-func avg(dps Series, args ...float64) (a float64) {
-	for _, v := range dps {
-		a += float64(v)
+func parseHistogramBounds(bounds string) ([]float64, error) {
+	var b []float64
+	for _, f := range strings.Split(bounds, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("histogram: bad bucket bound %q", f)
+		}
+		if len(b) > 0 && v <= b[len(b)-1] {
+			return nil, fmt.Errorf("histogram: bucket bounds must be increasing")
+		}
+		b = append(b, v)
 	}
-	a /= float64(len(dps))
-	return
+	return b, nil
 }
 
-func CCount(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, cCount)
+func histogramCheck(t *parse.Tree, f *parse.FuncNode) error {
+	n, ok := f.Args[1].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	_, err := parseHistogramBounds(n.Text)
+	return err
 }
 
-func cCount(dps Series, args ...float64) (a float64) {
-	if len(dps) < 2 {
-		return float64(0)
+// Histogram counts the points of each series falling in each of the buckets
+// between the comma separated, increasing bounds. A bucket holds values from
+// its lower bound up to but not including its upper bound, and is tagged
+// lower_upper, such as 0_10. Values below the first bound or at or above the
+// last go in the -inf and inf overflow buckets. NaN values are not counted.
+func Histogram(e *State, T miniprofiler.Timer, series *Results, bounds string) (*Results, error) {
+	b, err := parseHistogramBounds(bounds)
+	if err != nil {
+		return nil, err
 	}
-	series := NewSortedSeries(dps)
-	count := 0
-	last := series[0].V
-	for _, p := range series[1:] {
-		if p.V != last {
-			count++
+	names := make([]string, len(b)+1)
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for i := range names {
+		lower, upper := "-inf", "inf"
+		if i > 0 {
+			lower = format(b[i-1])
 		}
-		last = p.V
+		if i < len(b) {
+			upper = format(b[i])
+		}
+		names[i] = lower + "_" + upper
 	}
-	return float64(count)
+	r := *series
+	r.Results = nil
+	for _, res := range series.Results {
+		counts := make([]int, len(names))
+		for _, v := range res.Value.(Series) {
+			if math.IsNaN(v) {
+				continue
+			}
+			counts[sort.Search(len(b), func(i int) bool { return b[i] > v })]++
+		}
+		for i, name := range names {
+			group := res.Group.Copy()
+			group[histogramTag] = name
+			r.Results = append(r.Results, &Result{
+				Group:        group,
+				Value:        Number(counts[i]),
+				Computations: res.Computations,
+			})
+		}
+	}
+	return &r, nil
 }
 
-func Count(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
-	r, err = Query(e, T, query, sduration, eduration)
-	if err != nil {
-		return
+func matchCheck(t *parse.Tree, f *parse.FuncNode) error {
+	n, ok := f.Args[1].(*parse.StringNode)
+	if !ok {
+		return nil
 	}
-	return &Results{
-		Results: []*Result{
-			{Value: Scalar(len(r.Results))},
-		},
-	}, nil
+	_, err := regexp.Compile(n.Text)
+	return err
 }
 
-func Sum(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, sum)
+// Match converts string series to numeric series, with each value 1 if it
+// matches the regular expression pattern and 0 if not.
+func Match(e *State, T miniprofiler.Timer, series *Results, pattern string) (*Results, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range series.Results {
+		ss, ok := res.Value.(StringSeries)
+		if !ok {
+			return nil, fmt.Errorf("match: expected string series, got %v", res.Value.Type())
+		}
+		values := make(Series, len(ss))
+		for t, v := range ss {
+			if re.MatchString(v) {
+				values[t] = 1
+			} else {
+				values[t] = 0
+			}
+		}
+		res.Value = values
+	}
+	return series, nil
 }
 
-func sum(dps Series, args ...float64) (a float64) {
-	for _, v := range dps {
-		a += float64(v)
+// medianInterval returns the median time between consecutive points of dps,
+// or 0 if it has fewer than two points.
+func medianInterval(dps Series) time.Duration {
+	sorted := NewSortedSeries(dps)
+	if len(sorted) < 2 {
+		return 0
 	}
-	return
+	intervals := make([]float64, len(sorted)-1)
+	for i := 1; i < len(sorted); i++ {
+		intervals[i-1] = float64(sorted[i].T.Sub(sorted[i-1].T))
+	}
+	sort.Float64s(intervals)
+	return time.Duration(intervals[len(intervals)/2])
 }
 
 func Des(e *State, T miniprofiler.Timer, series *Results, alpha float64, beta float64) *Results {
@@ -1076,6 +2313,246 @@ func streak(dps Series, args ...float64) (a float64) {
 	return float64(longest)
 }
 
+func availabilityCheck(t *parse.Tree, f *parse.FuncNode) error {
+	if n, ok := f.Args[2].(*parse.StringNode); ok && n.Text != "down" && n.Text != "ignore" {
+		return fmt.Errorf("availability: gaps must be down or ignore, got %q", n.Text)
+	}
+	return nil
+}
+
+// Availability returns the fraction of time each series was non-zero,
+// weighting each value by how long it held.
+func Availability(e *State, T miniprofiler.Timer, series *Results, maxGap, gaps string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(maxGap)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("availability: maxGap must be positive")
+	}
+	if gaps != "down" && gaps != "ignore" {
+		return nil, fmt.Errorf("availability: gaps must be down or ignore, got %q", gaps)
+	}
+	var gapsDown float64
+	if gaps == "down" {
+		gapsDown = 1
+	}
+	return reduce(e, T, series, availability, fromScalar(d.Seconds()), fromScalar(gapsDown))
+}
+
+// availability returns the fraction of time dps was non-zero. Each point holds
+// until the next one. Only the first args[0] seconds of an interval are
+// credited to its point, the rest is a gap that counts as down if args[1] is
+// non-zero, or is left out otherwise. The last point ends the window.
+func availability(dps Series, args ...float64) float64 {
+	maxGap, gapsDown := args[0], args[1] != 0
+	series := NewSortedSeries(dps)
+	var up, total float64
+	for i := 0; i+1 < len(series); i++ {
+		held := series[i+1].T.Sub(series[i].T).Seconds()
+		if held > maxGap {
+			if gapsDown {
+				total += held - maxGap
+			}
+			held = maxGap
+		}
+		if series[i].V != 0 {
+			up += held
+		}
+		total += held
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	return up / total
+}
+
+// Edges returns the number of times each series changed between zero and
+// non-zero within window of the query time.
+func Edges(e *State, T miniprofiler.Timer, series *Results, window string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("edges: window must be positive")
+	}
+	start := e.now.Add(-time.Duration(d))
+	return reduce(e, T, series, edges, fromScalar(float64(start.Unix())))
+}
+
+// edges counts the transitions between zero and non-zero values of the
+// points of dps at or after the Unix time args[0]. A NaN point breaks the
+// run: a change across it is not counted, since what happened in the gap is
+// unknown.
+func edges(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	var n float64
+	var prev, seen bool
+	for _, p := range NewSortedSeries(dps) {
+		if p.T.Before(start) {
+			continue
+		}
+		if math.IsNaN(p.V) {
+			seen = false
+			continue
+		}
+		cur := p.V != 0
+		if seen && cur != prev {
+			n++
+		}
+		prev, seen = cur, true
+	}
+	return n
+}
+
+// Resets returns the number of times each counter series was reset within
+// window of the query time.
+func Resets(e *State, T miniprofiler.Timer, series *Results, window string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("resets: window must be positive")
+	}
+	start := e.now.Add(-time.Duration(d))
+	return reduce(e, T, series, resets, fromScalar(float64(start.Unix())))
+}
+
+// resets counts the points of dps at or after the Unix time args[0] that are
+// lower than the point before them. NaN points are skipped, so a value after
+// a gap is compared to the last one before it.
+func resets(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	var n, prev float64
+	seen := false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if !p.T.Before(start) && seen && p.V < prev {
+			n++
+		}
+		prev, seen = p.V, true
+	}
+	return n
+}
+
+// Integral returns the area under each series within window of the query
+// time, with time in seconds.
+func Integral(e *State, T miniprofiler.Timer, series *Results, window string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("integral: window must be positive")
+	}
+	start := e.now.Add(-time.Duration(d))
+	return reduce(e, T, series, integral, fromScalar(float64(start.Unix())))
+}
+
+// integral sums the trapezoids between consecutive points of dps at or after
+// the Unix time args[0], each as wide as the seconds between its points. A
+// NaN point breaks the series into segments: the interval on either side of
+// it is left out.
+func integral(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	var a float64
+	var prev SortablePoint
+	seen := false
+	for _, p := range NewSortedSeries(dps) {
+		if p.T.Before(start) {
+			continue
+		}
+		if math.IsNaN(p.V) {
+			seen = false
+			continue
+		}
+		if seen {
+			a += (prev.V + p.V) / 2 * p.T.Sub(prev.T).Seconds()
+		}
+		prev, seen = p, true
+	}
+	return a
+}
+
+func timeThresholdCheck(t *parse.Tree, f *parse.FuncNode) error {
+	if n, ok := f.Args[4].(*parse.StringNode); ok && n.Text != "count" && n.Text != "ignore" {
+		return fmt.Errorf("%s: gaps must be count or ignore, got %q", f.Name, n.Text)
+	}
+	return nil
+}
+
+// TimeAbove returns the number of seconds within window of the query time
+// that each series was above threshold.
+func TimeAbove(e *State, T miniprofiler.Timer, series *Results, threshold float64, window, maxGap, gaps string) (*Results, error) {
+	return timeThreshold(e, T, "timeabove", series, threshold, 1, window, maxGap, gaps)
+}
+
+// TimeBelow returns the number of seconds within window of the query time
+// that each series was below threshold.
+func TimeBelow(e *State, T miniprofiler.Timer, series *Results, threshold float64, window, maxGap, gaps string) (*Results, error) {
+	return timeThreshold(e, T, "timebelow", series, threshold, -1, window, maxGap, gaps)
+}
+
+// timeThreshold implements timeabove for a sign of 1 and timebelow for -1.
+func timeThreshold(e *State, T miniprofiler.Timer, name string, series *Results, threshold, sign float64, window, maxGap, gaps string) (*Results, error) {
+	w, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if w <= 0 {
+		return nil, fmt.Errorf("%s: window must be positive", name)
+	}
+	g, err := opentsdb.ParseDuration(maxGap)
+	if err != nil {
+		return nil, err
+	}
+	if g <= 0 {
+		return nil, fmt.Errorf("%s: maxGap must be positive", name)
+	}
+	if gaps != "count" && gaps != "ignore" {
+		return nil, fmt.Errorf("%s: gaps must be count or ignore, got %q", name, gaps)
+	}
+	var gapsCount float64
+	if gaps == "count" {
+		gapsCount = 1
+	}
+	start := e.now.Add(-time.Duration(w))
+	return reduce(e, T, series, timeBeyond, fromScalar(float64(start.Unix())), fromScalar(threshold), fromScalar(sign), fromScalar(g.Seconds()), fromScalar(gapsCount))
+}
+
+// timeBeyond returns the seconds that the points of dps at or after the Unix
+// time args[0] were beyond the threshold args[1]: above it if args[2] is 1,
+// below it if -1. Each point holds until the next one, and the last point
+// ends the window. Only the first args[3] seconds of an interval are credited
+// to its point, unless args[4] is non-zero to count gaps too. NaN points are
+// neither above nor below.
+func timeBeyond(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	threshold, sign, maxGap, gapsCount := args[1], args[2], args[3], args[4] != 0
+	var series SortableSeries
+	for _, p := range NewSortedSeries(dps) {
+		if !p.T.Before(start) {
+			series = append(series, p)
+		}
+	}
+	var beyond float64
+	for i := 0; i+1 < len(series); i++ {
+		if !(sign*(series[i].V-threshold) > 0) {
+			continue
+		}
+		held := series[i+1].T.Sub(series[i].T).Seconds()
+		if held > maxGap && !gapsCount {
+			held = maxGap
+		}
+		beyond += held
+	}
+	return beyond
+}
+
 func Dev(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
 	return reduce(e, T, series, dev)
 }
@@ -1147,6 +2624,39 @@ func (e *State) since(dps Series, args ...float64) (a float64) {
 	return s.Seconds()
 }
 
+// PctChange returns, for each series, the percentage change from the value
+// window before the latest point to the latest point. It is NaN when the
+// series does not reach back window or the baseline value is zero.
+func PctChange(e *State, T miniprofiler.Timer, series *Results, window string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, T, series, func(dps Series, args ...float64) float64 {
+		return pctChange(dps, time.Duration(d))
+	})
+}
+
+func pctChange(dps Series, window time.Duration) float64 {
+	var lastT, baseT time.Time
+	var lastV, baseV float64
+	for k, v := range dps {
+		if k.After(lastT) {
+			lastT, lastV = k, v
+		}
+	}
+	cutoff := lastT.Add(-window)
+	for k, v := range dps {
+		if !k.After(cutoff) && k.After(baseT) {
+			baseT, baseV = k, v
+		}
+	}
+	if baseT.IsZero() || baseV == 0 {
+		return math.NaN()
+	}
+	return (lastV - baseV) / math.Abs(baseV) * 100
+}
+
 func Forecast_lr(e *State, T miniprofiler.Timer, series *Results, y *Results) (r *Results, err error) {
 	return reduce(e, T, series, e.forecast_lr, y)
 }
@@ -1243,6 +2753,60 @@ func Rename(e *State, T miniprofiler.Timer, series *Results, s string) (*Results
 	return series, nil
 }
 
+// DropTag removes the comma-separated tag keys from each result. It is an
+// error if two results end up with the same group.
+func DropTag(e *State, T miniprofiler.Timer, series *Results, s string) (*Results, error) {
+	keys := strings.Split(s, ",")
+	seen := make(map[string]bool)
+	for _, res := range series.Results {
+		g := res.Group.Copy()
+		for _, k := range keys {
+			delete(g, k)
+		}
+		if seen[g.String()] {
+			return nil, fmt.Errorf("droptag: multiple results with group %s", g)
+		}
+		seen[g.String()] = true
+		res.Group = g
+	}
+	return series, nil
+}
+
+func deriveTagCheck(t *parse.Tree, f *parse.FuncNode) error {
+	re, ok := f.Args[3].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	r, err := regexp.Compile(re.Text)
+	if err != nil {
+		return fmt.Errorf("derivetag: %v", err)
+	}
+	if r.NumSubexp() < 1 {
+		return fmt.Errorf("derivetag: regular expression must have a capture group")
+	}
+	return nil
+}
+
+// DeriveTag adds the tag newKey to each result, with its value taken from the
+// first capture group of re matched against the value of the tag srcKey.
+func DeriveTag(e *State, T miniprofiler.Timer, series *Results, newKey, srcKey, re string) (*Results, error) {
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return nil, fmt.Errorf("derivetag: %v", err)
+	}
+	for _, res := range series.Results {
+		if _, ok := res.Group[newKey]; ok {
+			return nil, fmt.Errorf("derivetag: %s already in group", newKey)
+		}
+		m := r.FindStringSubmatch(res.Group[srcKey])
+		if len(m) < 2 || m[1] == "" {
+			return nil, fmt.Errorf("derivetag: %s value %q of %s does not match %s", srcKey, res.Group[srcKey], res.Group, re)
+		}
+		res.Group = res.Group.Copy().Merge(opentsdb.TagSet{newKey: m[1]})
+	}
+	return series, nil
+}
+
 func Ungroup(e *State, T miniprofiler.Timer, d *Results) (*Results, error) {
 	if len(d.Results) != 1 {
 		return nil, fmt.Errorf("ungroup: requires exactly one group")
@@ -1251,6 +2815,146 @@ func Ungroup(e *State, T miniprofiler.Timer, d *Results) (*Results, error) {
 	return d, nil
 }
 
+// WeightedAvg averages the values of all groups in values, each weighted by
+// the value of the group with the same tags in weights. Values without a
+// matching weight are left out.
+func WeightedAvg(e *State, T miniprofiler.Timer, values, weights *Results) (*Results, error) {
+	r := &Result{Group: make(opentsdb.TagSet)}
+	var sum, total float64
+	for _, v := range values.Results {
+		var w *Result
+		for _, c := range weights.Results {
+			if c.Group.Equal(v.Group) {
+				w = c
+				break
+			}
+		}
+		if w == nil {
+			e.AddComputation(r, fmt.Sprintf("wavg: no weight for %s, dropped", v.Group), v.Value)
+			continue
+		}
+		vn, wn := float64(v.Value.(Number)), float64(w.Value.(Number))
+		sum += vn * wn
+		total += wn
+		e.AddComputation(r, fmt.Sprintf("wavg: %s weight", v.Group), w.Value)
+	}
+	if total == 0 {
+		r.Value = Number(math.NaN())
+	} else {
+		r.Value = Number(sum / total)
+	}
+	return &Results{Results: ResultSlice{r}}, nil
+}
+
+// If returns, for each element of cond, the value of the joined element of
+// then if cond is non-zero, and of els otherwise. Elements are joined by tags
+// as by binary operators. Elements of cond that do not join with both then and
+// els are NaN, or are dropped if unjoined groups are allowed.
+func If(e *State, T miniprofiler.Timer, cond, then, els *Results) (*Results, error) {
+	number := func(v Value) float64 {
+		switch v := v.(type) {
+		case Number:
+			return float64(v)
+		case Scalar:
+			return float64(v)
+		}
+		panic(ErrUnknownOp)
+	}
+	res := new(Results)
+	for _, c := range cond.Results {
+		joined := false
+		for _, t := range then.Results {
+			tg, ok := joinGroup(c.Group, t.Group)
+			if !ok {
+				continue
+			}
+			for _, f := range els.Results {
+				g, ok := joinGroup(tg, f.Group)
+				if !ok {
+					continue
+				}
+				joined = true
+				r := &Result{Group: g}
+				v := t.Value
+				if number(c.Value) == 0 {
+					v = f.Value
+				}
+				r.Value = Number(number(v))
+				e.AddComputation(r, "if", r.Value)
+				res.Results = append(res.Results, r)
+			}
+		}
+		if !joined && !e.unjoinedOk {
+			r := &Result{Group: c.Group, Value: Number(math.NaN())}
+			e.AddComputation(r, "if", fmt.Sprintf("unjoined group (%v)", c.Group))
+			res.Results = append(res.Results, r)
+		}
+	}
+	return res, nil
+}
+
+// mergeCheck rejects sets whose tag keys differ when parsing, rather than
+// only when merge is the operand of another node.
+func mergeCheck(t *parse.Tree, f *parse.FuncNode) error {
+	_, err := f.Tags()
+	return err
+}
+
+// Merge returns the elements of a and of b, which must not share a group.
+func Merge(e *State, T miniprofiler.Timer, a, b *Results) (*Results, error) {
+	seen := make(map[string]bool)
+	res := new(Results)
+	for _, r := range append(a.Results, b.Results...) {
+		id := r.Group.String()
+		if seen[id] {
+			return nil, fmt.Errorf("merge: %s in both sets", r.Group)
+		}
+		seen[id] = true
+		res.Results = append(res.Results, r)
+	}
+	return res, nil
+}
+
+// Join returns, for each element of a, the value of the element of b whose
+// tags match it on keys, grouped with a's tags. It is an error for more than
+// one element of b to match. Elements of a with no match are dropped.
+func Join(e *State, T miniprofiler.Timer, a, b *Results, keys string) (*Results, error) {
+	var ks []string
+	for _, k := range strings.Split(keys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			ks = append(ks, k)
+		}
+	}
+	byKey := make(map[string]*Result)
+	for _, r := range b.Results {
+		ts := make(opentsdb.TagSet)
+		for _, k := range ks {
+			ts[k] = r.Group[k]
+		}
+		id := ts.String()
+		if prev, ok := byKey[id]; ok {
+			return nil, fmt.Errorf("join: %s and %s both match %s", prev.Group, r.Group, id)
+		}
+		byKey[id] = r
+	}
+	res := new(Results)
+	for _, r := range a.Results {
+		ts := make(opentsdb.TagSet)
+		for _, k := range ks {
+			ts[k] = r.Group[k]
+		}
+		m, ok := byKey[ts.String()]
+		if !ok {
+			e.AddComputation(r, fmt.Sprintf("join: no match for %s, dropped", r.Group), r.Value)
+			continue
+		}
+		j := &Result{Group: r.Group, Value: m.Value}
+		e.AddComputation(j, fmt.Sprintf("join: %s", m.Group), m.Value)
+		res.Results = append(res.Results, j)
+	}
+	return res, nil
+}
+
 func Transpose(e *State, T miniprofiler.Timer, d *Results, gp string) (*Results, error) {
 	gps := strings.Split(gp, ",")
 	m := make(map[string]*Result)
@@ -22,6 +22,12 @@ var Influx = map[string]parse.Func{
 		Tags:   influxTag,
 		F:      InfluxQuery,
 	},
+	"influxString": {
+		Args:   []parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString},
+		Return: parse.TypeStringSeriesSet,
+		Tags:   influxTag,
+		F:      InfluxStringQuery,
+	},
 }
 
 func influxTag(args []parse.Node) (parse.Tags, error) {
@@ -60,14 +66,7 @@ func InfluxQuery(e *State, T miniprofiler.Timer, db, query, startDuration, endDu
 		}
 		values := make(Series, len(row.Values))
 		for _, v := range row.Values {
-			if len(v) != 2 {
-				return nil, fmt.Errorf("influx: expected exactly one result column")
-			}
-			ts, ok := v[0].(string)
-			if !ok {
-				return nil, fmt.Errorf("influx: expected time string column")
-			}
-			t, err := time.Parse(time.RFC3339, ts)
+			t, err := influxTime(v)
 			if err != nil {
 				return nil, err
 			}
@@ -90,6 +89,54 @@ func InfluxQuery(e *State, T miniprofiler.Timer, db, query, startDuration, endDu
 	return r, nil
 }
 
+// InfluxStringQuery is like InfluxQuery, but for queries of a field holding
+// text, such as the state of a status check.
+func InfluxStringQuery(e *State, T miniprofiler.Timer, db, query, startDuration, endDuration, groupByInterval string) (*Results, error) {
+	qres, err := timeInfluxRequest(e, T, db, query, startDuration, endDuration, groupByInterval)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Results)
+	for _, row := range qres {
+		tags := opentsdb.TagSet(row.Tags)
+		if e.squelched(tags) {
+			continue
+		}
+		if len(row.Columns) != 2 {
+			return nil, fmt.Errorf("influx: expected exactly one result column")
+		}
+		values := make(StringSeries, len(row.Values))
+		for _, v := range row.Values {
+			t, err := influxTime(v)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := v[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("influx: expected string value, got %T", v[1])
+			}
+			values[t] = s
+		}
+		r.Results = append(r.Results, &Result{
+			Value: values,
+			Group: tags,
+		})
+	}
+	return r, nil
+}
+
+// influxTime returns the time of a row value with one result column.
+func influxTime(v []interface{}) (time.Time, error) {
+	if len(v) != 2 {
+		return time.Time{}, fmt.Errorf("influx: expected exactly one result column")
+	}
+	ts, ok := v[0].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("influx: expected time string column")
+	}
+	return time.Parse(time.RFC3339, ts)
+}
+
 // influxQueryDuration adds time WHERE clauses to query for the given start and end durations.
 func influxQueryDuration(now time.Time, query, start, end, groupByInterval string) (string, error) {
 	sd, err := opentsdb.ParseDuration(start)
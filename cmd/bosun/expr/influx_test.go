@@ -2,11 +2,15 @@ package expr
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
 	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"bosun.org/_third_party/github.com/influxdb/influxdb/client"
+	"bosun.org/cmd/bosun/cache"
 	"bosun.org/opentsdb"
 )
 
@@ -63,3 +67,65 @@ func TestInfluxQuery(t *testing.T) {
 		t.Fatal("Should have received an error from InfluxQuery")
 	}
 }
+
+func TestInfluxStringQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results":[{"series":[
+			{"name":"check","tags":{"host":"a"},"columns":["time","state"],"values":[["2015-02-24T23:00:00Z","ok"],["2015-02-24T23:30:00Z","degraded"]]},
+			{"name":"check","tags":{"host":"b"},"columns":["time","state"],"values":[["2015-02-24T23:00:00Z","ok"],["2015-02-24T23:30:00Z","ok"]]}
+		]}]}`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := State{
+		now:          time.Date(2015, time.February, 25, 0, 0, 0, 0, time.UTC),
+		InfluxConfig: client.Config{URL: *u},
+		cache:        cache.New(0),
+		squelched: func(tags opentsdb.TagSet) bool {
+			return false
+		},
+	}
+	T := new(miniprofiler.Profile)
+	r, err := InfluxStringQuery(&e, T, "db", "select state from check group by host", "1h", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = Match(&e, T, r, "^(ok|up)$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2015, time.February, 24, 23, 30, 0, 0, time.UTC)
+	expected := map[string]float64{"a": 0, "b": 1}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(r.Results))
+	}
+	for _, res := range r.Results {
+		s := res.Value.(Series)
+		if len(s) != 2 {
+			t.Errorf("%v: expected 2 points, got %v", res.Group, s)
+		}
+		if v := s[last]; v != expected[res.Group["host"]] {
+			t.Errorf("%v: expected %v, got %v", res.Group, expected[res.Group["host"]], v)
+		}
+	}
+}
+
+func TestInfluxStringMisuse(t *testing.T) {
+	q := `influxString("db", "select state from check group by host", "1h", "", "")`
+	for _, s := range []string{
+		"avg(" + q + ")",
+		q + " + 1",
+		"-" + q,
+		`match(` + q + `, "(")`,
+	} {
+		if _, err := New(s, Influx); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	if _, err := New(`last(match(`+q+`, "^ok$"))`, Influx); err != nil {
+		t.Error(err)
+	}
+}
@@ -57,6 +57,9 @@ const (
 	itemString
 	itemFunc
 	itemTripleQuotedString
+	itemVar       // '$' followed by a name
+	itemAssign    // '='
+	itemSemicolon // ';'
 )
 
 const eof = -1
@@ -187,6 +190,10 @@ Loop:
 			return lexStringTripleBegin
 		case r == ',':
 			l.emit(itemComma)
+		case r == '$':
+			return lexVar
+		case r == ';':
+			l.emit(itemSemicolon)
 		case isSpace(r):
 			l.ignore()
 		case r == eof:
@@ -231,6 +238,11 @@ func (l *lexer) scanNumber() bool {
 const symbols = "!<>=&|+-*/%"
 
 func lexSymbol(l *lexer) stateFn {
+	// A single = is always an assignment, so that $x=-1 binds -1.
+	if l.input[l.start:l.pos] == "=" && l.peek() != '=' {
+		l.emit(itemAssign)
+		return lexItem
+	}
 	l.acceptRun(symbols)
 	s := l.input[l.start:l.pos]
 	switch s {
@@ -281,6 +293,23 @@ func lexFunc(l *lexer) stateFn {
 	}
 }
 
+// lexVar scans a variable name after its '$'.
+func lexVar(l *lexer) stateFn {
+	for {
+		switch r := l.next(); {
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			// absorb
+		default:
+			l.backup()
+			if l.pos-l.start < 2 {
+				return l.errorf("missing variable name after $")
+			}
+			l.emit(itemVar)
+			return lexItem
+		}
+	}
+}
+
 func lexString(l *lexer) stateFn {
 	for {
 		switch l.next() {
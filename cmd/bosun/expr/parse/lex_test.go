@@ -33,6 +33,9 @@ var itemName = map[itemType]string{
 	itemRightParen: ")",
 	itemString:     "string",
 	itemFunc:       "func",
+	itemVar:        "var",
+	itemAssign:     "=",
+	itemSemicolon:  ";",
 }
 
 func (i itemType) String() string {
@@ -143,7 +146,25 @@ var lexTests = []lexTest{
 		tRpar,
 		tEOF,
 	}},
+	{"variable binding", "$x_1 = 2; $x_1", []item{
+		{itemVar, 0, "$x_1"},
+		{itemAssign, 0, "="},
+		{itemNumber, 0, "2"},
+		{itemSemicolon, 0, ";"},
+		{itemVar, 0, "$x_1"},
+		tEOF,
+	}},
+	{"binding a negative number", "$x=-1", []item{
+		{itemVar, 0, "$x"},
+		{itemAssign, 0, "="},
+		{itemMinus, 0, "-"},
+		{itemNumber, 0, "1"},
+		tEOF,
+	}},
 	// errors
+	{"missing variable name", "$ = 1", []item{
+		{itemError, 0, "missing variable name after $"},
+	}},
 	{"unclosed quote", "\"", []item{
 		{itemError, 0, "unterminated string"},
 	}},
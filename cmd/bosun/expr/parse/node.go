@@ -56,6 +56,7 @@ const (
 	NodeUnary                  // Unary operator: !, -
 	NodeString                 // A string constant.
 	NodeNumber                 // A numerical constant.
+	NodeVar                    // A use of a bound variable.
 )
 
 // Nodes.
@@ -113,6 +114,8 @@ func (f *FuncNode) Check(t *Tree) error {
 		at := a.Return()
 		if ft == TypeNumberSet && at == TypeScalar {
 			// Scalars are promoted to NumberSets during execution.
+		} else if at == TypeStringSeriesSet && ft != at {
+			return fmt.Errorf("parse: expected %v, got %v in %s: use match to convert string series to numbers", ft, at, f.Name)
 		} else if ft != at {
 			return fmt.Errorf("parse: expected %v, got %v", ft, at)
 		}
@@ -256,6 +259,9 @@ func (b *BinaryNode) StringAST() string {
 func (b *BinaryNode) Check(t *Tree) error {
 	t1 := b.Args[0].Return()
 	t2 := b.Args[1].Return()
+	if t1 == TypeStringSeriesSet || t2 == TypeStringSeriesSet {
+		return fmt.Errorf("parse: type error in %s: string series must be converted to numbers with match", b)
+	}
 	if t1 == TypeSeriesSet && t2 == TypeSeriesSet {
 		return fmt.Errorf("parse: type error in %s: at least one side must be a number", b)
 	}
@@ -344,6 +350,40 @@ func (u *UnaryNode) Tags() (Tags, error) {
 	return u.Arg.Tags()
 }
 
+// VarNode is a use of a variable bound at the start of the expression. All
+// uses of a variable share the node of its binding.
+type VarNode struct {
+	NodeType
+	Pos
+	Name  string // The name, with its $.
+	Value Node
+}
+
+func newVar(pos Pos, name string, value Node) *VarNode {
+	return &VarNode{NodeType: NodeVar, Pos: pos, Name: name, Value: value}
+}
+
+func (v *VarNode) String() string {
+	return v.Name
+}
+
+func (v *VarNode) StringAST() string {
+	return v.String()
+}
+
+// Check does nothing: the value was checked when it was bound.
+func (v *VarNode) Check(*Tree) error {
+	return nil
+}
+
+func (v *VarNode) Return() FuncType {
+	return v.Value.Return()
+}
+
+func (v *VarNode) Tags() (Tags, error) {
+	return v.Value.Tags()
+}
+
 // Walk invokes f on n and sub-nodes of n.
 func Walk(n Node, f func(Node)) {
 	f(n)
@@ -359,6 +399,8 @@ func Walk(n Node, f func(Node)) {
 		// Ignore.
 	case *UnaryNode:
 		Walk(n.Arg, f)
+	case *VarNode:
+		Walk(n.Value, f)
 	default:
 		panic(fmt.Errorf("other type: %T", n))
 	}
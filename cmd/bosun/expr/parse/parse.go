@@ -19,13 +19,16 @@ import (
 type Tree struct {
 	Text string // text parsed to create the expression.
 	Root Node   // top-level root of the tree, returns a number.
+	// Vars are the variables bound before Root, in order.
+	Vars []*VarNode
 
 	funcs []map[string]Func
 
 	// Parsing only; cleared after parse.
 	lex       *lexer
-	token     [1]item // one-token lookahead for parser.
+	token     [2]item // two-token lookahead for parser.
 	peekCount int
+	vars      map[string]*VarNode
 }
 
 type Func struct {
@@ -48,6 +51,8 @@ func (f FuncType) String() string {
 		return "series"
 	case TypeScalar:
 		return "scalar"
+	case TypeStringSeriesSet:
+		return "string series"
 	default:
 		return "unknown"
 	}
@@ -58,6 +63,10 @@ const (
 	TypeScalar
 	TypeNumberSet
 	TypeSeriesSet
+	// TypeStringSeriesSet holds series of text values, such as the states of
+	// a status check. They can't be reduced or used in arithmetic, only
+	// converted to numbers with match.
+	TypeStringSeriesSet
 )
 
 type Tags map[string]struct{}
@@ -129,6 +138,13 @@ func (t *Tree) backup() {
 	t.peekCount++
 }
 
+// backup2 backs the input stream up two tokens.
+// The zeroth token is already there.
+func (t *Tree) backup2(t1 item) {
+	t.token[1] = t1
+	t.peekCount = 2
+}
+
 // peek returns but does not consume the next token.
 func (t *Tree) peek() item {
 	if t.peekCount > 0 {
@@ -206,7 +222,7 @@ func (t *Tree) startParse(funcs []map[string]Func, lex *lexer) {
 	for _, funcMap := range funcs {
 		for name, f := range funcMap {
 			switch f.Return {
-			case TypeSeriesSet, TypeNumberSet:
+			case TypeSeriesSet, TypeNumberSet, TypeStringSeriesSet:
 				if f.Tags == nil {
 					panic(fmt.Errorf("%v: expected Tags definition: got nil", name))
 				}
@@ -222,6 +238,7 @@ func (t *Tree) startParse(funcs []map[string]Func, lex *lexer) {
 // stopParse terminates parsing.
 func (t *Tree) stopParse() {
 	t.lex = nil
+	t.vars = nil
 }
 
 // Parse parses the expression definition string to construct a representation
@@ -238,6 +255,17 @@ func (t *Tree) Parse(text string, funcs ...map[string]Func) (err error) {
 // parse is the top-level parser for an expression.
 // It runs to EOF.
 func (t *Tree) parse() {
+	t.Vars = nil
+	t.vars = make(map[string]*VarNode)
+	for t.peek().typ == itemVar {
+		name := t.next()
+		if t.peek().typ != itemAssign {
+			t.backup2(name)
+			break
+		}
+		t.next()
+		t.bind(name)
+	}
 	t.Root = t.O()
 	t.expect(itemEOF, "input")
 	if err := t.Root.Check(t); err != nil {
@@ -245,14 +273,29 @@ func (t *Tree) parse() {
 	}
 }
 
+// bind parses the value of the variable name up to its ';'.
+func (t *Tree) bind(name item) {
+	if _, ok := t.vars[name.val]; ok {
+		t.errorf("variable %s already bound", name.val)
+	}
+	n := newVar(name.pos, name.val, t.O())
+	t.expect(itemSemicolon, "variable binding")
+	if err := n.Value.Check(t); err != nil {
+		t.error(err)
+	}
+	t.vars[name.val] = n
+	t.Vars = append(t.Vars, n)
+}
+
 /* Grammar:
+E -> {var "=" O ";"} O
 O -> A {"||" A}
 A -> C {"&&" C}
 C -> P {( "==" | "!=" | ">" | ">=" | "<" | "<=") P}
 P -> M {( "+" | "-" ) M}
 M -> F {( "*" | "/" ) F}
 F -> v | "(" O ")" | "!" O | "-" O
-v -> number | func(..)
+v -> number | var | func(..)
 Func -> name "(" param {"," param} ")"
 param -> number | "string" | [query]
 */
@@ -322,6 +365,13 @@ func (t *Tree) F() Node {
 	switch token := t.peek(); token.typ {
 	case itemNumber, itemFunc:
 		return t.v()
+	case itemVar:
+		t.next()
+		n, ok := t.vars[token.val]
+		if !ok {
+			t.errorf("undefined variable %s", token.val)
+		}
+		return n
 	case itemNot, itemMinus:
 		return newUnary(t.next(), t.F())
 	case itemLeftParen:
@@ -400,5 +450,9 @@ func (t *Tree) GetFunction(name string) (v Func, ok bool) {
 }
 
 func (t *Tree) String() string {
-	return t.Root.String()
+	s := ""
+	for _, v := range t.Vars {
+		s += fmt.Sprintf("%s = %s; ", v.Name, v.Value)
+	}
+	return s + t.Root.String()
 }
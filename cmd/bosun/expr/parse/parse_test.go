@@ -107,6 +107,7 @@ var parseTests = []parseTest{
 	{"unary series", `!q("q", "1m")`, noError, `!q("q", "1m")`},
 	{"expr in func", `forecastlr(q("q", "1m"), -1)`, noError, `forecastlr(q("q", "1m"), -1)`},
 	{"nested func expr", `avg(q("q","1m")>0)`, noError, `avg(q("q", "1m") > 0)`},
+	{"variables", `$x = q("q", "1m"); $mean=avg($x);$mean / avg($x) == 1`, noError, `$x = q("q", "1m"); $mean = avg($x); $mean / avg($x) == 1`},
 	// Errors.
 	{"empty", "", hasError, ""},
 	{"unclosed function", "avg(", hasError, ""},
@@ -114,6 +115,13 @@ var parseTests = []parseTest{
 	{"bad type", `band("q", "1h", "1m", "8")`, hasError, ""},
 	{"wrong number args", `avg(q("q", "1m"), "1m", 1)`, hasError, ""},
 	{"2 series math", `band(q("q", "1m"))+band(q("q", "1m"))`, hasError, ""},
+	{"negative binding", `$x=-1; $x`, noError, `$x = -1; $x`},
+	{"undefined variable", `$x + 1`, hasError, ""},
+	{"variable bound twice", `$x = 1; $x = 2; $x`, hasError, ""},
+	{"variable bound to itself", `$x = $x + 1; $x`, hasError, ""},
+	{"binding without semicolon", `$x = 1 $x`, hasError, ""},
+	{"variable without name", `$ = 1; 1`, hasError, ""},
+	{"bad type in binding", `$x = band("q", "1h", "1m", "8"); 1`, hasError, ""},
 }
 
 func TestParse(t *testing.T) {
@@ -137,7 +145,7 @@ func TestParse(t *testing.T) {
 			continue
 		}
 		var result string
-		result = tmpl.Root.String()
+		result = tmpl.String()
 		if result != test.result {
 			t.Errorf("%s=(%q): got\n\t%v\nexpected\n\t%v", test.name, test.input, result, test.result)
 		}
@@ -5,6 +5,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/pprof"
@@ -20,6 +21,7 @@ import (
 	"bosun.org/_third_party/github.com/facebookgo/httpcontrol"
 	"bosun.org/_third_party/gopkg.in/fsnotify.v1"
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/database"
 	"bosun.org/cmd/bosun/sched"
 	"bosun.org/cmd/bosun/web"
 	"bosun.org/collect"
@@ -69,6 +71,12 @@ var (
 	flagNoChecks = flag.Bool("n", false, "no-checks: don't run the checks at the run interval")
 	flagDev      = flag.Bool("dev", false, "enable dev mode: use local resources; no syslog")
 	flagVersion  = flag.Bool("version", false, "Prints the version and exits")
+	flagMigrate  = flag.String("migrate-data", "", "copy all data from the configured redis (or ledis) to the redis server at this address and exit; safe to rerun after an interruption")
+	flagDryRun   = flag.Bool("dry-run", false, "with -migrate-data: report what would be copied without writing anything")
+	flagExport   = flag.String("export-bundle", "", "write the config, incidents, silences, mutes and alert errors to this bundle file and exit; stop bosun first")
+	flagImport   = flag.String("import-bundle", "", "restore the config file and state from this bundle file and exit; stop bosun first")
+	flagForce    = flag.Bool("force", false, "with -import-bundle: replace an existing config file and state")
+	flagShutdown = flag.Duration("shutdown-timeout", 30*time.Second, "on interrupt, how long to wait for running checks and notifications to finish before exiting")
 
 	mains []func()
 )
@@ -83,6 +91,12 @@ func main() {
 		m()
 	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if *flagImport != "" {
+		if err := importBundle(*flagImport, *flagConf, *flagForce); err != nil {
+			slog.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	c, err := conf.ParseFile(*flagConf)
 	if err != nil {
 		slog.Fatal(err)
@@ -90,6 +104,18 @@ func main() {
 	if *flagTest {
 		os.Exit(0)
 	}
+	if *flagExport != "" {
+		if err := exportBundle(c, *flagExport); err != nil {
+			slog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *flagMigrate != "" {
+		if err := migrateData(c, *flagMigrate, *flagDryRun); err != nil {
+			slog.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	httpListen := &url.URL{
 		Scheme: "http",
 		Host:   c.HTTPListen,
@@ -157,7 +183,7 @@ func main() {
 			killing = true
 			go func() {
 				slog.Infoln("Interrupt: closing down...")
-				sched.Close()
+				sched.Shutdown(*flagShutdown)
 				slog.Infoln("done")
 				os.Exit(1)
 			}()
@@ -172,6 +198,96 @@ func main() {
 	select {}
 }
 
+func migrateData(c *conf.Conf, to string, dryRun bool) error {
+	var src database.DataAccess
+	if c.RedisHost != "" {
+		src = database.NewDataAccess(c.RedisHost, true, database.EncodingJSON, c.RedisKeyPrefix)
+	} else {
+		bind := "127.0.0.1:9565"
+		stop, err := database.StartLedis(c.LedisDir, bind)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		src = database.NewDataAccess(bind, false, database.EncodingJSON, c.RedisKeyPrefix)
+	}
+	dst := database.NewDataAccess(to, true, database.EncodingJSON, c.RedisKeyPrefix)
+	verb := "copied"
+	if dryRun {
+		verb = "would copy"
+	}
+	p, err := database.Migrate(src, dst, dryRun, func(key string, p database.MigrateProgress) {
+		if p.Keys%1000 == 0 {
+			slog.Infof("migrate: %d keys visited, %d elements %s, %d expiring (at %s)", p.Keys, p.Elements, verb, p.Expiring, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	slog.Infof("migrate: done: %d keys visited, %d elements %s, %d expiring", p.Keys, p.Elements, verb, p.Expiring)
+	return nil
+}
+
+func exportBundle(c *conf.Conf, path string) error {
+	if err := sched.Load(c); err != nil {
+		return err
+	}
+	defer sched.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := sched.WriteBundle(f, sched.DefaultSched.ExportBundle()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	slog.Infof("exported bundle to %s", path)
+	return nil
+}
+
+// importBundle writes the bundle's config to confPath and restores its state.
+// Unless force is set, an existing, different config file or existing state
+// is an error. Nothing is written unless every check passes.
+func importBundle(path, confPath string, force bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	b, err := sched.ReadBundle(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadFile(confPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	changed := string(existing) != b.Config
+	if err == nil && changed && !force {
+		return fmt.Errorf("%s differs from the bundle's config; use -force to replace it", confPath)
+	}
+	c, err := conf.New(confPath, b.Config)
+	if err != nil {
+		return err
+	}
+	if err := sched.Load(c); err != nil {
+		return err
+	}
+	defer sched.Close()
+	if err := sched.DefaultSched.CheckImport(force); err != nil {
+		return err
+	}
+	if changed {
+		if err := ioutil.WriteFile(confPath, []byte(b.Config), 0644); err != nil {
+			return err
+		}
+	}
+	return sched.DefaultSched.ImportBundle(b, force)
+}
+
 func quit() {
 	os.Exit(0)
 }
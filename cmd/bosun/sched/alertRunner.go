@@ -2,10 +2,15 @@ package sched
 
 import (
 	"fmt"
+	"hash/fnv"
+	"sync"
 	"time"
 
 	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/opentsdb"
 	"bosun.org/slog"
 )
 
@@ -19,28 +24,78 @@ func (s *Schedule) Run() error {
 		go s.PingHosts()
 	}
 	go s.dispatchNotifications()
+	go s.resendNotifications()
 	go s.performSave()
 	go s.updateCheckContext()
+	if s.Conf.ErrorHistoryMax > 0 || s.Conf.ErrorDedup {
+		go s.compactErrorsLoop()
+	}
+	collect.Set("notifications.queue_depth", nil, func() interface{} {
+		depth, err := s.DataAccess.NotificationQueue().QueueDepth()
+		if err != nil {
+			slog.Errorln(err)
+		}
+		return depth
+	})
+	collect.Set("check.queue_depth", nil, func() interface{} {
+		return s.checkLimit.queued()
+	})
+	collect.Set("check.utilization", nil, func() interface{} {
+		return s.checkLimit.utilization()
+	})
+	collect.Set("check.overdue", nil, func() interface{} {
+		return s.EvaluationLag().Overdue
+	})
+	collect.Set("check.lag", nil, func() interface{} {
+		return s.EvaluationLag().MaxLag
+	})
+	collect.Set("breaker.state", opentsdb.TagSet{"datasource": "tsdb"}, func() interface{} {
+		return int(s.Conf.TSDBBreaker.State())
+	})
+	collect.Set("breaker.state", opentsdb.TagSet{"datasource": "graphite"}, func() interface{} {
+		return int(s.Conf.GraphiteBreaker.State())
+	})
+	jitter := s.checkJitter()
+	phases := make(map[string]time.Duration)
+	for name := range s.Conf.Alerts {
+		phases[name] = checkPhase(name, jitter)
+	}
+	peak := peakStarts(phases)
+	collect.Set("check.peak_starts", nil, func() interface{} {
+		return peak
+	})
 	for _, a := range s.Conf.Alerts {
-		go s.RunAlert(a)
+		go s.RunAlert(a, phases[a.Name])
 	}
 	return nil
 }
 func (s *Schedule) updateCheckContext() {
 	for {
-		ctx := &checkContext{time.Now(), cache.New(0)}
+		ctx := &checkContext{s.Clock.Now(), cache.New(0)}
 		s.ctx = ctx
-		time.Sleep(s.Conf.CheckFrequency)
+		<-s.Clock.After(s.Conf.CheckFrequency)
 		s.Lock("CollectStates")
 		s.CollectStates()
 		s.Unlock()
 	}
 }
-func (s *Schedule) RunAlert(a *conf.Alert) {
+
+// RunAlert checks a every RunEvery check intervals, starting after phase,
+// until the schedule shuts down.
+func (s *Schedule) RunAlert(a *conf.Alert, phase time.Duration) {
+	interval := s.Conf.CheckFrequency * time.Duration(a.RunEvery)
+	s.runs.schedule(a.Name, s.Clock.Now().Add(phase))
+	<-s.Clock.After(phase)
 	for {
-		wait := time.After(s.Conf.CheckFrequency * time.Duration(a.RunEvery))
+		start := s.Clock.Now()
+		wait := s.Clock.After(interval)
+		if !s.work.start() {
+			return
+		}
 		s.checkAlert(a)
-		s.LastCheck = time.Now()
+		s.work.done()
+		s.LastCheck = s.Clock.Now()
+		s.runs.schedule(a.Name, start.Add(interval))
 		<-wait
 	}
 }
@@ -49,9 +104,201 @@ func (s *Schedule) checkAlert(a *conf.Alert) {
 	checkTime := s.ctx.runTime
 	checkCache := s.ctx.checkCache
 	rh := s.NewRunHistory(checkTime, checkCache)
-	s.CheckAlert(nil, rh, a)
+	s.limitedCheck(rh, a)
 
 	start := time.Now()
 	s.RunHistory(rh)
 	slog.Infof("runHistory on %s took %v\n", a.Name, time.Since(start))
 }
+
+// limitedCheck checks a while holding one of the concurrent check slots.
+func (s *Schedule) limitedCheck(rh *RunHistory, a *conf.Alert) {
+	s.checkLimit.acquire()
+	defer s.checkLimit.release()
+	s.runs.start(a.Name)
+	s.CheckAlert(nil, rh, a)
+}
+
+// checkJitter returns the configured jitter, which is at most CheckFrequency.
+func (s *Schedule) checkJitter() time.Duration {
+	if s.Conf.CheckJitter > s.Conf.CheckFrequency {
+		return s.Conf.CheckFrequency
+	}
+	return s.Conf.CheckJitter
+}
+
+// checkPhase returns the offset into each check interval at which the named
+// alert is checked. It is derived from the name, so it is the same every
+// interval and across restarts.
+func checkPhase(name string, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+// peakStarts returns the largest number of phases that fall in the same second.
+func peakStarts(phases map[string]time.Duration) int {
+	counts := make(map[time.Duration]int)
+	peak := 0
+	for _, p := range phases {
+		sec := p / time.Second
+		counts[sec]++
+		if counts[sec] > peak {
+			peak = counts[sec]
+		}
+	}
+	return peak
+}
+
+// errorCompactInterval is how often alert error histories are compacted.
+const errorCompactInterval = 5 * time.Minute
+
+func (s *Schedule) compactErrorsLoop() {
+	for {
+		<-s.Clock.After(errorCompactInterval)
+		n := s.compactErrors(s.Conf.ErrorHistoryMax, s.Conf.ErrorDedup)
+		collect.Put("errors.compacted", nil, n)
+	}
+}
+
+func init() {
+	metadata.AddMetricMeta("bosun.check.peak_starts", metadata.Gauge, metadata.Alert,
+		"The most alert checks started in the same second of each check interval. Lowered by checkJitter.")
+	metadata.AddMetricMeta("bosun.check.queue_depth", metadata.Gauge, metadata.Count,
+		"The number of alert checks waiting for a free slot when checkConcurrency is set.")
+	metadata.AddMetricMeta("bosun.check.utilization", metadata.Gauge, metadata.Pct,
+		"The percentage of checkConcurrency slots in use. 0 when checks are not limited.")
+	metadata.AddMetricMeta("bosun.check.overdue", metadata.Gauge, metadata.Alert,
+		"The number of alerts whose check is due but has not started.")
+	metadata.AddMetricMeta("bosun.check.lag", metadata.Gauge, metadata.Second,
+		"How long the most overdue alert check has been due, 0 when no check is overdue.")
+	metadata.AddMetricMeta("bosun.breaker.state", metadata.Gauge, metadata.StatusCode,
+		"State of the datasource circuit breaker: 0=closed, 1=half-open (probing), 2=open (queries are not sent).")
+	metadata.AddMetricMeta("bosun.errors.compacted", metadata.Gauge, metadata.Count,
+		"The number of alert error entries removed by the last compaction run.")
+}
+
+// checkLimiter bounds the number of alert checks evaluated at once. Checks
+// over the limit wait in a FIFO queue, so every alert gets its turn and a
+// slow one only ever holds a single slot. A max of 0 means no limit.
+type checkLimiter struct {
+	sync.Mutex
+	max     int
+	running int
+	waiting []chan struct{}
+}
+
+func newCheckLimiter(max int) *checkLimiter {
+	return &checkLimiter{max: max}
+}
+
+func (l *checkLimiter) acquire() {
+	l.Lock()
+	if l.max <= 0 || l.running < l.max {
+		l.running++
+		l.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	l.waiting = append(l.waiting, ch)
+	l.Unlock()
+	<-ch
+}
+
+func (l *checkLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.waiting) > 0 {
+		// Hand the slot directly to the longest waiter.
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		return
+	}
+	l.running--
+}
+
+func (l *checkLimiter) queued() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.waiting)
+}
+
+func (l *checkLimiter) utilization() float64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.max <= 0 {
+		return 0
+	}
+	return float64(l.running) / float64(l.max) * 100
+}
+
+// runTracker records when the next check of each alert is due, so the
+// scheduler can report how far behind it is.
+type runTracker struct {
+	sync.Mutex
+	due     map[string]time.Time
+	running map[string]bool
+}
+
+func newRunTracker() *runTracker {
+	return &runTracker{
+		due:     make(map[string]time.Time),
+		running: make(map[string]bool),
+	}
+}
+
+// schedule records that the next check of the named alert is due at due.
+func (r *runTracker) schedule(name string, due time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.due[name] = due
+	r.running[name] = false
+}
+
+// start records that the check of the named alert has begun.
+func (r *runTracker) start(name string) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.due[name]; ok {
+		r.running[name] = true
+	}
+}
+
+// overdue returns how long past due each alert whose check has not started
+// is at now.
+func (r *runTracker) overdue(now time.Time) map[string]time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	lag := make(map[string]time.Duration)
+	for name, due := range r.due {
+		if !r.running[name] && now.After(due) {
+			lag[name] = now.Sub(due)
+		}
+	}
+	return lag
+}
+
+// EvaluationLag is how far alert checks are behind their scheduled time.
+// Lags are in seconds.
+type EvaluationLag struct {
+	Overdue int
+	MaxLag  float64
+	Alerts  map[string]float64
+}
+
+// EvaluationLag returns the alerts whose check is due but has not started,
+// and how long each has been due.
+func (s *Schedule) EvaluationLag() *EvaluationLag {
+	l := &EvaluationLag{Alerts: make(map[string]float64)}
+	for name, d := range s.runs.overdue(s.Clock.Now()) {
+		l.Alerts[name] = d.Seconds()
+		l.Overdue++
+		if d.Seconds() > l.MaxLag {
+			l.MaxLag = d.Seconds()
+		}
+	}
+	return l
+}
@@ -0,0 +1,198 @@
+package sched
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+)
+
+func TestCheckConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":1}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := fmt.Sprintf("tsdbHost = %s\ncheckConcurrency = 2\n", u.Host)
+	for i := 0; i < 6; i++ {
+		text += fmt.Sprintf("alert a%d {\n crit = avg(q(\"avg:m{host=*}\", \"%dm\", \"\"))\n}\n", i, i+1)
+	}
+	c, err := conf.New("", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, a := range c.Alerts {
+		wg.Add(1)
+		go func(a *conf.Alert) {
+			defer wg.Done()
+			s.checkAlert(a)
+		}(a)
+	}
+	wg.Wait()
+	if maxInflight != 2 {
+		t.Fatalf("expected at most 2 concurrent evaluations (and the limit reached), got %d", maxInflight)
+	}
+	if q := s.checkLimit.queued(); q != 0 {
+		t.Fatalf("expected empty queue, got %d", q)
+	}
+}
+
+func TestCheckLimiterFIFO(t *testing.T) {
+	l := newCheckLimiter(1)
+	l.acquire()
+	var order []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l.acquire()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			l.release()
+		}(i)
+		// wait for each goroutine to queue before starting the next.
+		for l.queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if u := l.utilization(); u != 100 {
+		t.Fatalf("expected 100%% utilization, got %v", u)
+	}
+	l.release()
+	wg.Wait()
+	if fmt.Sprint(order) != "[0 1 2 3 4]" {
+		t.Fatalf("expected checks to run in arrival order, got %v", order)
+	}
+	if u := l.utilization(); u != 0 {
+		t.Fatalf("expected 0%% utilization, got %v", u)
+	}
+}
+
+func TestCheckPhase(t *testing.T) {
+	const jitter = time.Minute
+	phases := make(map[string]time.Duration)
+	var min, max time.Duration = jitter, 0
+	for i := 0; i < 120; i++ {
+		name := fmt.Sprintf("alert%d", i)
+		p := checkPhase(name, jitter)
+		if p < 0 || p >= jitter {
+			t.Fatalf("%s: phase %v outside [0, %v)", name, p, jitter)
+		}
+		if p != checkPhase(name, jitter) {
+			t.Fatalf("%s: phase is not stable", name)
+		}
+		if p < min {
+			min = p
+		}
+		if p > max {
+			max = p
+		}
+		phases[name] = p
+	}
+	if max-min < jitter/2 {
+		t.Errorf("phases not spread over the interval: %v to %v", min, max)
+	}
+	if peak := peakStarts(phases); peak > 10 {
+		t.Errorf("expected checks spread across seconds, got %d starting in the same second", peak)
+	}
+	if checkPhase("a", 0) != 0 {
+		t.Error("expected no phase without jitter")
+	}
+	for name := range phases {
+		phases[name] = 0
+	}
+	if peak := peakStarts(phases); peak != len(phases) {
+		t.Errorf("expected all %d checks in the same second without jitter, got %d", len(phases), peak)
+	}
+}
+
+func TestEvaluationLag(t *testing.T) {
+	block := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":1}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		checkConcurrency = 1
+		alert a {
+			crit = avg(q("avg:m{host=*}", "1m", ""))
+		}
+		alert b {
+			crit = avg(q("avg:m{host=*}", "2m", ""))
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	s.runs.schedule("a", clock.Now())
+	s.runs.schedule("b", clock.Now())
+	// a holds the only check slot, so b falls behind.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.checkAlert(c.Alerts["a"])
+	}()
+	for s.checkLimit.utilization() != 100 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		defer wg.Done()
+		s.checkAlert(c.Alerts["b"])
+	}()
+	for s.checkLimit.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(2 * time.Minute)
+	lag := s.EvaluationLag()
+	if lag.Overdue != 1 || lag.MaxLag != 120 || lag.Alerts["b"] != 120 {
+		t.Fatalf("expected b to be 2m overdue, got %+v", lag)
+	}
+	close(block)
+	wg.Wait()
+	s.runs.schedule("a", clock.Now().Add(time.Minute))
+	s.runs.schedule("b", clock.Now().Add(time.Minute))
+	if lag := s.EvaluationLag(); lag.Overdue != 0 || lag.MaxLag != 0 {
+		t.Fatalf("expected no overdue checks, got %+v", lag)
+	}
+}
@@ -48,6 +48,10 @@ const (
 	dbStatus           = "status"
 	dbIncidents        = "incidents"
 	dbErrors           = "errors"
+	dbMutes            = "mutes"
+	dbDeferred         = "deferred"
+	dbDigests          = "digests"
+	dbFailingAlerts    = "failingAlerts"
 )
 
 func (s *Schedule) save() {
@@ -59,29 +63,28 @@ func (s *Schedule) save() {
 		dbNotifications: s.Notifications,
 		dbSilence:       s.Silence,
 		dbStatus:        s.status,
-		dbIncidents:     s.Incidents,
+		dbIncidents:     s.copyIncidents(),
 		dbErrors:        s.AlertStatuses,
+		dbMutes:         s.GetMutes(),
+		dbDeferred:      s.Deferred,
+		dbDigests:       s.Digests,
+		dbFailingAlerts: s.failingAlertsActive,
 	}
 	tostore := make(map[string][]byte)
 	for name, data := range store {
-		f := new(bytes.Buffer)
-		gz := gzip.NewWriter(f)
-		cw := &counterWriter{w: gz}
-		enc := gob.NewEncoder(cw)
-		if err := enc.Encode(data); err != nil {
+		enc := database.EncodingJSON
+		if name == dbErrors || name == dbIncidents {
+			enc = s.encoding
+		}
+		b, written, err := encodeState(data, enc)
+		if err != nil {
 			slog.Errorf("error saving %s: %v", name, err)
 			s.Unlock()
 			return
 		}
-		if err := gz.Flush(); err != nil {
-			slog.Errorf("gzip flush error saving %s: %v", name, err)
-		}
-		if err := gz.Close(); err != nil {
-			slog.Errorf("gzip close error saving %s: %v", name, err)
-		}
-		tostore[name] = f.Bytes()
-		slog.Infof("wrote %s: %v", name, conf.ByteSize(cw.written))
-		collect.Put("statefile.size", opentsdb.TagSet{"object": name}, cw.written)
+		tostore[name] = b
+		slog.Infof("wrote %s: %v", name, conf.ByteSize(written))
+		collect.Put("statefile.size", opentsdb.TagSet{"object": name}, written)
 	}
 	s.Unlock()
 	err := s.db.Update(func(tx *bolt.Tx) error {
@@ -120,6 +123,33 @@ func decode(db *bolt.DB, name string, dst interface{}) error {
 	if err != nil {
 		return err
 	}
+	return decodeState(data, dst)
+}
+
+// encodeState encodes data for the state file as gzipped gob, or with enc if
+// it is database.EncodingMsgpack. It also returns the uncompressed size.
+func encodeState(data interface{}, enc database.Encoding) ([]byte, int, error) {
+	if enc == database.EncodingMsgpack {
+		b, err := enc.Marshal(data)
+		return b, len(b), err
+	}
+	f := new(bytes.Buffer)
+	gz := gzip.NewWriter(f)
+	cw := &counterWriter{w: gz}
+	if err := gob.NewEncoder(cw).Encode(data); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return f.Bytes(), cw.written, nil
+}
+
+// decodeState decodes data written by encodeState in either encoding.
+func decodeState(data []byte, dst interface{}) error {
+	if database.IsMsgpack(data) {
+		return database.Unmarshal(data, dst)
+	}
 	gr, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return err
@@ -155,6 +185,18 @@ func (s *Schedule) RestoreState() error {
 	if err := decode(db, dbErrors, &s.AlertStatuses); err != nil {
 		slog.Errorln(dbErrors, err)
 	}
+	if err := decode(db, dbMutes, &s.Mutes); err != nil {
+		slog.Errorln(dbMutes, err)
+	}
+	if err := decode(db, dbDeferred, &s.Deferred); err != nil {
+		slog.Errorln(dbDeferred, err)
+	}
+	if err := decode(db, dbDigests, &s.Digests); err != nil {
+		slog.Errorln(dbDigests, err)
+	}
+	if err := decode(db, dbFailingAlerts, &s.failingAlertsActive); err != nil {
+		slog.Errorln(dbFailingAlerts, err)
+	}
 
 	// Calculate next incident id.
 	for _, i := range s.Incidents {
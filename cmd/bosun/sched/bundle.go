@@ -0,0 +1,186 @@
+package sched
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+)
+
+// BundleVersion is the version of bundles written by WriteBundle. Only bundles
+// of this version can be imported.
+const BundleVersion = 1
+
+// Bundle is a portable copy of a bosun instance's config and state, for
+// disaster recovery or cloning an environment. It is stored as gzipped JSON.
+type Bundle struct {
+	Version   int
+	Created   time.Time
+	Config    string
+	Incidents map[uint64]*Incident
+	Silences  []*bundleSilence
+	Mutes     map[string]*Mute
+	Errors    map[string]*AlertStatus
+}
+
+// bundleSilence matches the JSON encoding of Silence, whose tags are written
+// as a string.
+type bundleSilence struct {
+	Start, End time.Time
+	Alert      string
+	Tags       string
+	Forget     bool
+	User       string
+	Message    string
+	MaxStatus  string
+}
+
+// ExportBundle returns the current config, incidents, silences, mutes and
+// alert errors as a Bundle.
+func (s *Schedule) ExportBundle() *Bundle {
+	b := &Bundle{
+		Version: BundleVersion,
+		Created: s.Clock.Now().UTC(),
+		Config:  s.Conf.RawText,
+	}
+	b.Incidents = s.copyIncidents()
+	silenceLock.RLock()
+	for _, si := range s.Silence {
+		b.Silences = append(b.Silences, &bundleSilence{
+			Start:   si.Start,
+			End:     si.End,
+			Alert:   si.Alert,
+			Tags:    si.Tags.Tags(),
+			Forget:  si.Forget,
+			User:      si.User,
+			Message:   si.Message,
+			MaxStatus: si.MaxStatus.String(),
+		})
+	}
+	silenceLock.RUnlock()
+	b.Mutes = make(map[string]*Mute)
+	muteLock.RLock()
+	for id, m := range s.Mutes {
+		c := *m
+		c.Actions = append([]MuteAction(nil), m.Actions...)
+		b.Mutes[id] = &c
+	}
+	muteLock.RUnlock()
+	b.Errors = s.GetErrorHistory()
+	return b
+}
+
+// CheckImport returns an error if importing a bundle would overwrite existing
+// state, unless force is set.
+func (s *Schedule) CheckImport(force bool) error {
+	s.Lock("CheckImport")
+	defer s.Unlock()
+	return s.checkImport(force)
+}
+
+func (s *Schedule) checkImport(force bool) error {
+	if !force && (len(s.Incidents) > 0 || len(s.Silence) > 0 || len(s.Mutes) > 0 || len(s.AlertStatuses) > 0) {
+		return fmt.Errorf("bundle import would overwrite existing state; use force to replace it")
+	}
+	return nil
+}
+
+// ImportBundle replaces the schedule's incidents, silences, mutes and alert
+// errors with those in b. Unless force is set it refuses to overwrite any
+// existing state. The config is not changed.
+func (s *Schedule) ImportBundle(b *Bundle, force bool) error {
+	silences := make(map[string]*Silence)
+	for _, bs := range b.Silences {
+		si := &Silence{
+			Start:   bs.Start,
+			End:     bs.End,
+			Alert:   bs.Alert,
+			Tags:    make(opentsdb.TagSet),
+			Forget:  bs.Forget,
+			User:    bs.User,
+			Message: bs.Message,
+		}
+		// A silence of every status is exported as "none", or as nothing by
+		// older bundles.
+		if bs.MaxStatus != StNone.String() {
+			var err error
+			if si.MaxStatus, err = parseMaxStatus(bs.MaxStatus); err != nil {
+				return fmt.Errorf("bundle silence %s: %v", bs.Tags, err)
+			}
+		}
+		if bs.Tags != "" {
+			tags, err := opentsdb.ParseTags(bs.Tags)
+			if err != nil && tags == nil {
+				return fmt.Errorf("bundle silence %s: %v", bs.Tags, err)
+			}
+			si.Tags = tags
+		}
+		silences[si.ID()] = si
+	}
+	s.Lock("ImportBundle")
+	defer s.Unlock()
+	if err := s.checkImport(force); err != nil {
+		return err
+	}
+	var maxId uint64
+	for id := range b.Incidents {
+		if id > maxId {
+			maxId = id
+		}
+	}
+	s.incidentLock.Lock()
+	s.Incidents = b.Incidents
+	s.maxIncidentId = maxId
+	s.incidentLock.Unlock()
+	silenceLock.Lock()
+	s.Silence = silences
+	silenceLock.Unlock()
+	muteLock.Lock()
+	s.Mutes = b.Mutes
+	muteLock.Unlock()
+	s.alertStatusLock.Lock()
+	s.AlertStatuses = b.Errors
+	s.alertStatusLock.Unlock()
+	slog.Infof("imported bundle from %v: %d incidents, %d silences, %d mutes, %d alert error histories", b.Created, len(b.Incidents), len(silences), len(b.Mutes), len(b.Errors))
+	return nil
+}
+
+// WriteBundle writes b to w as gzipped JSON.
+func WriteBundle(w io.Writer, b *Bundle) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadBundle reads a bundle written by WriteBundle, and checks that its
+// version can be imported.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var b Bundle
+	if err := json.NewDecoder(gz).Decode(&b); err != nil {
+		return nil, err
+	}
+	if b.Version != BundleVersion {
+		return nil, fmt.Errorf("bundle version %d is not supported, expected %d", b.Version, BundleVersion)
+	}
+	if b.Incidents == nil {
+		b.Incidents = make(map[uint64]*Incident)
+	}
+	if b.Mutes == nil {
+		b.Mutes = make(map[string]*Mute)
+	}
+	if b.Errors == nil {
+		b.Errors = make(map[string]*AlertStatus)
+	}
+	return &b, nil
+}
@@ -3,12 +3,15 @@ package sched
 import (
 	"fmt"
 	"math"
+	"strings"
 	"time"
 
 	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
+	"bosun.org/_third_party/github.com/bradfitz/slice"
 	"bosun.org/_third_party/github.com/influxdb/influxdb/client"
 	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/database"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/collect"
 	"bosun.org/graphite"
@@ -83,6 +86,12 @@ type RunHistory struct {
 	Logstash        expr.LogstashElasticHosts
 	Events          map[expr.AlertKey]*Event
 	schedule        *Schedule
+	// MaxQueryRange is the longest time range a datasource query may cover
+	// when evaluating expressions, 0 for no limit.
+	MaxQueryRange time.Duration
+	// partial are the queries that failed in expressions evaluated without
+	// them. CheckAlert records them on the alert.
+	partial []string
 }
 
 // AtTime creates a new RunHistory starting at t with the same context and
@@ -93,6 +102,16 @@ func (rh *RunHistory) AtTime(t time.Time) *RunHistory {
 	return &n
 }
 
+// limit returns e with the query range limit of rh applied.
+func (rh *RunHistory) limit(e *expr.Expr) *expr.Expr {
+	if rh.MaxQueryRange == 0 {
+		return e
+	}
+	l := *e
+	l.MaxQueryRange = rh.MaxQueryRange
+	return &l
+}
+
 func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache) *RunHistory {
 	return &RunHistory{
 		Cache:           cache,
@@ -110,8 +129,9 @@ func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache) *RunHistor
 func (s *Schedule) RunHistory(r *RunHistory) {
 	checkNotify := false
 	silenced := s.Silenced()
+	recovered := s.recoveredUntil(r)
 	for ak, event := range r.Events {
-		checkNotify = s.runHistory(r, ak, event, silenced) || checkNotify
+		checkNotify = s.runHistory(r, ak, event, silenced, recovered[ak]) || checkNotify
 	}
 	if checkNotify && s.nc != nil {
 		select {
@@ -121,8 +141,35 @@ func (s *Schedule) RunHistory(r *RunHistory) {
 	}
 }
 
+// recoveredUntil returns the end of the post-recovery cooldown of the
+// instances in r, read from the data layer in one call if any of their alerts
+// has a recoveryCooldown.
+func (s *Schedule) recoveredUntil(r *RunHistory) map[expr.AlertKey]time.Time {
+	cooldown := false
+	for ak := range r.Events {
+		if a := s.Conf.Alerts[ak.Name()]; a != nil && a.RecoveryCooldown > 0 {
+			cooldown = true
+			break
+		}
+	}
+	if !cooldown {
+		return nil
+	}
+	all, err := s.DataAccess.Recoveries().GetAllRecovered()
+	if err != nil {
+		slog.Errorln(err)
+		return nil
+	}
+	recovered := make(map[expr.AlertKey]time.Time, len(all))
+	for ak, until := range all {
+		recovered[expr.AlertKey(ak)] = until
+	}
+	return recovered
+}
+
 // RunHistory for a single alert key. Returns true if notifications were altered.
-func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, silenced map[expr.AlertKey]Silence) bool {
+// recoveredUntil is the end of its post-recovery cooldown, or zero.
+func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, silenced map[expr.AlertKey]Silence, recoveredUntil time.Time) bool {
 	checkNotify := false
 	// get existing state object for alert key. add to schedule status if doesn't already exist
 	state := s.GetStatus(ak)
@@ -147,6 +194,10 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 	// assign incident id to new event if applicable
 	prev := state.Last()
 	event.Time = r.Start
+	a := s.Conf.Alerts[ak.Name()]
+	// An instance that fires again during its post-recovery cooldown
+	// continues its last incident.
+	refire := a.RecoveryCooldown > 0 && event.Status != StNormal && event.Time.Before(recoveredUntil)
 	if prev.IncidentId != 0 {
 		// If last event has incident id and is not closed, we continue it.
 		s.incidentLock.Lock()
@@ -155,14 +206,31 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 		}
 		s.incidentLock.Unlock()
 	}
+	if event.IncidentId == 0 && refire {
+		if ev := state.AbnormalEvent(); ev != nil && ev.IncidentId != 0 {
+			s.incidentLock.Lock()
+			if incident, ok := s.Incidents[ev.IncidentId]; ok {
+				incident.End = nil
+				event.IncidentId = ev.IncidentId
+			}
+			s.incidentLock.Unlock()
+		}
+	}
 	if event.IncidentId == 0 && event.Status != StNormal {
 		// Otherwise, create new incident on first non-normal event.
 		event.IncidentId = s.createIncident(ak, event.Time).Id
 	}
+	if event.IncidentId != 0 && event.impact != nil {
+		s.incidentLock.Lock()
+		if incident, ok := s.Incidents[event.IncidentId]; ok {
+			incident.Impact = event.impact
+		}
+		s.incidentLock.Unlock()
+	}
 	// add new event to state
 	last := state.AbnormalStatus()
+	recoveredFrom := last
 	state.Append(event)
-	a := s.Conf.Alerts[ak.Name()]
 	wasOpen := state.Open
 	// render templates and open alert key if abnormal
 	if event.Status > StNormal {
@@ -177,17 +245,23 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 	// If the old alert was not acknowledged, do nothing.
 	// Do nothing if state did not change.
 	notify := func(ns *conf.Notifications) {
+		// A snoozed incident is notified again when the snooze ends.
+		if !state.SnoozedUntil.IsZero() {
+			return
+		}
 		if a.Log {
 			lastLogTime := state.LastLogTime
-			now := time.Now()
+			now := s.Clock.Now()
 			if now.Before(lastLogTime.Add(a.MaxLogFrequency)) {
 				return
 			}
 			state.LastLogTime = now
 		}
 		nots := ns.Get(s.Conf, state.Group)
-		for _, n := range nots {
+		state.Notified = nil
+		for name, n := range nots {
 			s.Notify(state, n)
+			state.Notified = append(state.Notified, name)
 			checkNotify = true
 		}
 	}
@@ -210,7 +284,11 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 		}
 		state.NeedAck = true
 		switch event.Status {
-		case StCritical, StUnknown:
+		case StUnknown:
+			if !a.QuietUnknown {
+				notify(a.CritNotification)
+			}
+		case StCritical:
 			notify(a.CritNotification)
 		case StWarning:
 			notify(a.WarnNotification)
@@ -228,13 +306,47 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 	if last < StNormal || !wasOpen {
 		last = StNormal
 	}
+	// A re-fire during the cooldown only notifies if it is worse than
+	// before the recovery, which has not been notified yet.
+	if refire && recoveredFrom > last {
+		last = recoveredFrom
+	}
+	notifyRecovery := func() {
+		if s.sendRecovery(state, event, a, r) {
+			checkNotify = true
+		}
+	}
+	if !recoveredUntil.IsZero() && (refire || !event.Time.Before(recoveredUntil)) {
+		if err := s.DataAccess.Recoveries().ClearRecovered(string(ak)); err != nil {
+			slog.Errorln(err)
+		}
+		// Still normal when the cooldown ends, so the recovery is sent.
+		if event.Status == StNormal {
+			notifyRecovery()
+		}
+	}
 	if event.Status > last {
 		clearOld()
 		notifyCurrent()
 	} else if event.Status < last {
+		if event.Status == StNormal {
+			state.SnoozedUntil = time.Time{}
+		}
 		if _, hasOld := s.Notifications[ak]; hasOld {
 			notifyCurrent()
 		}
+		// Send recovery to whoever was notified last, once any cooldown
+		// passes without the instance firing again.
+		if event.Status == StNormal && a.RecoveryCooldown > 0 {
+			if prev.Status > StNormal {
+				if err := s.DataAccess.Recoveries().SetRecoveredUntil(string(ak), event.Time.Add(a.RecoveryCooldown)); err != nil {
+					slog.Errorln(err)
+					notifyRecovery()
+				}
+			}
+		} else if event.Status == StNormal {
+			notifyRecovery()
+		}
 		// Auto close silenced alerts.
 		if _, ok := silenced[ak]; ok && event.Status == StNormal {
 			go func(ak expr.AlertKey) {
@@ -250,11 +362,31 @@ func (s *Schedule) runHistory(r *RunHistory, ak expr.AlertKey, event *Event, sil
 	return checkNotify
 }
 
+// sendRecovery queues the recovery notification of state to the notifications
+// it was last sent to, if its alert has notifyRecovery. It returns whether any
+// were queued. The caller must hold the schedule lock.
+func (s *Schedule) sendRecovery(state *State, event *Event, a *conf.Alert, r *RunHistory) bool {
+	if !a.NotifyRecovery || len(state.Notified) == 0 {
+		return false
+	}
+	s.executeTemplates(state, event, a, r)
+	sent := false
+	for _, name := range state.Notified {
+		if n, ok := s.Conf.Notifications[name]; ok {
+			s.NotifyRecovery(state, n)
+			sent = true
+		}
+	}
+	state.Notified = nil
+	return sent
+}
+
 func (s *Schedule) executeTemplates(state *State, event *Event, a *conf.Alert, r *RunHistory) {
 	state.Subject = ""
 	state.Body = ""
 	state.EmailBody = nil
 	state.EmailSubject = nil
+	state.EmailText = nil
 	state.Attachments = nil
 	if event.Status != StUnknown {
 		metric := "template.render"
@@ -283,7 +415,20 @@ func (s *Schedule) executeTemplates(state *State, event *Event, a *conf.Alert, r
 		endTiming = collect.StartTimer(metric, opentsdb.TagSet{"alert": a.Name, "type": "emailsubject"})
 		emailsubject, eserr := s.ExecuteSubject(r, a, state, true)
 		endTiming()
-		if serr != nil || berr != nil || merr != nil || eserr != nil {
+		//Render plain text email body
+		endTiming = collect.StartTimer(metric, opentsdb.TagSet{"alert": a.Name, "type": "emailtext"})
+		emailtext, terr := s.ExecuteTextBody(r, a, state)
+		if terr != nil {
+			slog.Infof("%s: %v", state.AlertKey(), terr)
+		}
+		endTiming()
+		if serr != nil || berr != nil || merr != nil || eserr != nil || terr != nil {
+			for _, err := range []error{serr, berr, merr, eserr, terr} {
+				if err != nil {
+					s.markAlertError(a.Name, ErrorTemplate, err)
+					break
+				}
+			}
 			var err error
 
 			endTiming = collect.StartTimer(metric, opentsdb.TagSet{"alert": a.Name, "type": "bad"})
@@ -294,12 +439,14 @@ func (s *Schedule) executeTemplates(state *State, event *Event, a *conf.Alert, r
 				subject = []byte(fmt.Sprintf("unable to create template error notification: %v", err))
 			}
 			emailbody = body
+			emailtext = nil
 			attachments = nil
 		}
 		state.Subject = string(subject)
 		state.Body = string(body)
 		state.EmailBody = emailbody
 		state.EmailSubject = emailsubject
+		state.EmailText = emailtext
 		state.Attachments = attachments
 	}
 }
@@ -384,7 +531,7 @@ func (s *Schedule) CollectStates() {
 		ts := opentsdb.TagSet{"notification": notification}
 		var ago time.Duration
 		if !timeStamp.Equal(time.Unix(1<<63-62135596801, 999999999)) {
-			ago = time.Now().UTC().Sub(timeStamp)
+			ago = s.Clock.Now().UTC().Sub(timeStamp)
 		}
 		err := collect.Put("alerts.oldest_unacked_by_notification",
 			ts,
@@ -455,6 +602,40 @@ func (r *RunHistory) GetUnknownAndUnevaluatedAlertKeys(alert string) (unknown, u
 	return unknown, uneval
 }
 
+func (r *RunHistory) GetFailingAlerts() map[string]int {
+	failing := make(map[string]int)
+	for name, as := range r.schedule.GetErrorHistory() {
+		if as.Success {
+			continue
+		}
+		for _, err := range as.Errors {
+			failing[name] += err.Count
+		}
+	}
+	return failing
+}
+
+func (r *RunHistory) GetOpenIncidentCounts(filter string) (map[string]int, error) {
+	matches, err := makeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	r.schedule.Lock("GetOpenIncidentCounts")
+	defer r.schedule.Unlock()
+	for ak, st := range r.schedule.status {
+		if !st.Open {
+			continue
+		}
+		a := r.schedule.Conf.Alerts[ak.Name()]
+		if a == nil || !matches(r.schedule.Conf, a, st) {
+			continue
+		}
+		counts[ak.Name()]++
+	}
+	return counts, nil
+}
+
 var bosunStartupTime = time.Now()
 
 func (s *Schedule) findUnknownAlerts(now time.Time, alert string) []expr.AlertKey {
@@ -498,16 +679,158 @@ func (s *Schedule) CheckAlert(T miniprofiler.Timer, r *RunHistory, a *conf.Alert
 			warns, err = s.CheckExpr(T, r, a, a.Warn, StWarning, crits)
 		}
 	}
+	if err == nil && a.Impact != nil {
+		// The impact only orders incidents, so the check goes on without it.
+		if ierr := s.checkImpact(T, r, a); ierr != nil {
+			slog.Errorf("Error checking impact of alert %s: %s", a.Name, ierr.Error())
+			s.markAlertPartial(a.Name, fmt.Errorf("impact: %v", ierr))
+		}
+	}
+	if err == nil && a.MaxNewInstances > 0 {
+		// Existing instances are still evaluated, so the alert is not failing.
+		if lerr := s.limitNewInstances(r, a.Name, a.MaxNewInstances); lerr != nil {
+			slog.Warningf("alert %s: %v", a.Name, lerr)
+			s.markAlertWarning(a.Name, ErrorCardinality, lerr)
+		}
+	}
+	if len(r.partial) > 0 {
+		slog.Warningf("alert %s evaluated with partial results", a.Name)
+		s.markAlertPartial(a.Name, fmt.Errorf("partial results, failed queries: %s", strings.Join(r.partial, "; ")))
+	}
 	unevalCount, unknownCount := markDependenciesUnevaluated(r.Events, deps, a.Name)
-	if err != nil {
+	if a.SuppressDuringParentSilence {
+		unevalCount += markParentSilencesUnevaluated(r.Events, s.Silenced(), a)
+	}
+	if _, ok := err.(*expr.BreakerOpenError); ok {
+		slog.Warningf("Skipping alert %s: %s", a.Name, err.Error())
+		unevalCount = s.markAlertUnevaluated(r, a.Name)
+		if s.markAlertError(a.Name, ErrorDatasource, err) {
+			slog.Warningf("alert %s started failing", a.Name)
+		}
+	} else if err != nil {
 		slog.Errorf("Error checking alert %s: %s", a.Name, err.Error())
 		removeUnknownEvents(r.Events, a.Name)
-		s.markAlertError(a.Name, err)
-	} else {
-		s.markAlertSuccessful(a.Name)
+		if s.markAlertError(a.Name, ErrorQuery, err) {
+			slog.Warningf("alert %s started failing", a.Name)
+		}
+	} else if s.markAlertSuccessful(a.Name) {
+		slog.Infof("alert %s recovered from failing", a.Name)
+	}
+	if err != nil && a.UnknownAfterError > 0 {
+		if since := s.alertFailingSince(a.Name); !since.IsZero() && s.Clock.Now().Sub(since) >= a.UnknownAfterError {
+			unknownCount += s.markAlertUnknown(r, a.Name)
+		}
 	}
 	collect.Put("check.duration", opentsdb.TagSet{"name": a.Name}, time.Since(start).Seconds())
 	slog.Infof("check alert %v done (%s): %v crits, %v warns, %v unevaluated, %v unknown", a.Name, time.Since(start), len(crits), len(warns), unevalCount, unknownCount)
+	info := &database.AlertEvalInfo{
+		Time:        r.Start.Unix(),
+		Duration:    time.Since(start),
+		Crits:       len(crits),
+		Warns:       len(warns),
+		Unevaluated: unevalCount,
+		Unknown:     unknownCount,
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	if err := s.DataAccess.EvalInfo().SetAlertEvalInfo(a.Name, info); err != nil {
+		slog.Errorf("storing last evaluation of %s: %v", a.Name, err)
+	}
+}
+
+// GetAlertEvalInfo returns the last evaluation of the named alert, or nil if
+// it has not run.
+func (s *Schedule) GetAlertEvalInfo(name string) (*database.AlertEvalInfo, error) {
+	if s.Conf.Alerts[name] == nil {
+		return nil, fmt.Errorf("unknown alert: %s", name)
+	}
+	return s.DataAccess.EvalInfo().GetAlertEvalInfo(name)
+}
+
+// checkImpact evaluates the impact expression of a, and gives each event of
+// a the value of the impact result whose group is a subset of its own.
+func (s *Schedule) checkImpact(T miniprofiler.Timer, r *RunHistory, a *conf.Alert) error {
+	results, err := s.executeExpr(T, r, a, a.Impact)
+	if err != nil {
+		return err
+	}
+	for ak, ev := range r.Events {
+		if ak.Name() != a.Name {
+			continue
+		}
+		for _, res := range results.Results {
+			if !ak.Group().Subset(res.Group) {
+				continue
+			}
+			var n float64
+			switch v := res.Value.(type) {
+			case expr.Number:
+				n = float64(v)
+			case expr.Scalar:
+				n = float64(v)
+			default:
+				return fmt.Errorf("impact: expected number or scalar")
+			}
+			ev.impact = &n
+			break
+		}
+	}
+	return nil
+}
+
+// limitNewInstances drops the events of new instances of alert if there are
+// more than max of them, so a query with a high-cardinality tag can not create
+// an unbounded number of states and incidents.
+func (s *Schedule) limitNewInstances(r *RunHistory, alert string, max int) error {
+	s.Lock("limitNewInstances")
+	defer s.Unlock()
+	var added []expr.AlertKey
+	for ak := range r.Events {
+		if ak.Name() != alert {
+			continue
+		}
+		if _, ok := s.status[ak]; !ok {
+			added = append(added, ak)
+		}
+	}
+	if len(added) <= max {
+		return nil
+	}
+	for _, ak := range added {
+		delete(r.Events, ak)
+	}
+	return fmt.Errorf("cardinality exceeded: %d new instances, limit is %d (maxNewInstances)", len(added), max)
+}
+
+// markAlertUnevaluated marks every known instance of alert unevaluated, so
+// their states are kept as they are while the alert cannot be checked.
+func (s *Schedule) markAlertUnevaluated(r *RunHistory, alert string) (unevalCount int) {
+	s.Lock("markAlertUnevaluated")
+	defer s.Unlock()
+	for ak, st := range s.status {
+		if ak.Name() != alert {
+			continue
+		}
+		r.Events[ak] = &Event{Status: st.Last().Status, Unevaluated: true}
+		unevalCount++
+	}
+	return unevalCount
+}
+
+// markAlertUnknown marks every known instance of alert unknown, for alerts
+// that have failed to evaluate for longer than their unknownAfterError.
+func (s *Schedule) markAlertUnknown(r *RunHistory, alert string) (unknownCount int) {
+	s.Lock("markAlertUnknown")
+	defer s.Unlock()
+	for ak := range s.status {
+		if ak.Name() != alert {
+			continue
+		}
+		r.Events[ak] = &Event{Status: StUnknown}
+		unknownCount++
+	}
+	return unknownCount
 }
 
 func removeUnknownEvents(evs map[expr.AlertKey]*Event, alert string) {
@@ -558,11 +881,103 @@ func markDependenciesUnevaluated(events map[expr.AlertKey]*Event, deps expr.Resu
 	return unevalCount, unknownCount
 }
 
+// markParentSilencesUnevaluated marks events of a unevaluated if an
+// overlapping instance of an alert that a depends on is silenced, so no
+// incidents are created during the parent's maintenance.
+func markParentSilencesUnevaluated(events map[expr.AlertKey]*Event, silenced map[expr.AlertKey]Silence, a *conf.Alert) (unevalCount int) {
+	parents := make(map[string]bool)
+	for _, name := range a.DependsAlerts {
+		parents[name] = true
+	}
+	for ak, ev := range events {
+		if ak.Name() != a.Name || ev.Unevaluated {
+			continue
+		}
+		for sak := range silenced {
+			if !parents[sak.Name()] {
+				continue
+			}
+			if g := sak.Group(); len(g) == 0 || g.Overlaps(ak.Group()) {
+				ev.Unevaluated = true
+				unevalCount++
+				break
+			}
+		}
+	}
+	return unevalCount
+}
+
+// AlertPreview describes the instances an alert would produce if it were
+// evaluated now.
+type AlertPreview struct {
+	Total, Critical, Warning, Normal int
+	// Truncated is true if there were more than the requested number of
+	// instances. The counts above still include all of them.
+	Truncated bool
+	Instances []*PreviewInstance
+}
+
+type PreviewInstance struct {
+	AlertKey expr.AlertKey
+	Status   Status
+}
+
+// PreviewAlert evaluates the warn and crit expressions of a and returns the
+// resulting instances without recording state or sending notifications.
+// At most limit instances are returned, most severe first.
+func (s *Schedule) PreviewAlert(T miniprofiler.Timer, a *conf.Alert, now time.Time, limit int) (*AlertPreview, error) {
+	rh := s.NewRunHistory(now, cache.New(0))
+	if _, err := s.CheckExpr(T, rh, a, a.Warn, StWarning, nil); err != nil {
+		return nil, err
+	}
+	if _, err := s.CheckExpr(T, rh, a, a.Crit, StCritical, nil); err != nil {
+		return nil, err
+	}
+	p := &AlertPreview{Total: len(rh.Events)}
+	for ak, event := range rh.Events {
+		switch event.Status {
+		case StCritical:
+			p.Critical++
+		case StWarning:
+			p.Warning++
+		default:
+			p.Normal++
+		}
+		p.Instances = append(p.Instances, &PreviewInstance{
+			AlertKey: ak,
+			Status:   event.Status,
+		})
+	}
+	slice.Sort(p.Instances, func(i, j int) bool {
+		a, b := p.Instances[i], p.Instances[j]
+		if a.Status != b.Status {
+			return a.Status > b.Status
+		}
+		return a.AlertKey < b.AlertKey
+	})
+	if limit > 0 && len(p.Instances) > limit {
+		p.Instances = p.Instances[:limit]
+		p.Truncated = true
+	}
+	return p, nil
+}
+
 func (s *Schedule) executeExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert, e *expr.Expr) (*expr.Results, error) {
 	if e == nil {
 		return nil, nil
 	}
-	results, _, err := e.Execute(rh.Context, rh.GraphiteContext, rh.Logstash, rh.InfluxConfig, rh.Cache, T, rh.Start, 0, a.UnjoinedOK, s.Search, s.Conf.AlertSquelched(a), rh)
+	results, _, err := rh.limit(e).Execute(rh.Context, rh.GraphiteContext, rh.Logstash, rh.InfluxConfig, rh.Cache, T, rh.Start, 0, a.UnjoinedOK, s.Search, s.Conf.AlertSquelched(a), rh)
+	if err == nil {
+	Partial:
+		for _, q := range results.Partial {
+			for _, seen := range rh.partial {
+				if q == seen {
+					continue Partial
+				}
+			}
+			rh.partial = append(rh.partial, q)
+		}
+	}
 	return results, err
 }
 
@@ -619,7 +1034,12 @@ Loop:
 		}
 		status := checkStatus
 		if math.IsNaN(n) {
-			status = checkStatus
+			switch a.StaleState {
+			case "normal":
+				status = StNormal
+			case "unknown":
+				status = StUnknown
+			}
 		} else if n == 0 {
 			status = StNormal
 		}
@@ -3,12 +3,17 @@ package sched
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
@@ -129,7 +134,7 @@ func TestCheckSilence(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = s.AddSilence(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), "a", "", false, true, "", "user", "message")
+	_, _, err = s.AddSilence(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), "a", "", "", false, true, false, "", "user", "message")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -143,6 +148,81 @@ func TestCheckSilence(t *testing.T) {
 	}
 }
 
+func TestSilenceMaxStatus(t *testing.T) {
+	posts := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = {{.Alert.Name}}
+		}
+		notification n {
+			post = http://%s/
+		}
+		alert w {
+			template = t
+			warnNotification = n
+			warn = 1
+		}
+		alert c {
+			template = t
+			critNotification = n
+			crit = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	if _, _, err := s.AddSilence(now.Add(-time.Hour), now.Add(time.Hour), "", "host=x", "warning", false, true, false, "", "user", "deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.AddSilence(now, now.Add(time.Hour), "", "host=x", "normal", false, false, false, "", "user", "deploy"); err == nil {
+		t.Error("expected maxStatus normal to be rejected")
+	}
+	wak := expr.NewAlertKey("w", opentsdb.TagSet{"host": "x"})
+	cak := expr.NewAlertKey("c", opentsdb.TagSet{"host": "x"})
+	s.RunHistory(&RunHistory{
+		Start: now,
+		Events: map[expr.AlertKey]*Event{
+			wak: {Status: StWarning},
+			cak: {Status: StCritical},
+		},
+	})
+	silenced := s.Silenced()
+	if _, ok := silenced[wak]; !ok {
+		t.Errorf("expected %s to be silenced", wak)
+	}
+	if _, ok := silenced[cak]; ok {
+		t.Errorf("expected %s not to be silenced", cak)
+	}
+	s.CheckNotifications()
+	select {
+	case p := <-posts:
+		if p != "c" {
+			t.Fatalf("expected the critical alert to notify, got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("critical alert did not notify")
+	}
+	select {
+	case p := <-posts:
+		t.Fatalf("silenced warning notified: %q", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
 func TestIncidentIds(t *testing.T) {
 	c, err := conf.New("", `
 		alert a {
@@ -482,3 +562,1270 @@ func TestCheckCritUnknownEmpty(t *testing.T) {
 	s.RunHistory(r)
 	verify(true)
 }
+
+func TestBosunStateFuncs(t *testing.T) {
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+		alert b {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.markAlertError("a", ErrorQuery, fmt.Errorf("boom"))
+	s.markAlertError("a", ErrorQuery, fmt.Errorf("boom"))
+	s.markAlertError("b", ErrorQuery, fmt.Errorf("boom"))
+	s.markAlertSuccessful("b")
+	r := &RunHistory{
+		Events: map[expr.AlertKey]*Event{
+			expr.NewAlertKey("b", opentsdb.TagSet{"host": "x"}): {Status: StCritical},
+			expr.NewAlertKey("b", opentsdb.TagSet{"host": "y"}): {Status: StCritical},
+		},
+	}
+	s.RunHistory(r)
+	rh := s.NewRunHistory(time.Now(), nil)
+	run := func(q string, expected map[string]float64) {
+		e, err := expr.New(q, c.Funcs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := e.Execute(rh.Context, rh.GraphiteContext, rh.Logstash, rh.InfluxConfig, nil, nil, rh.Start, 0, false, nil, nil, rh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != len(expected) {
+			t.Fatalf("%s: expected %d results, got %d", q, len(expected), len(res.Results))
+		}
+		for _, r := range res.Results {
+			name := r.Group["alert"]
+			if v, ok := expected[name]; !ok || float64(r.Value.(expr.Number)) != v {
+				t.Errorf("%s: unexpected value %v for alert %s", q, r.Value, name)
+			}
+		}
+	}
+	run(`bosunErrors()`, map[string]float64{"a": 2})
+	run(`bosunIncidents("")`, map[string]float64{"b": 2})
+	run(`bosunIncidents("host=x")`, map[string]float64{"b": 1})
+}
+
+func TestCheckMuted(t *testing.T) {
+	nc := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = {{.Last.Status}}
+		}
+		notification n {
+			post = http://%s/
+		}
+		alert a {
+			template = t
+			warnNotification = n
+			warn = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMute("a", "user", "known issue", true); err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	s.CheckNotifications()
+	select {
+	case r := <-nc:
+		t.Fatalf("muted notification was sent: %v", r)
+	case <-time.After(time.Second):
+	}
+	if st := s.GetStatus(expr.NewAlertKey("a", nil)); st == nil || st.Last().Status != StWarning {
+		t.Fatalf("expected warning state to be recorded while muted")
+	}
+	if m := s.GetMutes()["a"]; m == nil || len(m.Actions) != 1 || m.Actions[0].User != "user" {
+		t.Fatalf("expected mute audit entry")
+	}
+	if err := s.SetMute("b", "user", "", true); err == nil {
+		t.Fatal("expected error muting unknown alert")
+	}
+}
+
+func TestPreviewAlert(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"metric":"m","tags":{"host":"a"},"dps":{"0":3}},
+			{"metric":"m","tags":{"host":"b"},"dps":{"0":2}},
+			{"metric":"m","tags":{"host":"c"},"dps":{"0":0}}
+		]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			$q = avg(q("avg:m{host=*}", "5m", ""))
+			warn = $q > 1
+			crit = $q > 2
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.PreviewAlert(nil, c.Alerts["a"], time.Now(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Total != 3 || p.Critical != 1 || p.Warning != 1 || p.Normal != 1 {
+		t.Fatalf("unexpected counts: %+v", p)
+	}
+	if !p.Truncated || len(p.Instances) != 2 {
+		t.Fatalf("expected 2 of 3 instances, got %d", len(p.Instances))
+	}
+	if p.Instances[0].AlertKey != "a{host=a}" || p.Instances[0].Status != StCritical {
+		t.Errorf("expected critical a{host=a} first, got %v %v", p.Instances[0].AlertKey, p.Instances[0].Status)
+	}
+	if len(s.status) != 0 {
+		t.Errorf("preview should not record state, got %d states", len(s.status))
+	}
+}
+
+func TestAckIncidents(t *testing.T) {
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+		alert b {
+			warn = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ax := expr.NewAlertKey("a", opentsdb.TagSet{"host": "x"})
+	ay := expr.NewAlertKey("a", opentsdb.TagSet{"host": "y"})
+	bx := expr.NewAlertKey("b", opentsdb.TagSet{"host": "x"})
+	s.RunHistory(&RunHistory{
+		Events: map[expr.AlertKey]*Event{
+			ax: {Status: StCritical},
+			ay: {Status: StCritical},
+			bx: {Status: StWarning},
+		},
+	})
+	acked, err := s.AckIncidents("status:critical", "user", "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acked) != 2 || acked[0] != ax || acked[1] != ay {
+		t.Fatalf("unexpected acked keys: %v", acked)
+	}
+	for _, ak := range []expr.AlertKey{ax, ay} {
+		st := s.GetStatus(ak)
+		if st.NeedAck || len(st.Actions) != 1 || st.Actions[0].Type != ActionAcknowledge {
+			t.Errorf("%s: expected acknowledgement", ak)
+		}
+		_, _, actions, err := s.GetIncidentEvents(st.Last().IncidentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actions) != 1 || actions[0].User != "user" || actions[0].Message != "outage" {
+			t.Errorf("%s: expected acknowledgement in incident history, got %v", ak, actions)
+		}
+	}
+	if !s.GetStatus(bx).NeedAck {
+		t.Errorf("%s: should not be acknowledged", bx)
+	}
+	// Already acknowledged alerts are skipped.
+	if acked, err = s.AckIncidents("status:critical", "user", "again"); err != nil || len(acked) != 0 {
+		t.Fatalf("expected nothing to ack, got %v, %v", acked, err)
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %[1]s
+		template good {
+			subject = {{.Last.Status}}
+		}
+		template bad {
+			subject = {{index "abc" 10}}
+		}
+		notification n {
+			post = http://%[1]s/
+		}
+		alert query {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+		}
+		alert tmpl {
+			template = bad
+			crit = 1
+		}
+		alert notify {
+			template = good
+			critNotification = n
+			crit = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	s.CheckNotifications()
+	// Delivery errors are recorded, but do not mark the alert as failing.
+	// notifications are delivered asynchronously.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if as := s.GetErrorHistory()["notify"]; as != nil && len(as.Errors) > 0 {
+			break
+		}
+	}
+	expected := map[ErrorCategory][]string{
+		ErrorQuery:    {"query"},
+		ErrorTemplate: {"tmpl"},
+	}
+	if got := s.GetFailingAlertsByCategory(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for name, cat := range map[string]ErrorCategory{"query": ErrorQuery, "tmpl": ErrorTemplate, "notify": ErrorNotification} {
+		as := s.GetErrorHistory()[name]
+		if len(as.Errors) != 1 || as.Errors[0].Category != cat {
+			t.Errorf("%s: expected one %s error, got %+v", name, cat, as.Errors)
+		}
+	}
+	if !s.AlertSuccessful("notify") {
+		t.Error("notify: delivery error marked the alert as failing")
+	}
+}
+
+func TestCheckStaleState(t *testing.T) {
+	// A single point is too little history for pctchange, so it evaluates to NaN.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":3}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		macro m {
+			crit = pctchange(q("avg:m{host=*}", "5m", ""), "1h")
+		}
+		alert dflt {
+			macro = m
+		}
+		alert normal {
+			macro = m
+			staleState = normal
+		}
+		alert unknown {
+			macro = m
+			staleState = unknown
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	for name, expected := range map[string]Status{
+		"dflt":    StCritical,
+		"normal":  StNormal,
+		"unknown": StUnknown,
+	} {
+		st := s.GetStatus(expr.NewAlertKey(name, opentsdb.TagSet{"host": "a"}))
+		if st == nil || st.Last().Status != expected {
+			t.Errorf("%s: expected %v, got %+v", name, expected, st)
+		}
+	}
+}
+
+func TestCheckBreakerOpen(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":1}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		breakerThreshold = 1
+		alert a {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak := expr.NewAlertKey("a", opentsdb.TagSet{"host": "a"})
+	check(s, time.Now())
+	if st := s.GetStatus(ak); st == nil || st.Last().Status != StCritical {
+		t.Fatalf("expected critical state, got %+v", st)
+	}
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	check(s, time.Now().Add(time.Minute))
+	if b := c.TSDBBreaker.State(); b != expr.BreakerOpen {
+		t.Fatalf("expected open breaker, got %v", b)
+	}
+	st := s.GetStatus(ak)
+	if !st.Unevaluated || st.Last().Status != StCritical {
+		t.Fatalf("expected unevaluated critical state, got unevaluated=%v %v", st.Unevaluated, st.Last().Status)
+	}
+	if cats := s.GetFailingAlertsByCategory(); len(cats[ErrorDatasource]) != 1 {
+		t.Fatalf("expected a datasource error, got %v", cats)
+	}
+}
+
+func TestErrorCoalesce(t *testing.T) {
+	c, err := conf.New("", `errorCoalesce = 1h`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	s.Clock = clock
+	boom := fmt.Errorf("boom")
+	s.markAlertError("a", ErrorQuery, boom)
+	// Each repeat inside the window moves LastTime and Count on, but
+	// FirstTime stays at the first occurrence.
+	for i := 2; i <= 3; i++ {
+		clock.Advance(10 * time.Minute)
+		s.markAlertError("a", ErrorQuery, boom)
+		last := s.GetLastErrors([]string{"a"})["a"]
+		if last == nil || last.Count != i || !last.FirstTime.Equal(start) || !last.LastTime.Equal(clock.Now()) {
+			t.Fatalf("after %d errors: expected count %d from %v to %v, got %+v", i, i, start, clock.Now(), last)
+		}
+	}
+	errs := s.AlertStatuses["a"].Errors
+	if len(errs) != 1 {
+		t.Fatalf("expected one error inside the window, got %+v", errs)
+	}
+	// The same error after the window is a new event.
+	errs[0].LastTime = errs[0].LastTime.Add(-2 * time.Hour)
+	s.markAlertError("a", ErrorQuery, boom)
+	errs = s.AlertStatuses["a"].Errors
+	if len(errs) != 2 || errs[0].Count != 3 || errs[1].Count != 1 {
+		t.Fatalf("expected a new error outside the window, got %+v", errs)
+	}
+}
+
+func TestAlertFailureTransitions(t *testing.T) {
+	c, err := conf.New("", `alert a {
+		crit = 1
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Clock = &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	boom := fmt.Errorf("boom")
+	if !s.markAlertError("a", ErrorQuery, boom) {
+		t.Error("first failure: expected a new failure")
+	}
+	if s.markAlertError("a", ErrorQuery, boom) {
+		t.Error("repeat failure: expected no new failure")
+	}
+	if !s.markAlertSuccessful("a") {
+		t.Error("success after failure: expected a recovery")
+	}
+	if s.markAlertSuccessful("a") {
+		t.Error("repeat success: expected no recovery")
+	}
+	if !s.markAlertError("a", ErrorQuery, boom) {
+		t.Error("failure after recovery: expected a new failure")
+	}
+	if s.markAlertSuccessful("b") {
+		t.Error("first success: expected no recovery")
+	}
+	// Template and notification errors do not make the alert fail to
+	// evaluate, so they neither start a failure nor end in a recovery.
+	s.markAlertSuccessful("a")
+	if s.markAlertError("a", ErrorTemplate, boom) {
+		t.Error("template error: expected no new failure")
+	}
+	if s.markAlertSuccessful("a") {
+		t.Error("success after template error: expected no recovery")
+	}
+	s.markDeliveryError("a", boom)
+	if !s.AlertSuccessful("a") {
+		t.Error("delivery error: expected the alert to stay successful")
+	}
+	if !s.markAlertError("a", ErrorQuery, boom) {
+		t.Error("query error after notification error: expected a new failure")
+	}
+}
+
+func TestAlertEvalInfo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert ok {
+			crit = 1
+		}
+		alert broken {
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 1
+		}
+		alert idle {
+			crit = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.ctx.runTime = start
+	s.checkAlert(c.Alerts["ok"])
+	s.checkAlert(c.Alerts["broken"])
+	info, err := s.GetAlertEvalInfo("ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Time != start.Unix() || info.Crits != 1 || info.Error != "" {
+		t.Errorf("unexpected last evaluation of ok: %+v", info)
+	}
+	info, err = s.GetAlertEvalInfo("broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Crits != 0 || !strings.Contains(info.Error, "boom") {
+		t.Errorf("expected the last evaluation of broken to have failed, got %+v", info)
+	}
+	if info, err := s.GetAlertEvalInfo("idle"); err != nil || info != nil {
+		t.Errorf("expected no evaluation of idle, got %+v, %v", info, err)
+	}
+	if _, err := s.GetAlertEvalInfo("missing"); err == nil {
+		t.Error("expected an error for an unknown alert")
+	}
+}
+
+func TestGetFailingAlertsPage(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("a%05d", i)
+		if i%10 == 0 {
+			s.markAlertSuccessful(name)
+		} else {
+			s.markAlertError(name, ErrorQuery, fmt.Errorf("boom"))
+		}
+	}
+	failing := n - n/10
+	var all []string
+	for offset := 0; ; offset += 128 {
+		page, total, err := s.GetFailingAlertsPage(offset, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != failing {
+			t.Fatalf("expected total %d, got %d", failing, total)
+		}
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+	}
+	if len(all) != failing {
+		t.Fatalf("expected %d alerts over all pages, got %d", failing, len(all))
+	}
+	for i, name := range all {
+		if i > 0 && name <= all[i-1] {
+			t.Fatalf("alerts out of order at %d: %s after %s", i, name, all[i-1])
+		}
+		if name == "a00000" || name == "a04990" {
+			t.Fatalf("successful alert %s listed as failing", name)
+		}
+	}
+	// Pages of the same set are the same.
+	page, _, _ := s.GetFailingAlertsPage(1000, 10)
+	again, _, _ := s.GetFailingAlertsPage(1000, 10)
+	for i := range page {
+		if page[i] != again[i] || page[i] != all[1000+i] {
+			t.Fatalf("inconsistent pages: %v, %v", page, again)
+		}
+	}
+	if page, total, err := s.GetFailingAlertsPage(failing+10, 10); err != nil || len(page) != 0 || total != failing {
+		t.Errorf("expected an empty page past the end, got %v, %d, %v", page, total, err)
+	}
+	if _, _, err := s.GetFailingAlertsPage(-1, 10); err == nil {
+		t.Error("expected error for negative offset")
+	}
+	// A count that would overflow offset + count returns the rest.
+	if page, _, err := s.GetFailingAlertsPage(1000, math.MaxInt64); err != nil || len(page) != failing-1000 {
+		t.Errorf("expected the rest of the failing alerts, got %d, %v", len(page), err)
+	}
+}
+
+func TestGetAlertStates(t *testing.T) {
+	c, err := conf.New("", `
+		alert crit {
+			crit = 1
+		}
+		alert warn {
+			warn = 1
+		}
+		alert quiet {
+			crit = 0
+		}
+		alert failing {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(name, host string) expr.AlertKey {
+		return expr.NewAlertKey(name, opentsdb.TagSet{"host": host})
+	}
+	s.RunHistory(&RunHistory{
+		Start: time.Now(),
+		Events: map[expr.AlertKey]*Event{
+			key("crit", "a"):    {Status: StCritical},
+			key("crit", "b"):    {Status: StWarning},
+			key("crit", "c"):    {Status: StUnknown},
+			key("warn", "a"):    {Status: StWarning},
+			key("warn", "b"):    {Status: StNormal},
+			key("failing", "a"): {Status: StNormal},
+		},
+	})
+	// A state left over from a removed alert is not listed.
+	s.SetStatus(key("removed", "a"), NewStatus(key("removed", "a")))
+	s.markAlertError("failing", ErrorQuery, fmt.Errorf("boom"))
+	s.markAlertSuccessful("crit")
+	expected := []*AlertState{
+		{Alert: "crit", Status: StUnknown, Instances: 3},
+		{Alert: "failing", Status: StNormal, Instances: 1, Failing: true},
+		{Alert: "quiet", Status: StNone},
+		{Alert: "warn", Status: StWarning, Instances: 2},
+	}
+	if got := s.GetAlertStates(); !reflect.DeepEqual(got, expected) {
+		for _, as := range got {
+			t.Logf("%+v", as)
+		}
+		t.Errorf("unexpected alert states")
+	}
+}
+
+func TestGetErrorStats(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC)
+	s.Clock = &fakeClock{now: now}
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	failingSince := ago(30 * time.Minute)
+	s.AlertStatuses["failing"] = &AlertStatus{
+		FailingSince: failingSince,
+		Errors: []*AlertError{
+			// Too old to count.
+			{FirstTime: ago(72 * time.Hour), LastTime: ago(48 * time.Hour), Count: 100},
+			{FirstTime: ago(5 * time.Hour), LastTime: ago(5 * time.Hour), Count: 1},
+			// A run of 7 repeats every 10 minutes, 4 of them in the last
+			// hour.
+			{FirstTime: ago(90 * time.Minute), LastTime: ago(30 * time.Minute), Count: 7},
+			{FirstTime: ago(time.Minute), LastTime: ago(time.Minute), Count: 1},
+		},
+	}
+	s.AlertStatuses["recovered"] = &AlertStatus{
+		Success: true,
+		Errors: []*AlertError{
+			{FirstTime: ago(2 * time.Hour), LastTime: ago(2 * time.Hour), Count: 2},
+		},
+	}
+	s.AlertStatuses["ok"] = &AlertStatus{Success: true}
+	stats := s.GetErrorStats()
+	expected := map[string]*ErrorStats{
+		"failing":   {LastHour: 5, LastDay: 9, Failing: true, FailingSince: failingSince},
+		"recovered": {LastDay: 2},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		for name, st := range stats {
+			t.Logf("%s: %+v", name, st)
+		}
+		t.Errorf("unexpected error stats")
+	}
+}
+
+func TestCompactErrors(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &AlertStatus{}
+	for i := 0; i < 100; i++ {
+		as.Errors = append(as.Errors, &AlertError{Message: fmt.Sprint(i / 2), Count: 1})
+	}
+	s.AlertStatuses["a"] = as
+	if n := s.compactErrors(0, true); n != 50 {
+		t.Errorf("expected dedup to remove 50 entries, removed %v", n)
+	}
+	if len(as.Errors) != 50 || as.Errors[0].Count != 2 || as.Errors[49].Message != "49" {
+		t.Fatalf("unexpected errors after dedup: %+v", as.Errors)
+	}
+	if n := s.compactErrors(10, false); n != 40 {
+		t.Errorf("expected trim to remove 40 entries, removed %v", n)
+	}
+	if len(as.Errors) != 10 || as.Errors[0].Message != "40" || as.Errors[9].Message != "49" {
+		t.Fatalf("expected the 10 most recent errors, got %+v", as.Errors)
+	}
+
+	// Categories are deduplicated separately, entries split by errorCoalesce
+	// stay split, and merged entries keep the history in time order.
+	c.ErrorCoalesce = time.Hour
+	now := time.Now().UTC()
+	at := func(m int) time.Time { return now.Add(time.Duration(m) * time.Minute) }
+	as.Errors = []*AlertError{
+		{Message: "q", Category: ErrorQuery, FirstTime: at(0), LastTime: at(0), Count: 1},
+		{Message: "t", Category: ErrorTemplate, FirstTime: at(1), LastTime: at(1), Count: 1},
+		{Message: "q", Category: ErrorQuery, FirstTime: at(2), LastTime: at(2), Count: 1},
+		{Message: "u", Category: ErrorTemplate, FirstTime: at(3), LastTime: at(3), Count: 1},
+		{Message: "q", Category: ErrorTemplate, FirstTime: at(4), LastTime: at(4), Count: 1},
+		{Message: "q", Category: ErrorQuery, FirstTime: at(180), LastTime: at(180), Count: 1},
+	}
+	if n := s.compactErrors(0, true); n != 1 {
+		t.Errorf("expected dedup to remove 1 entry, removed %v", n)
+	}
+	type entry struct {
+		Message  string
+		Category ErrorCategory
+		Count    int
+	}
+	var got []entry
+	for i, e := range as.Errors {
+		got = append(got, entry{e.Message, e.Category, e.Count})
+		if i > 0 && e.LastTime.Before(as.Errors[i-1].LastTime) {
+			t.Errorf("entry %d is older than the one before it", i)
+		}
+	}
+	expected := []entry{
+		{"t", ErrorTemplate, 1},
+		{"q", ErrorQuery, 2},
+		{"u", ErrorTemplate, 1},
+		{"q", ErrorTemplate, 1},
+		{"q", ErrorQuery, 1},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected errors after dedup: %+v", got)
+	}
+}
+
+func TestClearErrorsResetsFailingSince(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := func() {
+		for _, name := range []string{"a", "b", "c"} {
+			s.markAlertError(name, ErrorQuery, fmt.Errorf("boom"))
+		}
+	}
+	clears := map[string]func() error{
+		"ClearAlertErrors": func() error { return s.ClearAlertErrors("a", "u") },
+		"ClearAlerts": func() error {
+			_, err := s.ClearAlerts([]string{"a", "b", "c"}, "u")
+			return err
+		},
+		"ClearAllErrors": func() error { return s.ClearAllErrors("u") },
+		"ClearErrorLine": func() error {
+			s.ClearErrorLine("a", s.AlertStatuses["a"].Errors[0].FirstTime)
+			return nil
+		},
+	}
+	for name, clear := range clears {
+		fail()
+		if err := clear(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if since := s.alertFailingSince("a"); !since.IsZero() {
+			t.Errorf("%s: FailingSince still %v", name, since)
+		}
+		if !s.markAlertError("a", ErrorQuery, fmt.Errorf("boom")) {
+			t.Errorf("%s: the next error is not a new failure", name)
+		}
+		s.ClearAllErrors("u")
+	}
+}
+
+func TestUnknownAfterError(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":1}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		notification n {
+			post = http://%[1]s/
+		}
+		template t {
+			subject = {{.Last.Status}}
+		}
+		alert a {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 5
+			critNotification = n
+			unknownAfterError = 10m
+		}
+		alert quiet {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 5
+			critNotification = n
+			unknownAfterError = 10m
+			quietUnknown = true
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak := expr.NewAlertKey("a", opentsdb.TagSet{"host": "a"})
+	quiet := expr.NewAlertKey("quiet", opentsdb.TagSet{"host": "a"})
+	now := time.Now()
+	check(s, now)
+	if st := s.GetStatus(ak); st == nil || st.Last().Status != StNormal {
+		t.Fatalf("expected normal state, got %+v", st)
+	}
+	mu.Lock()
+	down = true
+	mu.Unlock()
+
+	// A short outage leaves the state alone.
+	check(s, now.Add(time.Minute))
+	if st := s.GetStatus(ak).Last().Status; st != StNormal {
+		t.Fatalf("expected normal during a short outage, got %v", st)
+	}
+	if s.alertFailingSince("a").IsZero() {
+		t.Fatal("expected failure start to be recorded")
+	}
+
+	// A sustained one makes it unknown.
+	for _, name := range []string{"a", "quiet"} {
+		s.AlertStatuses[name].FailingSince = time.Now().Add(-time.Hour)
+	}
+	s.pendingNotifications = nil
+	check(s, now.Add(2*time.Minute))
+	for _, k := range []expr.AlertKey{ak, quiet} {
+		if st := s.GetStatus(k).Last().Status; st != StUnknown {
+			t.Fatalf("%s: expected unknown after a sustained outage, got %v", k, st)
+		}
+	}
+	var notified []expr.AlertKey
+	for _, states := range s.pendingNotifications {
+		for _, st := range states {
+			notified = append(notified, st.AlertKey())
+		}
+	}
+	if len(notified) != 1 || notified[0] != ak {
+		t.Fatalf("expected only %s to notify, got %v", ak, notified)
+	}
+
+	// Recovery clears the failure start.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	check(s, now.Add(3*time.Minute))
+	if !s.alertFailingSince("a").IsZero() {
+		t.Fatal("expected failure start to be cleared")
+	}
+}
+
+func TestNotifyRecovery(t *testing.T) {
+	var mu sync.Mutex
+	value := 1.5
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":%v}}]`, value)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		notification chat {
+			print = true
+		}
+		notification pager {
+			print = true
+		}
+		template t {
+			subject = {{.Last.Status}}
+		}
+		alert escalate {
+			template = t
+			warn = avg(q("avg:m{host=*}", "5m", "")) > 1
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			warnNotification = chat
+			critNotification = pager
+			notifyRecovery = true
+		}
+		alert warnonly {
+			template = t
+			warn = avg(q("avg:m{host=*}", "5m", "")) > 1
+			warnNotification = chat
+			notifyRecovery = true
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// step sets the queried value, runs a check and returns the notifications
+	// sent by each alert and the status they were sent for.
+	step := func(v float64, i int) map[string]string {
+		mu.Lock()
+		value = v
+		mu.Unlock()
+		s.pendingNotifications = nil
+		check(s, time.Now().Add(time.Duration(i)*time.Minute))
+		sent := make(map[string]string)
+		for n, states := range s.pendingNotifications {
+			for _, st := range states {
+				sent[st.Alert] += n.Name + ":" + st.Last().Status.String()
+			}
+		}
+		return sent
+	}
+	tests := []struct {
+		value    float64
+		expected map[string]string
+	}{
+		{1.5, map[string]string{"escalate": "chat:warning", "warnonly": "chat:warning"}},
+		{3, map[string]string{"escalate": "pager:critical"}},
+		{0, map[string]string{"escalate": "pager:normal", "warnonly": "chat:normal"}},
+	}
+	for i, test := range tests {
+		sent := step(test.value, i)
+		if !reflect.DeepEqual(sent, test.expected) {
+			t.Errorf("%v: value %v: expected %v, got %v", i, test.value, test.expected, sent)
+		}
+	}
+}
+
+func TestLookupThreshold(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"big01"},"dps":{"0":80}},{"metric":"m","tags":{"host":"small01"},"dps":{"0":80}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		lookup cpu {
+			high = 50
+			entry host=big* {
+				high = 90
+			}
+		}
+		template t {
+			subject = {{.Alert.Name}} over {{.Lookup "cpu" "high"}}
+		}
+		alert cpu {
+			template = t
+			$q = q("avg:m{host=*}", "5m", "")
+			crit = avg($q) > lookupSeries($q, "cpu", "high")
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	// The same alert uses the entry's threshold for big01 and the default
+	// for small01.
+	if st := s.GetStatus("cpu{host=big01}"); st == nil || st.Status() != StNormal {
+		t.Errorf("expected big01 to be under its threshold of 90, got %+v", st)
+	}
+	st := s.GetStatus("cpu{host=small01}")
+	if st == nil || st.Status() != StCritical {
+		t.Fatalf("expected small01 to be over the default threshold of 50, got %+v", st)
+	}
+	if st.Subject != "cpu over 50" {
+		t.Errorf("expected the default threshold in the subject, got %q", st.Subject)
+	}
+}
+
+func TestRecoveryTemplate(t *testing.T) {
+	var mu sync.Mutex
+	value := 3.0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":%v}}]`, value)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		notification pager {
+			print = true
+		}
+		template t {
+			subject = {{.Last.Status}}: {{.Alert.Name}}
+			body = <p>{{.Alert.Name}} is {{.Last.Status}}</p>
+		}
+		template resolved {
+			subject = {{.Alert.Name}} resolved after {{.IncidentDuration}}
+			body = <p>{{.Alert.Name}} is back to normal</p>
+		}
+		alert a {
+			template = t
+			recoveryTemplate = resolved
+			warn = avg(q("avg:m{host=*}", "5m", "")) > 1
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			warnNotification = pager
+			critNotification = pager
+			notifyRecovery = true
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   float64
+		minute  int
+		subject string
+		body    string
+	}{
+		{1.5, 0, "warning: a", "<p>a is warning</p>"},
+		{3, 3, "critical: a", "<p>a is critical</p>"},
+		{0, 7, "a resolved after 7m0s", "<p>a is back to normal</p>"},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		value = test.value
+		mu.Unlock()
+		s.pendingNotifications = nil
+		check(s, start.Add(time.Duration(test.minute)*time.Minute))
+		states := s.pendingNotifications[c.Notifications["pager"]]
+		if len(states) != 1 {
+			t.Fatalf("minute %v: expected one notification, got %v", test.minute, s.pendingNotifications)
+		}
+		if st := states[0]; st.Subject != test.subject || !strings.Contains(st.Body, test.body) {
+			t.Errorf("minute %v: expected %q and %q, got %q and %q", test.minute, test.subject, test.body, st.Subject, st.Body)
+		}
+	}
+}
+
+func TestRecoveryCooldown(t *testing.T) {
+	var mu sync.Mutex
+	value := 3.0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":%v}}]`, value)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		notification pager {
+			print = true
+		}
+		template t {
+			subject = {{.Last.Status}}
+		}
+		alert a {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			critNotification = pager
+			notifyRecovery = true
+			recoveryCooldown = 10m
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak := expr.AlertKey("a{host=a}")
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	// step sets the queried value, runs a check i minutes after start and
+	// returns the notifications sent and the incident of the instance.
+	step := func(v float64, i int) ([]string, uint64) {
+		mu.Lock()
+		value = v
+		mu.Unlock()
+		s.pendingNotifications = nil
+		check(s, start.Add(time.Duration(i)*time.Minute))
+		var sent []string
+		for n, states := range s.pendingNotifications {
+			for _, st := range states {
+				sent = append(sent, n.Name+":"+st.Last().Status.String())
+			}
+		}
+		return sent, s.GetStatus(ak).Last().IncidentId
+	}
+	expect := func(i int, sent []string, expected ...string) {
+		if !reflect.DeepEqual(sent, expected) {
+			t.Errorf("minute %v: expected %v, got %v", i, expected, sent)
+		}
+	}
+	sent, first := step(3, 0)
+	expect(0, sent, "pager:critical")
+
+	// Recovering and firing again within the cooldown continues the
+	// incident without any notifications.
+	sent, _ = step(0, 1)
+	expect(1, sent)
+	sent, id := step(3, 5)
+	expect(5, sent)
+	if id != first {
+		t.Errorf("expected a re-fire to continue incident %v, got %v", first, id)
+	}
+
+	// The recovery is sent once the cooldown passes.
+	sent, _ = step(0, 6)
+	expect(6, sent)
+	sent, _ = step(0, 15)
+	expect(15, sent)
+	sent, _ = step(0, 16)
+	expect(16, sent, "pager:normal")
+	sent, _ = step(0, 17)
+	expect(17, sent)
+
+	// After the cooldown a new incident starts.
+	if err := s.Action("user", "", ActionClose, ak); err != nil {
+		t.Fatal(err)
+	}
+	sent, id = step(3, 18)
+	expect(18, sent, "pager:critical")
+	if id == first {
+		t.Errorf("expected a new incident after the cooldown, got %v", id)
+	}
+
+	// Closing ends the cooldown, so firing again starts a new incident.
+	sent, _ = step(0, 19)
+	expect(19, sent)
+	if err := s.Action("user", "", ActionClose, ak); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := s.DataAccess.Recoveries().GetRecoveredUntil(string(ak)); !until.IsZero() {
+		t.Errorf("expected closing to clear the cooldown, got %v", until)
+	}
+	sent, second := step(3, 20)
+	expect(20, sent, "pager:critical")
+	if second == id {
+		t.Errorf("expected a new incident after closing, got %v", second)
+	}
+
+	// A held recovery is sent by the notification loop once the cooldown
+	// passes, even if the instance is not evaluated again.
+	sent, _ = step(0, 21)
+	expect(21, sent)
+	s.Clock = &fakeClock{now: start.Add(32 * time.Minute)}
+	s.pendingNotifications = nil
+	recovered := s.heldRecoveries()
+	s.Lock("test")
+	s.flushRecoveries(recovered)
+	s.Unlock()
+	sent = nil
+	for n, states := range s.pendingNotifications {
+		for _, st := range states {
+			sent = append(sent, n.Name+":"+st.Last().Status.String())
+		}
+	}
+	expect(32, sent, "pager:normal")
+	if until, _ := s.DataAccess.Recoveries().GetRecoveredUntil(string(ak)); !until.IsZero() {
+		t.Errorf("expected the flushed recovery to be cleared, got %v", until)
+	}
+}
+
+func TestMaxNewInstances(t *testing.T) {
+	var mu sync.Mutex
+	hosts := 3
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var series []string
+		for i := 0; i < hosts; i++ {
+			series = append(series, fmt.Sprintf(`{"metric":"m","tags":{"host":"h%d"},"dps":{"0":1}}`, i))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+			maxNewInstances = 5
+			unknownAfterError = 1s
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	if n := len(s.GetOpenStates()); n != 3 || !s.AlertSuccessful("a") {
+		t.Fatalf("expected 3 open states under the limit, got %v", n)
+	}
+
+	// 7 new hosts exceed the limit of 5.
+	mu.Lock()
+	hosts = 10
+	mu.Unlock()
+	s.ctx.checkCache = cache.New(0)
+	check(s, time.Now())
+	open := s.GetOpenStates()
+	if n := len(open); n != 3 {
+		t.Errorf("expected no new states over the limit, got %v", n)
+	}
+	// The existing instances were evaluated, so the alert is not failing and
+	// they do not go unknown.
+	if !s.AlertSuccessful("a") || !s.alertFailingSince("a").IsZero() {
+		t.Fatal("expected the alert not to be failing")
+	}
+	for ak, st := range open {
+		if st.Status() != StCritical {
+			t.Errorf("expected %s to stay critical, got %s", ak, st.Status())
+		}
+	}
+	errs := s.GetErrorHistory()["a"].Errors
+	if e := errs[len(errs)-1]; e.Category != ErrorCardinality || !strings.Contains(e.Message, "cardinality exceeded") {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
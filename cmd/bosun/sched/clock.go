@@ -0,0 +1,18 @@
+package sched
+
+import "time"
+
+// Clock is the scheduler's source of time. Tests can replace it to control
+// time-dependent behavior such as notification timeouts.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock that uses the system time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,101 @@
+package sched
+
+import (
+	"sort"
+	"time"
+
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/opentsdb"
+)
+
+func init() {
+	collect.AggregateMeta("bosun.notifications.latency", metadata.Second,
+		"The time from an incident opening to the first successful send of each of its notifications, by medium.")
+}
+
+// maxIncidentDeliveries is the number of sends kept on an incident. Older
+// ones are dropped first.
+const maxIncidentDeliveries = 100
+
+// Delivery is one attempt to send a notification for an incident on one
+// medium.
+type Delivery struct {
+	Notification string
+	// Medium is "email", "post", "get" or "print".
+	Medium string
+	Time   time.Time
+	// Latency is the time from the incident opening to the send.
+	Latency time.Duration
+	Error   string `json:",omitempty"`
+}
+
+// recordDelivery adds a send of notification on medium at t to the incident
+// with the given id, if it still exists. The first successful send of each
+// notification and medium is sampled in the latency metric.
+func (s *Schedule) recordDelivery(id uint64, notification, medium string, t time.Time, err error) {
+	s.incidentLock.Lock()
+	defer s.incidentLock.Unlock()
+	incident, ok := s.Incidents[id]
+	if !ok {
+		return
+	}
+	d := Delivery{
+		Notification: notification,
+		Medium:       medium,
+		Time:         t,
+		Latency:      t.Sub(incident.Start),
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	first := err == nil
+	for _, prev := range incident.Deliveries {
+		if prev.Notification == notification && prev.Medium == medium && prev.Error == "" {
+			first = false
+		}
+	}
+	if first {
+		collect.Sample("notifications.latency", opentsdb.TagSet{"medium": medium}, d.Latency.Seconds())
+	}
+	// Always copy, so readers of the old slice are not affected.
+	deliveries := incident.Deliveries
+	if len(deliveries) >= maxIncidentDeliveries {
+		deliveries = deliveries[len(deliveries)-maxIncidentDeliveries+1:]
+	}
+	incident.Deliveries = append(deliveries[:len(deliveries):len(deliveries)], d)
+}
+
+// IncidentDelivery is a Delivery and the incident it was for.
+type IncidentDelivery struct {
+	IncidentId uint64
+	Delivery
+}
+
+// SlowDeliveries returns the sends of incidents started since that took at
+// least a non-zero minLatency, or that failed if failed is set, newest first.
+// With neither it returns every send.
+func (s *Schedule) SlowDeliveries(since time.Time, minLatency time.Duration, failed bool) []IncidentDelivery {
+	var list []IncidentDelivery
+	s.incidentLock.Lock()
+	for _, i := range s.Incidents {
+		if i.Start.Before(since) {
+			continue
+		}
+		for _, d := range i.Deliveries {
+			slow := minLatency > 0 && d.Latency >= minLatency
+			if slow || (failed && d.Error != "") || (minLatency == 0 && !failed) {
+				list = append(list, IncidentDelivery{i.Id, d})
+			}
+		}
+	}
+	s.incidentLock.Unlock()
+	sort.Sort(incidentDeliveries(list))
+	return list
+}
+
+type incidentDeliveries []IncidentDelivery
+
+func (d incidentDeliveries) Len() int           { return len(d) }
+func (d incidentDeliveries) Less(a, b int) bool { return d[a].Time.After(d[b].Time) }
+func (d incidentDeliveries) Swap(a, b int)      { d[a], d[b] = d[b], d[a] }
@@ -0,0 +1,125 @@
+package sched
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf"
+)
+
+// DependencyGraph is the graph of alerts whose depends expression references
+// other alerts with the alert function.
+type DependencyGraph struct {
+	Nodes []*DependencyNode
+	// Edges point from an alert to an alert it depends on.
+	Edges []DependencyEdge
+}
+
+// DependencyNode is an alert in a DependencyGraph with its current state.
+type DependencyNode struct {
+	Alert string
+	// Status is the most severe status of the alert's instances.
+	Status Status
+	// Instances is the number of instances of the alert, and Unevaluated the
+	// number of those currently suppressed by a dependency.
+	Instances   int
+	Unevaluated int
+}
+
+type DependencyEdge struct {
+	From, To string
+}
+
+// DependencyGraph returns the alert dependency graph with the state of each
+// alert in it. It is an error if the dependencies form a cycle.
+func (s *Schedule) DependencyGraph() (*DependencyGraph, error) {
+	g, err := dependencyGraph(s.Conf.Alerts)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*DependencyNode)
+	for _, n := range g.Nodes {
+		nodes[n.Alert] = n
+	}
+	s.Lock("DependencyGraph")
+	defer s.Unlock()
+	for ak, st := range s.status {
+		n := nodes[ak.Name()]
+		if n == nil {
+			continue
+		}
+		n.Instances++
+		if st.Unevaluated {
+			n.Unevaluated++
+		}
+		if status := st.Status(); status > n.Status {
+			n.Status = status
+		}
+	}
+	return g, nil
+}
+
+// dependencyGraph builds the graph of alerts that depend on or are depended
+// on by other alerts, sorted by name.
+func dependencyGraph(alerts map[string]*conf.Alert) (*DependencyGraph, error) {
+	g := new(DependencyGraph)
+	deps := make(map[string][]string)
+	names := make(map[string]bool)
+	for name, a := range alerts {
+		for _, dep := range a.DependsAlerts {
+			deps[name] = append(deps[name], dep)
+			names[name] = true
+			names[dep] = true
+		}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		g.Nodes = append(g.Nodes, &DependencyNode{Alert: name})
+		sort.Strings(deps[name])
+		for _, dep := range deps[name] {
+			g.Edges = append(g.Edges, DependencyEdge{name, dep})
+		}
+	}
+	// Depth first search for a cycle, keeping the current path.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, p := range path {
+				if p == name {
+					return fmt.Errorf("dependency cycle: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+	for _, name := range sorted {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
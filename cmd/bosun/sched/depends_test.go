@@ -1,9 +1,16 @@
 package sched
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
+	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
 )
@@ -311,3 +318,134 @@ alert c {
 		},
 	})
 }
+
+// Child instances whose parent instance is silenced are unevaluated, so no
+// incident is created for them.
+func TestDependency_ParentSilenced(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		v := 1
+		if req.Queries[0].Metric == "p" {
+			v = 0
+		}
+		fmt.Fprintf(w, `[
+			{"metric":"m","tags":{"host":"a"},"dps":{"0":%d}},
+			{"metric":"m","tags":{"host":"b"},"dps":{"0":%[1]d}}
+		]`, v)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert parent {
+			crit = avg(q("avg:p{host=*}", "5m", "")) > 0
+		}
+		alert child {
+			crit = avg(q("avg:c{host=*}", "5m", "")) > 0
+			depends = alert("parent", "crit")
+			suppressDuringParentSilence = true
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RunHistory(&RunHistory{
+		Events: map[expr.AlertKey]*Event{
+			expr.NewAlertKey("parent", opentsdb.TagSet{"host": "a"}): {Status: StNormal},
+			expr.NewAlertKey("parent", opentsdb.TagSet{"host": "b"}): {Status: StNormal},
+		},
+	})
+	now := time.Now()
+	if _, _, err := s.AddSilence(now.Add(-time.Hour), now.Add(time.Hour), "parent", "host=a", "", false, true, false, "", "user", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	check(s, now)
+	if st := s.GetStatus(expr.NewAlertKey("child", opentsdb.TagSet{"host": "a"})); st != nil && st.Last().IncidentId != 0 {
+		t.Errorf("expected no incident for child{host=a} while parent is silenced")
+	}
+	if st := s.GetStatus(expr.NewAlertKey("child", opentsdb.TagSet{"host": "b"})); st == nil || st.Last().IncidentId == 0 {
+		t.Errorf("expected incident for child{host=b}")
+	}
+	if _, err := conf.New("", `
+		alert child {
+			crit = 1
+			suppressDuringParentSilence = true
+		}
+	`); err == nil {
+		t.Error("expected error for suppressDuringParentSilence without an alert dependency")
+	}
+}
+
+func TestDependencyGraph(t *testing.T) {
+	c, err := conf.New("", `
+		tsdbHost = localhost:0
+		alert parent {
+			crit = avg(q("avg:p{host=*}", "5m", "")) > 0
+		}
+		alert child {
+			crit = avg(q("avg:c{host=*}", "5m", "")) > 0
+			depends = alert("parent", "crit")
+		}
+		alert grandchild {
+			crit = avg(q("avg:g{host=*}", "5m", "")) > 0
+			depends = alert("child", "crit") || alert("parent", "crit")
+		}
+		alert other {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := func(h string) opentsdb.TagSet { return opentsdb.TagSet{"host": h} }
+	s.status[expr.NewAlertKey("parent", host("a"))] = &State{Alert: "parent", Group: host("a"), History: []Event{{Status: StCritical}}}
+	s.status[expr.NewAlertKey("parent", host("b"))] = &State{Alert: "parent", Group: host("b"), History: []Event{{Status: StNormal}}}
+	s.status[expr.NewAlertKey("child", host("a"))] = &State{Alert: "child", Group: host("a"), History: []Event{{Status: StNormal}}, Unevaluated: true}
+	g, err := s.DependencyGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNodes := []DependencyNode{
+		{Alert: "child", Status: StNormal, Instances: 1, Unevaluated: 1},
+		{Alert: "grandchild"},
+		{Alert: "parent", Status: StCritical, Instances: 2},
+	}
+	if len(g.Nodes) != len(expectedNodes) {
+		t.Fatalf("expected %d nodes, got %d", len(expectedNodes), len(g.Nodes))
+	}
+	for i, n := range g.Nodes {
+		if *n != expectedNodes[i] {
+			t.Errorf("node %d: got %+v, expected %+v", i, *n, expectedNodes[i])
+		}
+	}
+	expectedEdges := []DependencyEdge{{"child", "parent"}, {"grandchild", "child"}, {"grandchild", "parent"}}
+	if !reflect.DeepEqual(g.Edges, expectedEdges) {
+		t.Errorf("got edges %v, expected %v", g.Edges, expectedEdges)
+	}
+
+	// The config only allows references to alerts defined earlier, so build
+	// a cycle directly.
+	_, err = dependencyGraph(map[string]*conf.Alert{
+		"a": {DependsAlerts: []string{"b"}},
+		"b": {DependsAlerts: []string{"c"}},
+		"c": {DependsAlerts: []string{"a"}},
+		"d": {DependsAlerts: []string{"a"}},
+	})
+	if err == nil || err.Error() != "dependency cycle: a -> b -> c -> a" {
+		t.Errorf("expected a dependency cycle error, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package sched
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Favorites are the alerts and incidents a user has pinned.
+type Favorites struct {
+	Alerts    []string
+	Incidents []uint64
+}
+
+// favoriteItem returns the stored form of a favorite of kind "alert" or
+// "incident", checking that it exists.
+func (s *Schedule) favoriteItem(kind, id string) (string, error) {
+	switch kind {
+	case "alert":
+		if s.Conf.Alerts[id] == nil {
+			return "", fmt.Errorf("unknown alert: %s", id)
+		}
+	case "incident":
+		i, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad incident id: %s", id)
+		}
+		if _, err := s.GetIncident(i); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown favorite type %q, expected alert or incident", kind)
+	}
+	return kind + ":" + id, nil
+}
+
+// AddFavorite pins the alert or incident id for user.
+func (s *Schedule) AddFavorite(user, kind, id string) error {
+	if user == "" {
+		return fmt.Errorf("user must be specified")
+	}
+	item, err := s.favoriteItem(kind, id)
+	if err != nil {
+		return err
+	}
+	return s.DataAccess.Favorites().AddFavorite(user, item)
+}
+
+// RemoveFavorite unpins the alert or incident id for user. The alert or
+// incident need not exist any more.
+func (s *Schedule) RemoveFavorite(user, kind, id string) error {
+	if user == "" {
+		return fmt.Errorf("user must be specified")
+	}
+	if kind != "alert" && kind != "incident" {
+		return fmt.Errorf("unknown favorite type %q, expected alert or incident", kind)
+	}
+	return s.DataAccess.Favorites().RemoveFavorite(user, kind+":"+id)
+}
+
+// GetFavorites returns the favorites of user, sorted.
+func (s *Schedule) GetFavorites(user string) (*Favorites, error) {
+	if user == "" {
+		return nil, fmt.Errorf("user must be specified")
+	}
+	items, err := s.DataAccess.Favorites().GetFavorites(user)
+	if err != nil {
+		return nil, err
+	}
+	f := &Favorites{
+		Alerts:    []string{},
+		Incidents: []uint64{},
+	}
+	for _, item := range items {
+		sp := strings.SplitN(item, ":", 2)
+		if len(sp) != 2 {
+			continue
+		}
+		switch sp[0] {
+		case "alert":
+			f.Alerts = append(f.Alerts, sp[1])
+		case "incident":
+			if i, err := strconv.ParseUint(sp[1], 10, 64); err == nil {
+				f.Incidents = append(f.Incidents, i)
+			}
+		}
+	}
+	sort.Strings(f.Alerts)
+	sort.Sort(uint64s(f.Incidents))
+	return f, nil
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,167 @@
+package sched
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IncidentSortKey is a field incidents are sorted by, and its direction.
+type IncidentSortKey struct {
+	Field string
+	Desc  bool
+}
+
+// defaultIncidentSort lists the newest incidents first.
+var defaultIncidentSort = []IncidentSortKey{{Field: "start", Desc: true}}
+
+// incidentSortFields compares two incidents by a field, returning a negative
+// number if a sorts before b in ascending order, and a positive one if after.
+var incidentSortFields = map[string]func(a, b *sortIncident) int{
+	"id": func(a, b *sortIncident) int {
+		return compareUint64(a.Id, b.Id)
+	},
+	"start": func(a, b *sortIncident) int {
+		return compareInt64(a.Start.UnixNano(), b.Start.UnixNano())
+	},
+	"end": func(a, b *sortIncident) int {
+		// Open incidents have not ended, so sort after closed ones.
+		switch {
+		case a.End == nil && b.End == nil:
+			return 0
+		case a.End == nil:
+			return 1
+		case b.End == nil:
+			return -1
+		}
+		return compareInt64(a.End.UnixNano(), b.End.UnixNano())
+	},
+	"alert": func(a, b *sortIncident) int {
+		return strings.Compare(a.AlertKey.Name(), b.AlertKey.Name())
+	},
+	"severity": func(a, b *sortIncident) int {
+		return compareInt64(int64(a.severity), int64(b.severity))
+	},
+	"impact": func(a, b *sortIncident) int {
+		// Incidents without an impact sort before any with one.
+		switch {
+		case a.Impact == nil && b.Impact == nil:
+			return 0
+		case a.Impact == nil:
+			return -1
+		case b.Impact == nil:
+			return 1
+		case *a.Impact < *b.Impact:
+			return -1
+		case *a.Impact > *b.Impact:
+			return 1
+		}
+		return 0
+	},
+}
+
+// ParseIncidentSort parses a comma separated list of incident sort keys, such
+// as "-severity,-start". Each key is one of id, start, end, alert, severity or
+// impact, and is descending if prefixed with "-". The severity of an incident
+// is the most severe status of its events, and its impact the value of its
+// alert's impact expression. Incidents that are equal on every key are
+// ordered by ascending id, so the order is the same across requests.
+func ParseIncidentSort(s string) ([]IncidentSortKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var keys []IncidentSortKey
+	for _, f := range strings.Split(s, ",") {
+		k := IncidentSortKey{Field: strings.TrimSpace(f)}
+		if strings.HasPrefix(k.Field, "-") {
+			k.Field = k.Field[1:]
+			k.Desc = true
+		}
+		if incidentSortFields[k.Field] == nil {
+			return nil, fmt.Errorf("unknown incident sort key: %q", f)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+type sortIncident struct {
+	*Incident
+	severity Status
+}
+
+type incidentSorter struct {
+	list []*sortIncident
+	keys []IncidentSortKey
+}
+
+func (s incidentSorter) Len() int      { return len(s.list) }
+func (s incidentSorter) Swap(i, j int) { s.list[i], s.list[j] = s.list[j], s.list[i] }
+func (s incidentSorter) Less(i, j int) bool {
+	a, b := s.list[i], s.list[j]
+	for _, k := range s.keys {
+		c := incidentSortFields[k.Field](a, b)
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return a.Id < b.Id
+}
+
+// sortIncidents sorts list by keys in place.
+func (s *Schedule) sortIncidents(list []*Incident, keys []IncidentSortKey) {
+	sorter := incidentSorter{keys: keys}
+	for _, i := range list {
+		sorter.list = append(sorter.list, &sortIncident{Incident: i})
+	}
+	for _, k := range keys {
+		if k.Field == "severity" {
+			s.incidentSeverities(sorter.list)
+			break
+		}
+	}
+	sort.Stable(sorter)
+	for idx, i := range sorter.list {
+		list[idx] = i.Incident
+	}
+}
+
+// incidentSeverities sets the severity of each incident in list.
+func (s *Schedule) incidentSeverities(list []*sortIncident) {
+	s.Lock("IncidentSeverities")
+	defer s.Unlock()
+	for _, i := range list {
+		st := s.status[i.AlertKey]
+		if st == nil {
+			continue
+		}
+		for _, e := range st.History {
+			if e.IncidentId == i.Id && e.Status > i.severity {
+				i.severity = e.Status
+			}
+		}
+	}
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
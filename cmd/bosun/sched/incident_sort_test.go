@@ -0,0 +1,79 @@
+package sched
+
+import (
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/expr"
+)
+
+func TestGetIncidents_Sort(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := expr.AlertKey("a{host=a}")
+	b := expr.AlertKey("b{host=b}")
+	s := &Schedule{
+		Incidents: make(map[uint64]*Incident),
+		status:    make(States),
+	}
+	s.status[a] = &State{}
+	s.status[b] = &State{}
+	// Incidents 1 to 3 start together, and 1 and 3 are both critical.
+	for _, i := range []struct {
+		id     uint64
+		ak     expr.AlertKey
+		start  time.Duration
+		status Status
+	}{
+		{3, a, 0, StCritical},
+		{1, b, 0, StCritical},
+		{2, b, 0, StWarning},
+		{4, a, time.Hour, StWarning},
+		{5, b, 2 * time.Hour, StCritical},
+	} {
+		s.Incidents[i.id] = &Incident{Id: i.id, AlertKey: i.ak, Start: start.Add(i.start)}
+		st := s.status[i.ak]
+		st.History = append(st.History, Event{Status: StNormal, IncidentId: i.id}, Event{Status: i.status, IncidentId: i.id})
+	}
+	for _, test := range []struct {
+		sort string
+		ids  []uint64
+	}{
+		{"", []uint64{5, 4, 1, 2, 3}},
+		{"start", []uint64{1, 2, 3, 4, 5}},
+		{"-severity", []uint64{1, 3, 5, 2, 4}},
+		{"-severity,-start", []uint64{5, 1, 3, 4, 2}},
+		{"-severity,-start,-id", []uint64{5, 3, 1, 4, 2}},
+		{"alert,-start", []uint64{4, 3, 5, 1, 2}},
+	} {
+		keys, err := ParseIncidentSort(test.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Repeat to catch an order that depends on map iteration.
+		for n := 0; n < 10; n++ {
+			incidents := s.GetIncidents("", start, start.Add(3*time.Hour), keys...)
+			var ids []uint64
+			for _, i := range incidents {
+				ids = append(ids, i.Id)
+			}
+			if !equalIds(ids, test.ids) {
+				t.Fatalf("sort %q: got %v, expected %v", test.sort, ids, test.ids)
+			}
+		}
+	}
+	if _, err := ParseIncidentSort("-start,bogus"); err == nil {
+		t.Fatal("expected error for unknown sort key")
+	}
+}
+
+func equalIds(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package sched
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bosun.org/slog"
+)
+
+// Mute stops notifications for an alert without affecting evaluation or
+// state tracking. Unlike a silence it does not expire, so every change is
+// recorded in Actions.
+type Mute struct {
+	Muted   bool
+	Actions []MuteAction
+}
+
+type MuteAction struct {
+	User    string
+	Message string
+	Muted   bool
+	Time    time.Time
+}
+
+var muteLock = sync.RWMutex{}
+
+// SetMute mutes or unmutes notifications for the named alert.
+func (s *Schedule) SetMute(alert, user, message string, muted bool) error {
+	if _, ok := s.Conf.Alerts[alert]; !ok {
+		return fmt.Errorf("unknown alert: %s", alert)
+	}
+	if user == "" {
+		return fmt.Errorf("must specify user")
+	}
+	muteLock.Lock()
+	defer muteLock.Unlock()
+	m := s.Mutes[alert]
+	if m == nil {
+		m = &Mute{}
+		s.Mutes[alert] = m
+	}
+	if m.Muted == muted {
+		return nil
+	}
+	m.Muted = muted
+	m.Actions = append(m.Actions, MuteAction{
+		User:    user,
+		Message: message,
+		Muted:   muted,
+		Time:    s.Clock.Now().UTC(),
+	})
+	slog.Infof("%s set mute=%v on %s: %s", user, muted, alert, message)
+	return nil
+}
+
+// IsMuted returns true if notifications for the named alert are muted.
+func (s *Schedule) IsMuted(alert string) bool {
+	muteLock.RLock()
+	defer muteLock.RUnlock()
+	m := s.Mutes[alert]
+	return m != nil && m.Muted
+}
+
+// GetMutes returns a copy of the mute state and audit history of all alerts
+// that have ever been muted.
+func (s *Schedule) GetMutes() map[string]*Mute {
+	muteLock.RLock()
+	defer muteLock.RUnlock()
+	mutes := make(map[string]*Mute, len(s.Mutes))
+	for name, m := range s.Mutes {
+		mutes[name] = &Mute{
+			Muted:   m.Muted,
+			Actions: append([]MuteAction(nil), m.Actions...),
+		}
+	}
+	return mutes
+}
@@ -2,9 +2,21 @@ package sched
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"bosun.org/_third_party/github.com/boltdb/bolt"
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
@@ -141,3 +153,1081 @@ func TestActionNotificationGrouping(t *testing.T) {
 	expect("n2", acrit, bwarn, cA)
 	expect("n3", bcrit, cB)
 }
+
+func TestRenotifyTimeout(t *testing.T) {
+	nc := make(chan bool, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nc <- true
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = s
+		}
+		notification n {
+			post = http://%s/
+			next = n
+			timeout = 10m
+		}
+		alert a {
+			template = t
+			crit = 1
+			critNotification = n
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	notified := func() int {
+		n := 0
+		for {
+			select {
+			case <-nc:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+	check(s, clock.Now())
+	if timeout := s.CheckNotifications(); timeout != 10*time.Minute {
+		t.Errorf("expected next notification in 10m, got %v", timeout)
+	}
+	if n := notified(); n != 1 {
+		t.Fatalf("expected first notification, got %v", n)
+	}
+	clock.Advance(9 * time.Minute)
+	if timeout := s.CheckNotifications(); timeout != time.Minute {
+		t.Errorf("expected next notification in 1m, got %v", timeout)
+	}
+	if n := notified(); n != 0 {
+		t.Fatalf("expected no notification before the timeout, got %v", n)
+	}
+	clock.Advance(2 * time.Minute)
+	if timeout := s.CheckNotifications(); timeout != 10*time.Minute {
+		t.Errorf("expected the chain to restart, got %v", timeout)
+	}
+	if n := notified(); n != 1 {
+		t.Fatalf("expected renotification after the timeout, got %v", n)
+	}
+}
+
+func TestRecoveredIncidentEscalates(t *testing.T) {
+	var mu sync.Mutex
+	value := 3
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":%v}}]`, value)
+	}))
+	defer tsdb.Close()
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- string(b)
+	}))
+	defer ts.Close()
+	tu, err := url.Parse(tsdb.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		checkFrequency = 1h
+		template t {
+			subject = {{.Last.Status}}
+		}
+		notification n {
+			post = http://%s/
+			next = n
+			timeout = 10m
+		}
+		alert a {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			critNotification = n
+		}
+	`, tu.Host, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	notified := func() []string {
+		var posts []string
+		for {
+			select {
+			case p := <-nc:
+				posts = append(posts, p)
+			case <-time.After(100 * time.Millisecond):
+				return posts
+			}
+		}
+	}
+	check(s, clock.Now())
+	s.CheckNotifications()
+	if posts := notified(); len(posts) != 1 {
+		t.Fatalf("expected the critical notification, got %q", posts)
+	}
+	mu.Lock()
+	value = 1
+	mu.Unlock()
+	clock.Advance(time.Minute)
+	check(s, clock.Now())
+	// Without notifyRecovery, an unacked incident keeps escalating after it
+	// recovers.
+	for i := 0; i < 2; i++ {
+		clock.Advance(10 * time.Minute)
+		if timeout := s.CheckNotifications(); timeout != 10*time.Minute {
+			t.Errorf("renotification %d: expected the next in 10m, got %v", i, timeout)
+		}
+		if posts := notified(); len(posts) != 1 {
+			t.Fatalf("renotification %d: expected a notification, got %q", i, posts)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = {{.Alert.Name}} is {{.Last.Status}}
+		}
+		notification n {
+			post = http://%s/
+			quietHours = 22:00-07:00
+		}
+		alert w {
+			template = t
+			warn = 1
+			warnNotification = n
+		}
+		alert c {
+			template = t
+			crit = 1
+			critNotification = n
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 23, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	notified := func() []string {
+		var posts []string
+		for {
+			select {
+			case p := <-nc:
+				posts = append(posts, p)
+			case <-time.After(100 * time.Millisecond):
+				return posts
+			}
+		}
+	}
+	check(s, clock.Now())
+	s.CheckNotifications()
+	// Critical is exempt by default, warning is deferred.
+	if posts := notified(); len(posts) != 1 || posts[0] != "c is critical" {
+		t.Fatalf("expected only the critical notification, got %q", posts)
+	}
+	if d := s.Deferred["n"]; len(d) != 1 || d[0].AlertKey != "w{}" || d[0].Status != StWarning {
+		t.Fatalf("expected the warning to be deferred, got %v", d)
+	}
+	clock.Advance(8*time.Hour - time.Minute)
+	if timeout := s.CheckNotifications(); timeout != time.Minute {
+		t.Errorf("expected a wakeup when quiet hours end in 1m, got %v", timeout)
+	}
+	if posts := notified(); len(posts) != 0 {
+		t.Fatalf("expected nothing before quiet hours end, got %q", posts)
+	}
+	clock.Advance(time.Minute)
+	s.CheckNotifications()
+	if posts := notified(); len(posts) != 1 || posts[0] != "1 notifications deferred during quiet hours" {
+		t.Fatalf("expected a summary when quiet hours end, got %q", posts)
+	}
+	if len(s.Deferred) != 0 {
+		t.Fatalf("expected the deferred notifications to be cleared, got %v", s.Deferred)
+	}
+}
+
+func TestRateLimitDigests(t *testing.T) {
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- r.URL.Path + " " + string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = {{.Alert.Name}} is {{.Last.Status}}
+		}
+		notification a {
+			post = http://%[1]s/a
+			rateLimit = 1
+		}
+		notification b {
+			post = http://%[1]s/b
+			rateLimit = 1
+			rateInterval = 30m
+		}
+		alert a1 {
+			template = t
+			crit = 1
+			critNotification = a
+		}
+		alert a2 {
+			template = t
+			crit = 1
+			critNotification = a
+		}
+		alert a3 {
+			template = t
+			crit = 1
+			critNotification = a
+		}
+		alert b1 {
+			template = t
+			crit = 1
+			critNotification = b
+		}
+		alert b2 {
+			template = t
+			crit = 1
+			critNotification = b
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	notified := func() []string {
+		var posts []string
+		for {
+			select {
+			case p := <-nc:
+				posts = append(posts, p)
+			case <-time.After(100 * time.Millisecond):
+				sort.Strings(posts)
+				return posts
+			}
+		}
+	}
+	check(s, clock.Now())
+	if timeout := s.CheckNotifications(); timeout != 30*time.Minute {
+		t.Errorf("expected a wakeup when b's interval ends in 30m, got %v", timeout)
+	}
+	// Each notification sends one, holding the rest in its own digest.
+	if posts := notified(); len(posts) != 2 || !strings.HasPrefix(posts[0], "/a a") || !strings.HasPrefix(posts[1], "/b b") {
+		t.Fatalf("expected one notification for each of a and b, got %q", posts)
+	}
+	if a, b := s.Digests["a"], s.Digests["b"]; a == nil || len(a.Held) != 2 || b == nil || len(b.Held) != 1 {
+		t.Fatalf("expected 2 held for a and 1 for b, got %+v and %+v", a, b)
+	}
+	clock.Advance(30 * time.Minute)
+	if timeout := s.CheckNotifications(); timeout != 30*time.Minute {
+		t.Errorf("expected a wakeup when a's interval ends in 30m, got %v", timeout)
+	}
+	if posts := notified(); len(posts) != 1 || posts[0] != "/b 1 notifications held back by rate limit" {
+		t.Fatalf("expected only b's digest, got %q", posts)
+	}
+	if a := s.Digests["a"]; a == nil || len(a.Held) != 2 {
+		t.Fatalf("expected a's digest to be unaffected, got %+v", a)
+	}
+	clock.Advance(30 * time.Minute)
+	s.CheckNotifications()
+	if posts := notified(); len(posts) != 1 || posts[0] != "/a 2 notifications held back by rate limit" {
+		t.Fatalf("expected a's digest, got %q", posts)
+	}
+	if len(s.Digests) != 0 {
+		t.Fatalf("expected the digests to be cleared, got %v", s.Digests)
+	}
+}
+
+func TestSnooze(t *testing.T) {
+	var mu sync.Mutex
+	values := map[string]float64{"a": 3, "b": 3}
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":%v}},{"metric":"m","tags":{"host":"b"},"dps":{"0":%v}}]`, values["a"], values["b"])
+	}))
+	defer tsdb.Close()
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- string(b)
+	}))
+	defer ts.Close()
+	tu, err := url.Parse(tsdb.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A long checkFrequency keeps the alerts from going unknown between checks.
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		checkFrequency = 1h
+		template t {
+			subject = {{.Group.host}} {{.Last.Status}}
+		}
+		notification n {
+			post = http://%s/
+		}
+		alert a {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			critNotification = n
+		}
+	`, tu.Host, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	notified := func() []string {
+		var posts []string
+		for {
+			select {
+			case p := <-nc:
+				posts = append(posts, p)
+			case <-time.After(100 * time.Millisecond):
+				sort.Strings(posts)
+				return posts
+			}
+		}
+	}
+	akA := expr.AlertKey("a{host=a}")
+	akB := expr.AlertKey("a{host=b}")
+	check(s, clock.Now())
+	s.CheckNotifications()
+	if posts := notified(); len(posts) != 2 {
+		t.Fatalf("expected both hosts to notify, got %q", posts)
+	}
+	s.nc = make(chan interface{}, 1)
+	for _, ak := range []expr.AlertKey{akA, akB} {
+		if err := s.Snooze("user", "looking", ak, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Snoozing wakes the dispatcher to reschedule its next wakeup.
+	select {
+	case <-s.nc:
+	default:
+		t.Error("expected snoozing to wake the notification dispatcher")
+	}
+	if err := s.Snooze("user", "", akA, 0); err == nil {
+		t.Error("expected a zero snooze to be rejected")
+	}
+
+	// b recovers during the snooze and can be closed as usual.
+	mu.Lock()
+	values["b"] = 0
+	mu.Unlock()
+	clock.Advance(30 * time.Minute)
+	check(s, clock.Now())
+	if timeout := s.CheckNotifications(); timeout != 30*time.Minute {
+		t.Errorf("expected a wakeup when the snooze ends in 30m, got %v", timeout)
+	}
+	if posts := notified(); len(posts) != 0 {
+		t.Fatalf("expected no notifications while snoozed, got %q", posts)
+	}
+	if st := s.GetStatus(akB); !st.SnoozedUntil.IsZero() {
+		t.Errorf("expected recovery to end the snooze, got %v", st.SnoozedUntil)
+	}
+	if err := s.Action("user", "recovered", ActionClose, akB); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is still critical when the snooze ends and notifies again.
+	clock.Advance(30 * time.Minute)
+	s.CheckNotifications()
+	if posts := notified(); len(posts) != 1 || posts[0] != "a critical" {
+		t.Fatalf("expected a to notify again when the snooze ends, got %q", posts)
+	}
+	st := s.GetStatus(akA)
+	if !st.SnoozedUntil.IsZero() {
+		t.Errorf("expected the snooze to be cleared, got %v", st.SnoozedUntil)
+	}
+	if last := st.Actions[len(st.Actions)-1]; last.Type != ActionSnooze || last.User != "user" {
+		t.Errorf("expected a snooze action, got %+v", last)
+	}
+}
+
+func TestSuppress(t *testing.T) {
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"web01"},"dps":{"0":1}},{"metric":"m","tags":{"host":"lab01"},"dps":{"0":1}}]`)
+	}))
+	defer tsdb.Close()
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		nc <- string(b)
+	}))
+	defer ts.Close()
+	tu, err := url.Parse(tsdb.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		suppress = host=lab.*
+		suppress = host=test.*
+		template t {
+			subject = {{.Group.host}}
+		}
+		notification n {
+			post = http://%s/
+		}
+		alert a {
+			template = t
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 0
+			critNotification = n
+		}
+	`, tu.Host, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, time.Now())
+	s.CheckNotifications()
+	var posts []string
+	for done := false; !done; {
+		select {
+		case p := <-nc:
+			posts = append(posts, p)
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if len(posts) != 1 || posts[0] != "web01" {
+		t.Fatalf("expected only web01 to notify, got %q", posts)
+	}
+	st := s.GetStatus(expr.AlertKey("a{host=lab01}"))
+	if st == nil || !st.Open || st.Status() != StCritical || st.Last().IncidentId == 0 {
+		t.Fatalf("expected a suppressed open critical incident for lab01, got %+v", st)
+	}
+}
+
+func TestNotificationQueue(t *testing.T) {
+	type post struct{ key, body string }
+	posts := make(chan post, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		posts <- post{r.Header.Get(conf.DedupHeader), string(b)}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification n {
+			post = http://%s/
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	da := new(nopDataAccess)
+	restart := func() *Schedule {
+		s := &Schedule{DataAccess: da}
+		if err := s.Init(c); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	depth := func() int {
+		d, _ := da.QueueDepth()
+		return d
+	}
+
+	// Crash after queueing a notification but before sending it.
+	q := restart().enqueueNotification(c.Notifications["n"], "a{host=a}", 0, "subject", "", nil, nil, nil)
+	if depth() != 1 {
+		t.Fatalf("expected 1 queued notification, got %d", depth())
+	}
+	restart().sendQueued()
+	select {
+	case p := <-posts:
+		if p.body != "subject" || p.key != q.Id {
+			t.Errorf("expected subject with key %s, got %+v", q.Id, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending notification was not sent after restart")
+	}
+	if depth() != 0 {
+		t.Errorf("expected sent notification to be removed from the queue, got %d queued", depth())
+	}
+
+	// A failed notification stays queued until it has been tried
+	// maxNotificationAttempts times.
+	s := restart()
+	s.enqueueNotification(c.Notifications["n"], "a{host=a}", 0, "fail", "", nil, nil, nil)
+	for i := 1; i <= maxNotificationAttempts; i++ {
+		s.sendQueued()
+		expected := 1
+		if i == maxNotificationAttempts {
+			expected = 0
+		}
+		if depth() != expected {
+			t.Fatalf("after %d attempts: expected %d queued, got %d", i, expected, depth())
+		}
+	}
+
+	// A notification read by a retry pass, but sent and dequeued by its
+	// first delivery before the pass gets to it, is not sent again.
+	q = s.enqueueNotification(c.Notifications["n"], "a{host=a}", 0, "once", "", nil, nil, nil)
+	pending, err := da.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected 1 pending notification, got %v, %v", pending, err)
+	}
+	s.deliver(q, false)
+	s.deliver(pending[0], true)
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-posts:
+			if i > 0 {
+				t.Fatalf("expected one send, got another %+v", p)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if i == 0 {
+				t.Fatal("notification was not sent")
+			}
+		}
+	}
+}
+
+func TestRetryFailedChannels(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	failPost := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[r.Method]++
+		if r.Method == "POST" && failPost {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification n {
+			post = http://%[1]s/
+			get = http://%[1]s/
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	da := new(nopDataAccess)
+	s := &Schedule{DataAccess: da}
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	s.enqueueNotification(c.Notifications["n"], "a{host=a}", 0, "subject", "", nil, nil, nil)
+	s.sendQueued()
+	mu.Lock()
+	failPost = false
+	mu.Unlock()
+	s.sendQueued()
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["GET"] != 1 || calls["POST"] != 2 {
+		t.Errorf("expected only the failed post to be retried, got %v", calls)
+	}
+	if d, _ := da.QueueDepth(); d != 0 {
+		t.Errorf("expected the notification to be dequeued, got %d queued", d)
+	}
+}
+
+func TestDeliveryLatency(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		// The receiver takes 90 seconds to accept the post.
+		clock.Advance(90 * time.Second)
+		if string(b) == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification n {
+			post = http://%s/
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := &Schedule{DataAccess: new(nopDataAccess), Clock: clock}
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	start := clock.Now()
+	incident := s.createIncident("a{host=a}", start)
+	clock.Advance(30 * time.Second)
+	n := c.Notifications["n"]
+	s.deliver(s.enqueueNotification(n, "a{host=a}", incident.Id, "ok", "", nil, nil, nil), false)
+	// Incidents are returned as copies, which later deliveries do not change.
+	copied, err := s.GetIncident(incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.deliver(s.enqueueNotification(n, "a{host=a}", incident.Id, "fail", "", nil, nil, nil), false)
+	if len(copied.Deliveries) != 1 {
+		t.Errorf("expected the copy to keep 1 delivery, got %+v", copied.Deliveries)
+	}
+	if len(incident.Deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %+v", incident.Deliveries)
+	}
+	if d := incident.Deliveries[0]; d.Medium != "post" || d.Latency != 2*time.Minute || d.Error != "" {
+		t.Errorf("expected a post 2m after the incident opened, got %+v", d)
+	}
+	if d := incident.Deliveries[1]; d.Latency != 3*time.Minute+30*time.Second || d.Error == "" {
+		t.Errorf("expected a failed post 3m30s after the incident opened, got %+v", d)
+	}
+	if slow := s.SlowDeliveries(start, 3*time.Minute, false); len(slow) != 1 || slow[0].Error == "" {
+		t.Errorf("expected only the failed post to take 3m, got %+v", slow)
+	}
+	if failed := s.SlowDeliveries(start, 0, true); len(failed) != 1 || failed[0].IncidentId != incident.Id {
+		t.Errorf("expected the failed post, got %+v", failed)
+	}
+	if all := s.SlowDeliveries(start, 0, false); len(all) != 2 || all[0].Time.Before(all[1].Time) {
+		t.Errorf("expected both posts newest first, got %+v", all)
+	}
+	if none := s.SlowDeliveries(start.Add(time.Second), 0, false); len(none) != 0 {
+		t.Errorf("expected no deliveries of later incidents, got %+v", none)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	posts := make(chan string, 10)
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/db" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- r.URL.Path + " " + string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification network {
+			post = http://%[1]s/network
+		}
+		notification app {
+			post = http://%[1]s/app
+			body = app: {{.}}
+		}
+		notification db {
+			post = http://%[1]s/db
+		}
+		notification teams {
+			fanout = network, app, db
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	da := new(nopDataAccess)
+	s := &Schedule{DataAccess: da}
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	incident := s.createIncident("a{host=a}", time.Now())
+	s.queueNotification(c.Notifications["teams"], "a{host=a}", incident.Id, "down", "", nil, nil, nil)
+	// Both working targets are sent to with their own body, whatever
+	// happens to db.
+	var got []string
+	for len(got) < 2 {
+		select {
+		case p := <-posts:
+			got = append(got, p)
+		case <-time.After(time.Second):
+			t.Fatalf("expected posts to network and app, got %q", got)
+		}
+	}
+	sort.Strings(got)
+	if expected := []string{"/app app: down", "/network down"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	deliveries := func() map[string]string {
+		s.incidentLock.Lock()
+		defer s.incidentLock.Unlock()
+		m := make(map[string]string)
+		for _, d := range incident.Deliveries {
+			m[d.Notification] = d.Error
+		}
+		return m
+	}
+	for i := 0; len(deliveries()) < 3; i++ {
+		if i == 100 {
+			t.Fatalf("expected a delivery for each target, got %v", deliveries())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := deliveries(); d["network"] != "" || d["app"] != "" || d["db"] == "" {
+		t.Errorf("expected only db to fail, got %v", d)
+	}
+	// Only the failed target stays queued and is retried.
+	if depth, _ := da.QueueDepth(); depth != 1 {
+		t.Errorf("expected only db to stay queued, got %d", depth)
+	}
+	s.sendQueued()
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := map[string]int{"/network": 1, "/app": 1, "/db": 2}; !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("expected %v, got %v", expected, attempts)
+	}
+}
+
+func TestFanoutRateLimit(t *testing.T) {
+	nc := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nc <- r.URL.Path
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		template t {
+			subject = {{.Alert.Name}}
+		}
+		notification team {
+			post = http://%[1]s/team
+			rateLimit = 1
+		}
+		notification all {
+			post = http://%[1]s/all
+			fanout = team
+		}
+		alert a1 {
+			template = t
+			crit = 1
+			critNotification = all
+		}
+		alert a2 {
+			template = t
+			crit = 1
+			critNotification = all
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	check(s, clock.Now())
+	s.CheckNotifications()
+	var posts []string
+	for len(posts) < 3 {
+		select {
+		case p := <-nc:
+			posts = append(posts, p)
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 notifications, got %q", posts)
+		}
+	}
+	select {
+	case p := <-nc:
+		t.Fatalf("expected the team's rate limit to hold back its second notification, got %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+	sort.Strings(posts)
+	if !reflect.DeepEqual(posts, []string{"/all", "/all", "/team"}) {
+		t.Errorf("expected both for all and one for team, got %q", posts)
+	}
+	if d := s.Digests["team"]; d == nil || len(d.Held) != 1 {
+		t.Errorf("expected 1 held in the team's digest, got %+v", d)
+	}
+	if d := s.Digests["all"]; d != nil {
+		t.Errorf("expected no digest for all, got %+v", d)
+	}
+}
+
+func TestShutdownWaitsForNotification(t *testing.T) {
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification n {
+			post = http://%s/
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	da := new(nopDataAccess)
+	s := &Schedule{DataAccess: da}
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	s.queueNotification(c.Notifications["n"], "a{host=a}", 0, "subject", "", nil, nil, nil)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("notification was not sent")
+	}
+	done := make(chan bool)
+	go func() {
+		s.Shutdown(time.Minute)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the notification being sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not finish after the notification was sent")
+	}
+	if d, _ := da.QueueDepth(); d != 0 {
+		t.Errorf("expected sent notification to be removed from the queue, got %d queued", d)
+	}
+
+	// Notifications after shutdown are queued for the next start, not sent.
+	s.queueNotification(c.Notifications["n"], "a{host=a}", 0, "later", "", nil, nil, nil)
+	select {
+	case <-started:
+		t.Error("notification was sent after shutdown")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if d, _ := da.QueueDepth(); d != 1 {
+		t.Errorf("expected 1 queued notification after shutdown, got %d", d)
+	}
+}
+
+func TestAckButton(t *testing.T) {
+	type post struct {
+		contentType string
+		body        string
+	}
+	posts := make(chan post, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- post{r.Header.Get("Content-Type"), string(b)}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		notification n {
+			post = http://%s/
+			ackButton = true
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() post {
+		select {
+		case p := <-posts:
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("notification was not sent")
+		}
+		return post{}
+	}
+	s.queueNotification(c.Notifications["n"], "a{host=a}", 7, "a{host=a} critical", "", nil, nil, nil)
+	p := next()
+	expected := `{"text":"a{host=a} critical","attachments":[{"fallback":"Acknowledge incident 7 in bosun","callback_id":"bosun_ack","actions":[{"name":"ack","text":"Ack","type":"button","value":"7"}]}]}`
+	if p.contentType != "application/json" || p.body != expected {
+		t.Errorf("unexpected ack button post %s: %s", p.contentType, p.body)
+	}
+	// Notifications without an incident have no button.
+	s.queueNotification(c.Notifications["n"], "failing_alerts", 0, "failing", "", nil, nil, nil)
+	if p := next(); p.body != "failing" {
+		t.Errorf("unexpected post without incident: %s", p.body)
+	}
+}
+
+func TestFailingAlertNotification(t *testing.T) {
+	posts := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		failingAlertNotification = n
+		failingAlertThreshold = 2
+		notification n {
+			post = http://%s/
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(name, subject string) {
+		select {
+		case p := <-posts:
+			if subject == "" {
+				t.Errorf("%s: expected no notification, got %q", name, p)
+			} else if p != subject {
+				t.Errorf("%s: expected %q, got %q", name, subject, p)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if subject != "" {
+				t.Errorf("%s: expected %q, got no notification", name, subject)
+			}
+		}
+	}
+
+	s.markAlertError("a", ErrorQuery, fmt.Errorf("boom"))
+	s.CheckNotifications()
+	expect("below threshold", "")
+
+	s.markAlertError("b", ErrorQuery, fmt.Errorf("boom"))
+	s.CheckNotifications()
+	expect("crossing threshold", "bosun: 2 alerts failing to evaluate")
+
+	// Still failing, so it is not sent again.
+	s.markAlertError("c", ErrorQuery, fmt.Errorf("boom"))
+	s.CheckNotifications()
+	expect("still over threshold", "")
+
+	// A restart does not forget that the threshold was crossed.
+	dir, err := ioutil.TempDir("", "bosun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "bosun.state"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s.db = db
+	s.save()
+	restored, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.db = db
+	if err := restored.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.failingAlertsActive {
+		t.Error("failingAlertsActive not restored")
+	}
+	s.db = nil
+
+	if err := s.ClearAllErrors("u"); err != nil {
+		t.Fatal(err)
+	}
+	s.CheckNotifications()
+	expect("clearing", "bosun: failing alerts recovered, 0 failing")
+	s.CheckNotifications()
+	expect("still clear", "")
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	htemplate "html/template"
+	"math"
 	"strings"
 	ttemplate "text/template"
 	"time"
 
+	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/slog"
@@ -18,7 +20,7 @@ func (s *Schedule) dispatchNotifications() {
 	timeout := s.CheckNotifications()
 	for {
 		select {
-		case <-time.After(timeout):
+		case <-s.Clock.After(timeout):
 			timeout = s.CheckNotifications()
 		case <-s.nc:
 			timeout = s.CheckNotifications()
@@ -36,10 +38,24 @@ func (s *Schedule) Notify(st *State, n *conf.Notification) {
 	s.pendingNotifications[n] = append(s.pendingNotifications[n], st)
 }
 
+// NotifyRecovery queues the recovery notification of st to n. Unlike other
+// notifications it does not escalate to n's next notification.
+func (s *Schedule) NotifyRecovery(st *State, n *conf.Notification) {
+	s.Notify(st, n)
+	if s.pendingRecoveries == nil {
+		s.pendingRecoveries = make(map[*conf.Notification]map[expr.AlertKey]bool)
+	}
+	if s.pendingRecoveries[n] == nil {
+		s.pendingRecoveries[n] = make(map[expr.AlertKey]bool)
+	}
+	s.pendingRecoveries[n][st.AlertKey()] = true
+}
+
 // CheckNotifications processes past notification events. It returns the
 // duration until the soonest notification triggers.
 func (s *Schedule) CheckNotifications() time.Duration {
 	silenced := s.Silenced()
+	recovered := s.heldRecoveries()
 	s.Lock("CheckNotifications")
 	defer s.Unlock()
 	notifications := s.Notifications
@@ -54,7 +70,7 @@ func (s *Schedule) CheckNotifications() time.Duration {
 			if !present {
 				continue
 			}
-			remaining := t.Add(n.Timeout).Sub(time.Now())
+			remaining := t.Add(n.Timeout).Sub(s.Clock.Now())
 			if remaining > 0 {
 				s.AddNotification(ak, n, t)
 				continue
@@ -72,10 +88,36 @@ func (s *Schedule) CheckNotifications() time.Duration {
 			s.Notify(st, n)
 		}
 	}
+	timeout := time.Hour
+	if wake := s.wakeSnoozed(); wake < timeout {
+		timeout = wake
+	}
+	s.flushRecoveries(recovered)
+	s.sendDigests()
 	s.sendNotifications(silenced)
 	s.pendingNotifications = nil
-	timeout := time.Hour
-	now := time.Now()
+	s.pendingRecoveries = nil
+	s.sendDeferred()
+	s.checkFailingAlerts()
+	now := s.Clock.Now()
+	for name, d := range s.Digests {
+		n := s.Conf.Notifications[name]
+		if n == nil || len(d.Held) == 0 {
+			continue
+		}
+		if remaining := d.Start.Add(n.RateInterval).Sub(now); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	for name := range s.Deferred {
+		n := s.Conf.Notifications[name]
+		if n == nil || n.Quiet == nil {
+			continue
+		}
+		if end, quiet := n.Quiet.Until(now); quiet && end.Sub(now) < timeout {
+			timeout = end.Sub(now)
+		}
+	}
 	for _, ns := range s.Notifications {
 		for name, t := range ns {
 			n, present := s.Conf.Notifications[name]
@@ -91,6 +133,51 @@ func (s *Schedule) CheckNotifications() time.Duration {
 	return timeout
 }
 
+// wakeSnoozed ends the snoozes that are over, queueing notifications for the
+// incidents that are still active. It returns the duration until the soonest
+// remaining snooze ends.
+func (s *Schedule) wakeSnoozed() time.Duration {
+	now := s.Clock.Now()
+	next := time.Duration(math.MaxInt64)
+	for ak, st := range s.status {
+		if st.SnoozedUntil.IsZero() {
+			continue
+		}
+		if remaining := st.SnoozedUntil.Sub(now); remaining > 0 {
+			if remaining < next {
+				next = remaining
+			}
+			continue
+		}
+		st.SnoozedUntil = time.Time{}
+		a := s.Conf.Alerts[ak.Name()]
+		if a == nil || !st.Open || !st.IsActive() {
+			continue
+		}
+		var ns *conf.Notifications
+		switch st.Status() {
+		case StCritical:
+			ns = a.CritNotification
+		case StUnknown:
+			if !a.QuietUnknown {
+				ns = a.CritNotification
+			}
+		case StWarning:
+			ns = a.WarnNotification
+		}
+		if ns == nil {
+			continue
+		}
+		slog.Infoln("snooze ended, notifying", ak)
+		st.Notified = nil
+		for name, n := range ns.Get(s.Conf, st.Group) {
+			s.Notify(st, n)
+			st.Notified = append(st.Notified, name)
+		}
+	}
+	return next
+}
+
 func (s *Schedule) sendNotifications(silenced map[expr.AlertKey]Silence) {
 	if s.Conf.Quiet {
 		slog.Infoln("quiet mode prevented", len(s.pendingNotifications), "notifications")
@@ -100,7 +187,11 @@ func (s *Schedule) sendNotifications(silenced map[expr.AlertKey]Silence) {
 		for _, st := range states {
 			ak := st.AlertKey()
 			_, silenced := silenced[ak]
-			if st.Last().Status == StUnknown {
+			if s.IsMuted(ak.Name()) {
+				slog.Infoln("muted", ak)
+			} else if s.Conf.Suppress.Squelched(st.Group) {
+				slog.Infoln("suppressed", ak)
+			} else if st.Last().Status == StUnknown {
 				if silenced {
 					slog.Infoln("silencing unknown", ak)
 					continue
@@ -108,16 +199,257 @@ func (s *Schedule) sendNotifications(silenced map[expr.AlertKey]Silence) {
 				s.pendingUnknowns[n] = append(s.pendingUnknowns[n], st)
 			} else if silenced {
 				slog.Infoln("silencing", ak)
+			} else if s.deferQuiet(st, n) {
+				slog.Infoln("deferring during quiet hours", ak)
 			} else {
 				s.notify(st, n)
 			}
-			if n.Next != nil {
-				s.AddNotification(ak, n.Next, time.Now().UTC())
+			if n.Next != nil && !s.pendingRecoveries[n][ak] {
+				s.AddNotification(ak, n.Next, s.Clock.Now().UTC())
 			}
 		}
 	}
 }
 
+// DeferredNotification is a notification held back during quiet hours or by
+// a rate limit.
+type DeferredNotification struct {
+	AlertKey expr.AlertKey
+	Status   Status
+	Subject  string
+	Time     time.Time
+}
+
+// deferQuiet records st for a later summary instead of notifying n, if n is
+// in quiet hours that apply to the status of st.
+func (s *Schedule) deferQuiet(st *State, n *conf.Notification) bool {
+	if n.Quiet == nil {
+		return false
+	}
+	now := s.Clock.Now().UTC()
+	status := st.Last().Status
+	if _, quiet := n.Quiet.Until(now); !quiet || !n.Quiet.Applies(status.String()) {
+		return false
+	}
+	if s.Deferred == nil {
+		s.Deferred = make(map[string][]*DeferredNotification)
+	}
+	s.Deferred[n.Name] = append(s.Deferred[n.Name], &DeferredNotification{
+		AlertKey: st.AlertKey(),
+		Status:   status,
+		Subject:  st.Subject,
+		Time:     now,
+	})
+	return true
+}
+
+// Digest is the rate limit state of one notification: the start of its
+// current interval, how many notifications were sent in it, and those held
+// back once the limit was reached.
+type Digest struct {
+	Start time.Time
+	Sent  int
+	Held  []*DeferredNotification
+}
+
+// holdForDigest records st in the digest of n instead of notifying n, if n
+// has already sent its rateLimit of notifications in the current interval.
+// Each notification is limited on its own, so one noisy team does not hold
+// back another's.
+func (s *Schedule) holdForDigest(st *State, n *conf.Notification) bool {
+	if n.RateLimit == 0 {
+		return false
+	}
+	now := s.Clock.Now().UTC()
+	if s.Digests == nil {
+		s.Digests = make(map[string]*Digest)
+	}
+	d := s.Digests[n.Name]
+	if d == nil {
+		d = &Digest{Start: now}
+		s.Digests[n.Name] = d
+	}
+	if d.Sent < n.RateLimit {
+		d.Sent++
+		return false
+	}
+	d.Held = append(d.Held, &DeferredNotification{
+		AlertKey: st.AlertKey(),
+		Status:   st.Last().Status,
+		Subject:  st.Subject,
+		Time:     now,
+	})
+	return true
+}
+
+var deferredSummary = htemplate.Must(htemplate.New("deferredSummary").Parse(`
+	<p>The following notifications were deferred during quiet hours.
+	<ul>
+	{{ range . }}
+		<li>{{ .Time.Format "2006-01-02 15:04:05 MST" }} {{ .Status }} {{ .AlertKey }}: {{ .Subject }}</li>
+	{{ end }}
+	</ul>
+	`))
+
+var failingAlertsSummary = htemplate.Must(htemplate.New("failingAlertsSummary").Parse(`
+	<p>{{ len .Failing }} alerts are failing to evaluate (threshold {{ .Threshold }}).
+	<ul>
+	{{ range $name, $err := .Failing }}
+		<li>{{ $name }}{{ if $err }}: {{ $err.Message }}{{ end }}</li>
+	{{ end }}
+	</ul>
+	`))
+
+// heldRecoveries returns the end of the post-recovery cooldown of every
+// instance in one, if any alert has a recoveryCooldown.
+func (s *Schedule) heldRecoveries() map[string]time.Time {
+	for _, a := range s.Conf.Alerts {
+		if a.RecoveryCooldown == 0 {
+			continue
+		}
+		recovered, err := s.DataAccess.Recoveries().GetAllRecovered()
+		if err != nil {
+			slog.Errorln(err)
+		}
+		return recovered
+	}
+	return nil
+}
+
+// flushRecoveries sends the recovery notifications held by recoveryCooldown
+// whose cooldown has ended without the instance being evaluated again, for
+// example because it stopped reporting. recovered is from heldRecoveries.
+// The caller must hold the schedule lock.
+func (s *Schedule) flushRecoveries(recovered map[string]time.Time) {
+	now := s.Clock.Now()
+	for key, until := range recovered {
+		if now.Before(until) {
+			continue
+		}
+		if err := s.DataAccess.Recoveries().ClearRecovered(key); err != nil {
+			slog.Errorln(err)
+			continue
+		}
+		ak := expr.AlertKey(key)
+		st, a := s.status[ak], s.Conf.Alerts[ak.Name()]
+		if st == nil || a == nil {
+			continue
+		}
+		// A re-fire continued the incident, which notifies on its own.
+		if ev := st.Last(); ev.Status == StNormal {
+			s.sendRecovery(st, &ev, a, s.NewRunHistory(now, cache.New(0)))
+		}
+	}
+}
+
+// checkFailingAlerts sends the failingAlertNotification when the number of
+// alerts failing to evaluate reaches failingAlertThreshold, and once more when
+// it falls back below it.
+func (s *Schedule) checkFailingAlerts() {
+	n := s.Conf.FailingAlertNotification
+	if n == nil {
+		return
+	}
+	failing := make(map[string]*AlertError)
+	for name, as := range s.GetErrorHistory() {
+		if as.Success {
+			continue
+		}
+		var last *AlertError
+		if len(as.Errors) > 0 {
+			last = as.Errors[len(as.Errors)-1]
+		}
+		failing[name] = last
+	}
+	active := len(failing) >= s.Conf.FailingAlertThreshold
+	if active == s.failingAlertsActive {
+		return
+	}
+	s.failingAlertsActive = active
+	subject := fmt.Sprintf("bosun: %d alerts failing to evaluate", len(failing))
+	if !active {
+		subject = fmt.Sprintf("bosun: failing alerts recovered, %d failing", len(failing))
+	}
+	body := new(bytes.Buffer)
+	if err := failingAlertsSummary.Execute(body, struct {
+		Failing   map[string]*AlertError
+		Threshold int
+	}{failing, s.Conf.FailingAlertThreshold}); err != nil {
+		slog.Errorln(err)
+	}
+	slog.Infoln(subject)
+	s.queueNotification(n, "failing_alerts", 0, subject, body.String(), []byte(subject), body.Bytes(), nil)
+}
+
+// sendDeferred sends a summary of the notifications deferred for each
+// notification whose quiet hours have ended.
+func (s *Schedule) sendDeferred() {
+	now := s.Clock.Now()
+	for name, deferred := range s.Deferred {
+		n := s.Conf.Notifications[name]
+		if n == nil {
+			delete(s.Deferred, name)
+			continue
+		}
+		if n.Quiet != nil {
+			if _, quiet := n.Quiet.Until(now); quiet {
+				continue
+			}
+		}
+		delete(s.Deferred, name)
+		if s.Conf.Quiet {
+			slog.Infoln("quiet mode prevented summary of", len(deferred), "deferred notifications")
+			continue
+		}
+		subject := fmt.Sprintf("%d notifications deferred during quiet hours", len(deferred))
+		body := new(bytes.Buffer)
+		if err := deferredSummary.Execute(body, deferred); err != nil {
+			slog.Errorln(err)
+		}
+		s.queueNotification(n, "quiet_hours_summary", 0, subject, body.String(), []byte(subject), body.Bytes(), nil)
+	}
+}
+
+var digestSummary = htemplate.Must(htemplate.New("digestSummary").Parse(`
+	<p>The following notifications were held back by the rate limit.
+	<ul>
+	{{ range . }}
+		<li>{{ .Time.Format "2006-01-02 15:04:05 MST" }} {{ .Status }} {{ .AlertKey }}: {{ .Subject }}</li>
+	{{ end }}
+	</ul>
+	`))
+
+// sendDigests ends the rate limit intervals that are over, sending a digest
+// of the notifications held back in each.
+func (s *Schedule) sendDigests() {
+	now := s.Clock.Now()
+	for name, d := range s.Digests {
+		n := s.Conf.Notifications[name]
+		if n == nil {
+			delete(s.Digests, name)
+			continue
+		}
+		if n.RateLimit > 0 && now.Before(d.Start.Add(n.RateInterval)) {
+			continue
+		}
+		delete(s.Digests, name)
+		if len(d.Held) == 0 {
+			continue
+		}
+		if s.Conf.Quiet {
+			slog.Infoln("quiet mode prevented digest of", len(d.Held), "rate limited notifications")
+			continue
+		}
+		subject := fmt.Sprintf("%d notifications held back by rate limit", len(d.Held))
+		body := new(bytes.Buffer)
+		if err := digestSummary.Execute(body, d.Held); err != nil {
+			slog.Errorln(err)
+		}
+		// Fanout targets keep digests of their own.
+		s.queueOne(n, "rate_limit_digest", 0, subject, body.String(), []byte(subject), body.Bytes(), nil)
+	}
+}
+
 func (s *Schedule) sendUnknownNotifications() {
 	slog.Info("Batching and sending unknown notifications")
 	defer slog.Info("Done sending unknown notifications")
@@ -168,14 +500,22 @@ var unknownMultiGroup = ttemplate.Must(ttemplate.New("unknownMultiGroup").Parse(
 	</ul>
 	`))
 
+// notify sends st to n and each of its fanout targets, adding it to the
+// digest of any that have reached their rateLimit instead.
 func (s *Schedule) notify(st *State, n *conf.Notification) {
-	n.Notify(st.Subject, st.Body, st.EmailSubject, st.EmailBody, s.Conf, string(st.AlertKey()), st.Attachments...)
+	for _, n := range append([]*conf.Notification{n}, n.Fanout...) {
+		if s.holdForDigest(st, n) {
+			slog.Infoln("rate limited, adding to digest of", n.Name, st.AlertKey())
+			continue
+		}
+		s.queueOne(n, string(st.AlertKey()), st.Last().IncidentId, st.Subject, st.Body, st.EmailSubject, st.EmailBody, st.EmailText, st.Attachments...)
+	}
 }
 
 // utnotify is single notification for N unknown groups into a single notification
 func (s *Schedule) utnotify(groups map[string]expr.AlertKeys, n *conf.Notification) {
 	var total int
-	now := time.Now().UTC()
+	now := s.Clock.Now().UTC()
 	for _, group := range groups {
 		// Don't know what the following line does, just copied from unotify
 		s.Group[now] = group
@@ -192,7 +532,7 @@ func (s *Schedule) utnotify(groups map[string]expr.AlertKeys, n *conf.Notificati
 	}); err != nil {
 		slog.Errorln(err)
 	}
-	n.Notify(subject, body.String(), []byte(subject), body.Bytes(), s.Conf, "unknown_treshold")
+	s.queueNotification(n, "unknown_treshold", 0, subject, body.String(), []byte(subject), body.Bytes(), nil)
 }
 
 var defaultUnknownTemplate = &conf.Template{
@@ -210,7 +550,7 @@ var defaultUnknownTemplate = &conf.Template{
 func (s *Schedule) unotify(name string, group expr.AlertKeys, n *conf.Notification) {
 	subject := new(bytes.Buffer)
 	body := new(bytes.Buffer)
-	now := time.Now().UTC()
+	now := s.Clock.Now().UTC()
 	s.Group[now] = group
 	t := s.Conf.UnknownTemplate
 	if t == nil {
@@ -227,7 +567,7 @@ func (s *Schedule) unotify(name string, group expr.AlertKeys, n *conf.Notificati
 			slog.Infoln("unknown template error:", err)
 		}
 	}
-	n.Notify(subject.String(), body.String(), subject.Bytes(), body.Bytes(), s.Conf, name)
+	s.queueNotification(n, name, 0, subject.String(), body.String(), subject.Bytes(), body.Bytes(), nil)
 }
 
 func (s *Schedule) AddNotification(ak expr.AlertKey, n *conf.Notification, started time.Time) {
@@ -287,7 +627,7 @@ func (s *Schedule) ActionNotify(at ActionType, user, message string, aks []expr.
 			slog.Error("Error rendering action notification body", err)
 		}
 
-		notification.Notify(subject, buf.String(), []byte(subject), buf.Bytes(), s.Conf, "actionNotification")
+		s.queueNotification(notification, "actionNotification", 0, subject, buf.String(), []byte(subject), buf.Bytes(), nil)
 	}
 }
 
@@ -296,7 +636,7 @@ func (s *Schedule) groupActionNotifications(aks []expr.AlertKey) map[*conf.Notif
 	for _, ak := range aks {
 		alert := s.Conf.Alerts[ak.Name()]
 		status := s.GetStatus(ak)
-		if alert == nil || status == nil {
+		if alert == nil || status == nil || s.Conf.Suppress.Squelched(status.Group) {
 			continue
 		}
 		var n *conf.Notifications
@@ -0,0 +1,208 @@
+package sched
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/database"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/slog"
+)
+
+// Notifications are written to the queue in the data layer before they are
+// sent, and removed once every channel has been delivered to. Any left in the
+// queue after a restart are sent again, so delivery is at-least-once: each
+// carries its queue id in conf.DedupHeader for receivers to drop duplicates.
+
+const (
+	// maxNotificationAttempts is the number of times a notification is sent
+	// before it is dropped from the queue.
+	maxNotificationAttempts = 5
+	// notificationRetryInterval is how often failed and left over
+	// notifications are sent again.
+	notificationRetryInterval = time.Minute
+)
+
+func init() {
+	metadata.AddMetricMeta("bosun.notifications.queue_depth", metadata.Gauge, metadata.Count,
+		"The number of notifications waiting to be sent.")
+	metadata.AddMetricMeta("bosun.notifications.dropped", metadata.Counter, metadata.Count,
+		"The number of notifications dropped from the queue after failing to send.")
+}
+
+// sending is the set of queued notification ids being delivered, so a retry
+// pass does not send one again while it is in flight.
+type sending struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+func (s *sending) start(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	if s.ids == nil {
+		s.ids = make(map[string]bool)
+	}
+	s.ids[id] = true
+	return true
+}
+
+func (s *sending) done(id string) {
+	s.Lock()
+	delete(s.ids, id)
+	s.Unlock()
+}
+
+// queueNotification queues a notification on n and each of its fanout
+// targets, and sends them in the background. Each is queued and retried on
+// its own, so one failing does not hold up the others. If one cannot be
+// queued it is sent anyway. incidentId is the incident the notifications are
+// for, or zero for none.
+func (s *Schedule) queueNotification(n *conf.Notification, ak string, incidentId uint64, subject, body string, emailsubject, emailbody, emailtext []byte, attachments ...*conf.Attachment) {
+	for _, n := range append([]*conf.Notification{n}, n.Fanout...) {
+		s.queueOne(n, ak, incidentId, subject, body, emailsubject, emailbody, emailtext, attachments...)
+	}
+}
+
+// queueOne queues a notification on n alone, without its fanout targets, and
+// sends it in the background.
+func (s *Schedule) queueOne(n *conf.Notification, ak string, incidentId uint64, subject, body string, emailsubject, emailbody, emailtext []byte, attachments ...*conf.Attachment) {
+	q := s.enqueueNotification(n, ak, incidentId, subject, body, emailsubject, emailbody, emailtext, attachments...)
+	go s.deliver(q, false)
+}
+
+func (s *Schedule) enqueueNotification(n *conf.Notification, ak string, incidentId uint64, subject, body string, emailsubject, emailbody, emailtext []byte, attachments ...*conf.Attachment) *database.QueuedNotification {
+	now := s.Clock.Now().UTC()
+	q := &database.QueuedNotification{
+		Id:           fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprint(n.Name, ak, subject, now.UnixNano())))),
+		Notification: n.Name,
+		AlertKey:     ak,
+		IncidentId:   incidentId,
+		Subject:      subject,
+		Body:         body,
+		EmailSubject: emailsubject,
+		EmailBody:    emailbody,
+		EmailText:    emailtext,
+		Enqueued:     now.Unix(),
+	}
+	for _, a := range attachments {
+		q.Attachments = append(q.Attachments, &database.QueuedAttachment{
+			Data:        a.Data,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+		})
+	}
+	if err := s.DataAccess.NotificationQueue().Enqueue(q); err != nil {
+		slog.Errorf("queueing notification %s for %s: %v", n.Name, ak, err)
+	}
+	return q
+}
+
+// deliver sends q, and removes it from the queue once sent or after
+// maxNotificationAttempts failures. Channels that were sent are recorded in
+// q.Sent, so a retry only sends to those that failed. Nothing is sent while shutting down. If
+// fromQueue is set, q was read from the queue and is only sent if it is still
+// queued, since another delivery may have sent it after it was read.
+func (s *Schedule) deliver(q *database.QueuedNotification, fromQueue bool) {
+	if !s.work.start() {
+		return
+	}
+	defer s.work.done()
+	if !s.sending.start(q.Id) {
+		return
+	}
+	defer s.sending.done(q.Id)
+	queue := s.DataAccess.NotificationQueue()
+	if fromQueue {
+		if queued, err := queue.IsQueued(q.Id); err != nil {
+			slog.Errorln(err)
+			return
+		} else if !queued {
+			return
+		}
+	}
+	n := s.Conf.Notifications[q.Notification]
+	if n == nil {
+		slog.Infof("dropping queued notification for %s: notification %s no longer exists", q.AlertKey, q.Notification)
+		if err := queue.Dequeue(q.Id); err != nil {
+			slog.Errorln(err)
+		}
+		return
+	}
+	var attachments []*conf.Attachment
+	for _, a := range q.Attachments {
+		attachments = append(attachments, &conf.Attachment{
+			Data:        a.Data,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+		})
+	}
+	var mu sync.Mutex
+	var sent []string
+	onSent := func(medium string, err error) {
+		if err == nil {
+			mu.Lock()
+			sent = append(sent, medium)
+			mu.Unlock()
+		}
+		if q.IncidentId != 0 {
+			s.recordDelivery(q.IncidentId, n.Name, medium, s.Clock.Now().UTC(), err)
+		}
+	}
+	err := n.Deliver(onSent, q.Sent, q.Id, q.Subject, q.Body, q.EmailSubject, q.EmailBody, q.EmailText, s.Conf, q.AlertKey, q.IncidentId, attachments...)
+	q.Sent = append(q.Sent, sent...)
+	if err != nil {
+		if ak, perr := expr.ParseAlertKey(q.AlertKey); perr == nil && s.Conf.Alerts[ak.Name()] != nil {
+			s.markDeliveryError(ak.Name(), err)
+		}
+		q.Attempts++
+		if q.Attempts < maxNotificationAttempts {
+			err = queue.Enqueue(q)
+		} else {
+			slog.Errorf("dropping notification %s for %s after %d attempts", q.Notification, q.AlertKey, q.Attempts)
+			collect.Add("notifications.dropped", nil, 1)
+			err = queue.Dequeue(q.Id)
+		}
+	} else {
+		err = queue.Dequeue(q.Id)
+	}
+	if err != nil {
+		slog.Errorln(err)
+	}
+}
+
+// sendQueued sends every notification in the queue that is not already being
+// sent.
+func (s *Schedule) sendQueued() {
+	pending, err := s.DataAccess.NotificationQueue().Pending()
+	if err != nil {
+		slog.Errorln("reading notification queue:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, q := range pending {
+		wg.Add(1)
+		go func(q *database.QueuedNotification) {
+			defer wg.Done()
+			s.deliver(q, true)
+		}(q)
+	}
+	wg.Wait()
+}
+
+// resendNotifications sends notifications left in the queue at startup, and
+// then retries failed ones every notificationRetryInterval.
+func (s *Schedule) resendNotifications() {
+	for {
+		s.sendQueued()
+		<-s.Clock.After(notificationRetryInterval)
+	}
+}
@@ -39,6 +39,7 @@ type Schedule struct {
 	Conf    *conf.Conf
 	status  States
 	Silence map[string]*Silence
+	Mutes   map[string]*Mute
 	Group   map[time.Time]expr.AlertKeys
 
 	Incidents map[uint64]*Incident
@@ -50,21 +51,37 @@ type Schedule struct {
 	nc chan interface{}
 	//notifications to be sent immediately
 	pendingNotifications map[*conf.Notification][]*State
+	//recovery notifications among pendingNotifications, which are not escalated.
+	pendingRecoveries map[*conf.Notification]map[expr.AlertKey]bool
 	//notifications we are currently tracking, potentially with future or repeated actions.
 	Notifications map[expr.AlertKey]map[string]time.Time
 	//unknown states that need to be notified about. Collected and sent in batches.
 	pendingUnknowns map[*conf.Notification][]*State
+	//notifications held back during quiet hours, by notification name. Sent as one summary when the window ends.
+	Deferred map[string][]*DeferredNotification
+	//rate limit state of notifications with a rateLimit, by notification name. Held notifications are sent as one digest when the interval ends.
+	Digests map[string]*Digest
+	//whether the failing alert notification was last sent for crossing the threshold, rather than for recovering.
+	failingAlertsActive bool
 
 	alertStatusLock sync.Mutex
 	maxIncidentId   uint64
 	incidentLock    sync.Mutex
 	db              *bolt.DB
+	encoding        database.Encoding
 
 	LastCheck time.Time
 
-	ctx *checkContext
+	ctx        *checkContext
+	checkLimit *checkLimiter
+	runs       *runTracker
+	sending    sending
+	work       work
 
 	DataAccess database.DataAccess
+
+	// Clock is the source of time, RealClock unless set before Init.
+	Clock Clock
 }
 
 func (s *Schedule) Init(c *conf.Conf) error {
@@ -76,22 +93,34 @@ func (s *Schedule) Init(c *conf.Conf) error {
 	s.Conf = c
 	s.AlertStatuses = make(map[string]*AlertStatus)
 	s.Silence = make(map[string]*Silence)
+	s.Mutes = make(map[string]*Mute)
 	s.Group = make(map[time.Time]expr.AlertKeys)
 	s.Incidents = make(map[uint64]*Incident)
 	s.pendingUnknowns = make(map[*conf.Notification][]*State)
 	s.status = make(States)
-	s.LastCheck = time.Now()
-	s.ctx = &checkContext{time.Now(), cache.New(0)}
+	if s.Clock == nil {
+		s.Clock = RealClock
+	}
+	s.LastCheck = s.Clock.Now()
+	s.ctx = &checkContext{s.Clock.Now(), cache.New(0)}
+	s.checkLimit = newCheckLimiter(c.CheckConcurrency)
+	s.runs = newRunTracker()
+	s.encoding = database.EncodingJSON
+	if c.StateEncoding == "msgpack" {
+		s.encoding = database.EncodingMsgpack
+	}
 	if s.DataAccess == nil {
+		enc := s.encoding
+		database.SetTimingFlush(c.RedisTimingFlush)
 		if c.RedisHost != "" {
-			s.DataAccess = database.NewDataAccess(c.RedisHost, true)
+			s.DataAccess = database.NewDataAccess(c.RedisHost, true, enc, c.RedisKeyPrefix)
 		} else {
 			bind := "127.0.0.1:9565"
 			_, err := database.StartLedis(c.LedisDir, bind)
 			if err != nil {
 				return err
 			}
-			s.DataAccess = database.NewDataAccess(bind, false)
+			s.DataAccess = database.NewDataAccess(bind, false, enc, c.RedisKeyPrefix)
 		}
 	}
 	if s.Search == nil {
@@ -343,6 +372,7 @@ type StateGroup struct {
 	Active   bool `json:",omitempty"`
 	Status   Status
 	Silenced bool
+	Muted    bool          `json:",omitempty"`
 	IsError  bool          `json:",omitempty"`
 	Subject  string        `json:",omitempty"`
 	Alert    string        `json:",omitempty"`
@@ -372,7 +402,7 @@ func (s *Schedule) MarshalGroups(T miniprofiler.Timer, filter string) (*StateGro
 	t := StateGroups{
 		TimeAndDate: s.Conf.TimeAndDate,
 	}
-	t.FailingAlerts, t.UnclosedErrors = s.getErrorCounts()
+	t.FailingAlerts, t.UnclosedErrors = s.ErrorCounts()
 	s.Lock("MarshallGroups")
 	defer s.Unlock()
 	T.Step("Setup", func(miniprofiler.Timer) {
@@ -434,6 +464,7 @@ func (s *Schedule) MarshalGroups(T miniprofiler.Timer, filter string) (*StateGro
 							Active:   tuple.Active,
 							Status:   tuple.Status,
 							Silenced: tuple.Silenced,
+							Muted:    s.IsMuted(ak.Name()),
 							AlertKey: ak,
 							Alert:    ak.Name(),
 							Subject:  string(st.Subject),
@@ -600,12 +631,19 @@ type State struct {
 	Body         string
 	EmailBody    []byte             `json:"-"`
 	EmailSubject []byte             `json:"-"`
+	EmailText    []byte             `json:"-"`
 	Attachments  []*conf.Attachment `json:"-"`
 	NeedAck      bool
 	Open         bool
 	Forgotten    bool
 	Unevaluated  bool
 	LastLogTime  time.Time
+	// Notified holds the names of the notifications last sent for this
+	// state, used to route its recovery notification.
+	Notified []string `json:",omitempty"`
+	// SnoozedUntil is when a snooze of the incident ends. Notifications are
+	// paused until then, and sent again if it is still active.
+	SnoozedUntil time.Time
 }
 
 func (s *State) Copy() *State {
@@ -620,12 +658,15 @@ func (s *State) Copy() *State {
 		Body:         s.Body,
 		EmailBody:    s.EmailBody,
 		EmailSubject: s.EmailSubject,
+		EmailText:    s.EmailText,
 		Attachments:  s.Attachments,
 		NeedAck:      s.NeedAck,
 		Open:         s.Open,
 		Forgotten:    s.Forgotten,
 		Unevaluated:  s.Unevaluated,
 		LastLogTime:  s.LastLogTime,
+		Notified:     s.Notified,
+		SnoozedUntil: s.SnoozedUntil,
 	}
 	newState.Result = s.Result
 	return newState
@@ -675,6 +716,59 @@ func (s *State) Action(user, message string, t ActionType, timestamp time.Time)
 func (s *Schedule) Action(user, message string, t ActionType, ak expr.AlertKey) error {
 	s.Lock("Action")
 	defer s.Unlock()
+	return s.action(user, message, t, ak)
+}
+
+// AckIncident acknowledges the alert key of the incident with the given id,
+// and returns the key. It fails if the incident is no longer the key's
+// current one.
+func (s *Schedule) AckIncident(id uint64, user, message string) (expr.AlertKey, error) {
+	incident, err := s.GetIncident(id)
+	if err != nil {
+		return "", err
+	}
+	ak := incident.AlertKey
+	s.Lock("AckIncident")
+	defer s.Unlock()
+	if st := s.status[ak]; st == nil || st.Last().IncidentId != id {
+		return "", fmt.Errorf("incident %d is no longer current for %s", id, ak)
+	}
+	return ak, s.action(user, message, ActionAcknowledge, ak)
+}
+
+// AckIncidents acknowledges every open, unacknowledged alert that matches the
+// dashboard filter and returns the acknowledged keys. The schedule lock is
+// held once for the whole batch.
+func (s *Schedule) AckIncidents(filter, user, message string) (expr.AlertKeys, error) {
+	if user == "" {
+		return nil, fmt.Errorf("must specify user")
+	}
+	matches, err := makeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock("AckIncidents")
+	defer s.Unlock()
+	var acked expr.AlertKeys
+	for ak, st := range s.status {
+		if !st.Open || !st.NeedAck {
+			continue
+		}
+		a := s.Conf.Alerts[ak.Name()]
+		if a == nil || !matches(s.Conf, a, st) {
+			continue
+		}
+		if err := s.action(user, message, ActionAcknowledge, ak); err != nil {
+			return acked, err
+		}
+		acked = append(acked, ak)
+	}
+	sort.Sort(acked)
+	slog.Infof("%s acknowledged %d alerts matching filter %q: %s", user, len(acked), filter, message)
+	return acked, nil
+}
+
+func (s *Schedule) action(user, message string, t ActionType, ak expr.AlertKey) error {
 	st := s.status[ak]
 	if st == nil {
 		return fmt.Errorf("no such alert key: %v", ak)
@@ -684,7 +778,7 @@ func (s *Schedule) Action(user, message string, t ActionType, ak expr.AlertKey)
 		st.NeedAck = false
 	}
 	isUnknown := st.AbnormalStatus() == StUnknown
-	timestamp := time.Now().UTC()
+	timestamp := s.Clock.Now().UTC()
 	switch t {
 	case ActionAcknowledge:
 		if !st.NeedAck {
@@ -702,6 +796,7 @@ func (s *Schedule) Action(user, message string, t ActionType, ak expr.AlertKey)
 			return fmt.Errorf("cannot close active alert")
 		}
 		st.Open = false
+		st.SnoozedUntil = time.Time{}
 		last := st.Last()
 		if last.IncidentId != 0 {
 			s.incidentLock.Lock()
@@ -723,6 +818,13 @@ func (s *Schedule) Action(user, message string, t ActionType, ak expr.AlertKey)
 	default:
 		return fmt.Errorf("unknown action type: %v", t)
 	}
+	// Closing or forgetting an instance ends its post-recovery cooldown,
+	// dropping any recovery notification it held.
+	if a := s.Conf.Alerts[ak.Name()]; (t == ActionClose || t == ActionForget) && a != nil && a.RecoveryCooldown > 0 {
+		if err := s.DataAccess.Recoveries().ClearRecovered(string(ak)); err != nil {
+			slog.Errorln(err)
+		}
+	}
 	st.Action(user, message, t, timestamp)
 	// Would like to also track the alert group, but I believe this is impossible because any character
 	// that could be used as a delimiter could also be a valid tag key or tag value character
@@ -732,6 +834,38 @@ func (s *Schedule) Action(user, message string, t ActionType, ak expr.AlertKey)
 	return nil
 }
 
+// Snooze pauses the notifications of an open, active incident for d. If it is
+// still active when the snooze ends, its notifications are sent again.
+func (s *Schedule) Snooze(user, message string, ak expr.AlertKey, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("snooze duration must be positive")
+	}
+	s.Lock("Snooze")
+	defer s.Unlock()
+	st := s.status[ak]
+	if st == nil {
+		return fmt.Errorf("no such alert key: %v", ak)
+	}
+	if !st.Open || !st.IsActive() {
+		return fmt.Errorf("can only snooze open, active alerts")
+	}
+	timestamp := s.Clock.Now().UTC()
+	delete(s.Notifications, ak)
+	st.SnoozedUntil = timestamp.Add(d)
+	st.Action(user, message, ActionSnooze, timestamp)
+	if err := collect.Add("actions", opentsdb.TagSet{"user": user, "alert": ak.Name(), "type": ActionSnooze.String()}, 1); err != nil {
+		slog.Errorln(err)
+	}
+	// Wake the dispatcher, so it wakes the snooze on time.
+	if s.nc != nil {
+		select {
+		case s.nc <- true:
+		default:
+		}
+	}
+	return nil
+}
+
 func (s *State) Touch() {
 	s.Touched = time.Now().UTC()
 	s.Forgotten = false
@@ -760,6 +894,9 @@ type Event struct {
 	Time        time.Time
 	Unevaluated bool
 	IncidentId  uint64
+	// impact is the value of the alert's impact expression for this
+	// check, stored on the incident rather than the event.
+	impact *float64
 }
 
 type Result struct {
@@ -819,6 +956,7 @@ const (
 	ActionAcknowledge
 	ActionClose
 	ActionForget
+	ActionSnooze
 )
 
 func (a ActionType) String() string {
@@ -829,6 +967,8 @@ func (a ActionType) String() string {
 		return "Closed"
 	case ActionForget:
 		return "Forgotten"
+	case ActionSnooze:
+		return "Snoozed"
 	default:
 		return "none"
 	}
@@ -843,6 +983,11 @@ type Incident struct {
 	Start    time.Time
 	End      *time.Time
 	AlertKey expr.AlertKey
+	// Impact is the latest value of the alert's impact expression for the
+	// instance while the incident was open.
+	Impact *float64 `json:",omitempty"`
+	// Deliveries are the most recent sends of the incident's notifications.
+	Deliveries []Delivery `json:",omitempty"`
 }
 
 func (s *Schedule) createIncident(ak expr.AlertKey, start time.Time) *Incident {
@@ -860,6 +1005,20 @@ func (s *Schedule) createIncident(ak expr.AlertKey, start time.Time) *Incident {
 	return incident
 }
 
+// copyIncidents returns a copy of the incidents, made under incidentLock, that
+// can be read while they are updated. An incident's Deliveries slice is never
+// modified in place, so it is shared with the copy.
+func (s *Schedule) copyIncidents() map[uint64]*Incident {
+	s.incidentLock.Lock()
+	defer s.incidentLock.Unlock()
+	incidents := make(map[uint64]*Incident, len(s.Incidents))
+	for id, i := range s.Incidents {
+		c := *i
+		incidents[id] = &c
+	}
+	return incidents
+}
+
 type incidentList []*Incident
 
 func (i incidentList) Len() int { return len(i) }
@@ -926,9 +1085,12 @@ func (s *Schedule) createHistoricIncidents() {
 	}
 }
 
-func (s *Schedule) GetIncidents(alert string, from, to time.Time) []*Incident {
+// GetIncidents returns copies of the incidents of alert, or of all alerts if
+// alert is empty, that started between from and to. They are sorted by keys
+// as described in ParseIncidentSort, and by start time descending if there are
+// none.
+func (s *Schedule) GetIncidents(alert string, from, to time.Time, keys ...IncidentSortKey) []*Incident {
 	s.incidentLock.Lock()
-	defer s.incidentLock.Unlock()
 	list := []*Incident{}
 	for _, i := range s.Incidents {
 		if alert != "" && i.AlertKey.Name() != alert {
@@ -937,27 +1099,48 @@ func (s *Schedule) GetIncidents(alert string, from, to time.Time) []*Incident {
 		if i.Start.Before(from) || i.Start.After(to) {
 			continue
 		}
-		list = append(list, i)
+		c := *i
+		list = append(list, &c)
+	}
+	s.incidentLock.Unlock()
+	if len(keys) == 0 {
+		keys = defaultIncidentSort
+	}
+	s.sortIncidents(list, keys)
+	return list
+}
+
+// GetIncidentsOverlapping returns copies of all incidents that were open at
+// some point between from and to. Incidents that are still open have a nil End.
+func (s *Schedule) GetIncidentsOverlapping(from, to time.Time) []Incident {
+	s.incidentLock.Lock()
+	defer s.incidentLock.Unlock()
+	list := []Incident{}
+	for _, i := range s.Incidents {
+		if i.Start.After(to) || (i.End != nil && i.End.Before(from)) {
+			continue
+		}
+		list = append(list, *i)
 	}
 	return list
 }
 
+// GetIncident returns a copy of the incident with the given id.
 func (s *Schedule) GetIncident(id uint64) (*Incident, error) {
 	s.incidentLock.Lock()
+	defer s.incidentLock.Unlock()
 	incident, ok := s.Incidents[id]
-	s.incidentLock.Unlock()
 	if !ok {
 		return nil, fmt.Errorf("incident %d not found", id)
 	}
-	return incident, nil
+	c := *incident
+	return &c, nil
 }
 
 func (s *Schedule) GetIncidentEvents(id uint64) (*Incident, []Event, []Action, error) {
-	s.incidentLock.Lock()
-	incident, ok := s.Incidents[id]
-	s.incidentLock.Unlock()
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("incident %d not found", id)
+	incident, err := s.GetIncident(id)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 	list := []Event{}
 	state := s.GetStatus(incident.AlertKey)
@@ -999,14 +1182,43 @@ type IncidentStatus struct {
 type AlertStatus struct {
 	Success bool
 	Errors  []*AlertError
+	// FailingSince is when the alert's checks started failing, or zero if
+	// its last check succeeded.
+	FailingSince time.Time
 }
 
+// AlertError is a run of Count occurrences of the same error, coalesced as
+// described for errorCoalesce. FirstTime stays at the first occurrence, and
+// LastTime and Count advance with each repeat.
 type AlertError struct {
 	FirstTime, LastTime time.Time
 	Count               int
 	Message             string
+	Category            ErrorCategory
 }
 
+// ErrorCategory records which stage of processing an alert failed in.
+type ErrorCategory string
+
+const (
+	// ErrorQuery is a failure evaluating the alert's expressions, including datasource errors.
+	ErrorQuery ErrorCategory = "query"
+	// ErrorTemplate is a failure rendering the alert's templates.
+	ErrorTemplate ErrorCategory = "template"
+	// ErrorNotification is a failure delivering a notification for the alert.
+	// It does not mark the alert as failing.
+	ErrorNotification ErrorCategory = "notification"
+	// ErrorDatasource is a check skipped because a datasource's circuit breaker was open.
+	ErrorDatasource ErrorCategory = "datasource"
+	// ErrorPartial is a check evaluated without the data of some failed
+	// queries. It does not mark the alert as failing.
+	ErrorPartial ErrorCategory = "partial"
+	// ErrorCardinality is a check that returned more new instances than the
+	// alert's maxNewInstances, which were left out. It does not mark the
+	// alert as failing.
+	ErrorCardinality ErrorCategory = "cardinality"
+)
+
 func (s *Schedule) AlertSuccessful(name string) bool {
 	s.alertStatusLock.Lock()
 	defer s.alertStatusLock.Unlock()
@@ -1016,7 +1228,11 @@ func (s *Schedule) AlertSuccessful(name string) bool {
 	return true
 }
 
-func (s *Schedule) markAlertError(name string, err error) {
+// markAlertError records err for the named alert and marks it as failing. It
+// returns whether the alert started failing to evaluate, that is whether err
+// is a query or datasource error and the alert was not failing since an
+// earlier one.
+func (s *Schedule) markAlertError(name string, category ErrorCategory, err error) bool {
 	s.alertStatusLock.Lock()
 	defer s.alertStatusLock.Unlock()
 	as, ok := s.AlertStatuses[name]
@@ -1024,33 +1240,81 @@ func (s *Schedule) markAlertError(name string, err error) {
 		as = &AlertStatus{}
 		s.AlertStatuses[name] = as
 	}
+	wasFailing := !as.FailingSince.IsZero()
 	// if it succeeded prior to now, make a new error event.
-	// else if message is same as last, coalesce together.
+	// else if message is same as last and recent enough, coalesce together.
 	// else append new event
-	now := time.Now().UTC().Truncate(time.Second)
-	newError := func() {
-		as.Errors = append(as.Errors, &AlertError{
-			FirstTime: now,
-			LastTime:  now,
-			Count:     1,
-			Message:   err.Error(),
-		})
-	}
-	if as.Success || len(as.Errors) == 0 {
-		newError()
-	} else {
+	now := s.Clock.Now().UTC().Truncate(time.Second)
+	s.addAlertError(as, now, category, err, !as.Success)
+	as.Success = false
+	if as.FailingSince.IsZero() && (category == ErrorQuery || category == ErrorDatasource) {
+		as.FailingSince = now
+	}
+	return !wasFailing && !as.FailingSince.IsZero()
+}
+
+// markAlertPartial records that the named alert was evaluated without the
+// data of some failed queries, or without its impact.
+func (s *Schedule) markAlertPartial(name string, err error) {
+	s.markAlertWarning(name, ErrorPartial, err)
+}
+
+// markDeliveryError records that a notification for the named alert could not
+// be delivered.
+func (s *Schedule) markDeliveryError(name string, err error) {
+	s.markAlertWarning(name, ErrorNotification, err)
+}
+
+// markAlertWarning records err for the named alert without marking it as
+// failing. Repeats of the same error are coalesced as for a failing alert.
+func (s *Schedule) markAlertWarning(name string, category ErrorCategory, err error) {
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	as, ok := s.AlertStatuses[name]
+	if !ok {
+		as = &AlertStatus{Success: true}
+		s.AlertStatuses[name] = as
+	}
+	s.addAlertError(as, s.Clock.Now().UTC().Truncate(time.Second), category, err, true)
+}
+
+// addAlertError adds err to the errors of as, or if coalesce is set and it
+// repeats the last error recently enough, counts it with that one. The caller
+// must hold alertStatusLock.
+func (s *Schedule) addAlertError(as *AlertStatus, now time.Time, category ErrorCategory, err error, coalesce bool) {
+	if coalesce && len(as.Errors) > 0 {
 		last := as.Errors[len(as.Errors)-1]
-		if err.Error() == last.Message {
+		window := s.Conf.ErrorCoalesce
+		if err.Error() == last.Message && category == last.Category && (window == 0 || now.Sub(last.LastTime) <= window) {
 			last.Count++
 			last.LastTime = now
-		} else {
-			newError()
+			return
 		}
 	}
-	as.Success = false
+	as.Errors = append(as.Errors, &AlertError{
+		FirstTime: now,
+		LastTime:  now,
+		Count:     1,
+		Message:   err.Error(),
+		Category:  category,
+	})
+}
+
+// alertFailingSince returns when checks of the named alert started failing,
+// or zero if the last check succeeded.
+func (s *Schedule) alertFailingSince(name string) time.Time {
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	if as, ok := s.AlertStatuses[name]; ok {
+		return as.FailingSince
+	}
+	return time.Time{}
 }
 
-func (s *Schedule) markAlertSuccessful(name string) {
+// markAlertSuccessful marks the named alert as not failing. It returns
+// whether the alert was failing to evaluate before, since a query or
+// datasource error.
+func (s *Schedule) markAlertSuccessful(name string) (recovered bool) {
 	s.alertStatusLock.Lock()
 	defer s.alertStatusLock.Unlock()
 	as, ok := s.AlertStatuses[name]
@@ -1058,7 +1322,10 @@ func (s *Schedule) markAlertSuccessful(name string) {
 		as = &AlertStatus{}
 		s.AlertStatuses[name] = as
 	}
+	recovered = !as.FailingSince.IsZero()
 	as.Success = true
+	as.FailingSince = time.Time{}
+	return recovered
 }
 
 func (s *Schedule) ClearErrorLine(alert string, startTime time.Time) {
@@ -1074,11 +1341,117 @@ func (s *Schedule) ClearErrorLine(alert string, startTime time.Time) {
 		as.Errors = newErrors
 		if len(as.Errors) == 0 {
 			as.Success = true
+			as.FailingSince = time.Time{}
+		}
+	}
+}
+
+// compactErrors trims each alert's error history to its max most recent
+// entries, or all of them if max is 0. If dedup is set, each entry is first
+// merged into the previous entry of its category when they have the same
+// message and are within errorCoalesce of each other. The merged entry moves
+// to where the later one was, so the history stays ordered by LastTime. It
+// returns the number of entries removed.
+func (s *Schedule) compactErrors(max int, dedup bool) int {
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	removed := 0
+	for _, as := range s.AlertStatuses {
+		n := len(as.Errors)
+		if dedup && n > 1 {
+			window := s.Conf.ErrorCoalesce
+			// last is the index in merged of each category's latest entry.
+			last := make(map[ErrorCategory]int)
+			merged := make([]*AlertError, 0, n)
+			for _, e := range as.Errors {
+				if i, ok := last[e.Category]; ok {
+					l := merged[i]
+					if e.Message == l.Message && (window == 0 || e.FirstTime.Sub(l.LastTime) <= window) {
+						l.Count += e.Count
+						l.LastTime = e.LastTime
+						merged[i] = nil
+						e = l
+					}
+				}
+				last[e.Category] = len(merged)
+				merged = append(merged, e)
+			}
+			errs := make([]*AlertError, 0, len(merged))
+			for _, e := range merged {
+				if e != nil {
+					errs = append(errs, e)
+				}
+			}
+			as.Errors = errs
+		}
+		if max > 0 && len(as.Errors) > max {
+			as.Errors = append([]*AlertError(nil), as.Errors[len(as.Errors)-max:]...)
 		}
+		removed += n - len(as.Errors)
 	}
+	return removed
 }
 
-func (s *Schedule) getErrorCounts() (failing, total int) {
+// ClearAlertErrors removes all recorded errors for alert and marks it successful.
+func (s *Schedule) ClearAlertErrors(alert, user string) error {
+	if user == "" {
+		return fmt.Errorf("must specify user")
+	}
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	return s.clearAlertErrors(alert, user)
+}
+
+func (s *Schedule) clearAlertErrors(alert, user string) error {
+	as, ok := s.AlertStatuses[alert]
+	if !ok {
+		return fmt.Errorf("no errors recorded for alert %s", alert)
+	}
+	n := len(as.Errors)
+	as.Errors = nil
+	as.Success = true
+	as.FailingSince = time.Time{}
+	slog.Infof("%s cleared %d errors for alert %s", user, n, alert)
+	return nil
+}
+
+// ClearAlerts clears the errors of each of the named alerts, as
+// ClearAlertErrors does, all at once. It returns the error for each alert
+// that could not be cleared; the others were cleared.
+func (s *Schedule) ClearAlerts(names []string, user string) (map[string]error, error) {
+	if user == "" {
+		return nil, fmt.Errorf("must specify user")
+	}
+	failed := make(map[string]error)
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	for _, name := range names {
+		if err := s.clearAlertErrors(name, user); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed, nil
+}
+
+// ClearAllErrors removes all recorded errors for every alert and marks them successful.
+func (s *Schedule) ClearAllErrors(user string) error {
+	if user == "" {
+		return fmt.Errorf("must specify user")
+	}
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	for _, as := range s.AlertStatuses {
+		as.Errors = nil
+		as.Success = true
+		as.FailingSince = time.Time{}
+	}
+	slog.Infof("%s cleared errors for all %d alerts", user, len(s.AlertStatuses))
+	return nil
+}
+
+// ErrorCounts returns the number of alerts currently failing and the total
+// number of errors recorded for all alerts.
+func (s *Schedule) ErrorCounts() (failing, total int) {
 	failing = 0
 	total = 0
 	s.alertStatusLock.Lock()
@@ -1094,24 +1467,234 @@ func (s *Schedule) getErrorCounts() (failing, total int) {
 	return
 }
 
+func (as *AlertStatus) copy() *AlertStatus {
+	asCopy := &AlertStatus{
+		Success:      as.Success,
+		Errors:       make([]*AlertError, len(as.Errors)),
+		FailingSince: as.FailingSince,
+	}
+	for i, err := range as.Errors {
+		asCopy.Errors[i] = &AlertError{
+			Count:     err.Count,
+			FirstTime: err.FirstTime.UTC(),
+			LastTime:  err.LastTime.UTC(),
+			Message:   err.Message,
+			Category:  err.Category,
+		}
+		// Errors recorded before categories existed all came from queries.
+		if asCopy.Errors[i].Category == "" {
+			asCopy.Errors[i].Category = ErrorQuery
+		}
+	}
+	return asCopy
+}
+
+// GetFailingAlertsByCategory returns the names of currently failing alerts,
+// grouped by the category of their most recent error that marked them as
+// failing.
+func (s *Schedule) GetFailingAlertsByCategory() map[ErrorCategory][]string {
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	failing := make(map[ErrorCategory][]string)
+	for name, as := range s.AlertStatuses {
+		if as.Success {
+			continue
+		}
+		for i := len(as.Errors) - 1; i >= 0; i-- {
+			category := as.Errors[i].Category
+			if category == ErrorPartial || category == ErrorNotification || category == ErrorCardinality {
+				continue
+			}
+			if category == "" {
+				category = ErrorQuery
+			}
+			failing[category] = append(failing[category], name)
+			break
+		}
+	}
+	for _, names := range failing {
+		sort.Strings(names)
+	}
+	return failing
+}
+
+// GetFailingAlertsPage returns up to count names of failing alerts, sorted by
+// name, starting at offset, and the total number of failing alerts.
+func (s *Schedule) GetFailingAlertsPage(offset, count int) ([]string, int, error) {
+	if offset < 0 || count < 0 {
+		return nil, 0, fmt.Errorf("offset and count must not be negative")
+	}
+	s.alertStatusLock.Lock()
+	failing := []string{}
+	for name, as := range s.AlertStatuses {
+		if !as.Success {
+			failing = append(failing, name)
+		}
+	}
+	s.alertStatusLock.Unlock()
+	sort.Strings(failing)
+	total := len(failing)
+	if offset > total {
+		offset = total
+	}
+	if count > total-offset {
+		count = total - offset
+	}
+	return failing[offset : offset+count], total, nil
+}
+
+// AlertState summarizes the current state of an alert.
+type AlertState struct {
+	Alert string
+	// Status is the most severe current status of the alert's instances, or
+	// none if it has none.
+	Status    Status
+	Instances int
+	Failing   bool
+}
+
+// GetAlertStates returns the state of every configured alert, sorted by name.
+func (s *Schedule) GetAlertStates() []*AlertState {
+	states := make(map[string]*AlertState, len(s.Conf.Alerts))
+	for name := range s.Conf.Alerts {
+		states[name] = &AlertState{Alert: name}
+	}
+	s.Lock("GetAlertStates")
+	for ak, st := range s.status {
+		as := states[ak.Name()]
+		if as == nil {
+			continue
+		}
+		as.Instances++
+		if status := st.Status(); status > as.Status {
+			as.Status = status
+		}
+	}
+	s.Unlock()
+	s.alertStatusLock.Lock()
+	for name, status := range s.AlertStatuses {
+		if as := states[name]; as != nil && !status.Success {
+			as.Failing = true
+		}
+	}
+	s.alertStatusLock.Unlock()
+	list := make([]*AlertState, 0, len(states))
+	for _, as := range states {
+		list = append(list, as)
+	}
+	sort.Sort(alertStates(list))
+	return list
+}
+
+type alertStates []*AlertState
+
+func (a alertStates) Len() int           { return len(a) }
+func (a alertStates) Less(i, j int) bool { return a[i].Alert < a[j].Alert }
+func (a alertStates) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
 func (s *Schedule) GetErrorHistory() map[string]*AlertStatus {
 	s.alertStatusLock.Lock()
 	defer s.alertStatusLock.Unlock()
 	mapCopy := make(map[string]*AlertStatus, len(s.AlertStatuses))
 	for name, as := range s.AlertStatuses {
-		asCopy := &AlertStatus{
-			Success: as.Success,
-			Errors:  make([]*AlertError, len(as.Errors)),
-		}
-		for i, err := range as.Errors {
-			asCopy.Errors[i] = &AlertError{
-				Count:     err.Count,
-				FirstTime: err.FirstTime.UTC(),
-				LastTime:  err.LastTime.UTC(),
-				Message:   err.Message,
+		mapCopy[name] = as.copy()
+	}
+	return mapCopy
+}
+
+// GetLastErrors returns a copy of the most recent error of each named alert,
+// or nil for alerts with no recorded errors.
+func (s *Schedule) GetLastErrors(names []string) map[string]*AlertError {
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	last := make(map[string]*AlertError, len(names))
+	for _, name := range names {
+		last[name] = nil
+		if as, ok := s.AlertStatuses[name]; ok && len(as.Errors) > 0 {
+			e := *as.Errors[len(as.Errors)-1]
+			last[name] = &e
+		}
+	}
+	return last
+}
+
+// ErrorStats summarizes an alert's recent errors.
+type ErrorStats struct {
+	// LastHour and LastDay are the number of errors in the last hour and
+	// day, counting each repeat of a coalesced error.
+	LastHour, LastDay int
+	Failing           bool
+	// FailingSince is when the alert's checks started failing, or zero.
+	FailingSince time.Time
+}
+
+// GetErrorStats returns the error stats of every alert with recorded errors
+// or that is failing. Each alert's errors are scanned from the newest, and
+// only as far back as a day.
+func (s *Schedule) GetErrorStats() map[string]*ErrorStats {
+	now := s.Clock.Now().UTC()
+	hour, day := now.Add(-time.Hour), now.Add(-24*time.Hour)
+	s.alertStatusLock.Lock()
+	defer s.alertStatusLock.Unlock()
+	stats := make(map[string]*ErrorStats, len(s.AlertStatuses))
+	for name, as := range s.AlertStatuses {
+		if as.Success && len(as.Errors) == 0 {
+			continue
+		}
+		st := &ErrorStats{
+			Failing:      !as.Success,
+			FailingSince: as.FailingSince,
+		}
+		for i := len(as.Errors) - 1; i >= 0; i-- {
+			e := as.Errors[i]
+			if e.LastTime.Before(day) {
+				break
 			}
+			st.LastHour += e.countSince(hour)
+			st.LastDay += e.countSince(day)
 		}
-		mapCopy[name] = asCopy
+		stats[name] = st
 	}
-	return mapCopy
+	return stats
+}
+
+// countSince returns how many of the occurrences of e were at or after t.
+// Repeats are assumed to be evenly spaced between FirstTime and LastTime.
+func (e *AlertError) countSince(t time.Time) int {
+	switch {
+	case e.LastTime.Before(t):
+		return 0
+	case !e.FirstTime.Before(t):
+		return e.Count
+	}
+	frac := float64(e.LastTime.Sub(t)) / float64(e.LastTime.Sub(e.FirstTime))
+	return int(float64(e.Count-1)*frac) + 1
+}
+
+// ScanErrorHistory calls fn with a copy of the error history of each alert,
+// in alert name order. Only one alert is copied at a time, so the lock is not
+// held while fn runs. Iteration stops at the first error returned by fn.
+func (s *Schedule) ScanErrorHistory(fn func(name string, as *AlertStatus) error) error {
+	s.alertStatusLock.Lock()
+	names := make([]string, 0, len(s.AlertStatuses))
+	for name := range s.AlertStatuses {
+		names = append(names, name)
+	}
+	s.alertStatusLock.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		s.alertStatusLock.Lock()
+		as, ok := s.AlertStatuses[name]
+		if ok {
+			as = as.copy()
+		}
+		s.alertStatusLock.Unlock()
+		if !ok {
+			continue
+		}
+		if err := fn(name, as); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package sched
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,11 +9,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
+	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/database"
 	"bosun.org/cmd/bosun/expr"
@@ -53,7 +58,12 @@ func check(s *Schedule, t time.Time) {
 
 //fake data access for tests. Perhaps a full mock would be more appropriate, once the interface contains more.
 // this implementation just panics
-type nopDataAccess struct{}
+type nopDataAccess struct {
+	mu        sync.Mutex
+	queue     map[string]database.QueuedNotification
+	recovered map[string]time.Time
+	evalInfo  map[string]database.AlertEvalInfo
+}
 
 func (n *nopDataAccess) PutMetricMetadata(metric string, field string, value string) error {
 	panic("not implemented")
@@ -70,7 +80,11 @@ func (n *nopDataAccess) GetTagMetadata(tags opentsdb.TagSet, name string) ([]*da
 func (n *nopDataAccess) DeleteTagMetadata(tags opentsdb.TagSet, name string) error {
 	panic("not implemented")
 }
+func (n *nopDataAccess) ScanList(key string, batch int, fn func([]byte) error) error {
+	panic("not implemented")
+}
 func (n *nopDataAccess) Search() database.SearchDataAccess { return n }
+func (n *nopDataAccess) Close() error                      { return nil }
 func (n *nopDataAccess) AddMetricForTag(tagK, tagV, metric string, time int64) error {
 	panic("not implemented")
 }
@@ -107,6 +121,102 @@ func (n *nopDataAccess) BackupLastInfos(map[string]map[string]*database.LastInfo
 func (n *nopDataAccess) LoadLastInfos() (map[string]map[string]*database.LastInfo, error) {
 	return map[string]map[string]*database.LastInfo{}, nil
 }
+func (n *nopDataAccess) Favorites() database.FavoritesDataAccess { return n }
+func (n *nopDataAccess) AddFavorite(user, item string) error {
+	panic("not implemented")
+}
+func (n *nopDataAccess) RemoveFavorite(user, item string) error {
+	panic("not implemented")
+}
+func (n *nopDataAccess) GetFavorites(user string) ([]string, error) {
+	panic("not implemented")
+}
+func (n *nopDataAccess) Recoveries() database.RecoveryDataAccess { return n }
+func (n *nopDataAccess) SetRecoveredUntil(ak string, until time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.recovered == nil {
+		n.recovered = make(map[string]time.Time)
+	}
+	n.recovered[ak] = until
+	return nil
+}
+func (n *nopDataAccess) GetRecoveredUntil(ak string) (time.Time, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.recovered[ak], nil
+}
+func (n *nopDataAccess) GetAllRecovered() (map[string]time.Time, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	all := make(map[string]time.Time, len(n.recovered))
+	for ak, until := range n.recovered {
+		all[ak] = until
+	}
+	return all, nil
+}
+func (n *nopDataAccess) ClearRecovered(ak string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.recovered, ak)
+	return nil
+}
+func (n *nopDataAccess) EvalInfo() database.EvalInfoDataAccess { return n }
+func (n *nopDataAccess) SetAlertEvalInfo(name string, info *database.AlertEvalInfo) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.evalInfo == nil {
+		n.evalInfo = make(map[string]database.AlertEvalInfo)
+	}
+	n.evalInfo[name] = *info
+	return nil
+}
+func (n *nopDataAccess) GetAlertEvalInfo(name string) (*database.AlertEvalInfo, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	info, ok := n.evalInfo[name]
+	if !ok {
+		return nil, nil
+	}
+	return &info, nil
+}
+func (n *nopDataAccess) NotificationQueue() database.NotificationQueueDataAccess { return n }
+func (n *nopDataAccess) Enqueue(q *database.QueuedNotification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.queue == nil {
+		n.queue = make(map[string]database.QueuedNotification)
+	}
+	n.queue[q.Id] = *q
+	return nil
+}
+func (n *nopDataAccess) Pending() ([]*database.QueuedNotification, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var pending []*database.QueuedNotification
+	for _, q := range n.queue {
+		q := q
+		pending = append(pending, &q)
+	}
+	return pending, nil
+}
+func (n *nopDataAccess) Dequeue(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.queue, id)
+	return nil
+}
+func (n *nopDataAccess) IsQueued(id string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.queue[id]
+	return ok, nil
+}
+func (n *nopDataAccess) QueueDepth() (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.queue), nil
+}
 
 func initSched(c *conf.Conf) (*Schedule, error) {
 	c.StateFile = ""
@@ -116,6 +226,52 @@ func initSched(c *conf.Conf) (*Schedule, error) {
 	return s, err
 }
 
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.waiters = append(f.waiters, fakeWaiter{f.now.Add(d), c})
+	return c
+}
+
+// Advance moves the clock forward by d, firing any After channels that are due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	var waiting []fakeWaiter
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- f.now
+	}
+	f.waiters = waiting
+}
+
 func testSched(t *testing.T, st *schedTest) (s *Schedule) {
 	bosunStartupTime = time.Date(1900, 0, 0, 0, 0, 0, 0, time.UTC) //pretend we've been running for a while.
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -343,6 +499,249 @@ func TestUnknown_WithError(t *testing.T) {
 	}
 }
 
+func TestPartialResults(t *testing.T) {
+	// The second of three band periods fails.
+	queries := map[string]opentsdb.ResponseSet{
+		`q("avg:m{a=*}", "9.467241e+08", "9.467244e+08")`: {
+			{
+				Metric: "m",
+				Tags:   opentsdb.TagSet{"a": "b"},
+				DPS:    map[string]opentsdb.Point{"946724100": 1},
+			},
+		},
+		`q("avg:m{a=*}", "9.467205e+08", "9.467208e+08")`: nil,
+		`q("avg:m{a=*}", "9.467169e+08", "9.467172e+08")`: {
+			{
+				Metric: "m",
+				Tags:   opentsdb.TagSet{"a": "b"},
+				DPS:    map[string]opentsdb.Point{"946716900": 3},
+			},
+		},
+	}
+	s := testSched(t, &schedTest{
+		conf: `alert a {
+			partialResults = true
+			crit = max(band("avg:m{a=*}", "5m", "1h", 3)) > 2
+		}`,
+		queries: queries,
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	if !s.AlertSuccessful("a") {
+		t.Fatal("expected alert a to be successful with partial results")
+	}
+	errs := s.GetErrorHistory()["a"].Errors
+	if len(errs) != 1 || errs[0].Category != ErrorPartial || !strings.Contains(errs[0].Message, "avg:m{a=*}") {
+		t.Fatalf("expected a partial results error for the failed query, got %+v", errs)
+	}
+
+	s = testSched(t, &schedTest{
+		conf: `alert a {
+			crit = max(band("avg:m{a=*}", "5m", "1h", 3)) > 2
+		}`,
+		queries: queries,
+		state:   map[schedState]bool{},
+	})
+	if s.AlertSuccessful("a") {
+		t.Fatal("expected alert a to fail without partialResults")
+	}
+}
+
+func TestPartialResultsGraphite(t *testing.T) {
+	// fail.* always fails, and so does the second of three band periods.
+	failUntil := fmt.Sprint(queryTime.Add(-2 * time.Hour).Unix())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, until := r.FormValue("target"), r.FormValue("until")
+		if strings.HasPrefix(target, "fail.") || until == failUntil {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `[{"target": "ok.h", "datapoints": [[3, %s]]}]`, until)
+	}))
+	defer ts.Close()
+	c, err := conf.New("", fmt.Sprintf(`
+		graphiteHost = %s
+		alert a {
+			partialResults = true
+			crit = max(graphite("ok.*", "5m", "", ".host")) > 2
+			warn = max(graphite("fail.*", "5m", "", ".host")) > 2
+		}
+		alert b {
+			partialResults = true
+			crit = max(graphiteBand("ok.*", "5m", "1h", ".host", 3)) > 2
+		}
+	`, ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, queryTime)
+	for _, name := range []string{"a", "b"} {
+		if !s.AlertSuccessful(name) {
+			t.Errorf("expected alert %s to be successful with partial results", name)
+		}
+		errs := s.GetErrorHistory()[name].Errors
+		if len(errs) != 1 || errs[0].Category != ErrorPartial {
+			t.Errorf("expected a partial results error for alert %s, got %+v", name, errs)
+		}
+		ak := expr.AlertKey(name + "{host=h}")
+		if st := s.GetStatus(ak); st == nil || st.Status() != StCritical {
+			t.Errorf("expected %s to be critical, got %+v", ak, st)
+		}
+	}
+}
+
+func TestImpact(t *testing.T) {
+	s := testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{host=*,region=*}", "5m", "")) > 1
+			impact = avg(q("avg:users{region=*}", "5m", ""))
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{host=*,region=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "a", "region": "east"},
+					DPS:    map[string]opentsdb.Point{"0": 2},
+				},
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "b", "region": "west"},
+					DPS:    map[string]opentsdb.Point{"0": 2},
+				},
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "c", "region": "north"},
+					DPS:    map[string]opentsdb.Point{"0": 2},
+				},
+			},
+			`q("avg:users{region=*}", ` + window5Min + `)`: {
+				{
+					Metric: "users",
+					Tags:   opentsdb.TagSet{"region": "east"},
+					DPS:    map[string]opentsdb.Point{"0": 100},
+				},
+				{
+					Metric: "users",
+					Tags:   opentsdb.TagSet{"region": "west"},
+					DPS:    map[string]opentsdb.Point{"0": 5000},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{host=a,region=east}", "critical"}:  true,
+			schedState{"a{host=b,region=west}", "critical"}:  true,
+			schedState{"a{host=c,region=north}", "critical"}: true,
+		},
+	})
+	impacts := make(map[expr.AlertKey]float64)
+	for _, i := range s.Incidents {
+		if i.Impact != nil {
+			impacts[i.AlertKey] = *i.Impact
+		}
+	}
+	expected := map[expr.AlertKey]float64{
+		"a{host=a,region=east}": 100,
+		"a{host=b,region=west}": 5000,
+	}
+	if !reflect.DeepEqual(impacts, expected) {
+		t.Fatalf("expected impacts %v, got %v", expected, impacts)
+	}
+	keys, err := ParseIncidentSort("-impact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []expr.AlertKey
+	for _, i := range s.GetIncidents("", queryTime.Add(-time.Hour), queryTime.Add(time.Hour), keys...) {
+		order = append(order, i.AlertKey)
+	}
+	// The incident without an impact sorts last.
+	if exp := []expr.AlertKey{"a{host=b,region=west}", "a{host=a,region=east}", "a{host=c,region=north}"}; !reflect.DeepEqual(order, exp) {
+		t.Errorf("expected %v, got %v", exp, order)
+	}
+}
+
+func TestPartialResultsPreview(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		// The second band period fails.
+		if start, ok := req.Start.(float64); ok && start > float64(now.Add(-3*time.Hour).Unix()) && start < float64(now.Add(-2*time.Hour).Unix()) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `[{"metric":"m","tags":{"a":"b"},"dps":{"0":3}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			partialResults = true
+			crit = max(band("avg:m{a=*}", "5m", "1h", 3)) > 2
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Alerts["a"]
+	// Previews, as rule tests run them, leave the alert's errors alone.
+	if _, err := s.CheckExpr(nil, s.NewRunHistory(now, cache.New(0)), a, a.Crit, StCritical, nil); err != nil {
+		t.Fatal(err)
+	}
+	if as := s.GetErrorHistory()["a"]; as != nil && len(as.Errors) != 0 {
+		t.Fatalf("expected no errors from a preview, got %+v", as.Errors)
+	}
+	s.CheckAlert(nil, s.NewRunHistory(now, cache.New(0)), a)
+	if as := s.GetErrorHistory()["a"]; as == nil || len(as.Errors) != 1 || as.Errors[0].Category != ErrorPartial {
+		t.Fatalf("expected a partial results error from the check, got %+v", as)
+	}
+}
+
+func TestImpactError(t *testing.T) {
+	s := testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 1
+			impact = avg(q("avg:users{host=*}", "5m", ""))
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{host=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "a"},
+					DPS:    map[string]opentsdb.Point{"0": 2},
+				},
+			},
+			`q("avg:users{host=*}", ` + window5Min + `)`: nil,
+		},
+		state: map[schedState]bool{
+			schedState{"a{host=a}", "critical"}: true,
+		},
+	})
+	// A failed impact is recorded, but does not fail the check.
+	if !s.AlertSuccessful("a") {
+		t.Error("expected the alert not to be failing")
+	}
+	errs := s.AlertStatuses["a"].Errors
+	if len(errs) != 1 || errs[0].Category != ErrorPartial || !strings.HasPrefix(errs[0].Message, "impact: ") {
+		t.Fatalf("expected a partial impact error, got %+v", errs)
+	}
+}
+
 func TestRename(t *testing.T) {
 	testSched(t, &schedTest{
 		conf: `
@@ -395,3 +794,177 @@ func TestRename(t *testing.T) {
 		},
 	})
 }
+
+func benchmarkAlertErrorEncoding(b *testing.B, enc database.Encoding) {
+	now := time.Now().UTC()
+	statuses := make(map[string]*AlertStatus)
+	for i := 0; i < 100; i++ {
+		as := &AlertStatus{}
+		for j := 0; j < 20; j++ {
+			as.Errors = append(as.Errors, &AlertError{
+				FirstTime: now.Add(-time.Duration(j) * time.Hour),
+				LastTime:  now.Add(-time.Duration(j)*time.Hour + time.Minute),
+				Count:     j + 1,
+				Message:   fmt.Sprintf(`alert.%d: tsdb: Post http://tsdb:4242/api/query: dial tcp 10.0.0.%d:4242: i/o timeout`, i, j),
+			})
+		}
+		statuses[fmt.Sprintf("alert.%d", i)] = as
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, _, err := encodeState(statuses, enc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out map[string]*AlertStatus
+		if err := decodeState(data, &out); err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkAlertErrorGob(b *testing.B) {
+	benchmarkAlertErrorEncoding(b, database.EncodingJSON)
+}
+
+func BenchmarkAlertErrorMsgpack(b *testing.B) {
+	benchmarkAlertErrorEncoding(b, database.EncodingMsgpack)
+}
+
+func TestStateEncoding(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	end := now.Add(time.Hour)
+	impact := 2.5
+	statuses := map[string]*AlertStatus{
+		"a": {FailingSince: now, Errors: []*AlertError{
+			{FirstTime: now, LastTime: now, Count: 2, Message: "boom", Category: ErrorQuery},
+		}},
+	}
+	incidents := map[uint64]*Incident{
+		1: {Id: 1, Start: now, End: &end, AlertKey: "a{host=h}", Impact: &impact},
+	}
+	for _, enc := range []database.Encoding{database.EncodingJSON, database.EncodingMsgpack} {
+		b, _, err := encodeState(statuses, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if database.IsMsgpack(b) != (enc == database.EncodingMsgpack) {
+			t.Errorf("encoding %d: wrote the wrong format", enc)
+		}
+		var gotStatuses map[string]*AlertStatus
+		if err := decodeState(b, &gotStatuses); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(statuses, gotStatuses) {
+			t.Errorf("encoding %d: got %+v, expected %+v", enc, gotStatuses["a"], statuses["a"])
+		}
+		b, _, err = encodeState(incidents, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotIncidents map[uint64]*Incident
+		if err := decodeState(b, &gotIncidents); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(incidents, gotIncidents) {
+			t.Errorf("encoding %d: got %+v, expected %+v", enc, gotIncidents[1], incidents[1])
+		}
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	ak := expr.AlertKey("a{host=x}")
+	s.createIncident(ak, now.Add(-time.Hour))
+	if _, _, err := s.AddSilence(now, now.Add(time.Hour), "", "host=x", "warning", false, true, false, "", "u", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	var silenceID string
+	for id := range s.Silence {
+		silenceID = id
+	}
+	if err := s.SetMute("a", "u", "noisy", true); err != nil {
+		t.Fatal(err)
+	}
+	s.markAlertError("a", ErrorQuery, fmt.Errorf("boom"))
+
+	var buf bytes.Buffer
+	if err := WriteBundle(&buf, s.ExportBundle()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	b, err := ReadBundle(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Config != c.RawText {
+		t.Errorf("config not preserved: %q", b.Config)
+	}
+	s2, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.ImportBundle(b, false); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := s2.GetIncident(1); err != nil || i.AlertKey != ak || !i.Start.Equal(now.Add(-time.Hour)) {
+		t.Errorf("incident not restored: %+v %v", i, err)
+	}
+	if i := s2.createIncident(ak, now); i.Id != 2 {
+		t.Errorf("expected next incident id 2, got %d", i.Id)
+	}
+	if len(s2.Silence) != 1 {
+		t.Errorf("expected one silence, got %v", s2.Silence)
+	}
+	for id, si := range s2.Silence {
+		if !si.Silenced(now, "a", ak.Group()) || si.Message != "maintenance" || !si.End.Equal(now.Add(time.Hour)) {
+			t.Errorf("silence not restored: %+v", si)
+		}
+		// A warning-only silence must not come back muting criticals.
+		if si.MaxStatus != StWarning || id != silenceID {
+			t.Errorf("silence maxStatus not restored: %v, id %s, expected %s", si.MaxStatus, id, silenceID)
+		}
+	}
+	if !s2.IsMuted("a") {
+		t.Error("mute not restored")
+	}
+	if as := s2.AlertStatuses["a"]; as == nil || len(as.Errors) != 1 || as.Errors[0].Message != "boom" {
+		t.Errorf("errors not restored: %+v", as)
+	}
+
+	// Importing over existing state requires force.
+	b, _ = ReadBundle(bytes.NewReader(data))
+	if err := s2.CheckImport(false); err == nil {
+		t.Error("expected the import check to fail over existing state without force")
+	}
+	if err := s2.CheckImport(true); err != nil {
+		t.Error(err)
+	}
+	if err := s2.ImportBundle(b, false); err == nil {
+		t.Error("expected import over existing state to fail without force")
+	}
+	if err := s2.ImportBundle(b, true); err != nil {
+		t.Error(err)
+	}
+
+	var old bytes.Buffer
+	if err := WriteBundle(&old, &Bundle{Version: BundleVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBundle(&old); err == nil {
+		t.Error("expected an unsupported bundle version to be rejected")
+	}
+}
@@ -0,0 +1,68 @@
+package sched
+
+import (
+	"sync"
+	"time"
+
+	"bosun.org/collect"
+	"bosun.org/slog"
+)
+
+// work tracks alert evaluations and notification sends in progress, so a
+// shutdown can wait for them to finish. Once stopped no new work starts.
+type work struct {
+	sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+// start marks the beginning of a piece of work, and returns false if the
+// schedule is shutting down and it should not be done.
+func (w *work) start() bool {
+	w.Lock()
+	defer w.Unlock()
+	if w.stopping {
+		return false
+	}
+	w.wg.Add(1)
+	return true
+}
+
+func (w *work) done() {
+	w.wg.Done()
+}
+
+// stop prevents new work from starting, and returns a channel that is closed
+// once the work in progress is done.
+func (w *work) stop() <-chan struct{} {
+	w.Lock()
+	w.stopping = true
+	w.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func Shutdown(timeout time.Duration) {
+	DefaultSched.Shutdown(timeout)
+}
+
+// Shutdown stops starting alert evaluations and notification sends, and waits
+// up to timeout for those in progress to finish. It then saves the state,
+// flushes metrics and closes the data layer. Notifications that are not sent
+// stay in the queue and are sent when bosun next starts.
+func (s *Schedule) Shutdown(timeout time.Duration) {
+	select {
+	case <-s.work.stop():
+	case <-s.Clock.After(timeout):
+		slog.Warningf("shutdown: gave up waiting for evaluations and notifications after %v", timeout)
+	}
+	s.Close()
+	collect.Flush()
+	if err := s.DataAccess.Close(); err != nil {
+		slog.Errorln(err)
+	}
+}
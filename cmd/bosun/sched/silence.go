@@ -4,11 +4,13 @@ import (
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
+	"bosun.org/slog"
 )
 
 type Silence struct {
@@ -18,6 +20,10 @@ type Silence struct {
 	Forget     bool
 	User       string
 	Message    string
+	// MaxStatus is the most severe status the silence applies to, or StNone
+	// for all of them. Unknown is more severe than critical, so a silence
+	// with a MaxStatus never covers unknown instances.
+	MaxStatus Status
 }
 
 func (s *Silence) MarshalJSON() ([]byte, error) {
@@ -28,14 +34,16 @@ func (s *Silence) MarshalJSON() ([]byte, error) {
 		Forget     bool
 		User       string
 		Message    string
+		MaxStatus  Status
 	}{
-		Start:   s.Start,
-		End:     s.End,
-		Alert:   s.Alert,
-		Tags:    s.Tags.Tags(),
-		Forget:  s.Forget,
-		User:    s.User,
-		Message: s.Message,
+		Start:     s.Start,
+		End:       s.End,
+		Alert:     s.Alert,
+		Tags:      s.Tags.Tags(),
+		Forget:    s.Forget,
+		User:      s.User,
+		Message:   s.Message,
+		MaxStatus: s.MaxStatus,
 	})
 }
 
@@ -46,6 +54,12 @@ func (s *Silence) Silenced(now time.Time, alert string, tags opentsdb.TagSet) bo
 	return s.Matches(alert, tags)
 }
 
+// AppliesTo returns whether the silence covers an instance whose most recent
+// abnormal status is status.
+func (s *Silence) AppliesTo(status Status) bool {
+	return s.MaxStatus == StNone || status <= s.MaxStatus
+}
+
 func (s *Silence) ActiveAt(now time.Time) bool {
 	if now.Before(s.Start) || now.After(s.End) {
 		return false
@@ -73,14 +87,18 @@ func (s *Silence) Matches(alert string, tags opentsdb.TagSet) bool {
 func (s Silence) ID() string {
 	h := sha1.New()
 	fmt.Fprintf(h, "%s|%s|%s%s", s.Start, s.End, s.Alert, s.Tags)
+	if s.MaxStatus != StNone {
+		fmt.Fprintf(h, "|%s", s.MaxStatus)
+	}
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
 // Silenced returns all currently silenced AlertKeys and the time they will be
-// unsilenced.
+// unsilenced. A silence with a MaxStatus only covers instances whose most
+// recent abnormal status is no more severe.
 func (s *Schedule) Silenced() map[expr.AlertKey]Silence {
 	aks := make(map[expr.AlertKey]Silence)
-	now := time.Now()
+	now := s.Clock.Now()
 	silenceLock.RLock()
 	defer silenceLock.RUnlock()
 	for _, si := range s.Silence {
@@ -88,8 +106,8 @@ func (s *Schedule) Silenced() map[expr.AlertKey]Silence {
 			continue
 		}
 		s.Lock("Silence")
-		for ak := range s.status {
-			if si.Silenced(now, ak.Name(), ak.Group()) {
+		for ak, st := range s.status {
+			if si.Silenced(now, ak.Name(), ak.Group()) && si.AppliesTo(st.AbnormalStatus()) {
 				if aks[ak].End.Before(si.End) {
 					aks[ak] = *si
 				}
@@ -100,20 +118,78 @@ func (s *Schedule) Silenced() map[expr.AlertKey]Silence {
 	return aks
 }
 
+// SilencesMatching returns the silences, by id, that are active or scheduled
+// to start and cover alert with tags. Silences of a single alert only match
+// when alert is that alert. Unless status is StNone, silences with a MaxStatus
+// less severe than status are left out.
+func (s *Schedule) SilencesMatching(alert string, tags opentsdb.TagSet, status Status) map[string]*Silence {
+	now := s.Clock.Now()
+	matching := make(map[string]*Silence)
+	silenceLock.RLock()
+	defer silenceLock.RUnlock()
+	for id, si := range s.Silence {
+		if now.After(si.End) || !si.Matches(alert, tags) || !si.AppliesTo(status) {
+			continue
+		}
+		matching[id] = si
+	}
+	return matching
+}
+
+// OverlappingSilences returns the silences, by id, of the same alert and tags
+// as si whose time windows overlap it. The silence with id edit, which si
+// replaces, and an identical silence, which si would replace, are left out.
+func (s *Schedule) OverlappingSilences(si *Silence, edit string) map[string]*Silence {
+	overlapping := make(map[string]*Silence)
+	silenceLock.RLock()
+	defer silenceLock.RUnlock()
+	s.overlappingSilences(si, edit, overlapping)
+	return overlapping
+}
+
+func (s *Schedule) overlappingSilences(si *Silence, edit string, overlapping map[string]*Silence) {
+	for id, o := range s.Silence {
+		if id == edit || id == si.ID() || o.Alert != si.Alert || !o.Tags.Equal(si.Tags) {
+			continue
+		}
+		if si.Start.Before(o.End) && o.Start.Before(si.End) {
+			overlapping[id] = o
+		}
+	}
+}
+
 var silenceLock = sync.RWMutex{}
 
-func (s *Schedule) AddSilence(start, end time.Time, alert, tagList string, forget, confirm bool, edit, user, message string) (map[expr.AlertKey]bool, error) {
+// parseMaxStatus parses the maxStatus of a silence: empty for every status,
+// or warning or critical.
+func parseMaxStatus(maxStatus string) (Status, error) {
+	switch maxStatus {
+	case "":
+		return StNone, nil
+	case "warning":
+		return StWarning, nil
+	case "critical":
+		return StCritical, nil
+	}
+	return StNone, fmt.Errorf("maxStatus must be warning or critical, got %q", maxStatus)
+}
+
+// AddSilence tests, or with confirm sets, a silence. The silence may start in
+// the future, and takes effect once it starts. It returns the ids of the
+// silences of the same alert and tags that it overlaps, or with rejectOverlap
+// fails if there are any.
+func (s *Schedule) AddSilence(start, end time.Time, alert, tagList, maxStatus string, forget, confirm, rejectOverlap bool, edit, user, message string) (map[expr.AlertKey]bool, []string, error) {
 	if start.IsZero() || end.IsZero() {
-		return nil, fmt.Errorf("both start and end must be specified")
+		return nil, nil, fmt.Errorf("both start and end must be specified")
 	}
-	if start.After(end) {
-		return nil, fmt.Errorf("start time must be before end time")
+	if !start.Before(end) {
+		return nil, nil, fmt.Errorf("start time must be before end time")
 	}
-	if time.Since(end) > 0 {
-		return nil, fmt.Errorf("end time must be in the future")
+	if s.Clock.Now().After(end) {
+		return nil, nil, fmt.Errorf("end time must be in the future")
 	}
 	if alert == "" && tagList == "" {
-		return nil, fmt.Errorf("must specify either alert or tags")
+		return nil, nil, fmt.Errorf("must specify either alert or tags")
 	}
 	si := &Silence{
 		Start:   start,
@@ -127,24 +203,41 @@ func (s *Schedule) AddSilence(start, end time.Time, alert, tagList string, forge
 	if tagList != "" {
 		tags, err := opentsdb.ParseTags(tagList)
 		if err != nil && tags == nil {
-			return nil, err
+			return nil, nil, err
 		}
 		si.Tags = tags
 	}
+	var err error
+	if si.MaxStatus, err = parseMaxStatus(maxStatus); err != nil {
+		return nil, nil, err
+	}
 	silenceLock.Lock()
 	defer silenceLock.Unlock()
+	overlapping := make(map[string]*Silence)
+	s.overlappingSilences(si, edit, overlapping)
+	var overlaps []string
+	for id, o := range overlapping {
+		if rejectOverlap {
+			return nil, nil, fmt.Errorf("silence overlaps silence %s from %v to %v", id, o.Start, o.End)
+		}
+		if confirm {
+			slog.Warningf("silence of %s%s from %v to %v overlaps silence %s from %v to %v", si.Alert, si.Tags, si.Start, si.End, id, o.Start, o.End)
+		}
+		overlaps = append(overlaps, id)
+	}
+	sort.Strings(overlaps)
 	if confirm {
 		delete(s.Silence, edit)
 		s.Silence[si.ID()] = si
-		return nil, nil
+		return nil, overlaps, nil
 	}
 	aks := make(map[expr.AlertKey]bool)
 	for ak := range s.status {
-		if si.Matches(ak.Name(), ak.Group()) {
+		if si.Matches(ak.Name(), ak.Group()) && si.AppliesTo(s.status[ak].AbnormalStatus()) {
 			aks[ak] = s.status[ak].IsActive()
 		}
 	}
-	return aks, nil
+	return aks, overlaps, nil
 }
 
 func (s *Schedule) ClearSilence(id string) error {
@@ -0,0 +1,182 @@
+package sched
+
+import (
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/opentsdb"
+)
+
+func TestSilencesMatching(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Clock = &fakeClock{now: now}
+	add := func(name string, start, end time.Duration, alert, tags string) {
+		si := &Silence{
+			Start:   now.Add(start),
+			End:     now.Add(end),
+			Alert:   alert,
+			Tags:    opentsdb.TagSet{},
+			Message: name,
+		}
+		if tags != "" {
+			// Globs are reported as errors but still parsed.
+			if si.Tags, err = opentsdb.ParseTags(tags); si.Tags == nil {
+				t.Fatal(err)
+			}
+		}
+		s.Silence[si.ID()] = si
+	}
+	add("host", -time.Hour, time.Hour, "", "host=web01")
+	add("glob", -time.Hour, 2*time.Hour, "", "host=web*")
+	add("alternatives", -time.Hour, time.Hour, "", "host=db01|web01,dc=ny")
+	add("scheduled", time.Hour, 3*time.Hour, "", "host=*")
+	add("alert", -time.Hour, time.Hour, "cpu", "host=web01")
+	add("expired", -2*time.Hour, -time.Hour, "", "host=web01")
+	add("other host", -time.Hour, time.Hour, "", "host=web02")
+	add("other tag", -time.Hour, time.Hour, "", "host=web01,dc=ny")
+	warnings := &Silence{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Tags: opentsdb.TagSet{"host": "db02"}, Message: "warnings", MaxStatus: StWarning}
+	s.Silence[warnings.ID()] = warnings
+
+	tests := []struct {
+		alert    string
+		tags     opentsdb.TagSet
+		status   Status
+		expected []string
+	}{
+		{"", opentsdb.TagSet{"host": "web01"}, StNone, []string{"host", "glob", "scheduled"}},
+		{"cpu", opentsdb.TagSet{"host": "web01"}, StNone, []string{"host", "glob", "scheduled", "alert"}},
+		{"disk", opentsdb.TagSet{"host": "web01", "dc": "ny"}, StNone, []string{"host", "glob", "alternatives", "scheduled", "other tag"}},
+		{"", opentsdb.TagSet{"host": "db01"}, StNone, []string{"scheduled"}},
+		{"", opentsdb.TagSet{"dc": "ny"}, StNone, nil},
+		{"", opentsdb.TagSet{"host": "db02"}, StNone, []string{"scheduled", "warnings"}},
+		{"", opentsdb.TagSet{"host": "db02"}, StWarning, []string{"scheduled", "warnings"}},
+		{"", opentsdb.TagSet{"host": "db02"}, StCritical, []string{"scheduled"}},
+	}
+	for _, test := range tests {
+		matching := s.SilencesMatching(test.alert, test.tags, test.status)
+		got := make(map[string]bool)
+		for id, si := range matching {
+			if id != si.ID() {
+				t.Errorf("%s %v: silence %s listed as %s", test.alert, test.tags, si.ID(), id)
+			}
+			got[si.Message] = true
+		}
+		if len(got) != len(test.expected) {
+			t.Errorf("%s %v: expected %v, got %v", test.alert, test.tags, test.expected, got)
+			continue
+		}
+		for _, name := range test.expected {
+			if !got[name] {
+				t.Errorf("%s %v: expected %v, got %v", test.alert, test.tags, test.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestFutureSilence(t *testing.T) {
+	c, err := conf.New("", `alert a {
+		warn = 1
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.Clock = clock
+	now := clock.Now()
+	if _, _, err := s.AddSilence(now.Add(time.Hour), now.Add(2*time.Hour), "a", "", "", false, true, false, "", "u", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	check(s, now)
+	if _, ok := s.Silenced()["a{}"]; ok {
+		t.Fatal("expected no silence before it starts")
+	}
+	clock.Advance(time.Hour)
+	if _, ok := s.Silenced()["a{}"]; !ok {
+		t.Fatal("expected the silence to be active once it starts")
+	}
+	clock.Advance(time.Hour + time.Second)
+	if _, ok := s.Silenced()["a{}"]; ok {
+		t.Fatal("expected the silence to be over")
+	}
+	if _, _, err := s.AddSilence(now, now, "a", "", "", false, true, false, "", "u", "empty"); err == nil {
+		t.Error("expected a silence ending at its start to fail")
+	}
+}
+
+func TestSilenceOverlap(t *testing.T) {
+	c, err := conf.New("", ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Clock = &fakeClock{now: now}
+	if _, _, err := s.AddSilence(now, now.Add(2*time.Hour), "", "host=x", "", false, true, false, "", "u", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for id = range s.Silence {
+	}
+	tests := []struct {
+		start, end time.Duration
+		tags       opentsdb.TagSet
+		edit       string
+		overlaps   bool
+	}{
+		{time.Hour, 3 * time.Hour, opentsdb.TagSet{"host": "x"}, "", true},
+		{-time.Hour, time.Hour, opentsdb.TagSet{"host": "x"}, "", true},
+		{time.Hour, 3 * time.Hour, opentsdb.TagSet{"host": "y"}, "", false},
+		{2 * time.Hour, 3 * time.Hour, opentsdb.TagSet{"host": "x"}, "", false},
+		{time.Hour, 3 * time.Hour, opentsdb.TagSet{"host": "x"}, id, false},
+	}
+	for _, test := range tests {
+		si := &Silence{Start: now.Add(test.start), End: now.Add(test.end), Tags: test.tags}
+		if got := s.OverlappingSilences(si, test.edit); (len(got) == 1) != test.overlaps {
+			t.Errorf("%s from %v to %v: expected overlap %v, got %v", test.tags, test.start, test.end, test.overlaps, got)
+		}
+	}
+	if _, _, err := s.AddSilence(now.Add(time.Hour), now.Add(3*time.Hour), "", "host=x", "", false, true, true, "", "u", "again"); err == nil {
+		t.Error("expected an overlapping silence to be rejected")
+	}
+	if len(s.Silence) != 1 {
+		t.Fatalf("expected the rejected silence not to be added, got %v", s.Silence)
+	}
+	// Resubmitting an identical silence does not overlap itself.
+	if _, _, err := s.AddSilence(now, now.Add(2*time.Hour), "", "host=x", "", false, true, true, "", "u", "maintenance"); err != nil {
+		t.Fatalf("identical silence rejected: %v", err)
+	}
+	if len(s.Silence) != 1 {
+		t.Fatalf("expected the identical silence to replace itself, got %v", s.Silence)
+	}
+	// Without rejectOverlap the overlap is reported to the caller.
+	_, overlaps, err := s.AddSilence(now.Add(time.Hour), now.Add(3*time.Hour), "", "host=x", "", false, false, false, "", "u", "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlaps) != 1 || overlaps[0] != id {
+		t.Errorf("expected overlap with %s, got %v", id, overlaps)
+	}
+	if _, _, err := s.AddSilence(now.Add(time.Hour), now.Add(3*time.Hour), "", "host=x", "", false, true, false, "", "u", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Silence) != 2 {
+		t.Fatalf("expected both silences, got %v", s.Silence)
+	}
+}
@@ -3,6 +3,7 @@ package sched
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -113,8 +114,53 @@ func (c *Context) Incident() string {
 	})
 }
 
+// Runbook returns the URL of the alert's runbook, or "" if it has none.
+func (c *Context) Runbook() string {
+	return c.Alert.Runbook
+}
+
+// SilenceURL returns the URL of the silence page, filled in to silence this
+// alert and group for duration, for example "1h".
+func (c *Context) SilenceURL(duration string) (string, error) {
+	if _, err := opentsdb.ParseDuration(duration); err != nil {
+		return "", err
+	}
+	return c.schedule.Conf.MakeLink("/silence", &url.Values{
+		"alert":    []string{c.Alert.Name},
+		"tags":     []string{c.Group.Tags()},
+		"duration": []string{duration},
+	}), nil
+}
+
+// IncidentDuration returns how long the instance's incident has lasted, up to
+// its recovery if it is normal again, or zero if it has none.
+func (c *Context) IncidentDuration() (time.Duration, error) {
+	last := c.State.Last()
+	if last.IncidentId == 0 {
+		return 0, nil
+	}
+	incident, err := c.schedule.GetIncident(last.IncidentId)
+	if err != nil {
+		return 0, err
+	}
+	end := c.runHistory.Start
+	if last.Status == StNormal {
+		end = last.Time
+	}
+	return end.Sub(incident.Start), nil
+}
+
+// alertTemplate returns the template to render st with: the alert's recovery
+// template once st has returned to normal, otherwise its template.
+func alertTemplate(a *conf.Alert, st *State) *conf.Template {
+	if a.RecoveryTemplate != nil && st.Last().Status == StNormal {
+		return a.RecoveryTemplate
+	}
+	return a.Template
+}
+
 func (s *Schedule) ExecuteBody(rh *RunHistory, a *conf.Alert, st *State, isEmail bool) ([]byte, []*conf.Attachment, error) {
-	t := a.Template
+	t := alertTemplate(a, st)
 	if t == nil || t.Body == nil {
 		return nil, nil, nil
 	}
@@ -131,8 +177,19 @@ func (s *Schedule) ExecuteBody(rh *RunHistory, a *conf.Alert, st *State, isEmail
 	return buf.Bytes(), c.Attachments, nil
 }
 
+// ExecuteTextBody renders the plain text email body, if the template has one.
+func (s *Schedule) ExecuteTextBody(rh *RunHistory, a *conf.Alert, st *State) ([]byte, error) {
+	t := alertTemplate(a, st)
+	if t == nil || t.TextBody == nil {
+		return nil, nil
+	}
+	buf := new(bytes.Buffer)
+	err := t.TextBody.Execute(buf, s.Data(rh, st, a, true))
+	return buf.Bytes(), err
+}
+
 func (s *Schedule) ExecuteSubject(rh *RunHistory, a *conf.Alert, st *State, isEmail bool) ([]byte, error) {
-	t := a.Template
+	t := alertTemplate(a, st)
 	if t == nil || t.Subject == nil {
 		return nil, nil
 	}
@@ -202,7 +259,7 @@ func (c *Context) evalExpr(e *expr.Expr, filter bool, series bool, autods int) (
 	if series && e.Root.Return() != parse.TypeSeriesSet {
 		return nil, "", fmt.Errorf("need a series, got %T (%v)", e, e)
 	}
-	res, _, err := e.Execute(c.runHistory.Context, c.runHistory.GraphiteContext, c.runHistory.Logstash, c.runHistory.InfluxConfig, c.runHistory.Cache, nil, c.runHistory.Start, autods, c.Alert.UnjoinedOK, c.schedule.Search, c.schedule.Conf.AlertSquelched(c.Alert), c.runHistory)
+	res, _, err := c.runHistory.limit(e).Execute(c.runHistory.Context, c.runHistory.GraphiteContext, c.runHistory.Logstash, c.runHistory.InfluxConfig, c.runHistory.Cache, nil, c.runHistory.Start, autods, c.Alert.UnjoinedOK, c.schedule.Search, c.schedule.Conf.AlertSquelched(c.Alert), c.runHistory)
 	if err != nil {
 		return nil, "", fmt.Errorf("%s: %v", e, err)
 	}
@@ -290,6 +347,22 @@ func (c *Context) EvalAll(v interface{}) (interface{}, error) {
 	return res, err
 }
 
+// templateQueryTimeout bounds how long LookupSeries evaluates an expression.
+var templateQueryTimeout = time.Second * 30
+
+// LookupSeries executes the expression and returns its results so related
+// data can be shown alongside an alert. Evaluation fails if it takes longer
+// than templateQueryTimeout.
+func (c *Context) LookupSeries(v string) (expr.ResultSlice, error) {
+	e, err := expr.New(v, c.schedule.Conf.Funcs())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", v, err)
+	}
+	e.Deadline = time.Now().Add(templateQueryTimeout)
+	res, _, err := c.eval(e, false, false, 0)
+	return res, err
+}
+
 func (c *Context) graph(v interface{}, unit string, filter bool) (val interface{}, err error) {
 	defer func() {
 		if p := recover(); p != nil {
@@ -312,12 +385,10 @@ func (c *Context) graph(v interface{}, unit string, filter bool) (val interface{
 		if err != nil {
 			return nil, err
 		}
-		name := fmt.Sprintf("%d.png", len(c.Attachments)+1)
-		c.Attachments = append(c.Attachments, &conf.Attachment{
-			Data:        buf.Bytes(),
-			Filename:    name,
-			ContentType: "image/png",
-		})
+		name, err := c.attach(buf.Bytes(), "png", "image/png")
+		if err != nil {
+			return nil, err
+		}
 		return template.HTML(fmt.Sprintf(`<a href="%s" style="text-decoration: none"><img alt="%s" src="cid:%s" /></a>%s`,
 			c.GraphLink(exprText),
 			template.HTMLEscapeString(fmt.Sprint(v)),
@@ -334,6 +405,83 @@ func (c *Context) graph(v interface{}, unit string, filter bool) (val interface{
 	return template.HTML(buf.String()), nil
 }
 
+// maxAttachmentSize is the most bytes of attachments an email may carry.
+const maxAttachmentSize = 10 << 20
+
+// attach adds data as an email attachment and returns its file name.
+func (c *Context) attach(data []byte, ext, contentType string) (string, error) {
+	size := len(data)
+	for _, a := range c.Attachments {
+		size += len(a.Data)
+	}
+	name := fmt.Sprintf("%d.%s", len(c.Attachments)+1, ext)
+	if size > maxAttachmentSize {
+		return "", fmt.Errorf("attachment %s: attachments total %d bytes, over the limit of %d", name, size, maxAttachmentSize)
+	}
+	c.Attachments = append(c.Attachments, &conf.Attachment{
+		Data:        data,
+		Filename:    name,
+		ContentType: contentType,
+	})
+	return name, nil
+}
+
+// AttachCSV attaches the given result (or expression, for which it gets the
+// result) with the same tags as the context's tags to the email as CSV. It
+// does nothing outside of emails.
+func (c *Context) AttachCSV(v interface{}) (string, error) {
+	if !c.IsEmail {
+		return "", nil
+	}
+	res, _, err := c.eval(v, true, false, 0)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"group", "time", "value"})
+	for _, r := range res {
+		group := r.Group.String()
+		switch v := r.Value.(type) {
+		case expr.Series:
+			for _, p := range expr.NewSortedSeries(v) {
+				w.Write([]string{group, p.T.UTC().Format(time.RFC3339), fmt.Sprint(p.V)})
+			}
+		default:
+			w.Write([]string{group, "", fmt.Sprint(v.Value())})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	_, err = c.attach(buf.Bytes(), "csv", "text/csv")
+	return "", err
+}
+
+// AttachGraph attaches a PNG graph of the given result (or expression, for
+// which it gets the result) with the same tags as the context's tags to the
+// email. It does nothing outside of emails.
+func (c *Context) AttachGraph(v interface{}, args ...string) (string, error) {
+	if !c.IsEmail {
+		return "", nil
+	}
+	var unit string
+	if len(args) > 0 {
+		unit = args[0]
+	}
+	res, _, err := c.eval(v, true, true, 1000)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := c.schedule.ExprPNG(nil, &buf, 800, 600, unit, res); err != nil {
+		return "", err
+	}
+	_, err = c.attach(buf.Bytes(), "png", "image/png")
+	return "", err
+}
+
 // Graph returns an SVG for the given result (or expression, for which it gets the result)
 // with same tags as the context's tags.
 func (c *Context) Graph(v interface{}, args ...string) (interface{}, error) {
@@ -0,0 +1,120 @@
+package sched
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/opentsdb"
+)
+
+// templateCheckTag is the value given to every tag of the synthetic instances
+// templates are checked with.
+const templateCheckTag = "bosun-template-check"
+
+// TemplateCheck is the outcome of rendering an alert's templates for a
+// synthetic instance.
+type TemplateCheck struct {
+	Alert  string
+	OK     bool
+	Errors []string `json:",omitempty"`
+}
+
+// CheckTemplates renders the templates of every alert that has one, as they
+// would be for a critical instance and, with a recovery template, for its
+// recovery. The instance has a made up value for each of the alert's tags and
+// no incident. Templates query data as usual, so a template may also fail
+// because a query did. The results are sorted by alert name.
+func (s *Schedule) CheckTemplates() []*TemplateCheck {
+	now := s.Clock.Now().UTC()
+	rh := s.NewRunHistory(now, cache.New(0))
+	var checks []*TemplateCheck
+	for name, a := range s.Conf.Alerts {
+		if a.Template == nil {
+			continue
+		}
+		check := &TemplateCheck{Alert: name}
+		st := templateCheckState(a, now)
+		check.Errors = s.renderAll(rh, a, st, "")
+		if a.RecoveryTemplate != nil {
+			st.Append(&Event{Status: StNormal, Time: now})
+			check.Errors = append(check.Errors, s.renderAll(rh, a, st, "recovery ")...)
+		}
+		check.OK = len(check.Errors) == 0
+		checks = append(checks, check)
+	}
+	sort.Sort(templateChecks(checks))
+	return checks
+}
+
+// templateCheckState returns a critical instance of a with templateCheckTag
+// for each of its tags.
+func templateCheckState(a *conf.Alert, now time.Time) *State {
+	e := a.Crit
+	if e == nil {
+		e = a.Warn
+	}
+	group := make(opentsdb.TagSet)
+	if tags, err := e.Root.Tags(); err == nil {
+		for k := range tags {
+			group[k] = templateCheckTag
+		}
+	}
+	st := NewStatus(expr.NewAlertKey(a.Name, group))
+	res := &Result{
+		Result: &expr.Result{
+			Value: expr.Number(1),
+			Group: group,
+		},
+		Expr: e.String(),
+	}
+	st.Result = res
+	st.Append(&Event{Status: StCritical, Crit: res, Time: now})
+	return st
+}
+
+// renderAll renders each part of st's template and returns an error message,
+// starting with prefix, for each that fails.
+func (s *Schedule) renderAll(rh *RunHistory, a *conf.Alert, st *State, prefix string) []string {
+	var errs []string
+	render := func(part string, f func() error) {
+		defer func() {
+			if p := recover(); p != nil {
+				errs = append(errs, fmt.Sprintf("%s%s: panic: %v", prefix, part, p))
+			}
+		}()
+		if err := f(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s%s: %v", prefix, part, err))
+		}
+	}
+	render("subject", func() error {
+		_, err := s.ExecuteSubject(rh, a, st, false)
+		return err
+	})
+	render("body", func() error {
+		_, _, err := s.ExecuteBody(rh, a, st, false)
+		return err
+	})
+	render("email subject", func() error {
+		_, err := s.ExecuteSubject(rh, a, st, true)
+		return err
+	})
+	render("email body", func() error {
+		_, _, err := s.ExecuteBody(rh, a, st, true)
+		return err
+	})
+	render("email text body", func() error {
+		_, err := s.ExecuteTextBody(rh, a, st)
+		return err
+	})
+	return errs
+}
+
+type templateChecks []*TemplateCheck
+
+func (t templateChecks) Len() int           { return len(t) }
+func (t templateChecks) Less(a, b int) bool { return t[a].Alert < t[b].Alert }
+func (t templateChecks) Swap(a, b int)      { t[a], t[b] = t[b], t[a] }
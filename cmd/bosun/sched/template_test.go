@@ -0,0 +1,229 @@
+package sched
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/opentsdb"
+)
+
+func TestLookupSeries(t *testing.T) {
+	block := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body [1024]byte
+		n, _ := r.Body.Read(body[:])
+		if strings.Contains(string(body[:n]), "slow") {
+			<-block
+			return
+		}
+		fmt.Fprint(w, `[
+			{"metric":"proc","tags":{"name":"a"},"dps":{"0":3}},
+			{"metric":"proc","tags":{"name":"b"},"dps":{"0":2}}
+		]`)
+	}))
+	defer ts.Close()
+	defer close(block)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			crit = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Alerts["a"]
+	st := s.GetOrCreateStatus(expr.NewAlertKey("a", opentsdb.TagSet{"host": "x"}))
+	ctx := s.Data(s.NewRunHistory(time.Now(), cache.New(0)), st, a, false)
+
+	res, err := ctx.LookupSeries(`avg(q("sum:proc{name=*}", "5m", ""))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+
+	timeout := templateQueryTimeout
+	templateQueryTimeout = time.Millisecond * 100
+	defer func() { templateQueryTimeout = timeout }()
+	start := time.Now()
+	if _, err := ctx.LookupSeries(`avg(q("sum:slow{name=*}", "5m", ""))`); err == nil || !strings.Contains(err.Error(), expr.ErrDeadline.Error()) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the query to give up at the deadline, took %v", d)
+	}
+	if _, err := ctx.LookupSeries(`avg(`); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
+
+func TestSilenceURL(t *testing.T) {
+	c, err := conf.New("", `
+		hostname = bosun.example.com:8070
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := opentsdb.TagSet{"host": "ny-web01.example.com", "path": "/var/log/a_b-c"}
+	st := s.GetOrCreateStatus(expr.NewAlertKey("a", group))
+	ctx := s.Data(s.NewRunHistory(time.Now(), cache.New(0)), st, c.Alerts["a"], false)
+	link, err := ctx.SilenceURL("2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "bosun.example.com:8070" || u.Path != "/silence" {
+		t.Fatalf("unexpected silence link %s", link)
+	}
+	// The values must be usable as given by the silence form.
+	q := u.Query()
+	tags, err := opentsdb.ParseTags(q.Get("tags"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tags.Equal(group) || q.Get("alert") != "a" || q.Get("duration") != "2h" {
+		t.Fatalf("unexpected silence parameters %v", q)
+	}
+	if _, err := opentsdb.ParseDuration(q.Get("duration")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.SilenceURL("soon"); err == nil {
+		t.Fatal("expected an invalid duration to be rejected")
+	}
+}
+
+func TestAttachCSV(t *testing.T) {
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := opentsdb.TagSet{"host": "a"}
+	st := s.GetOrCreateStatus(expr.NewAlertKey("a", group))
+	res := expr.ResultSlice{
+		{Group: group, Value: expr.Series{time.Unix(60, 0): 2, time.Unix(0, 0): 1}},
+		{Group: opentsdb.TagSet{"host": "b"}, Value: expr.Series{time.Unix(0, 0): 5}},
+	}
+	ctx := s.Data(s.NewRunHistory(time.Now(), cache.New(0)), st, c.Alerts["a"], false)
+	if _, err := ctx.AttachCSV(res); err != nil || len(ctx.Attachments) != 0 {
+		t.Fatalf("expected no attachment outside of emails, got %v, %v", ctx.Attachments, err)
+	}
+	ctx = s.Data(s.NewRunHistory(time.Now(), cache.New(0)), st, c.Alerts["a"], true)
+	if _, err := ctx.AttachCSV(res); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Attachments) != 1 {
+		t.Fatalf("expected one attachment, got %d", len(ctx.Attachments))
+	}
+	a := ctx.Attachments[0]
+	expected := "group,time,value\n{host=a},1970-01-01T00:00:00Z,1\n{host=a},1970-01-01T00:01:00Z,2\n"
+	if a.Filename != "1.csv" || a.ContentType != "text/csv" || string(a.Data) != expected {
+		t.Fatalf("unexpected attachment %s %s %q", a.Filename, a.ContentType, a.Data)
+	}
+
+	// Attachments over the size limit are refused.
+	ctx.Attachments[0].Data = make([]byte, maxAttachmentSize)
+	if _, err := ctx.AttachCSV(res); err == nil || !strings.Contains(err.Error(), "over the limit") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+	if len(ctx.Attachments) != 1 {
+		t.Fatal("attachment over the limit was added")
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	c, err := conf.New("", `
+		template good {
+			subject = {{.Last.Status}}: {{.Alert.Name}} on {{.Group.host}}
+			body = <a href="{{.Ack}}">ack</a> <a href="{{.Incident}}">incident</a> {{.Eval "1 + 1"}}
+		}
+		template resolved {
+			subject = {{.Alert.Name}} resolved after {{.IncidentDuration}}
+		}
+		template broken {
+			subject = {{.Alert.Name}}
+			body = {{.Lookup "missing" "threshold"}}
+		}
+		notification n {
+			print = true
+		}
+		alert a {
+			template = good
+			crit = 1
+		}
+		alert b {
+			template = broken
+			crit = 1
+		}
+		alert c {
+			template = good
+			recoveryTemplate = resolved
+			notifyRecovery = true
+			crit = 1
+		}
+		alert untemplated {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := s.CheckTemplates()
+	if len(checks) != 3 {
+		t.Fatalf("expected checks of the 3 alerts with templates, got %+v", checks)
+	}
+	for _, check := range checks {
+		switch check.Alert {
+		case "a", "c":
+			if !check.OK || len(check.Errors) != 0 {
+				t.Errorf("expected %s to render, got %v", check.Alert, check.Errors)
+			}
+		case "b":
+			// The body and email body fail, the rest render.
+			if check.OK || len(check.Errors) != 2 || !strings.Contains(check.Errors[0], "unknown lookup table missing") {
+				t.Errorf("expected the body of b to fail, got %v", check.Errors)
+			}
+		default:
+			t.Errorf("unexpected check of %s", check.Alert)
+		}
+	}
+}
@@ -16,16 +16,18 @@ import (
 	"bosun.org/_third_party/github.com/gorilla/mux"
 	"bosun.org/_third_party/github.com/vdobler/chart"
 	"bosun.org/_third_party/github.com/vdobler/chart/svgg"
+	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
 	"bosun.org/cmd/bosun/expr/parse"
 	"bosun.org/cmd/bosun/sched"
+	"bosun.org/collect"
 	"bosun.org/metadata"
 	"bosun.org/opentsdb"
 )
 
 // Graph takes an OpenTSDB request data structure and queries OpenTSDB. Use the
 // json parameter to pass JSON. Use the b64 parameter to pass base64-encoded
-// JSON.
+// JSON. Metrics containing a * are expanded to all matching metrics.
 func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	j := []byte(r.FormValue("json"))
 	if bs := r.FormValue("b64"); bs != "" {
@@ -42,6 +44,19 @@ func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 	if err != nil {
 		return nil, err
 	}
+	maxRange, err := maxQueryRange(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxRange > 0 {
+		d, err := opentsdb.GetDuration(oreq)
+		if err != nil {
+			return nil, err
+		}
+		if time.Duration(d) > maxRange {
+			return nil, fmt.Errorf("query range %v exceeds maxQueryRange of %v", time.Duration(d), maxRange)
+		}
+	}
 	if ads_v := r.FormValue("autods"); ads_v != "" {
 		ads_i, err := strconv.Atoi(ads_v)
 		if err != nil {
@@ -57,6 +72,30 @@ func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 			ar[i] = true
 		}
 	}
+	h := schedule.Conf.InteractiveTSDBHost()
+	if h == "" {
+		return nil, fmt.Errorf("tsdbHost not set")
+	}
+	// Metrics are expanded first, so the metadata and tags of each matching
+	// metric are looked up. Each expanded query keeps the autorate of its
+	// pattern.
+	suggest := func(prefix string, max int) ([]string, error) {
+		return opentsdb.SuggestMetrics(h, prefix, max)
+	}
+	var expanded []*opentsdb.Query
+	rates := make(map[int]bool)
+	for i, q := range oreq.Queries {
+		one := opentsdb.Request{Queries: []*opentsdb.Query{q}}
+		if err := one.ExpandMetrics(suggest, maxGraphMetrics); err != nil {
+			return nil, err
+		}
+		for _, eq := range one.Queries {
+			rates[len(expanded)] = ar[i]
+			expanded = append(expanded, eq)
+		}
+	}
+	oreq.Queries = expanded
+	ar = rates
 	queries := make([]string, len(oreq.Queries))
 	var start, end string
 	if s, ok := oreq.Start.(string); ok && strings.Contains(s, "-ago") {
@@ -111,11 +150,7 @@ func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 	var tr opentsdb.ResponseSet
 	b, _ := json.MarshalIndent(oreq, "", "  ")
 	t.StepCustomTiming("tsdb", "query", string(b), func() {
-		h := schedule.Conf.TSDBHost
-		if h == "" {
-			err = fmt.Errorf("tsdbHost not set")
-			return
-		}
+		collect.Add("query.count", opentsdb.TagSet{"datasource": "tsdb", "path": conf.QueryInteractive}, 1)
 		tr, err = oreq.Query(h)
 	})
 	if err != nil {
@@ -161,15 +196,131 @@ func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 		s.End()
 		return nil, nil
 	}
+	var bands []graphBand
+	if r.FormValue("overlayIncidents") == "true" {
+		from, err := opentsdb.ParseTime(oreq.Start)
+		if err != nil {
+			return nil, err
+		}
+		to := time.Now().UTC()
+		if oreq.End != nil {
+			if to, err = opentsdb.ParseTime(oreq.End); err != nil {
+				return nil, err
+			}
+		}
+		incidents := graphIncidents(schedule.GetIncidentsOverlapping(from, to), tr, r.Form["alertKey"])
+		bands = incidentBands(incidents, from, to, maxGraphBands)
+	}
 	return struct {
 		Queries []string
 		Series  []*chartSeries
+		Bands   []graphBand `json:",omitempty"`
 	}{
 		queries,
 		cs,
+		bands,
 	}, nil
 }
 
+// maxGraphMetrics is the most metrics a wildcard metric in a graph query may
+// expand to.
+const maxGraphMetrics = 100
+
+// maxGraphBands is the most incident bands returned for a single graph. Beyond
+// that the closest neighbouring bands are merged.
+const maxGraphBands = 100
+
+// graphBand is a shaded time range on a graph, in Unix seconds.
+type graphBand struct {
+	Start     int64
+	End       int64
+	Label     string
+	Incidents []uint64
+}
+
+// graphIncidents returns the incidents that belong on a graph of series: those
+// of alertKeys if any are given, otherwise those whose alert key has tags that
+// all match the tags of at least one of the series.
+func graphIncidents(incidents []sched.Incident, series opentsdb.ResponseSet, alertKeys []string) []sched.Incident {
+	keys := make(map[string]bool)
+	for _, k := range alertKeys {
+		keys[k] = true
+	}
+	var matched []sched.Incident
+	for _, i := range incidents {
+		if len(keys) > 0 {
+			if keys[string(i.AlertKey)] {
+				matched = append(matched, i)
+			}
+			continue
+		}
+		group := i.AlertKey.Group()
+		if len(group) == 0 {
+			continue
+		}
+		for _, r := range series {
+			if r.Tags.Subset(group) {
+				matched = append(matched, i)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// incidentBands clips incidents to [from, to], merges those that overlap, and
+// then merges the bands separated by the smallest gaps until at most max remain.
+func incidentBands(incidents []sched.Incident, from, to time.Time, max int) []graphBand {
+	slice.Sort(incidents, func(i, j int) bool {
+		return incidents[i].Start.Before(incidents[j].Start)
+	})
+	var bands []graphBand
+	for _, i := range incidents {
+		start, end := i.Start, to
+		if i.End != nil && i.End.Before(to) {
+			end = *i.End
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.Before(start) {
+			continue
+		}
+		if n := len(bands); n > 0 && start.Unix() <= bands[n-1].End {
+			b := &bands[n-1]
+			if end.Unix() > b.End {
+				b.End = end.Unix()
+			}
+			b.Incidents = append(b.Incidents, i.Id)
+			continue
+		}
+		bands = append(bands, graphBand{
+			Start:     start.Unix(),
+			End:       end.Unix(),
+			Incidents: []uint64{i.Id},
+			Label:     string(i.AlertKey),
+		})
+	}
+	for max > 0 && len(bands) > max {
+		gap := 0
+		for j := 1; j < len(bands)-1; j++ {
+			if bands[j+1].Start-bands[j].End < bands[gap+1].Start-bands[gap].End {
+				gap = j
+			}
+		}
+		a, b := &bands[gap], bands[gap+1]
+		a.End = b.End
+		a.Incidents = append(a.Incidents, b.Incidents...)
+		bands = append(bands[:gap+1], bands[gap+2:]...)
+	}
+	for j := range bands {
+		if n := len(bands[j].Incidents); n > 1 {
+			bands[j].Label = fmt.Sprintf("%d incidents", n)
+		}
+	}
+	return bands
+}
+
 // ExprGraph returns an svg graph.
 // The basename of the requested svg file should be a base64 encoded expression.
 func ExprGraph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
@@ -205,9 +356,12 @@ func ExprGraph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 	} else if e.Root.Return() != parse.TypeSeriesSet {
 		return nil, fmt.Errorf("egraph: requires an expression that returns a series")
 	}
+	if e.MaxQueryRange, err = maxQueryRange(r); err != nil {
+		return nil, err
+	}
 	// it may not strictly be necessary to recreate the contexts each time, but we do to be safe
-	tsdbContext := schedule.Conf.TSDBContext()
-	graphiteContext := schedule.Conf.GraphiteContext()
+	tsdbContext := schedule.Conf.InteractiveTSDBContext()
+	graphiteContext := schedule.Conf.InteractiveGraphiteContext()
 	ls := schedule.Conf.LogstashElasticHosts
 	influx := schedule.Conf.InfluxConfig
 	res, _, err := e.Execute(tsdbContext, graphiteContext, ls, influx, cacheObj, t, now, autods, false, schedule.Search, nil, nil)
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -70,12 +71,15 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 	if err != nil {
 		return nil, err
 	}
+	if e.MaxQueryRange, err = maxQueryRange(r); err != nil {
+		return nil, err
+	}
 	// it may not strictly be necessary to recreate the contexts each time, but we do to be safe
-	tsdbContext := schedule.Conf.TSDBContext()
-	graphiteContext := schedule.Conf.GraphiteContext()
+	tsdbContext := schedule.Conf.InteractiveTSDBContext()
+	graphiteContext := schedule.Conf.InteractiveGraphiteContext()
 	ls := schedule.Conf.LogstashElasticHosts
 	influx := schedule.Conf.InfluxConfig
-	res, queries, err := e.Execute(tsdbContext, graphiteContext, ls, influx, cacheObj, t, now, 0, false, schedule.Search, nil, nil)
+	res, queries, err := e.Execute(tsdbContext, graphiteContext, ls, influx, cacheObj, t, now, 0, false, schedule.Search, nil, schedule.NewRunHistory(now, cacheObj))
 	if err != nil {
 		return nil, err
 	}
@@ -114,12 +118,28 @@ func getTime(r *http.Request) (now time.Time, err error) {
 	return
 }
 
+// maxQueryRange returns the query range limit for r. Requests with the
+// override parameter set and the adminToken as a bearer token have no limit.
+func maxQueryRange(r *http.Request) (time.Duration, error) {
+	if r.FormValue("override") == "" {
+		return schedule.Conf.MaxQueryRange, nil
+	}
+	token := schedule.Conf.AdminToken
+	if token == "" {
+		return 0, fmt.Errorf("query range override disabled: adminToken not set")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		return 0, fmt.Errorf("query range override requires the admin token")
+	}
+	return 0, nil
+}
+
 type Res struct {
 	*sched.Event
 	Key expr.AlertKey
 }
 
-func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time, summary bool, email string, template_group string) (*ruleResult, error) {
+func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time, maxRange time.Duration, summary bool, email string, template_group string) (*ruleResult, error) {
 	s := &sched.Schedule{}
 	s.DataAccess = schedule.DataAccess
 	s.Search = schedule.Search
@@ -127,6 +147,9 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 		return nil, err
 	}
 	rh := s.NewRunHistory(now, cacheObj)
+	rh.Context = c.InteractiveTSDBContext()
+	rh.GraphiteContext = c.InteractiveGraphiteContext()
+	rh.MaxQueryRange = maxRange
 	if _, err := s.CheckExpr(t, rh, a, a.Warn, sched.StWarning, nil); err != nil {
 		return nil, err
 	}
@@ -224,12 +247,15 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 			}
 			email, attachments, b_err := s.ExecuteBody(rh, a, instance, true)
 			email_subject, s_err := s.ExecuteSubject(rh, a, instance, true)
+			email_text, t_err := s.ExecuteTextBody(rh, a, instance)
 			if b_err != nil {
 				warning = append(warning, b_err.Error())
 			} else if s_err != nil {
 				warning = append(warning, s_err.Error())
+			} else if t_err != nil {
+				warning = append(warning, t_err.Error())
 			} else {
-				n.DoEmail(email_subject, email, schedule.Conf, string(instance.AlertKey()), attachments...)
+				n.DoEmail(email_subject, email, email_text, schedule.Conf, string(instance.AlertKey()), attachments...)
 			}
 		}
 		data = s.Data(rh, instance, a, false)
@@ -297,6 +323,10 @@ func Rule(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 	if err != nil {
 		return nil, err
 	}
+	maxRange, err := maxQueryRange(r)
+	if err != nil {
+		return nil, err
+	}
 
 	ch := make(chan int)
 	errch := make(chan error, intervals)
@@ -311,7 +341,7 @@ func Rule(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 		for interval := range ch {
 			t.Step(fmt.Sprintf("interval %v", interval), func(t miniprofiler.Timer) {
 				now := from.Add(diff * time.Duration(interval))
-				res, err := procRule(t, c, a, now, interval != 0, r.FormValue("email"), r.FormValue("template_group"))
+				res, err := procRule(t, c, a, now, maxRange, interval != 0, r.FormValue("email"), r.FormValue("template_group"))
 				resch <- res
 				errch <- err
 			})
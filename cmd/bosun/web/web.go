@@ -3,6 +3,10 @@ package web // import "bosun.org/cmd/bosun/web"
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -84,13 +88,31 @@ func Listen(listenAddr string, devMode bool, tsdbHost string) error {
 	}
 	router.HandleFunc("/api/", APIRedirect)
 	router.Handle("/api/action", JSON(Action))
+	router.Handle("/api/action/ack", JSON(AckFilter)).Methods("POST")
+	router.Handle("/api/action/slack", JSON(SlackAck)).Methods("POST")
 	router.Handle("/api/alerts", JSON(Alerts))
+	router.Handle("/api/alerts/preview", JSON(AlertPreview))
+	router.Handle("/api/alerts/dependencies", JSON(AlertDependencies))
+	router.Handle("/api/alerts/eval", JSON(AlertEvalInfo))
+	router.Handle("/api/alerts/states", JSON(AlertStates))
 	router.Handle("/api/backup", JSON(Backup))
+	router.Handle("/api/check/lag", JSON(EvaluationLag))
 	router.Handle("/api/config", miniprofiler.NewHandler(Config))
 	router.Handle("/api/config_test", miniprofiler.NewHandler(ConfigTest))
+	router.Handle("/api/deploy", JSON(Deploy)).Methods("POST")
 	router.Handle("/api/egraph/{bs}.svg", JSON(ExprGraph))
 	router.Handle("/api/errors", JSON(ErrorHistory))
+	router.Handle("/api/errors/categories", JSON(ErrorCategories))
+	router.Handle("/api/errors/last", JSON(LastErrors))
+	router.Handle("/api/errors/failing", JSON(FailingAlerts))
+	router.Handle("/api/errors/stats", JSON(ErrorStats))
+	router.Handle("/api/errors/clearAll", JSON(ClearAllErrors)).Methods("POST")
+	router.Handle("/api/errors/clear", JSON(ClearAlerts)).Methods("POST")
+	router.Handle("/api/errors/{alert}/clear", JSON(ClearAlertErrors)).Methods("POST")
 	router.Handle("/api/expr", JSON(Expr))
+	router.Handle("/api/favorites", JSON(FavoritesGet))
+	router.Handle("/api/favorites/add", JSON(FavoritesAdd)).Methods("POST")
+	router.Handle("/api/favorites/remove", JSON(FavoritesRemove)).Methods("POST")
 	router.Handle("/api/graph", JSON(Graph))
 	router.Handle("/api/health", JSON(HealthCheck))
 	router.Handle("/api/host", JSON(Host))
@@ -102,17 +124,22 @@ func Listen(listenAddr string, devMode bool, tsdbHost string) error {
 	router.Handle("/api/metadata/put", JSON(PutMetadata))
 	router.Handle("/api/metadata/delete", JSON(DeleteMetadata)).Methods("DELETE")
 	router.Handle("/api/metric", JSON(UniqueMetrics))
+	router.Handle("/api/mute/get", JSON(MuteGet))
+	router.Handle("/api/mute/set", JSON(MuteSet))
 	router.Handle("/api/metric/{tagk}/{tagv}", JSON(MetricsByTagPair))
+	router.Handle("/api/notifications/deliveries", JSON(NotificationDeliveries))
 	router.Handle("/api/rule", JSON(Rule))
 	router.HandleFunc("/api/shorten", Shorten)
 	router.Handle("/api/silence/clear", JSON(SilenceClear))
 	router.Handle("/api/silence/get", JSON(SilenceGet))
+	router.Handle("/api/silence/matching", JSON(SilenceMatching))
 	router.Handle("/api/silence/set", JSON(SilenceSet))
 	router.Handle("/api/status", JSON(Status))
 	router.Handle("/api/tagk/{metric}", JSON(TagKeysByMetric))
 	router.Handle("/api/tagv/{tagk}", JSON(TagValuesByTagKey))
 	router.Handle("/api/tagv/{tagk}/{metric}", JSON(TagValuesByMetricTagKey))
 	router.Handle("/api/tagsets/{metric}", JSON(FilteredTagsetsByMetric))
+	router.Handle("/api/templates/check", JSON(CheckTemplates))
 	router.HandleFunc("/api/version", Version)
 	router.Handle("/api/debug/schedlock", JSON(ScheduleLockStatus))
 	http.Handle("/", miniprofiler.NewHandler(Index))
@@ -302,6 +329,27 @@ func HealthCheck(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (
 	return h, nil
 }
 
+// AlertDependencies returns the alert dependency graph and the state of each
+// alert in it.
+func AlertDependencies(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.DependencyGraph()
+}
+
+// AlertEvalInfo returns the last evaluation of an alert.
+func AlertEvalInfo(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetAlertEvalInfo(r.FormValue("alert"))
+}
+
+// AlertStates returns the current state of every alert.
+func AlertStates(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetAlertStates(), nil
+}
+
+// EvaluationLag returns the alerts whose check is overdue and by how long.
+func EvaluationLag(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.EvaluationLag(), nil
+}
+
 func PutMetadata(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	d := json.NewDecoder(r.Body)
 	var ms []metadata.Metasend
@@ -365,6 +413,22 @@ func Alerts(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (inter
 	return schedule.MarshalGroups(t, r.FormValue("filter"))
 }
 
+func AlertPreview(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	name := r.FormValue("alert")
+	a := schedule.Conf.Alerts[name]
+	if a == nil {
+		return nil, fmt.Errorf("unknown alert: %s", name)
+	}
+	limit := 100
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return nil, err
+		}
+	}
+	return schedule.PreviewAlert(t, a, time.Now().UTC(), limit)
+}
+
 func Backup(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	data, err := schedule.GetStateFileBackup()
 	if err != nil {
@@ -387,11 +451,16 @@ func IncidentEvents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return nil, err
 	}
+	var runbook string
+	if a := schedule.Conf.Alerts[incident.AlertKey.Name()]; a != nil {
+		runbook = a.Runbook
+	}
 	return struct {
 		Incident *sched.Incident
 		Events   []sched.Event
 		Actions  []sched.Action
-	}{incident, events, actions}, nil
+		Runbook  string `json:",omitempty"`
+	}{incident, events, actions, runbook}, nil
 }
 
 func Incidents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
@@ -413,7 +482,11 @@ func Incidents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 		}
 		toTime = t
 	}
-	incidents := schedule.GetIncidents(alert, fromTime, toTime)
+	keys, err := sched.ParseIncidentSort(r.FormValue("sort"))
+	if err != nil {
+		return nil, err
+	}
+	incidents := schedule.GetIncidents(alert, fromTime, toTime, keys...)
 	maxIncidents := 200
 	if len(incidents) > maxIncidents {
 		incidents = incidents[:maxIncidents]
@@ -421,6 +494,34 @@ func Incidents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 	return incidents, nil
 }
 
+// NotificationDeliveries returns the notification sends of incidents started
+// in the last since (default two weeks), limited to those slower than slow or
+// that failed if failed=true.
+func NotificationDeliveries(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	since := 14 * 24 * time.Hour
+	if v := r.FormValue("since"); v != "" {
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		since = time.Duration(d)
+	}
+	var slow time.Duration
+	if v := r.FormValue("slow"); v != "" {
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		slow = time.Duration(d)
+	}
+	deliveries := schedule.SlowDeliveries(time.Now().UTC().Add(-since), slow, r.FormValue("failed") == "true")
+	maxDeliveries := 200
+	if len(deliveries) > maxDeliveries {
+		deliveries = deliveries[:maxDeliveries]
+	}
+	return deliveries, nil
+}
+
 func Status(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	r.ParseForm()
 	type ExtStatus struct {
@@ -445,17 +546,19 @@ func Status(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (inter
 
 func Action(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	var data struct {
-		Type    string
-		User    string
-		Message string
-		Keys    []string
-		Notify  bool
+		Type     string
+		User     string
+		Message  string
+		Keys     []string
+		Notify   bool
+		Duration string
 	}
 	j := json.NewDecoder(r.Body)
 	if err := j.Decode(&data); err != nil {
 		return nil, err
 	}
 	var at sched.ActionType
+	var snooze time.Duration
 	switch data.Type {
 	case "ack":
 		at = sched.ActionAcknowledge
@@ -463,6 +566,13 @@ func Action(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (inter
 		at = sched.ActionClose
 	case "forget":
 		at = sched.ActionForget
+	case "snooze":
+		at = sched.ActionSnooze
+		d, err := opentsdb.ParseDuration(data.Duration)
+		if err != nil {
+			return nil, err
+		}
+		snooze = time.Duration(d)
 	}
 	errs := make(MultiError)
 	r.ParseForm()
@@ -472,7 +582,11 @@ func Action(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (inter
 		if err != nil {
 			return nil, err
 		}
-		err = schedule.Action(data.User, data.Message, at, ak)
+		if at == sched.ActionSnooze {
+			err = schedule.Snooze(data.User, data.Message, ak, snooze)
+		} else {
+			err = schedule.Action(data.User, data.Message, at, ak)
+		}
 		if err != nil {
 			errs[key] = err
 		} else {
@@ -488,6 +602,117 @@ func Action(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (inter
 	return nil, nil
 }
 
+// AckFilter acknowledges all alerts matching a dashboard filter. Since it can
+// acknowledge any number of alerts at once, it requires the adminToken as a
+// bearer token.
+func AckFilter(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	token := schedule.Conf.AdminToken
+	if token == "" {
+		return nil, fmt.Errorf("filter ack disabled: adminToken not set")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	var data struct {
+		Filter  string
+		User    string
+		Message string
+		Notify  bool
+	}
+	j := json.NewDecoder(r.Body)
+	if err := j.Decode(&data); err != nil {
+		return nil, err
+	}
+	acked, err := schedule.AckIncidents(data.Filter, data.User, data.Message)
+	if err != nil {
+		return nil, err
+	}
+	if data.Notify && len(acked) != 0 {
+		schedule.ActionNotify(sched.ActionAcknowledge, data.User, data.Message, acked)
+	}
+	return struct {
+		Count int
+		Keys  expr.AlertKeys
+	}{len(acked), acked}, nil
+}
+
+// SlackAck acknowledges the incident of an ack button pressed in a Slack
+// message sent by a notification with ackButton set, as the Slack user who
+// pressed it. Requests must be signed with slackSigningSecret.
+func SlackAck(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	secret := schedule.Conf.SlackSecret
+	if secret == "" {
+		return nil, fmt.Errorf("slack ack disabled: slackSigningSecret not set")
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySlackSignature(secret, r.Header, body, time.Now()); err != nil {
+		slog.Warningf("slack ack: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	var payload struct {
+		CallbackId string `json:"callback_id"`
+		User       struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"user"`
+		Actions []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		return nil, err
+	}
+	if payload.CallbackId != conf.AckCallbackId || len(payload.Actions) != 1 || payload.Actions[0].Name != "ack" {
+		return nil, fmt.Errorf("slack ack: unexpected callback %q", payload.CallbackId)
+	}
+	id, err := strconv.ParseUint(payload.Actions[0].Value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	user := payload.User.Name
+	if user == "" {
+		user = payload.User.Id
+	}
+	ak, err := schedule.AckIncident(id, user, "acknowledged in Slack")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"replace_original": false,
+		"text":             fmt.Sprintf("%s acknowledged %s", user, ak),
+	}, nil
+}
+
+// verifySlackSignature checks the signature Slack sends with requests, and
+// that they were made within five minutes of now so they can not be replayed.
+func verifySlackSignature(secret string, h http.Header, body []byte, now time.Time) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad request timestamp %q", ts)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return fmt.Errorf("request timestamp %v off by %v", ts, d)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(h.Get("X-Slack-Signature")), []byte(expected)) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
 type MultiError map[string]error
 
 func (m MultiError) Error() string {
@@ -498,6 +723,33 @@ func SilenceGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (i
 	return schedule.Silence, nil
 }
 
+// SilenceMatching returns the active and scheduled silences that cover the
+// tags and optional alert in the request.
+func SilenceMatching(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	tags := make(opentsdb.TagSet)
+	if t := r.FormValue("tags"); t != "" {
+		var err error
+		if tags, err = opentsdb.ParseTags(t); err != nil {
+			return nil, err
+		}
+	}
+	var status sched.Status
+	switch st := r.FormValue("status"); st {
+	case "":
+	case "normal":
+		status = sched.StNormal
+	case "warning":
+		status = sched.StWarning
+	case "critical":
+		status = sched.StCritical
+	case "unknown":
+		status = sched.StUnknown
+	default:
+		return nil, fmt.Errorf("unknown status %q", st)
+	}
+	return schedule.SilencesMatching(r.FormValue("alert"), tags, status), nil
+}
+
 var silenceLayouts = []string{
 	tsdbFormat,
 	tsdbFormatSecs,
@@ -549,7 +801,80 @@ func SilenceSet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (i
 		}
 		end = start.Add(time.Duration(d))
 	}
-	return schedule.AddSilence(start, end, data["alert"], data["tags"], data["forget"] == "true", len(data["confirm"]) > 0, data["edit"], data["user"], data["message"])
+	alert, tags, message := data["alert"], data["tags"], data["message"]
+	if id := data["incident"]; id != "" {
+		// Silence exactly the incident's alert key.
+		if alert != "" || tags != "" {
+			return nil, fmt.Errorf("incident may not be combined with alert or tags")
+		}
+		i, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		incident, err := schedule.GetIncident(i)
+		if err != nil {
+			return nil, err
+		}
+		alert = incident.AlertKey.Name()
+		tags = incident.AlertKey.Group().Tags()
+		if message == "" {
+			message = fmt.Sprintf("incident #%d", i)
+		} else {
+			message = fmt.Sprintf("incident #%d: %s", i, message)
+		}
+	}
+	aks, overlaps, err := schedule.AddSilence(start, end, alert, tags, data["maxStatus"], data["forget"] == "true", len(data["confirm"]) > 0, data["rejectOverlap"] == "true", data["edit"], data["user"], message)
+	if err != nil {
+		return nil, err
+	}
+	if len(overlaps) > 0 {
+		w.Header().Set("X-Silence-Overlaps", strings.Join(overlaps, ","))
+	}
+	return aks, nil
+}
+
+// Deploy silences a service for the length of a deploy. It is meant to be
+// called by CI with the deployToken as a bearer token. The POST body is a JSON
+// object with the tags to silence, the duration, and optionally a user and
+// message.
+func Deploy(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	token := schedule.Conf.DeployToken
+	if token == "" {
+		return nil, fmt.Errorf("deploy webhook disabled: deployToken not set")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	var data struct {
+		Tags     string
+		Duration string
+		User     string
+		Message  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Tags == "" {
+		return nil, fmt.Errorf("must specify tags")
+	}
+	d, err := opentsdb.ParseDuration(data.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if data.User == "" {
+		data.User = "deploy"
+	}
+	message := "deploy"
+	if data.Message != "" {
+		message += ": " + data.Message
+	}
+	start := time.Now().UTC()
+	if _, _, err := schedule.AddSilence(start, start.Add(time.Duration(d)), "", data.Tags, "", false, true, false, "", data.User, message); err != nil {
+		return nil, err
+	}
+	slog.Infof("%s deployed %s, silenced for %s", data.User, data.Tags, d)
+	return nil, nil
 }
 
 func SilenceClear(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
@@ -557,6 +882,64 @@ func SilenceClear(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request)
 	return nil, schedule.ClearSilence(id)
 }
 
+func MuteGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetMutes(), nil
+}
+
+func MuteSet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data struct {
+		Alert   string
+		User    string
+		Message string
+		Muted   bool
+	}
+	j := json.NewDecoder(r.Body)
+	if err := j.Decode(&data); err != nil {
+		return nil, err
+	}
+	return nil, schedule.SetMute(data.Alert, data.User, data.Message, data.Muted)
+}
+
+// requestUser returns user, or if it is empty the user the web UI records
+// actions as.
+func requestUser(r *http.Request, user string) string {
+	if user != "" {
+		return user
+	}
+	if c, err := r.Cookie("action-user"); err == nil {
+		if u, err := url.QueryUnescape(c.Value); err == nil {
+			return u
+		}
+	}
+	return ""
+}
+
+func FavoritesGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetFavorites(requestUser(r, r.FormValue("user")))
+}
+
+type favoriteRequest struct {
+	User string
+	Type string
+	Id   string
+}
+
+func FavoritesAdd(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data favoriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return nil, schedule.AddFavorite(requestUser(r, data.User), data.Type, data.Id)
+}
+
+func FavoritesRemove(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data favoriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return nil, schedule.RemoveFavorite(requestUser(r, data.User), data.Type, data.Id)
+}
+
 func ConfigTest(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -630,9 +1013,167 @@ func ScheduleLockStatus(t miniprofiler.Timer, w http.ResponseWriter, r *http.Req
 	return data, nil
 }
 
+// streamErrorHistory writes the error history as a JSON object one alert at a
+// time, flushing after each so large histories are never buffered in full.
+func streamErrorHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var tw io.Writer = w
+	var gz *gzip.Writer
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(w)
+		defer gz.Close()
+		tw = gz
+	}
+	flush := func() {
+		if gz != nil {
+			gz.Flush()
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	enc := json.NewEncoder(tw)
+	sep := "{"
+	err := schedule.ScanErrorHistory(func(name string, as *sched.AlertStatus) error {
+		if _, err := io.WriteString(tw, sep); err != nil {
+			return err
+		}
+		sep = ","
+		if err := enc.Encode(name); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, ":"); err != nil {
+			return err
+		}
+		if err := enc.Encode(as); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		slog.Errorf("streaming error history: %v", err)
+		return
+	}
+	if sep == "{" {
+		io.WriteString(tw, sep)
+	}
+	io.WriteString(tw, "}\n")
+}
+
+// ErrorCategories returns the currently failing alerts grouped by where they failed.
+func ErrorCategories(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetFailingAlertsByCategory(), nil
+}
+
+// LastErrors returns the most recent error of each alert given by the alert
+// query parameter, which may be repeated.
+func LastErrors(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	r.ParseForm()
+	names := r.Form["alert"]
+	if len(names) == 0 {
+		return nil, fmt.Errorf("missing alert parameter")
+	}
+	return schedule.GetLastErrors(names), nil
+}
+
+// FailingAlerts returns a page of the names of failing alerts, sorted by name,
+// and the total number of failing alerts.
+func FailingAlerts(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	offset, count := 0, 100
+	var err error
+	if o := r.FormValue("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil {
+			return nil, err
+		}
+	}
+	if c := r.FormValue("count"); c != "" {
+		if count, err = strconv.Atoi(c); err != nil {
+			return nil, err
+		}
+	}
+	alerts, total, err := schedule.GetFailingAlertsPage(offset, count)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Alerts []string
+		Total  int
+	}{alerts, total}, nil
+}
+
+// ErrorStats returns the number of errors of each alert in the last hour and
+// day, and whether it is failing.
+func ErrorStats(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.GetErrorStats(), nil
+}
+
+// CheckTemplates renders every alert's templates for a synthetic instance and
+// returns whether each succeeded.
+func CheckTemplates(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.CheckTemplates(), nil
+}
+
+// errorCounts is returned by the error clearing endpoints so the UI can refresh its counts.
+type errorCounts struct {
+	FailingAlerts  int
+	UnclosedErrors int
+}
+
+func currentErrorCounts() errorCounts {
+	failing, total := schedule.ErrorCounts()
+	return errorCounts{failing, total}
+}
+
+func ClearAlertErrors(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if err := schedule.ClearAlertErrors(mux.Vars(r)["alert"], r.FormValue("user")); err != nil {
+		return nil, err
+	}
+	return currentErrorCounts(), nil
+}
+
+func ClearAllErrors(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if err := schedule.ClearAllErrors(r.FormValue("user")); err != nil {
+		return nil, err
+	}
+	return currentErrorCounts(), nil
+}
+
+// ClearAlerts clears the errors of the alerts named in the JSON list in the
+// request body. Failed maps each alert that could not be cleared to the reason.
+func ClearAlerts(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var names []string
+	if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	failed, err := schedule.ClearAlerts(names, r.FormValue("user"))
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		errorCounts
+		Cleared []string
+		Failed  map[string]string
+	}{
+		errorCounts: currentErrorCounts(),
+		Cleared:     []string{},
+		Failed:      make(map[string]string),
+	}
+	for _, name := range names {
+		if err := failed[name]; err != nil {
+			res.Failed[name] = err.Error()
+		} else {
+			res.Cleared = append(res.Cleared, name)
+		}
+	}
+	return res, nil
+}
+
 func ErrorHistory(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	if r.Method == "GET" {
-		return schedule.GetErrorHistory(), nil
+		streamErrorHistory(w, r)
+		return nil, nil
 	}
 	data := []struct {
 		Alert string    `json:"Alert"`
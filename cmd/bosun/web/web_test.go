@@ -1,10 +1,30 @@
 package web
 
 import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"bosun.org/_third_party/github.com/gorilla/mux"
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/cmd/bosun/sched"
+	"bosun.org/opentsdb"
 )
 
 func TestErrorTemplate(t *testing.T) {
@@ -20,8 +40,798 @@ func TestErrorTemplate(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = procRule(nil, c, c.Alerts["a"], time.Time{}, false, "", "")
+	_, err = procRule(nil, c, c.Alerts["a"], time.Time{}, 0, false, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestErrorHistoryStream(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	now := time.Now().UTC().Truncate(time.Second)
+	schedule.AlertStatuses["a"] = &sched.AlertStatus{
+		Errors: []*sched.AlertError{{FirstTime: now, LastTime: now, Count: 2, Message: "boom"}},
+	}
+	schedule.AlertStatuses["b"] = &sched.AlertStatus{Success: true}
+	ts := httptest.NewServer(JSON(ErrorHistory))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("expected chunked transfer encoding, got %v", resp.TransferEncoding)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history map[string]*sched.AlertStatus
+	if err := json.NewDecoder(gr).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !history["b"].Success {
+		t.Fatalf("unexpected history: %v", history)
+	}
+	if e := history["a"].Errors; len(e) != 1 || e[0].Count != 2 || e[0].Message != "boom" || !e[0].FirstTime.Equal(now) {
+		t.Fatalf("unexpected errors for a: %v", e)
+	}
+}
+
+func TestLastErrors(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	now := time.Now().UTC()
+	schedule.AlertStatuses["a"] = &sched.AlertStatus{
+		Errors: []*sched.AlertError{
+			{FirstTime: now, LastTime: now, Count: 1, Message: "first"},
+			{FirstTime: now, LastTime: now, Count: 2, Message: "last"},
+		},
+	}
+	schedule.AlertStatuses["b"] = &sched.AlertStatus{Success: true}
+	ts := httptest.NewServer(JSON(LastErrors))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "?alert=a&alert=b&alert=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var last map[string]*sched.AlertError
+	if err := json.NewDecoder(resp.Body).Decode(&last); err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != 3 {
+		t.Fatalf("expected an entry per alert, got %v", last)
+	}
+	if e := last["a"]; e == nil || e.Message != "last" || e.Count != 2 {
+		t.Errorf("expected the most recent error of a, got %+v", e)
+	}
+	if last["b"] != nil || last["c"] != nil {
+		t.Errorf("expected nil for alerts without errors, got %+v %+v", last["b"], last["c"])
+	}
+}
+
+func TestClearErrors(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	now := time.Now().UTC()
+	for _, name := range []string{"a", "b"} {
+		schedule.AlertStatuses[name] = &sched.AlertStatus{
+			Errors: []*sched.AlertError{{FirstTime: now, LastTime: now, Count: 3, Message: "boom"}},
+		}
+	}
+	r := mux.NewRouter()
+	r.Handle("/api/errors/clearAll", JSON(ClearAllErrors)).Methods("POST")
+	r.Handle("/api/errors/{alert}/clear", JSON(ClearAlertErrors)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(path string) (int, errorCounts) {
+		resp, err := http.Post(ts.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var counts errorCounts
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&counts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, counts
+	}
+	if code, _ := post("/api/errors/a/clear"); code == http.StatusOK {
+		t.Fatal("expected clearing without a user to fail")
+	}
+	if code, counts := post("/api/errors/a/clear?user=u"); code != http.StatusOK || counts != (errorCounts{1, 3}) {
+		t.Fatalf("unexpected response %d %+v", code, counts)
+	}
+	if as := schedule.GetErrorHistory()["a"]; !as.Success || len(as.Errors) != 0 {
+		t.Fatalf("expected a to be cleared, got %+v", as)
+	}
+	if code, counts := post("/api/errors/clearAll?user=u"); code != http.StatusOK || counts != (errorCounts{0, 0}) {
+		t.Fatalf("unexpected response %d %+v", code, counts)
+	}
+}
+
+func TestClearAlerts(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	now := time.Now().UTC()
+	for _, name := range []string{"a", "b", "c"} {
+		schedule.AlertStatuses[name] = &sched.AlertStatus{
+			Errors: []*sched.AlertError{{FirstTime: now, LastTime: now, Count: 2, Message: "boom"}},
+		}
+	}
+	ts := httptest.NewServer(JSON(ClearAlerts))
+	defer ts.Close()
+	post := func(query, body string) *http.Response {
+		resp, err := http.Post(ts.URL+query, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := post("", `["a"]`); resp.StatusCode == http.StatusOK {
+		t.Fatal("expected clearing without a user to fail")
+	}
+	resp := post("?user=u", `["a", "missing", "c"]`)
+	defer resp.Body.Close()
+	var res struct {
+		errorCounts
+		Cleared []string
+		Failed  map[string]string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Cleared, []string{"a", "c"}) {
+		t.Errorf("expected a and c to be cleared, got %v", res.Cleared)
+	}
+	if len(res.Failed) != 1 || res.Failed["missing"] == "" {
+		t.Errorf("expected only missing to fail, got %v", res.Failed)
+	}
+	if res.errorCounts != (errorCounts{1, 2}) {
+		t.Errorf("expected only b to be failing, got %+v", res.errorCounts)
+	}
+	history := schedule.GetErrorHistory()
+	for name, cleared := range map[string]bool{"a": true, "b": false, "c": true} {
+		if as := history[name]; as.Success != cleared || (len(as.Errors) == 0) != cleared {
+			t.Errorf("%s: expected cleared %v, got %+v", name, cleared, as)
+		}
+	}
+}
+
+func TestIncidentBands(t *testing.T) {
+	from := time.Unix(1000, 0).UTC()
+	to := time.Unix(2000, 0).UTC()
+	at := func(s int64) *time.Time {
+		v := time.Unix(s, 0).UTC()
+		return &v
+	}
+	incidents := []sched.Incident{
+		{Id: 3, Start: time.Unix(1400, 0), End: at(1500), AlertKey: "b{host=x}"},
+		{Id: 1, Start: time.Unix(500, 0), End: at(1100), AlertKey: "a{host=x}"},
+		{Id: 2, Start: time.Unix(1450, 0), End: at(1600), AlertKey: "a{host=y}"},
+		{Id: 4, Start: time.Unix(1800, 0), AlertKey: "c{host=x}"},
+	}
+	bands := incidentBands(incidents, from, to, 10)
+	expected := []graphBand{
+		{Start: 1000, End: 1100, Label: "a{host=x}", Incidents: []uint64{1}},
+		{Start: 1400, End: 1600, Label: "2 incidents", Incidents: []uint64{3, 2}},
+		{Start: 1800, End: 2000, Label: "c{host=x}", Incidents: []uint64{4}},
+	}
+	if !reflect.DeepEqual(bands, expected) {
+		t.Fatalf("got %+v, expected %+v", bands, expected)
+	}
+	// Limiting to two bands merges the pair with the smallest gap.
+	bands = incidentBands(incidents, from, to, 2)
+	expected = []graphBand{
+		{Start: 1000, End: 1100, Label: "a{host=x}", Incidents: []uint64{1}},
+		{Start: 1400, End: 2000, Label: "3 incidents", Incidents: []uint64{3, 2, 4}},
+	}
+	if !reflect.DeepEqual(bands, expected) {
+		t.Fatalf("got %+v, expected %+v", bands, expected)
+	}
+}
+
+func TestGraphIncidents(t *testing.T) {
+	incidents := []sched.Incident{
+		{Id: 1, AlertKey: "a{host=x}"},
+		{Id: 2, AlertKey: "a{host=y}"},
+		{Id: 3, AlertKey: "b{dc=ny,host=x}"},
+		{Id: 4, AlertKey: "c{}"},
+	}
+	ids := func(incidents []sched.Incident) []uint64 {
+		var ids []uint64
+		for _, i := range incidents {
+			ids = append(ids, i.Id)
+		}
+		return ids
+	}
+	series := opentsdb.ResponseSet{
+		{Metric: "m", Tags: opentsdb.TagSet{"host": "x", "dc": "ny"}},
+		{Metric: "m", Tags: opentsdb.TagSet{"host": "z", "dc": "ny"}},
+	}
+	if got := ids(graphIncidents(incidents, series, nil)); !reflect.DeepEqual(got, []uint64{1, 3}) {
+		t.Errorf("expected the incidents matching the series tags, got %v", got)
+	}
+	if got := ids(graphIncidents(incidents, series, []string{"a{host=y}", "c{}"})); !reflect.DeepEqual(got, []uint64{2, 4}) {
+		t.Errorf("expected the incidents of the given alert keys, got %v", got)
+	}
+}
+
+func TestSilenceIncident(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	ak := expr.NewAlertKey("a", opentsdb.TagSet{"host": "web01", "dev": "sda"})
+	schedule.Incidents[7] = &sched.Incident{Id: 7, Start: time.Now().UTC(), AlertKey: ak}
+	r := mux.NewRouter()
+	r.Handle("/api/silence/set", JSON(SilenceSet))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(body string) int {
+		resp, err := http.Post(ts.URL+"/api/silence/set", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(`{"incident": "8", "duration": "1h", "user": "u", "confirm": "1"}`); code == http.StatusOK {
+		t.Fatal("expected an unknown incident to fail")
+	}
+	if code := post(`{"incident": "7", "tags": "host=web01", "duration": "1h", "user": "u", "confirm": "1"}`); code == http.StatusOK {
+		t.Fatal("expected incident with tags to fail")
+	}
+	if code := post(`{"incident": "7", "duration": "1h", "user": "u", "message": "noisy", "confirm": "1"}`); code != http.StatusOK {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if len(schedule.Silence) != 1 {
+		t.Fatalf("expected one silence, got %d", len(schedule.Silence))
+	}
+	now := time.Now().UTC()
+	for _, si := range schedule.Silence {
+		if si.Message != "incident #7: noisy" || si.User != "u" {
+			t.Errorf("unexpected silence annotation %q by %q", si.Message, si.User)
+		}
+		tests := []struct {
+			alert    string
+			tags     opentsdb.TagSet
+			silenced bool
+		}{
+			{"a", opentsdb.TagSet{"host": "web01", "dev": "sda"}, true},
+			{"a", opentsdb.TagSet{"host": "web01", "dev": "sdb"}, false},
+			{"a", opentsdb.TagSet{"host": "web02", "dev": "sda"}, false},
+			{"b", opentsdb.TagSet{"host": "web01", "dev": "sda"}, false},
+		}
+		for _, test := range tests {
+			if got := si.Silenced(now, test.alert, test.tags); got != test.silenced {
+				t.Errorf("%s%s: silenced %v, expected %v", test.alert, test.tags, got, test.silenced)
+			}
+		}
+	}
+}
+
+func TestSilenceOverlapHeader(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	r := mux.NewRouter()
+	r.Handle("/api/silence/set", JSON(SilenceSet))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(body string) string {
+		resp, err := http.Post(ts.URL+"/api/silence/set", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected response %d", resp.StatusCode)
+		}
+		return resp.Header.Get("X-Silence-Overlaps")
+	}
+	start := time.Now().UTC().Add(time.Hour).Format(tsdbFormatSecs)
+	if o := post(`{"alert": "a", "start": "` + start + `", "duration": "2h", "user": "u", "confirm": "1"}`); o != "" {
+		t.Fatalf("unexpected overlap %q", o)
+	}
+	var id string
+	for id = range schedule.Silence {
+	}
+	if o := post(`{"alert": "a", "start": "` + start + `", "duration": "1h", "user": "u"}`); o != id {
+		t.Errorf("expected overlap with %s, got %q", id, o)
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(&conf.Conf{DeployToken: "secret"})
+	r := mux.NewRouter()
+	r.Handle("/api/deploy", JSON(Deploy)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(token string) int {
+		req, err := http.NewRequest("POST", ts.URL+"/api/deploy", strings.NewReader(`{"Tags": "service=web", "Duration": "10m", "Message": "v1.2"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", code)
+	}
+	if len(schedule.Silence) != 0 {
+		t.Fatal("unauthorized deploy created a silence")
+	}
+	before := time.Now().UTC()
+	if code := post("secret"); code != http.StatusOK {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if len(schedule.Silence) != 1 {
+		t.Fatalf("expected one silence, got %d", len(schedule.Silence))
+	}
+	for _, si := range schedule.Silence {
+		if si.Tags.String() != "{service=web}" || si.Alert != "" {
+			t.Errorf("unexpected silence scope %v %q", si.Tags, si.Alert)
+		}
+		if si.Message != "deploy: v1.2" || si.User != "deploy" {
+			t.Errorf("unexpected silence annotation %q by %q", si.Message, si.User)
+		}
+		if d := si.End.Sub(si.Start); d != 10*time.Minute || si.Start.Before(before.Truncate(time.Second)) {
+			t.Errorf("unexpected silence window %v - %v", si.Start, si.End)
+		}
+	}
+}
+
+func TestAckFilter(t *testing.T) {
+	c, err := conf.New("", `
+		adminToken = secret
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	schedule.DataAccess = testData
+	if err := schedule.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	ak := expr.NewAlertKey("a", opentsdb.TagSet{"host": "x"})
+	schedule.RunHistory(&sched.RunHistory{
+		Events: map[expr.AlertKey]*sched.Event{ak: {Status: sched.StCritical}},
+	})
+	r := mux.NewRouter()
+	r.Handle("/api/action/ack", JSON(AckFilter)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(token string) int {
+		req, err := http.NewRequest("POST", ts.URL+"/api/action/ack", strings.NewReader(`{"Filter": "status:critical", "User": "u", "Message": "outage"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", code)
+	}
+	if !schedule.GetStatus(ak).NeedAck {
+		t.Fatal("unauthorized request acknowledged the alert")
+	}
+	if code := post("secret"); code != http.StatusOK {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if schedule.GetStatus(ak).NeedAck {
+		t.Fatal("expected the alert to be acknowledged")
+	}
+}
+
+func TestMaxQueryRange(t *testing.T) {
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: map[string]opentsdb.Point{"0": 1}}})
+	}))
+	defer tsdb.Close()
+	schedule.DataAccess = testData
+	schedule.Init(&conf.Conf{
+		TSDBHost:      strings.TrimPrefix(tsdb.URL, "http://"),
+		ResponseLimit: 1 << 20,
+		MaxQueryRange: time.Hour,
+		AdminToken:    "secret",
+	})
+	r := mux.NewRouter()
+	r.Handle("/api/expr", JSON(Expr)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(query, token string) int {
+		req, err := http.NewRequest("POST", ts.URL+"/api/expr"+query, strings.NewReader(`q("avg:m{host=*}", "2h", "")`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("", ""); code != http.StatusInternalServerError {
+		t.Errorf("expected over-limit query to be rejected, got %d", code)
+	}
+	if code := post("?override=1", "wrong"); code != http.StatusInternalServerError {
+		t.Errorf("expected override without the admin token to be rejected, got %d", code)
+	}
+	if code := post("?override=1", "secret"); code != http.StatusOK {
+		t.Errorf("expected admin override to succeed, got %d", code)
+	}
+}
+
+func TestMaxQueryRangeGraphRule(t *testing.T) {
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: map[string]opentsdb.Point{"0": 1}}})
+	}))
+	defer tsdb.Close()
+	host := strings.TrimPrefix(tsdb.URL, "http://")
+	dir, err := ioutil.TempDir("", "bosun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schedule.DataAccess = testData
+	// The rule page saves the tested config to the state file.
+	if err := schedule.Init(&conf.Conf{
+		TSDBHost:      host,
+		ResponseLimit: 1 << 20,
+		MaxQueryRange: time.Hour,
+		AdminToken:    "secret",
+		StateFile:     filepath.Join(dir, "bosun.state"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer schedule.Close()
+	r := mux.NewRouter()
+	r.Handle("/api/graph", JSON(Graph))
+	r.Handle("/api/rule", JSON(Rule)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(method, url, body, token string) (int, []byte) {
+		req, err := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, b
+	}
+
+	graph := "/api/graph?json=" + url.QueryEscape(`{"start":"2h-ago","queries":[{"aggregator":"avg","metric":"m"}]}`)
+	if code, _ := do("GET", graph, "", ""); code != http.StatusInternalServerError {
+		t.Errorf("expected over-limit graph to be rejected, got %d", code)
+	}
+	if code, _ := do("GET", graph+"&override=1", "", "wrong"); code != http.StatusInternalServerError {
+		t.Errorf("expected graph override without the admin token to be rejected, got %d", code)
+	}
+	if code, b := do("GET", graph+"&override=1", "", "secret"); code != http.StatusOK {
+		t.Errorf("expected admin graph override to succeed, got %d: %s", code, b)
+	}
+
+	config := fmt.Sprintf("tsdbHost = %s\nalert a {\n\tcrit = avg(q(\"avg:m{host=*}\", \"2h\", \"\")) > 0\n}\n", host)
+	rule := func(query, token string) []string {
+		code, b := do("POST", "/api/rule?alert=a"+query, config, token)
+		if code != http.StatusOK {
+			t.Fatalf("rule: got %d: %s", code, b)
+		}
+		var res struct{ Errors []string }
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Errors
+	}
+	if errs := rule("", ""); len(errs) != 1 || !strings.Contains(errs[0], "exceeds maxQueryRange") {
+		t.Errorf("expected over-limit rule to be rejected, got %v", errs)
+	}
+	if errs := rule("&override=1", "secret"); len(errs) != 0 {
+		t.Errorf("expected admin rule override to succeed, got %v", errs)
+	}
+}
+
+func TestRuleReadHost(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	tsdb := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			json.NewEncoder(w).Encode(opentsdb.ResponseSet{{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: map[string]opentsdb.Point{"0": 1}}})
+		}))
+	}
+	primary, read := tsdb("primary"), tsdb("read")
+	defer primary.Close()
+	defer read.Close()
+	dir, err := ioutil.TempDir("", "bosun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schedule.DataAccess = testData
+	// The rule page saves the tested config to the state file.
+	if err := schedule.Init(&conf.Conf{StateFile: filepath.Join(dir, "bosun.state")}); err != nil {
+		t.Fatal(err)
+	}
+	defer schedule.Close()
+	r := mux.NewRouter()
+	r.Handle("/api/rule", JSON(Rule)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	config := fmt.Sprintf("tsdbHost = %s\ntsdbReadHost = %s\nalert a {\n\tcrit = avg(q(\"avg:m{host=*}\", \"5m\", \"\")) > 0\n}\n",
+		strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(read.URL, "http://"))
+	resp, err := http.Post(ts.URL+"/api/rule?alert=a", "text/plain", strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct{ Errors []string }
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(res.Errors) != 0 {
+		t.Fatalf("rule: got %d: %v", resp.StatusCode, res.Errors)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["primary"] != 0 || hits["read"] == 0 {
+		t.Errorf("expected rule queries to go to tsdbReadHost only, got %v", hits)
+	}
+}
+
+func TestGraphExpandsMetrics(t *testing.T) {
+	var rates []string
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/suggest":
+			json.NewEncoder(w).Encode([]string{"graph.a", "graph.b", "other"})
+		case "/api/query":
+			var req opentsdb.Request
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			var rs opentsdb.ResponseSet
+			for _, q := range req.Queries {
+				rates = append(rates, fmt.Sprintf("%s:%v", q.Metric, q.Rate))
+				rs = append(rs, &opentsdb.Response{Metric: q.Metric, Tags: opentsdb.TagSet{}, DPS: map[string]opentsdb.Point{"0": 1}})
+			}
+			json.NewEncoder(w).Encode(rs)
+		}
+	}))
+	defer tsdb.Close()
+	schedule.DataAccess = testData
+	schedule.Init(&conf.Conf{
+		TSDBHost:      strings.TrimPrefix(tsdb.URL, "http://"),
+		ResponseLimit: 1 << 20,
+	})
+	// Only graph.a is a counter, so the autorate of the pattern only makes
+	// its query a rate.
+	if err := testData.PutMetricMetadata("graph.a", "rate", "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testData.PutMetricMetadata("graph.b", "rate", "gauge"); err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{
+		"json":     {`{"start":"1h-ago","queries":[{"metric":"graph.*","aggregator":"sum"}]}`},
+		"autorate": {"0"},
+	}
+	req, err := http.NewRequest("GET", "/api/graph?"+q.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	JSON(Graph).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the graph to succeed, got %d: %s", w.Code, w.Body)
+	}
+	sort.Strings(rates)
+	if exp := []string{"graph.a:true", "graph.b:false"}; !reflect.DeepEqual(rates, exp) {
+		t.Errorf("expected queries %v, got %v", exp, rates)
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+		alert b {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	schedule.DataAccess = testData
+	schedule.Init(c)
+	r := mux.NewRouter()
+	r.Handle("/api/favorites", JSON(FavoritesGet))
+	r.Handle("/api/favorites/add", JSON(FavoritesAdd)).Methods("POST")
+	r.Handle("/api/favorites/remove", JSON(FavoritesRemove)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(method, path, user, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.AddCookie(&http.Cookie{Name: "action-user", Value: user})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, body := range []string{
+		`{"User": "fav-alice", "Type": "alert", "Id": "a"}`,
+		`{"User": "fav-bob", "Type": "alert", "Id": "b"}`,
+	} {
+		if resp := do("POST", "/api/favorites/add", "", body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %v", body, resp.Status)
+		}
+	}
+	// The user can also come from the cookie the UI records actions with.
+	if resp := do("POST", "/api/favorites/add", "fav-alice", `{"Type": "alert", "Id": "b"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v", resp.Status)
+	}
+	if resp := do("POST", "/api/favorites/remove", "fav-alice", `{"Type": "alert", "Id": "a"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v", resp.Status)
+	}
+	for _, body := range []string{
+		`{"User": "fav-alice", "Type": "alert", "Id": "nonexistent"}`,
+		`{"User": "fav-alice", "Type": "incident", "Id": "1"}`,
+		`{"User": "fav-alice", "Type": "host", "Id": "a"}`,
+		`{"Type": "alert", "Id": "a"}`,
+	} {
+		if resp := do("POST", "/api/favorites/add", "", body); resp.StatusCode == http.StatusOK {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+	for user, expected := range map[string][]string{"fav-alice": {"b"}, "fav-bob": {"b"}} {
+		resp := do("GET", "/api/favorites?user="+user, "", "")
+		var f sched.Favorites
+		if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if !reflect.DeepEqual(f.Alerts, expected) || len(f.Incidents) != 0 {
+			t.Errorf("%s: got %+v, expected alerts %v", user, f, expected)
+		}
+	}
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Unix(1531420618, 0)
+	body := []byte("payload=%7B%7D")
+	// Signed with the secret "secret".
+	sign := func(ts string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		ts, sig string
+		ok      bool
+	}{
+		{"1531420618", sign("1531420618"), true},
+		{"1531420500", sign("1531420500"), true},
+		{"1531420618", sign("1531420617"), false},
+		{"1531420618", "v0=00", false},
+		{"1531420618", "", false},
+		{"1531420000", sign("1531420000"), false},
+		{"", sign(""), false},
+	}
+	for i, test := range tests {
+		h := http.Header{}
+		h.Set("X-Slack-Request-Timestamp", test.ts)
+		h.Set("X-Slack-Signature", test.sig)
+		if err := verifySlackSignature("secret", h, body, now); (err == nil) != test.ok {
+			t.Errorf("%d: expected ok %v, got %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestSlackAck(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(&conf.Conf{SlackSecret: "secret"})
+	for i, host := range []string{"a", "b"} {
+		ak := expr.NewAlertKey("a", opentsdb.TagSet{"host": host})
+		id := uint64(i + 1)
+		schedule.Incidents[id] = &sched.Incident{Id: id, Start: time.Now().UTC(), AlertKey: ak}
+		st := sched.NewStatus(ak)
+		st.Append(&sched.Event{Status: sched.StCritical, IncidentId: id})
+		st.Open = true
+		st.NeedAck = true
+		schedule.SetStatus(ak, st)
+	}
+	r := mux.NewRouter()
+	r.Handle("/api/action/slack", JSON(SlackAck)).Methods("POST")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	post := func(secret, id string) int {
+		payload := fmt.Sprintf(`{"callback_id":%q,"user":{"id":"U1","name":"alice"},"actions":[{"name":"ack","value":%q}]}`, conf.AckCallbackId, id)
+		body := url.Values{"payload": {payload}}.Encode()
+		req, err := http.NewRequest("POST", ts.URL+"/api/action/slack", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := fmt.Sprint(time.Now().Unix())
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "v0:%s:%s", now, body)
+		req.Header.Set("X-Slack-Request-Timestamp", now)
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	needAck := func(host string) bool {
+		return schedule.GetStatus(expr.NewAlertKey("a", opentsdb.TagSet{"host": host})).NeedAck
+	}
+	if code := post("wrong", "2"); code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", code)
+	}
+	if !needAck("b") {
+		t.Fatal("unsigned callback acknowledged the incident")
+	}
+	if code := post("secret", "3"); code == http.StatusOK {
+		t.Fatal("expected an unknown incident to fail")
+	}
+	if code := post("secret", "2"); code != http.StatusOK {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if needAck("b") || !needAck("a") {
+		t.Fatalf("expected only incident 2 on host b to be acknowledged")
+	}
+	st := schedule.GetStatus(expr.NewAlertKey("a", opentsdb.TagSet{"host": "b"}))
+	if last := st.Actions[len(st.Actions)-1]; last.User != "alice" || last.Type != sched.ActionAcknowledge {
+		t.Errorf("unexpected action %+v", last)
+	}
+}
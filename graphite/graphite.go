@@ -19,6 +19,12 @@ type Request struct {
 	End     *time.Time
 	Targets []string
 	URL     *url.URL
+	// MaxDataPoints, if not zero, asks Graphite to consolidate each series
+	// to at most this many points.
+	MaxDataPoints int
+	// ConsolidateBy is the function Graphite uses to consolidate points:
+	// sum, average, min or max. Empty uses Graphite's default, average.
+	ConsolidateBy string
 }
 
 type Response []Series
@@ -32,7 +38,7 @@ type DataPoint []json.Number
 
 func (r *Request) CacheKey() string {
 	targets, _ := json.Marshal(r.Targets)
-	return fmt.Sprintf("graphite-%d-%d-%s", r.Start.Unix(), r.End.Unix(), targets)
+	return fmt.Sprintf("graphite-%d-%d-%s-%d-%s", r.Start.Unix(), r.End.Unix(), targets, r.MaxDataPoints, r.ConsolidateBy)
 }
 
 // Query performs a request to Graphite at the given host. host specifies
@@ -40,9 +46,19 @@ func (r *Request) CacheKey() string {
 // (http, https) to specify the protocol (http is the default). header is
 // the headers to send.
 func (r *Request) Query(host string, header http.Header) (Response, error) {
+	targets := r.Targets
+	if r.ConsolidateBy != "" {
+		targets = make([]string, len(r.Targets))
+		for i, t := range r.Targets {
+			targets[i] = fmt.Sprintf("consolidateBy(%s,'%s')", t, r.ConsolidateBy)
+		}
+	}
 	v := url.Values{
 		"format": []string{"json"},
-		"target": r.Targets,
+		"target": targets,
+	}
+	if r.MaxDataPoints > 0 {
+		v.Add("maxDataPoints", fmt.Sprint(r.MaxDataPoints))
 	}
 	if r.Start != nil {
 		v.Add("from", fmt.Sprint(r.Start.Unix()))
@@ -89,9 +105,28 @@ func (r *Request) Query(host string, header http.Header) (Response, error) {
 		e := fmt.Errorf(requestErrFmt, r.URL, "Json decode failed: "+err.Error())
 		return series, e
 	}
+	if r.ConsolidateBy != "" {
+		for i := range series {
+			series[i].Target = unwrapConsolidateBy(series[i].Target)
+		}
+	}
 	return series, nil
 }
 
+// unwrapConsolidateBy returns the name of the series wrapped by consolidateBy
+// in target, which Graphite adds to the series name.
+func unwrapConsolidateBy(target string) string {
+	const prefix = "consolidateBy("
+	if !strings.HasPrefix(target, prefix) || !strings.HasSuffix(target, ")") {
+		return target
+	}
+	inner := target[len(prefix) : len(target)-1]
+	if i := strings.LastIndex(inner, ","); i >= 0 {
+		return inner[:i]
+	}
+	return target
+}
+
 func readTraceback(resp *http.Response) (*[]string, error) {
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
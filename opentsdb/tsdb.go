@@ -367,6 +367,33 @@ type Query struct {
 	RateOptions RateOptions `json:"rateOptions,omitempty"`
 	Downsample  string      `json:"downsample,omitempty"`
 	Tags        TagSet      `json:"tags,omitempty"`
+	Filters     []Filter    `json:"filters,omitempty"`
+}
+
+// Filter types supported by OpenTSDB 2.2 and later.
+const (
+	FilterLiteralOr     = "literal_or"
+	FilterILiteralOr    = "iliteral_or"
+	FilterNotLiteralOr  = "not_literal_or"
+	FilterNotILiteralOr = "not_iliteral_or"
+	FilterWildcard      = "wildcard"
+	FilterIWildcard     = "iwildcard"
+	FilterRegexp        = "regexp"
+)
+
+// Filter is an OpenTSDB 2.2 tag filter. Results are grouped by the values of
+// TagK only if GroupBy is set; otherwise the filter just selects series,
+// which are aggregated together.
+type Filter struct {
+	Type    string `json:"type"`
+	TagK    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+// String returns f in OpenTSDB's URI form, for example host=regexp(web.*).
+func (f Filter) String() string {
+	return fmt.Sprintf("%s=%s(%s)", f.TagK, f.Type, f.Filter)
 }
 
 // RateOptions are rate options for a query.
@@ -548,8 +575,27 @@ func (q Query) String() string {
 		s += ":"
 	}
 	s += q.Metric
+	if len(q.Filters) == 0 {
+		if len(q.Tags) > 0 {
+			s += q.Tags.String()
+		}
+		return s
+	}
+	// Tags and grouping filters go in the first braces, others in the second.
+	var group, nogroup []string
 	if len(q.Tags) > 0 {
-		s += q.Tags.String()
+		group = append(group, q.Tags.Tags())
+	}
+	for _, f := range q.Filters {
+		if f.GroupBy {
+			group = append(group, f.String())
+		} else {
+			nogroup = append(nogroup, f.String())
+		}
+	}
+	s += "{" + strings.Join(group, ",") + "}"
+	if len(nogroup) > 0 {
+		s += "{" + strings.Join(nogroup, ",") + "}"
 	}
 	return s
 }
@@ -858,15 +904,122 @@ func (c *LimitContext) Query(r *Request) (tr ResponseSet, err error) {
 	return
 }
 
+// FallbackContext queries Primary, and if that fails, retries the same request
+// against Fallback.
+type FallbackContext struct {
+	Primary, Fallback Context
+	// OnFallback, if not nil, is called with the primary's error each time
+	// the fallback is used.
+	OnFallback func(error)
+}
+
+// Query returns the result of the request from Primary, or from Fallback if
+// Primary returned an error.
+func (c *FallbackContext) Query(r *Request) (ResponseSet, error) {
+	tr, err := c.Primary.Query(r)
+	if err == nil || c.Fallback == nil {
+		return tr, err
+	}
+	if c.OnFallback != nil {
+		c.OnFallback(err)
+	}
+	return c.Fallback.Query(r)
+}
+
+// expandSuggestMax is the number of suggestions requested when expanding a
+// metric pattern. Getting this many back means the list may be truncated.
+const expandSuggestMax = 10000
+
+// SuggestMetrics returns up to max metric names starting with prefix, from the
+// suggest API of the given host.
+func SuggestMetrics(host, prefix string, max int) ([]string, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   host,
+		Path:   "/api/suggest",
+		RawQuery: url.Values{
+			"type": {"metrics"},
+			"q":    {prefix},
+			"max":  {strconv.Itoa(max)},
+		}.Encode(),
+	}
+	resp, err := DefaultClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("opentsdb: suggest: %s", resp.Status)
+	}
+	var metrics []string
+	err = json.NewDecoder(resp.Body).Decode(&metrics)
+	return metrics, err
+}
+
+// ExpandMetrics replaces each query whose metric contains a * wildcard with
+// one query per matching metric, as listed by suggest. It is an error for a
+// pattern to match no metrics or more than limit metrics.
+func (r *Request) ExpandMetrics(suggest func(prefix string, max int) ([]string, error), limit int) error {
+	var queries []*Query
+	for _, q := range r.Queries {
+		i := strings.Index(q.Metric, "*")
+		if i < 0 {
+			queries = append(queries, q)
+			continue
+		}
+		re, err := regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(q.Metric), `\*`, ".*", -1) + "$")
+		if err != nil {
+			return err
+		}
+		names, err := suggest(q.Metric[:i], expandSuggestMax)
+		if err != nil {
+			return err
+		}
+		if len(names) >= expandSuggestMax {
+			return fmt.Errorf("opentsdb: metric pattern %s: too many metrics with prefix %q", q.Metric, q.Metric[:i])
+		}
+		var matched []*Query
+		for _, name := range names {
+			if !re.MatchString(name) {
+				continue
+			}
+			if len(matched) == limit {
+				return fmt.Errorf("opentsdb: metric pattern %s matches more than %d metrics", q.Metric, limit)
+			}
+			nq := *q
+			nq.Metric = name
+			if q.Tags != nil {
+				nq.Tags = q.Tags.Copy()
+			}
+			matched = append(matched, &nq)
+		}
+		if len(matched) == 0 {
+			return fmt.Errorf("opentsdb: no metrics match %s", q.Metric)
+		}
+		queries = append(queries, matched...)
+	}
+	r.Queries = queries
+	return nil
+}
+
 // FilterTags removes tagks in tr not present in r. Does nothing in the event of
 // multiple queries in the request.
 func FilterTags(r *Request, tr ResponseSet) {
 	if len(r.Queries) != 1 {
 		return
 	}
+	keep := make(map[string]bool)
+	for k := range r.Queries[0].Tags {
+		keep[k] = true
+	}
+	for _, f := range r.Queries[0].Filters {
+		if f.GroupBy {
+			keep[f.TagK] = true
+		}
+	}
 	for _, resp := range tr {
 		for k := range resp.Tags {
-			if _, present := r.Queries[0].Tags[k]; !present {
+			if !keep[k] {
 				delete(resp.Tags, k)
 			}
 		}
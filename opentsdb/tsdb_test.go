@@ -1,7 +1,15 @@
 package opentsdb
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClean(t *testing.T) {
@@ -143,6 +151,93 @@ func TestQueryString(t *testing.T) {
 	}
 }
 
+func TestFilterJSON(t *testing.T) {
+	tests := []struct {
+		in  Filter
+		out string
+	}{
+		{
+			Filter{Type: FilterLiteralOr, TagK: "host", Filter: "web01|web02", GroupBy: true},
+			`{"type":"literal_or","tagk":"host","filter":"web01|web02","groupBy":true}`,
+		},
+		{
+			Filter{Type: FilterILiteralOr, TagK: "host", Filter: "WEB01"},
+			`{"type":"iliteral_or","tagk":"host","filter":"WEB01","groupBy":false}`,
+		},
+		{
+			Filter{Type: FilterNotLiteralOr, TagK: "dc", Filter: "lab|test"},
+			`{"type":"not_literal_or","tagk":"dc","filter":"lab|test","groupBy":false}`,
+		},
+		{
+			Filter{Type: FilterNotILiteralOr, TagK: "dc", Filter: "LAB"},
+			`{"type":"not_iliteral_or","tagk":"dc","filter":"LAB","groupBy":false}`,
+		},
+		{
+			Filter{Type: FilterWildcard, TagK: "host", Filter: "*.example.com", GroupBy: true},
+			`{"type":"wildcard","tagk":"host","filter":"*.example.com","groupBy":true}`,
+		},
+		{
+			Filter{Type: FilterIWildcard, TagK: "host", Filter: "WEB*"},
+			`{"type":"iwildcard","tagk":"host","filter":"WEB*","groupBy":false}`,
+		},
+		{
+			Filter{Type: FilterRegexp, TagK: "host", Filter: "web[0-9]+", GroupBy: true},
+			`{"type":"regexp","tagk":"host","filter":"web[0-9]+","groupBy":true}`,
+		},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.out {
+			t.Errorf("got %s, expected %s", b, test.out)
+		}
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	q := Query{
+		Aggregator: "sum",
+		Metric:     "os.cpu",
+		Tags:       TagSet{"dc": "*"},
+		Filters: []Filter{
+			{Type: FilterRegexp, TagK: "host", Filter: "web.*", GroupBy: true},
+			{Type: FilterNotLiteralOr, TagK: "env", Filter: "lab|test"},
+		},
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"aggregator":"sum","metric":"os.cpu","rateOptions":{},"tags":{"dc":"*"},"filters":[{"type":"regexp","tagk":"host","filter":"web.*","groupBy":true},{"type":"not_literal_or","tagk":"env","filter":"lab|test","groupBy":false}]}`
+	if string(b) != expected {
+		t.Errorf("got %s, expected %s", b, expected)
+	}
+	if s, expected := q.String(), "sum:os.cpu{dc=*,host=regexp(web.*)}{env=not_literal_or(lab|test)}"; s != expected {
+		t.Errorf("got %s, expected %s", s, expected)
+	}
+	q.Tags = nil
+	q.Filters = q.Filters[1:]
+	if s, expected := q.String(), "sum:os.cpu{}{env=not_literal_or(lab|test)}"; s != expected {
+		t.Errorf("got %s, expected %s", s, expected)
+	}
+
+	// Only tags and grouping filters are kept in results.
+	r := &Request{Queries: []*Query{{
+		Tags: TagSet{"dc": "*"},
+		Filters: []Filter{
+			{Type: FilterRegexp, TagK: "host", Filter: "web.*", GroupBy: true},
+			{Type: FilterNotLiteralOr, TagK: "env", Filter: "lab|test"},
+		},
+	}}}
+	tr := ResponseSet{{Tags: TagSet{"dc": "ny", "host": "web01", "env": "prod", "core": "0"}}}
+	FilterTags(r, tr)
+	if got := tr[0].Tags.String(); got != "{dc=ny,host=web01}" {
+		t.Errorf("got tags %s, expected {dc=ny,host=web01}", got)
+	}
+}
+
 func TestValidTag(t *testing.T) {
 	tests := map[string]bool{
 		"abcXYZ012_./-": true,
@@ -183,3 +278,92 @@ func TestAllSubsets(t *testing.T) {
 		t.Fatal("Expect 15 subsets")
 	}
 }
+
+func TestFallbackContext(t *testing.T) {
+	block := make(chan bool)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer primary.Close()
+	defer close(block)
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"1":2}}]`)
+	}))
+	defer fallback.Close()
+	timeout := DefaultClient.Timeout
+	DefaultClient.Timeout = 100 * time.Millisecond
+	defer func() { DefaultClient.Timeout = timeout }()
+
+	host := func(s *httptest.Server) string {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Host
+	}
+	var fellBack error
+	c := &FallbackContext{
+		Primary:  Host(host(primary)),
+		Fallback: Host(host(fallback)),
+		OnFallback: func(err error) {
+			fellBack = err
+		},
+	}
+	q, err := ParseQuery("sum:m{host=*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Start: 1, Queries: []*Query{q}}
+	rs, err := c.Query(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fellBack == nil {
+		t.Fatal("expected fallback to be used")
+	}
+	if len(rs) != 1 || rs[0].Metric != "m" || rs[0].DPS["1"] != 2 {
+		t.Fatalf("unexpected fallback response: %v", rs)
+	}
+}
+
+func TestExpandMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/suggest" || r.FormValue("type") != "metrics" || !strings.HasPrefix(r.FormValue("q"), "os.cpu") {
+			t.Errorf("unexpected suggest request %v", r.URL)
+		}
+		fmt.Fprint(w, `["os.cpu", "os.cpu.user", "os.cpu.sys", "os.cpus"]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suggest := func(prefix string, max int) ([]string, error) {
+		return SuggestMetrics(u.Host, prefix, max)
+	}
+	newReq := func() *Request {
+		return &Request{Start: 1, Queries: []*Query{
+			{Aggregator: "sum", Metric: "os.mem"},
+			{Aggregator: "avg", Metric: "os.cpu.*", Tags: TagSet{"host": "*"}},
+		}}
+	}
+	req := newReq()
+	if err := req.ExpandMetrics(suggest, 10); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, q := range req.Queries {
+		got = append(got, q.String())
+	}
+	expected := []string{"sum:os.mem", "avg:os.cpu.user{host=*}", "avg:os.cpu.sys{host=*}"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	if err := newReq().ExpandMetrics(suggest, 1); err == nil {
+		t.Fatal("expected an error when the pattern matches more than the limit")
+	}
+	req = &Request{Start: 1, Queries: []*Query{{Aggregator: "sum", Metric: "os.cpu*nope"}}}
+	if err := req.ExpandMetrics(suggest, 10); err == nil {
+		t.Fatal("expected an error when nothing matches")
+	}
+}